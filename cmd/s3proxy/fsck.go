@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/Grey0520/s3proxy/internal/config"
+	"github.com/Grey0520/s3proxy/internal/storage"
+)
+
+// fsck 重新计算本地存储中所有对象的 MD5，以 JSON 输出每个后端的检查结果，不指定存储桶时检查所有存储桶
+// 需要先停止服务，服务运行时 basedir 被锁定，fsck 会直接退出；服务运行时使用 filesystem.scrub 在后台检查
+// 发现损坏的对象时以状态码 1 退出
+func fsck(args []string) {
+	fs := flag.NewFlagSet("fsck", flag.ExitOnError)
+	quarantine := fs.Bool("quarantine", false, "把发现的文件移动到 basedir/.s3proxy/quarantine")
+	fs.Parse(args)
+
+	corrupt, err := runFsck(config.Cfg, *quarantine, fs.Args(), os.Stdout)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if corrupt > 0 {
+		os.Exit(1)
+	}
+}
+
+// runFsck 检查 cfg 中的所有本地存储，把结果写入 w，返回损坏的对象数量
+// 打开存储时不清理临时文件，中断的写入留下的文件作为 strayTempFiles 报告
+func runFsck(cfg config.Config, quarantine bool, buckets []string, w io.Writer) (int, error) {
+	stg, err := storage.NewStorageProvider(cfg, storage.WithoutRecovery())
+	if err != nil {
+		return 0, fmt.Errorf("failed to create storage: %v", err)
+	}
+	stores := findLocalStores(stg)
+	if len(stores) == 0 {
+		return 0, fmt.Errorf("no local backend is configured")
+	}
+	defer func() {
+		for _, s := range stores {
+			s.Close()
+		}
+	}()
+
+	reports := make(map[string]*storage.ScrubReport)
+	corrupt := 0
+	for _, name := range sortedNames(stores) {
+		report, err := stores[name].Scrub(quarantine, buckets...)
+		if err != nil {
+			return 0, fmt.Errorf("failed to check %s: %v", name, err)
+		}
+		reports[name] = report
+		corrupt += len(report.Corrupt)
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(reports); err != nil {
+		return 0, fmt.Errorf("failed to write report: %v", err)
+	}
+	return corrupt, nil
+}
+
+func findLocalStores(stg storage.StorageProvider) map[string]*storage.LFSStore {
+	stores := make(map[string]*storage.LFSStore)
+	storage.WalkProviders(stg, func(name string, p storage.StorageProvider) {
+		if l, ok := p.(*storage.LFSStore); ok {
+			stores[name] = l
+		}
+	})
+	return stores
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Grey0520/s3proxy/internal/config"
+	"github.com/Grey0520/s3proxy/internal/storage"
+)
+
+func TestFsck(t *testing.T) {
+	dir := t.TempDir()
+	store, err := storage.NewLFSStore(dir)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	store.CreateBucket("bucket")
+	err = store.PutObject("bucket", "key", &storage.Object{Data: io.NopCloser(strings.NewReader("content"))})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	store.Close()
+	// 中断的写入留下的临时文件
+	stray := filepath.Join(dir, ".s3proxy", "tmp", "interrupted.data")
+	os.WriteFile(stray, []byte("partial"), 0o644)
+
+	cfg := config.Config{Cloud: config.CloudsConfig{Provider: "local", Filesystem: config.FilesystemConfig{Basedir: dir}}}
+	var out bytes.Buffer
+	corrupt, err := runFsck(cfg, false, nil, &out)
+	if err != nil || corrupt != 0 {
+		t.Fatalf("Expected no corrupt objects, got %d, %v", corrupt, err)
+	}
+	var reports map[string]*storage.ScrubReport
+	if err := json.Unmarshal(out.Bytes(), &reports); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	report := reports[storage.DefaultBackend]
+	if report == nil || report.Objects != 1 || len(report.StrayTempFiles) != 1 || report.StrayTempFiles[0] != stray {
+		t.Fatalf("Expected stray temp file to be reported, got %s", out.String())
+	}
+	if _, err := os.Stat(stray); err != nil {
+		t.Errorf("Expected stray temp file to be kept, got %v", err)
+	}
+
+	// 服务运行时 basedir 被锁定
+	store, err = storage.NewLFSStore(dir)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	defer store.Close()
+	if _, err := runFsck(cfg, false, nil, io.Discard); err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Errorf("Expected error while the server is running, got %v", err)
+	}
+}
+
+// 被镜像和缓存包装的本地存储也会被检查
+func TestFsckWrappedStore(t *testing.T) {
+	cfg := config.Config{
+		Cloud: config.CloudsConfig{
+			Provider: "mirror",
+			Mirror:   config.MirrorConfig{Primary: "a", Secondary: "b"},
+			Cache:    config.CacheConfig{Dir: t.TempDir()},
+		},
+		Backends: []config.BackendConfig{
+			{Name: "a", CloudsConfig: config.CloudsConfig{Provider: "memory"}},
+			{Name: "b", CloudsConfig: config.CloudsConfig{Provider: "local", Filesystem: config.FilesystemConfig{Basedir: t.TempDir()}}},
+		},
+	}
+	var out bytes.Buffer
+	if _, err := runFsck(cfg, false, nil, &out); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	var reports map[string]*storage.ScrubReport
+	if err := json.Unmarshal(out.Bytes(), &reports); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, ok := reports[storage.DefaultBackend+".secondary"]; !ok || len(reports) != 1 {
+		t.Errorf("Expected the mirrored local store to be checked, got %s", out.String())
+	}
+}
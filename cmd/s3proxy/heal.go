@@ -0,0 +1,53 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/Grey0520/s3proxy/internal/config"
+	"github.com/Grey0520/s3proxy/internal/storage"
+)
+
+// heal 重建纠删码布局中丢失或损坏的分片，更换磁盘之后执行
+// 有无法恢复的对象时以状态码 1 退出
+func heal(args []string) {
+	fs := flag.NewFlagSet("heal", flag.ExitOnError)
+	fs.Parse(args)
+
+	stg, err := storage.NewStorageProvider(config.Cfg)
+	if err != nil {
+		log.Fatal("failed to create storage:", err)
+	}
+	stores := findErasureStores(stg)
+	if len(stores) == 0 {
+		log.Fatal("no backend with multiple data directories is configured")
+	}
+
+	lost := 0
+	for _, name := range sortedNames(stores) {
+		result, err := stores[name].Heal()
+		if err != nil {
+			log.Fatalf("failed to heal %s: %v", name, err)
+		}
+		for _, key := range result.Lost {
+			fmt.Printf("%s: lost %s\n", name, key)
+		}
+		fmt.Printf("%s: %d buckets and %d shards rebuilt\n", name, result.Buckets, result.Shards)
+		lost += len(result.Lost)
+	}
+	if lost > 0 {
+		os.Exit(1)
+	}
+}
+
+func findErasureStores(stg storage.StorageProvider) map[string]*storage.ErasureStore {
+	stores := make(map[string]*storage.ErasureStore)
+	storage.WalkProviders(stg, func(name string, p storage.StorageProvider) {
+		if e, ok := p.(*storage.ErasureStore); ok {
+			stores[name] = e
+		}
+	})
+	return stores
+}
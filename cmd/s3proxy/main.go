@@ -1,7 +1,10 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	"log"
+	"os"
 
 	"github.com/Grey0520/s3proxy/internal/config"
 	"github.com/Grey0520/s3proxy/internal/server"
@@ -9,18 +12,44 @@ import (
 )
 
 func main() {
+	configPath := flag.String("config", "", "配置文件路径，为空时在当前目录查找 config.yaml")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [-config file] [serve | reconcile [-fix] | heal | reindex [bucket...] | fsck [-quarantine] [bucket...]]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
 	// 1. 加载配置
-	err := config.LoadConfig("")
+	err := config.LoadConfig(*configPath)
 	if err != nil {
 		log.Fatal("failed to load configuration:", err)
 	}
+
+	switch cmd := flag.Arg(0); cmd {
+	case "", "serve":
+		serve()
+	case "reconcile":
+		reconcile(flag.Args()[1:])
+	case "heal":
+		heal(flag.Args()[1:])
+	case "reindex":
+		reindex(flag.Args()[1:])
+	case "fsck":
+		fsck(flag.Args()[1:])
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+func serve() {
 	log.Print(config.Cfg)
 
 	// 2. 资源初始化
 	app := server.NewServer(&config.Cfg)
 
 	routes.ConfigureRoutes(app)
-	err = app.Start(config.Cfg.S3Proxy.Endpoint)
+	err := app.Start(config.Cfg.S3Proxy.Endpoint)
 	if err != nil {
 		log.Fatal("Port already used")
 	}
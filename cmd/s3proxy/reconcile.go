@@ -0,0 +1,69 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+
+	"github.com/Grey0520/s3proxy/internal/config"
+	"github.com/Grey0520/s3proxy/internal/storage"
+)
+
+// reconcile 比较 mirror 后端的主、备份，输出不一致的存储桶和对象
+// 有不一致且没有指定 -fix 时以状态码 1 退出，方便在定时任务中检查
+func reconcile(args []string) {
+	fs := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	fix := fs.Bool("fix", false, "以主后端为准修复备份")
+	fs.Parse(args)
+
+	stg, err := storage.NewStorageProvider(config.Cfg)
+	if err != nil {
+		log.Fatal("failed to create storage:", err)
+	}
+	mirrors := findMirrors(stg)
+	if len(mirrors) == 0 {
+		log.Fatal("no mirror backend is configured")
+	}
+
+	found := 0
+	for _, name := range sortedNames(mirrors) {
+		diffs, err := mirrors[name].Reconcile(*fix)
+		for _, d := range diffs {
+			fmt.Printf("%s: %s\n", name, d)
+		}
+		if err != nil {
+			log.Fatalf("failed to reconcile %s: %v", name, err)
+		}
+		found += len(diffs)
+	}
+
+	if *fix {
+		fmt.Printf("%d differences fixed\n", found)
+		return
+	}
+	fmt.Printf("%d differences found\n", found)
+	if found > 0 {
+		os.Exit(1)
+	}
+}
+
+func findMirrors(stg storage.StorageProvider) map[string]*storage.MirrorStore {
+	mirrors := make(map[string]*storage.MirrorStore)
+	storage.WalkProviders(stg, func(name string, p storage.StorageProvider) {
+		if m, ok := p.(*storage.MirrorStore); ok {
+			mirrors[name] = m
+		}
+	})
+	return mirrors
+}
+
+func sortedNames[V any](backends map[string]V) []string {
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
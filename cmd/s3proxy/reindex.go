@@ -0,0 +1,58 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/Grey0520/s3proxy/internal/config"
+	"github.com/Grey0520/s3proxy/internal/storage"
+)
+
+// reindex 根据磁盘上的对象重新生成本地存储的元数据索引，不指定存储桶时处理所有存储桶
+// basedir 同时只能被一个进程打开，需要先停止服务，否则会因为 basedir 被锁定而退出
+func reindex(args []string) {
+	fs := flag.NewFlagSet("reindex", flag.ExitOnError)
+	fs.Parse(args)
+
+	stg, err := storage.NewStorageProvider(config.Cfg)
+	if err != nil {
+		log.Fatal("failed to create storage:", err)
+	}
+	stores := findIndexedStores(stg)
+	if len(stores) == 0 {
+		log.Fatal("no local backend with index enabled is configured")
+	}
+
+	for _, name := range sortedNames(stores) {
+		store := stores[name]
+		buckets := fs.Args()
+		if len(buckets) == 0 {
+			result, err := store.ListAllMyBuckets()
+			if err != nil {
+				log.Fatalf("failed to list buckets of %s: %v", name, err)
+			}
+			for _, b := range result.Buckets.Bucket {
+				buckets = append(buckets, b.Name)
+			}
+		}
+		for _, bucketName := range buckets {
+			n, err := store.RebuildIndex(bucketName)
+			if err != nil {
+				log.Fatalf("failed to rebuild index of %s/%s: %v", name, bucketName, err)
+			}
+			fmt.Printf("%s: %s indexed %d objects\n", name, bucketName, n)
+		}
+		store.Close()
+	}
+}
+
+func findIndexedStores(stg storage.StorageProvider) map[string]*storage.LFSStore {
+	stores := findLocalStores(stg)
+	for name, s := range stores {
+		if !s.Indexed() {
+			delete(stores, name)
+		}
+	}
+	return stores
+}
@@ -0,0 +1,73 @@
+package auth
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const arnPrefix = "arn:aws:s3:::"
+
+// RequestAction 返回请求对应的 IAM 操作和资源 ARN，用于评估会话策略
+func RequestAction(r *http.Request) (action, resource string) {
+	bucket, key := splitPath(r.URL.Path)
+	query := r.URL.Query()
+
+	if bucket == "" {
+		if r.Method == http.MethodPost {
+			return "sts:" + r.FormValue("Action"), "*"
+		}
+		return "s3:ListAllMyBuckets", arnPrefix + "*"
+	}
+
+	if key == "" {
+		resource = arnPrefix + bucket
+		if _, ok := query["encryption"]; ok {
+			// AWS 中删除默认加密也使用 PutEncryptionConfiguration 权限
+			if r.Method == http.MethodGet {
+				return "s3:GetEncryptionConfiguration", resource
+			}
+			return "s3:PutEncryptionConfiguration", resource
+		}
+		switch r.Method {
+		case http.MethodPut:
+			return "s3:CreateBucket", resource
+		case http.MethodDelete:
+			return "s3:DeleteBucket", resource
+		default:
+			if _, ok := query["acl"]; ok {
+				return "s3:GetBucketAcl", resource
+			}
+			return "s3:ListBucket", resource
+		}
+	}
+
+	resource = arnPrefix + bucket + "/" + key
+	switch r.Method {
+	case http.MethodPut:
+		return "s3:PutObject", resource
+	case http.MethodDelete:
+		return "s3:DeleteObject", resource
+	default:
+		return "s3:GetObject", resource
+	}
+}
+
+// CopySourceResource 返回 CopyObject 请求中源对象的资源 ARN
+func CopySourceResource(r *http.Request) (string, bool) {
+	src := r.Header.Get("X-Amz-Copy-Source")
+	if src == "" {
+		return "", false
+	}
+	if unescaped, err := url.PathUnescape(src); err == nil {
+		src = unescaped
+	}
+	bucket, key := splitPath(src)
+	return arnPrefix + bucket + "/" + key, true
+}
+
+func splitPath(p string) (bucket, key string) {
+	p = strings.TrimPrefix(p, "/")
+	bucket, key, _ = strings.Cut(p, "/")
+	return bucket, key
+}
@@ -0,0 +1,47 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequestAction(t *testing.T) {
+	tests := []struct {
+		method       string
+		target       string
+		wantAction   string
+		wantResource string
+	}{
+		{http.MethodGet, "/", "s3:ListAllMyBuckets", "arn:aws:s3:::*"},
+		{http.MethodPut, "/bucket", "s3:CreateBucket", "arn:aws:s3:::bucket"},
+		{http.MethodDelete, "/bucket", "s3:DeleteBucket", "arn:aws:s3:::bucket"},
+		{http.MethodGet, "/bucket", "s3:ListBucket", "arn:aws:s3:::bucket"},
+		{http.MethodGet, "/bucket?acl", "s3:GetBucketAcl", "arn:aws:s3:::bucket"},
+		{http.MethodGet, "/bucket?encryption", "s3:GetEncryptionConfiguration", "arn:aws:s3:::bucket"},
+		{http.MethodPut, "/bucket?encryption", "s3:PutEncryptionConfiguration", "arn:aws:s3:::bucket"},
+		{http.MethodDelete, "/bucket?encryption", "s3:PutEncryptionConfiguration", "arn:aws:s3:::bucket"},
+		{http.MethodGet, "/bucket/a/b.txt", "s3:GetObject", "arn:aws:s3:::bucket/a/b.txt"},
+		{http.MethodHead, "/bucket/key", "s3:GetObject", "arn:aws:s3:::bucket/key"},
+		{http.MethodPut, "/bucket/key", "s3:PutObject", "arn:aws:s3:::bucket/key"},
+		{http.MethodDelete, "/bucket/key", "s3:DeleteObject", "arn:aws:s3:::bucket/key"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.target, nil)
+		action, resource := RequestAction(r)
+		if action != tt.wantAction || resource != tt.wantResource {
+			t.Errorf("%s %s: got (%s, %s), want (%s, %s)", tt.method, tt.target, action, resource, tt.wantAction, tt.wantResource)
+		}
+	}
+}
+
+func TestCopySourceResource(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPut, "/dst/key", nil)
+	if _, ok := CopySourceResource(r); ok {
+		t.Error("Expected no copy source")
+	}
+	r.Header.Set("X-Amz-Copy-Source", "/src/dir%2Fkey")
+	if got, _ := CopySourceResource(r); got != "arn:aws:s3:::src/dir/key" {
+		t.Errorf("Unexpected copy source resource %s", got)
+	}
+}
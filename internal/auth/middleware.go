@@ -0,0 +1,113 @@
+package auth
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/Grey0520/s3proxy/internal/identity"
+	"github.com/Grey0520/s3proxy/internal/s3err"
+	"github.com/Grey0520/s3proxy/internal/sts"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	userContextKey    = "s3proxy.user"
+	sessionContextKey = "s3proxy.session"
+)
+
+// HealthPath 是健康检查的路径，负载均衡器等调用方无法签名，不签名的请求也可以访问
+const HealthPath = "/_s3proxy/health"
+
+// Middleware 校验请求的签名，并把请求者放进上下文中
+// 没有配置用户或不签名地请求健康检查时直接放行，此时 CurrentUser 返回 nil
+// issuer 不为空时同时接受 STS 签发的临时凭证
+func Middleware(store *identity.Store, issuer *sts.Issuer) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			r := c.Request()
+			if !store.Enabled() || (r.Method == http.MethodGet && r.URL.Path == HealthPath && !IsSigned(r)) {
+				return next(c)
+			}
+
+			if !IsSigned(r) {
+				return s3err.ErrAccessDenied
+			}
+			sig, err := ParseV4(r)
+			if err != nil {
+				return err
+			}
+
+			now := time.Now().UTC()
+			if token := securityToken(r); token != "" {
+				user, session, err := verifySession(store, issuer, r, sig, token, now)
+				if err != nil {
+					return err
+				}
+				c.Set(userContextKey, user)
+				c.Set(sessionContextKey, session)
+				return next(c)
+			}
+
+			user, ok := store.LookupAccessKey(sig.AccessKey)
+			if !ok {
+				return s3err.ErrInvalidAccessKeyID
+			}
+			if err := VerifyV4(r, sig, user.SecretKey, now); err != nil {
+				return err
+			}
+
+			c.Set(userContextKey, user)
+			return next(c)
+		}
+	}
+}
+
+// verifySession 校验临时凭证，并用会话策略检查本次请求
+func verifySession(store *identity.Store, issuer *sts.Issuer, r *http.Request, sig *SignatureV4, token string, now time.Time) (*identity.User, *sts.Claims, error) {
+	if issuer == nil {
+		return nil, nil, s3err.ErrInvalidAccessKeyID
+	}
+	claims, secretKey, err := issuer.Validate(token, now)
+	if err != nil {
+		return nil, nil, s3err.ErrInvalidToken.WithMessage(err.Error())
+	}
+	if claims.AccessKey != sig.AccessKey {
+		return nil, nil, s3err.ErrInvalidAccessKeyID
+	}
+	if err := VerifyV4(r, sig, secretKey, now); err != nil {
+		return nil, nil, err
+	}
+	user, ok := store.LookupCanonicalID(claims.Parent)
+	if !ok {
+		return nil, nil, s3err.ErrInvalidToken.WithMessage("the user that issued this token no longer exists")
+	}
+
+	action, resource := RequestAction(r)
+	if !claims.Allows(action, resource) {
+		return nil, nil, s3err.ErrAccessDenied
+	}
+	if src, ok := CopySourceResource(r); ok && !claims.Allows("s3:GetObject", src) {
+		return nil, nil, s3err.ErrAccessDenied
+	}
+	return user, claims, nil
+}
+
+func securityToken(r *http.Request) string {
+	if token := r.Header.Get("X-Amz-Security-Token"); token != "" {
+		return token
+	}
+	return r.URL.Query().Get("X-Amz-Security-Token")
+}
+
+// CurrentUser 返回发起请求的用户，未启用鉴权时返回 nil
+// 使用临时凭证时返回签发该凭证的用户
+func CurrentUser(c echo.Context) *identity.User {
+	user, _ := c.Get(userContextKey).(*identity.User)
+	return user
+}
+
+// CurrentSession 返回请求使用的临时凭证信息，使用长期凭证时返回 nil
+func CurrentSession(c echo.Context) *sts.Claims {
+	session, _ := c.Get(sessionContextKey).(*sts.Claims)
+	return session
+}
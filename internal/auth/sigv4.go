@@ -0,0 +1,348 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Grey0520/s3proxy/internal/s3err"
+)
+
+const (
+	signV4Algorithm = "AWS4-HMAC-SHA256"
+	iso8601Format   = "20060102T150405Z"
+	yyyymmdd        = "20060102"
+
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+	// aws-chunked 上传的每个分块单独签名，整个请求体没有哈希
+	streamingPayloadPrefix = "STREAMING-"
+	// 没有 x-amz-content-sha256 时由服务端计算哈希的请求体上限
+	maxComputedPayload = 1 << 20
+
+	// 请求时间与服务器时间允许的最大偏差
+	maxClockSkew = 15 * time.Minute
+	// 预签名 URL 允许的最长有效期
+	maxPresignExpires = 7 * 24 * time.Hour
+)
+
+// SignatureV4 是从请求中解析出的 AWS Signature Version 4 签名信息
+type SignatureV4 struct {
+	AccessKey     string
+	Date          time.Time
+	Region        string
+	Service       string
+	SignedHeaders []string
+	Signature     string
+	// 预签名 URL 的签名放在查询参数里
+	Presigned bool
+	Expires   time.Duration
+
+	scopeDate string
+}
+
+// scope 返回签名的凭证范围，形如 20130524/us-east-1/s3/aws4_request
+func (sig *SignatureV4) scope() string {
+	return strings.Join([]string{sig.scopeDate, sig.Region, sig.Service, "aws4_request"}, "/")
+}
+
+// IsSigned 判断请求是否携带了签名
+func IsSigned(r *http.Request) bool {
+	return r.Header.Get("Authorization") != "" || r.URL.Query().Get("X-Amz-Algorithm") != ""
+}
+
+// ParseV4 从 Authorization 头或预签名 URL 中解析签名
+func ParseV4(r *http.Request) (*SignatureV4, error) {
+	if r.URL.Query().Get("X-Amz-Algorithm") != "" {
+		return parsePresignedV4(r)
+	}
+	return parseHeaderV4(r)
+}
+
+func parseHeaderV4(r *http.Request) (*SignatureV4, error) {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, signV4Algorithm+" ") {
+		return nil, s3err.ErrAuthorizationHeaderMalformed.WithMessage("unsupported authorization type")
+	}
+
+	sig := &SignatureV4{}
+	for _, field := range strings.Split(strings.TrimPrefix(header, signV4Algorithm+" "), ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(field), "=")
+		if !ok {
+			return nil, s3err.ErrAuthorizationHeaderMalformed
+		}
+		switch name {
+		case "Credential":
+			if err := sig.parseCredential(value); err != nil {
+				return nil, err
+			}
+		case "SignedHeaders":
+			sig.SignedHeaders = strings.Split(value, ";")
+		case "Signature":
+			sig.Signature = value
+		}
+	}
+	if sig.AccessKey == "" || len(sig.SignedHeaders) == 0 || sig.Signature == "" {
+		return nil, s3err.ErrAuthorizationHeaderMalformed
+	}
+
+	var date time.Time
+	var err error
+	if amzDate := r.Header.Get("X-Amz-Date"); amzDate != "" {
+		date, err = time.Parse(iso8601Format, amzDate)
+	} else {
+		date, err = http.ParseTime(r.Header.Get("Date"))
+	}
+	if err != nil {
+		return nil, s3err.ErrAccessDenied.WithMessage("AWS authentication requires a valid Date or x-amz-date header")
+	}
+	sig.Date = date
+	return sig, nil
+}
+
+func parsePresignedV4(r *http.Request) (*SignatureV4, error) {
+	query := r.URL.Query()
+	if query.Get("X-Amz-Algorithm") != signV4Algorithm {
+		return nil, s3err.ErrAuthorizationHeaderMalformed.WithMessage("unsupported X-Amz-Algorithm")
+	}
+
+	sig := &SignatureV4{Presigned: true}
+	if err := sig.parseCredential(query.Get("X-Amz-Credential")); err != nil {
+		return nil, err
+	}
+	sig.SignedHeaders = strings.Split(query.Get("X-Amz-SignedHeaders"), ";")
+	sig.Signature = query.Get("X-Amz-Signature")
+	if sig.Signature == "" {
+		return nil, s3err.ErrAuthorizationHeaderMalformed
+	}
+
+	date, err := time.Parse(iso8601Format, query.Get("X-Amz-Date"))
+	if err != nil {
+		return nil, s3err.ErrAuthorizationHeaderMalformed.WithMessage("invalid X-Amz-Date")
+	}
+	sig.Date = date
+
+	expires, err := strconv.ParseInt(query.Get("X-Amz-Expires"), 10, 64)
+	if err != nil || expires < 0 || time.Duration(expires)*time.Second > maxPresignExpires {
+		return nil, s3err.ErrAuthorizationHeaderMalformed.WithMessage("invalid X-Amz-Expires")
+	}
+	sig.Expires = time.Duration(expires) * time.Second
+	return sig, nil
+}
+
+// parseCredential 解析 AKID/20130524/us-east-1/s3/aws4_request
+func (sig *SignatureV4) parseCredential(credential string) error {
+	parts := strings.Split(credential, "/")
+	if len(parts) != 5 || parts[4] != "aws4_request" {
+		return s3err.ErrAuthorizationHeaderMalformed.WithMessage("invalid credential scope")
+	}
+	sig.AccessKey = parts[0]
+	sig.scopeDate = parts[1]
+	sig.Region = parts[2]
+	sig.Service = parts[3]
+	return nil
+}
+
+// VerifyV4 使用 secretKey 重新计算请求签名并与请求中的签名比较
+func VerifyV4(r *http.Request, sig *SignatureV4, secretKey string, now time.Time) error {
+	if sig.Presigned {
+		if now.Before(sig.Date.Add(-maxClockSkew)) || now.After(sig.Date.Add(sig.Expires)) {
+			return s3err.ErrAccessDenied.WithMessage("Request has expired")
+		}
+	} else if d := now.Sub(sig.Date); d > maxClockSkew || d < -maxClockSkew {
+		return s3err.ErrRequestTimeTooSkewed
+	}
+	if sig.Date.Format(yyyymmdd) != sig.scopeDate {
+		return s3err.ErrAuthorizationHeaderMalformed.WithMessage("credential date does not match request date")
+	}
+
+	payloadHash, err := payloadHash(r, sig)
+	if err != nil {
+		return err
+	}
+	canonicalRequest := strings.Join([]string{
+		r.Method,
+		canonicalURI(r, sig.Service),
+		canonicalQuery(r, sig.Presigned),
+		canonicalHeaders(r, sig.SignedHeaders),
+		strings.Join(sig.SignedHeaders, ";"),
+		payloadHash,
+	}, "\n")
+
+	stringToSign := strings.Join([]string{
+		signV4Algorithm,
+		sig.Date.Format(iso8601Format),
+		sig.scope(),
+		hexSHA256([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := signingKey(secretKey, sig.scopeDate, sig.Region, sig.Service)
+	expected := hex.EncodeToString(hmacSHA256(key, []byte(stringToSign)))
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(sig.Signature)) != 1 {
+		return s3err.ErrSignatureDoesNotMatch
+	}
+	return nil
+}
+
+// payloadHash 返回参与签名的请求体哈希
+// S3 客户端必须通过 x-amz-content-sha256 头声明，其它服务（如 STS）的表单请求需要自行计算
+func payloadHash(r *http.Request, sig *SignatureV4) (string, error) {
+	if sig.Presigned {
+		return unsignedPayload, nil
+	}
+	if h := r.Header.Get("X-Amz-Content-Sha256"); h != "" {
+		if h == unsignedPayload {
+			return h, nil
+		}
+		// aws-chunked 编码的请求体需要逐块校验签名并解码，目前不支持
+		if strings.HasPrefix(h, streamingPayloadPrefix) {
+			return "", s3err.ErrNotImplemented.WithMessage("aws-chunked uploads (x-amz-content-sha256: " + h + ") are not supported, use UNSIGNED-PAYLOAD or the SHA-256 of the body")
+		}
+		expected, err := hex.DecodeString(h)
+		if err != nil || len(expected) != sha256.Size {
+			return "", s3err.ErrInvalidArgument.WithMessage("x-amz-content-sha256 must be UNSIGNED-PAYLOAD, STREAMING-* or a SHA-256 hex digest")
+		}
+		// 声明的哈希参与签名，读取请求体时还要确认它与实际内容一致
+		body := r.Body
+		if body == nil {
+			body = http.NoBody
+		}
+		r.Body = &verifyingReader{ReadCloser: body, hash: sha256.New(), expected: expected}
+		return h, nil
+	}
+	// 签名校验之前读取整个请求体，只允许较小的表单请求，避免未经鉴权的请求占用内存
+	if sig.Service == "s3" {
+		return "", s3err.ErrInvalidRequest.WithMessage("Missing required header for this request: x-amz-content-sha256")
+	}
+	if r.Body == nil {
+		return hexSHA256(nil), nil
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(nil, r.Body, maxComputedPayload))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return "", s3err.ErrEntityTooLarge.WithMessage(fmt.Sprintf("Requests without x-amz-content-sha256 cannot exceed %d bytes", maxComputedPayload))
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read request body: %v", err)
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	return hexSHA256(body), nil
+}
+
+// verifyingReader 在读到请求体末尾时比较实际的 SHA-256 与声明的值，
+// 不一致时用错误代替 io.EOF，存储后端会因此放弃这次写入
+type verifyingReader struct {
+	io.ReadCloser
+	hash     hash.Hash
+	expected []byte
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	n, err := v.ReadCloser.Read(p)
+	v.hash.Write(p[:n])
+	if err == io.EOF && !bytes.Equal(v.hash.Sum(nil), v.expected) {
+		return n, s3err.ErrXAmzContentSHA256Mismatch
+	}
+	return n, err
+}
+
+// canonicalURI 返回规范化的请求路径
+// S3 直接使用客户端发送的路径，其它服务需要对路径再编码一次
+func canonicalURI(r *http.Request, service string) string {
+	path := r.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	if service == "s3" {
+		return path
+	}
+	return uriEncode(path, false)
+}
+
+func canonicalQuery(r *http.Request, presigned bool) string {
+	query := r.URL.Query()
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		if presigned && k == "X-Amz-Signature" {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var pairs []string
+	for _, k := range keys {
+		values := append([]string(nil), query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			pairs = append(pairs, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+func canonicalHeaders(r *http.Request, signedHeaders []string) string {
+	var b strings.Builder
+	for _, name := range signedHeaders {
+		var values []string
+		if name == "host" {
+			values = []string{r.Host}
+		} else {
+			values = append([]string(nil), r.Header.Values(name)...)
+		}
+		for i := range values {
+			values[i] = strings.Join(strings.Fields(values[i]), " ")
+		}
+		b.WriteString(name)
+		b.WriteByte(':')
+		b.WriteString(strings.Join(values, ","))
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// uriEncode 按照 AWS 的规则编码，只保留 RFC 3986 中的非保留字符
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func signingKey(secretKey, date, region, service string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secretKey), []byte(date))
+	key = hmacSHA256(key, []byte(region))
+	key = hmacSHA256(key, []byte(service))
+	return hmacSHA256(key, []byte("aws4_request"))
+}
+
+func hmacSHA256(key, data []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+func hexSHA256(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
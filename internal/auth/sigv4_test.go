@@ -0,0 +1,186 @@
+package auth
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Grey0520/s3proxy/internal/s3err"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+)
+
+const (
+	testAccessKey = "AKIDEXAMPLE"
+	testSecretKey = "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"
+)
+
+func newSigner() *v4.Signer {
+	signer := v4.NewSigner(credentials.NewStaticCredentials(testAccessKey, testSecretKey, ""))
+	signer.DisableURIPathEscaping = true
+	return signer
+}
+
+func TestVerifyV4Header(t *testing.T) {
+	body := []byte("hello world")
+	r := httptest.NewRequest(http.MethodPut, "http://localhost:5080/bucket/dir%2Fkey?tagging=a%20b", bytes.NewReader(body))
+	r.Header.Set("Content-Type", "text/plain")
+	if _, err := newSigner().Sign(r, bytes.NewReader(body), "s3", "us-east-1", time.Now()); err != nil {
+		t.Fatalf("failed to sign request: %v", err)
+	}
+
+	sig, err := ParseV4(r)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if sig.AccessKey != testAccessKey {
+		t.Errorf("Expected access key %s, got %s", testAccessKey, sig.AccessKey)
+	}
+	if err := VerifyV4(r, sig, testSecretKey, time.Now()); err != nil {
+		t.Fatalf("Expected valid signature, got %v", err)
+	}
+
+	if err := VerifyV4(r, sig, "wrong-secret", time.Now()); !errors.Is(err, s3err.ErrSignatureDoesNotMatch) {
+		t.Errorf("Expected SignatureDoesNotMatch, got %v", err)
+	}
+
+	r.Header.Set("Content-Type", "application/json")
+	if err := VerifyV4(r, sig, testSecretKey, time.Now()); !errors.Is(err, s3err.ErrSignatureDoesNotMatch) {
+		t.Errorf("Expected SignatureDoesNotMatch for tampered header, got %v", err)
+	}
+}
+
+func TestVerifyV4ComputedPayload(t *testing.T) {
+	// STS 之类的服务不发送 x-amz-content-sha256，需要服务端自己计算请求体哈希
+	body := []byte("Action=GetSessionToken&Version=2011-06-15")
+	r := httptest.NewRequest(http.MethodPost, "http://localhost:5080/", bytes.NewReader(body))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	signer := v4.NewSigner(credentials.NewStaticCredentials(testAccessKey, testSecretKey, ""))
+	if _, err := signer.Sign(r, bytes.NewReader(body), "sts", "us-east-1", time.Now()); err != nil {
+		t.Fatalf("failed to sign request: %v", err)
+	}
+	r.Header.Del("X-Amz-Content-Sha256")
+
+	sig, err := ParseV4(r)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := VerifyV4(r, sig, testSecretKey, time.Now()); err != nil {
+		t.Fatalf("Expected valid signature, got %v", err)
+	}
+}
+
+func TestVerifyV4PayloadMismatch(t *testing.T) {
+	body := []byte("hello world")
+	r := httptest.NewRequest(http.MethodPut, "http://localhost:5080/bucket/key", bytes.NewReader(body))
+	if _, err := newSigner().Sign(r, bytes.NewReader(body), "s3", "us-east-1", time.Now()); err != nil {
+		t.Fatalf("failed to sign request: %v", err)
+	}
+	// 签名有效，但请求体在传输中被替换
+	r.Body = io.NopCloser(bytes.NewReader([]byte("hello there")))
+
+	sig, err := ParseV4(r)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := VerifyV4(r, sig, testSecretKey, time.Now()); err != nil {
+		t.Fatalf("Expected valid signature, got %v", err)
+	}
+	if _, err := io.ReadAll(r.Body); !errors.Is(err, s3err.ErrXAmzContentSHA256Mismatch) {
+		t.Errorf("Expected XAmzContentSHA256Mismatch, got %v", err)
+	}
+
+	r.Header.Set("X-Amz-Content-Sha256", "not-a-hash")
+	if err := VerifyV4(r, sig, testSecretKey, time.Now()); !errors.Is(err, s3err.ErrInvalidArgument) {
+		t.Errorf("Expected InvalidArgument for malformed payload hash, got %v", err)
+	}
+}
+
+func TestVerifyV4Streaming(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPut, "http://localhost:5080/bucket/key", bytes.NewReader([]byte("5;chunk-signature=abc\r\nhello\r\n")))
+	r.Header.Set("X-Amz-Content-Sha256", "STREAMING-AWS4-HMAC-SHA256-PAYLOAD")
+	if _, err := newSigner().Sign(r, nil, "s3", "us-east-1", time.Now()); err != nil {
+		t.Fatalf("failed to sign request: %v", err)
+	}
+	sig, err := ParseV4(r)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := VerifyV4(r, sig, testSecretKey, time.Now()); !errors.Is(err, s3err.ErrNotImplemented) {
+		t.Errorf("Expected NotImplemented for aws-chunked uploads, got %v", err)
+	}
+}
+
+func TestVerifyV4MissingPayloadHash(t *testing.T) {
+	// S3 请求必须声明请求体的哈希，服务端不会为了计算哈希读取整个请求体
+	body := []byte("hello world")
+	r := httptest.NewRequest(http.MethodPut, "http://localhost:5080/bucket/key", bytes.NewReader(body))
+	if _, err := newSigner().Sign(r, bytes.NewReader(body), "s3", "us-east-1", time.Now()); err != nil {
+		t.Fatalf("failed to sign request: %v", err)
+	}
+	r.Header.Del("X-Amz-Content-Sha256")
+	sig, err := ParseV4(r)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := VerifyV4(r, sig, testSecretKey, time.Now()); !errors.Is(err, s3err.ErrInvalidRequest) {
+		t.Errorf("Expected InvalidRequest without x-amz-content-sha256, got %v", err)
+	}
+
+	// 其它服务的请求体有大小上限
+	body = bytes.Repeat([]byte("a"), maxComputedPayload+1)
+	r = httptest.NewRequest(http.MethodPost, "http://localhost:5080/", bytes.NewReader(body))
+	signer := v4.NewSigner(credentials.NewStaticCredentials(testAccessKey, testSecretKey, ""))
+	if _, err := signer.Sign(r, bytes.NewReader(body), "sts", "us-east-1", time.Now()); err != nil {
+		t.Fatalf("failed to sign request: %v", err)
+	}
+	r.Header.Del("X-Amz-Content-Sha256")
+	if sig, err = ParseV4(r); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := VerifyV4(r, sig, testSecretKey, time.Now()); !errors.Is(err, s3err.ErrEntityTooLarge) {
+		t.Errorf("Expected EntityTooLarge, got %v", err)
+	}
+}
+
+func TestVerifyV4Skew(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "http://localhost:5080/", nil)
+	signed := time.Now().Add(-time.Hour)
+	if _, err := newSigner().Sign(r, nil, "s3", "us-east-1", signed); err != nil {
+		t.Fatalf("failed to sign request: %v", err)
+	}
+	sig, err := ParseV4(r)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := VerifyV4(r, sig, testSecretKey, time.Now()); !errors.Is(err, s3err.ErrRequestTimeTooSkewed) {
+		t.Errorf("Expected RequestTimeTooSkewed, got %v", err)
+	}
+}
+
+func TestVerifyV4Presigned(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "http://localhost:5080/bucket/key", nil)
+	if _, err := newSigner().Presign(r, nil, "s3", "us-east-1", 5*time.Minute, time.Now()); err != nil {
+		t.Fatalf("failed to presign request: %v", err)
+	}
+	// 预签名 URL 由客户端原样发出
+	r = httptest.NewRequest(http.MethodGet, r.URL.String(), nil)
+
+	sig, err := ParseV4(r)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !sig.Presigned {
+		t.Fatal("Expected presigned signature")
+	}
+	if err := VerifyV4(r, sig, testSecretKey, time.Now()); err != nil {
+		t.Fatalf("Expected valid signature, got %v", err)
+	}
+	if err := VerifyV4(r, sig, testSecretKey, time.Now().Add(10*time.Minute)); !errors.Is(err, s3err.ErrAccessDenied) {
+		t.Errorf("Expected expired presigned URL to be denied, got %v", err)
+	}
+}
@@ -1,5 +1,11 @@
 package config
 
+import (
+	"time"
+
+	"github.com/Grey0520/s3proxy/pkg/confutil"
+)
+
 type S3ProxyConfig struct {
 	Endpoint       string `env:"ENDPOINT"`
 	SecureEndpoint string `env:"SECURE_ENDPOINT"`
@@ -14,15 +20,236 @@ type CloudsConfig struct {
 	Key        string           `env:"KEY"`
 	Region     string           `env:"REGION"`
 	Credential string           `env:"CREDENTIAL"`
+	S3         S3Config         `envPrefix:"S3_"`
 	Filesystem FilesystemConfig `envPrefix:"FILESYSTEM_"`
+	Memory     MemoryConfig     `envPrefix:"MEMORY_"`
+	SFTP       SFTPConfig       `envPrefix:"SFTP_"`
+	Mirror     MirrorConfig     `envPrefix:"MIRROR_"`
+	Cache      CacheConfig      `envPrefix:"CACHE_"`
+	Tiering    TieringConfig    `envPrefix:"TIERING_"`
+}
+
+// TieringConfig 是 tiering 后端的配置，新对象写入 hot，满足策略的对象由后台任务移到 cold
+type TieringConfig struct {
+	// backends 中的后端名称，default 表示 cloud
+	Hot  string `env:"HOT"`
+	Cold string `env:"COLD"`
+	// 最后修改超过这个时间的对象移到 cold，为 0 时不按修改时间
+	MaxAge time.Duration `env:"MAX_AGE"`
+	// 超过这个时间没有被读取的对象移到 cold，为 0 时不按读取时间
+	MaxIdle time.Duration `env:"MAX_IDLE"`
+	// 后台任务检查的间隔
+	Interval time.Duration `env:"INTERVAL" default:"1h"`
+	// 保存移到 cold 的对象记录的目录，必须是持久的
+	StateDir string `env:"STATE_DIR"`
+	// cold 中的对象在列举结果中的 StorageClass
+	ColdStorageClass string `env:"COLD_STORAGE_CLASS" default:"STANDARD_IA"`
+}
+
+// CacheConfig 是后端前面的磁盘读缓存的配置，适合反复读取的远端对象
+type CacheConfig struct {
+	// 缓存文件的目录，为空时不缓存
+	Dir string `env:"DIR"`
+	// 缓存总大小上限（字节），为 0 时不限制
+	MaxSize int64 `env:"MAX_SIZE"`
+	// 距上次向后端确认 ETag 不到这个时间时直接使用缓存，为 0 时每次读取都确认
+	Revalidate time.Duration `env:"REVALIDATE"`
+}
+
+// MirrorConfig 是 mirror 后端的配置，写操作同时应用到主、备两个后端，读操作在主后端出错时改读备份
+type MirrorConfig struct {
+	// backends 中的后端名称，default 表示 cloud
+	Primary   string `env:"PRIMARY"`
+	Secondary string `env:"SECONDARY"`
+	// sync：写入主后端后等待备份完成再返回；async：备份在后台进行
+	Mode string `env:"MODE" default:"sync"`
+	// 保存备份失败的写操作的目录，重启后继续重试，为空时只保存在内存中
+	QueueDir string `env:"QUEUE_DIR"`
+	// 重试的间隔
+	RetryInterval time.Duration `env:"RETRY_INTERVAL" default:"30s"`
+}
+
+// SFTPConfig 是 sftp 后端的配置
+// 服务器地址（host:port）使用 CloudsConfig.Endpoint，Identity 为用户名，
+// Key 为密码，Credential 为私钥或私钥文件路径
+type SFTPConfig struct {
+	// 服务器上存放存储桶的目录，为空时使用登录后的当前目录
+	Root string `env:"ROOT"`
+	// 校验服务器身份的 known_hosts 文件
+	KnownHosts string `env:"KNOWN_HOSTS"`
+	// 不校验服务器身份，只应在测试环境中使用
+	InsecureIgnoreHostKey bool `env:"INSECURE_IGNORE_HOST_KEY"`
+}
+
+// MemoryConfig 是内存存储的配置
+type MemoryConfig struct {
+	// 所有对象的总大小上限（字节），为 0 时不限制
+	MaxSize int64 `env:"MAX_SIZE"`
+}
+
+// S3Config 是 aws 后端连接兼容 S3 的服务（MinIO、Ceph、R2 等）时的配置
+// 服务地址使用 CloudsConfig.Endpoint，为空时连接 AWS
+type S3Config struct {
+	// 使用 http://endpoint/bucket/key 形式的地址
+	PathStyle bool `env:"PATH_STYLE"`
+	// Endpoint 没有指定协议时使用 http
+	DisableSSL bool `env:"DISABLE_SSL"`
+	// PEM 格式的 CA 证书文件，用于自签名证书的服务
+	CABundle string `env:"CA_BUNDLE"`
+	// 签名版本：v4（默认）或 v2
+	SignatureVersion string `env:"SIGNATURE_VERSION"`
 }
 
 type FilesystemConfig struct {
 	Basedir string `env:"BASEDIR"`
+	// 多个数据目录，设置后使用纠删码布局，每个目录保存对象的一个分片，不使用 Basedir
+	Dirs        []string          `env:"DIRS"`
+	Erasure     ErasureConfig     `envPrefix:"ERASURE_"`
+	Encryption  EncryptionConfig  `envPrefix:"ENCRYPTION_"`
+	Compression CompressionConfig `envPrefix:"COMPRESSION_"`
+	Dedup       DedupConfig       `envPrefix:"DEDUP_"`
+	Index       IndexConfig       `envPrefix:"INDEX_"`
+	Scrub       ScrubConfig       `envPrefix:"SCRUB_"`
+	Watch       WatchConfig       `envPrefix:"WATCH_"`
+	Space       SpaceConfig       `envPrefix:"SPACE_"`
+	// 写入对象时的持久化级别：none、file（fsync 文件）或 full（同时 fsync 目录），只用于 Basedir
+	Durability string `env:"DURABILITY" default:"file"`
+}
+
+// ErasureConfig 是纠删码布局的分片数量，数据和校验分片的总数必须等于目录数量
+type ErasureConfig struct {
+	// 为 0 时使用目录数量减去校验分片数量
+	DataShards int `env:"DATA_SHARDS"`
+	// 最多允许损坏的目录数量
+	ParityShards int `env:"PARITY_SHARDS" default:"2"`
+}
+
+// DedupConfig 是本地存储去重的配置
+// 开启后对象内容按 SHA-256 保存在 basedir/.cas 下，内容相同的对象只保存一份
+type DedupConfig struct {
+	Enabled bool `env:"ENABLED"`
+	// 回收不再被引用的内容的间隔，为 0 时不自动回收
+	GCInterval time.Duration `env:"GC_INTERVAL" default:"1h"`
+}
+
+// IndexConfig 是本地存储元数据索引的配置
+// 开启后每个存储桶的对象记录在 basedir/.s3proxy/index 下的 bbolt 文件中
+type IndexConfig struct {
+	Enabled bool `env:"ENABLED"`
+}
+
+// ScrubConfig 是本地存储后台完整性检查的配置，检查的结果写入 basedir/.s3proxy/scrub.json
+type ScrubConfig struct {
+	// 检查的间隔，为 0 时不检查
+	Interval time.Duration `env:"INTERVAL"`
+	// 把损坏的对象、孤立的属性文件和残留的临时文件移动到 basedir/.s3proxy/quarantine，需要设置 interval
+	Quarantine bool `env:"QUARANTINE"`
+}
+
+// WatchConfig 用于发现直接写入存储桶目录的文件，例如其他程序通过 NFS 放入的文件
+type WatchConfig struct {
+	Enabled bool `env:"ENABLED"`
+	// 完整扫描一次存储桶目录的间隔，inotify 收不到其他机器通过 NFS 做的修改，为 0 时只在启动时扫描
+	// 只通过修改时间判断文件是否被修改，覆盖时保留了较早修改时间的文件（如 rsync -t）不会被发现
+	Interval time.Duration `env:"INTERVAL" default:"5m"`
+}
+
+// SpaceConfig 是本地存储剩余空间的检查，低于下限时拒绝写入，只允许读取和删除，状态见 GET /_s3proxy/health
+type SpaceConfig struct {
+	// 剩余空间的下限（字节），为 0 时不检查
+	MinFreeBytes int64 `env:"MIN_FREE_BYTES"`
+	// 剩余 inode 的下限，为 0 时不检查
+	MinFreeInodes int64 `env:"MIN_FREE_INODES"`
+	// 检查结果缓存的时间，期间的写入使用缓存的结果并扣除写入的大小
+	Interval time.Duration `env:"INTERVAL" default:"30s"`
+}
+
+// EncryptionConfig 是本地存储服务端加密的配置
+type EncryptionConfig struct {
+	// base64 编码的 32 字节主密钥，用于加密每个对象的数据密钥，为空时不支持服务端加密
+	MasterKey confutil.SecretString `env:"MASTER_KEY"`
+}
+
+// CompressionConfig 是本地存储透明压缩的配置
+// 对象所在的存储桶在 Buckets 中，或者 Content-Type 匹配 ContentTypes 时才会压缩
+type CompressionConfig struct {
+	// 压缩算法：zstd 或 gzip，为空时不压缩
+	Algorithm string `env:"ALGORITHM"`
+	// 需要压缩的存储桶
+	Buckets []string `env:"BUCKETS"`
+	// 需要压缩的 Content-Type，支持 text/* 这样的通配
+	ContentTypes []string `env:"CONTENT_TYPES"`
+}
+
+// IdentityConfig 是用户与凭证的配置
+// 没有配置任何用户时不做鉴权，所有请求都以默认的匿名身份执行
+// 数据库中没有所有者的存储桶（例如启用用户之前创建的）对所有通过鉴权的用户开放
+type IdentityConfig struct {
+	// 本地文件数据库路径，用于保存额外的用户和存储桶归属，为空则只保存在内存中
+	Database string       `env:"DATABASE"`
+	Users    []UserConfig `env:"USERS"`
+	STS      STSConfig    `envPrefix:"STS_"`
+}
+
+// STSConfig 是临时凭证的配置
+type STSConfig struct {
+	// 签发会话令牌使用的密钥，为空时不提供 STS 接口
+	SigningKey      confutil.SecretString `env:"SIGNING_KEY"`
+	DefaultDuration time.Duration         `env:"DEFAULT_DURATION" default:"1h"`
+	MaxDuration     time.Duration         `env:"MAX_DURATION" default:"12h"`
+}
+
+type UserConfig struct {
+	Name        string
+	DisplayName string
+	// 为空时根据 Name 生成
+	CanonicalID string
+	AccessKey   string
+	SecretKey   confutil.SecretString
+	// 可以使用 /_s3proxy/quotas 等管理接口
+	Admin bool
+}
+
+// QuotaConfig 是存储桶和用户的配额配置，单个存储桶或用户的配额可以通过 /_s3proxy/quotas 修改
+// 启用后启动时会列出所有存储桶中的对象来统计用量
+type QuotaConfig struct {
+	Enabled bool `env:"ENABLED"`
+	// 保存通过接口修改的配额的文件，为空时只保存在内存中
+	Database string `env:"DATABASE"`
+	// 没有单独设置配额的存储桶使用的配额
+	Bucket QuotaLimitConfig `envPrefix:"BUCKET_"`
+	// 没有单独设置配额的用户使用的配额，按用户拥有的所有存储桶计算
+	User QuotaLimitConfig `envPrefix:"USER_"`
+}
+
+// QuotaLimitConfig 是字节数和对象数量的上限，为 0 时不限制
+type QuotaLimitConfig struct {
+	MaxBytes   int64 `env:"MAX_BYTES"`
+	MaxObjects int64 `env:"MAX_OBJECTS"`
+}
+
+// BackendConfig 是一个命名的后端，字段与 cloud 相同
+type BackendConfig struct {
+	Name         string
+	CloudsConfig `mapstructure:",squash"`
+}
+
+// RouteConfig 把匹配的存储桶交给指定的后端，按配置的顺序匹配
+type RouteConfig struct {
+	// 存储桶名称、glob（如 logs-*）或正则表达式
+	Bucket string
+	// exact、glob 或 regex，为空时根据 Bucket 是否含有 *?[ 选择 glob 或 exact
+	Match   string
+	Backend string
 }
 
 // Config 是配置文件的最顶级
 type Config struct {
-	S3Proxy S3ProxyConfig `envPrefix:"S3PROXY_"`
-	Cloud   CloudsConfig  `envPrefix:"CLOUD_"`
+	S3Proxy  S3ProxyConfig  `envPrefix:"S3PROXY_"`
+	Cloud    CloudsConfig   `envPrefix:"CLOUD_"`
+	Identity IdentityConfig `envPrefix:"IDENTITY_"`
+	Quota    QuotaConfig    `envPrefix:"QUOTA_"`
+	// 命名的后端，供 routes 和 mirror 引用；配置 routes 后 cloud 作为名为 default 的后端，处理没有路由匹配的存储桶
+	Backends []BackendConfig `env:"BACKENDS"`
+	Routes   []RouteConfig   `env:"ROUTES"`
 }
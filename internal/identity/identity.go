@@ -0,0 +1,240 @@
+package identity
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/Grey0520/s3proxy/internal/config"
+)
+
+// User 是 s3proxy 的一个用户
+type User struct {
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+	CanonicalID string `json:"canonicalId"`
+	AccessKey   string `json:"accessKey"`
+	SecretKey   string `json:"secretKey"`
+	// 可以使用管理接口
+	Admin bool `json:"admin,omitempty"`
+}
+
+// database 是本地文件数据库的内容
+type database struct {
+	Users []User `json:"users"`
+	// 存储桶名 -> 所有者的 CanonicalID
+	Buckets map[string]string `json:"buckets"`
+}
+
+// Store 保存用户、凭证与存储桶的归属
+type Store struct {
+	mu   sync.RWMutex
+	path string
+
+	byAccessKey   map[string]*User
+	byCanonicalID map[string]*User
+	// 只来自本地文件数据库的用户，持久化时写回
+	fileUsers []User
+	owners    map[string]string
+}
+
+// NewStore 从配置和本地文件数据库中加载用户
+func NewStore(cfg config.IdentityConfig) (*Store, error) {
+	store := &Store{
+		path:          cfg.Database,
+		byAccessKey:   make(map[string]*User),
+		byCanonicalID: make(map[string]*User),
+		owners:        make(map[string]string),
+	}
+
+	for _, u := range cfg.Users {
+		if err := store.addUser(User{
+			Name:        u.Name,
+			DisplayName: u.DisplayName,
+			CanonicalID: u.CanonicalID,
+			AccessKey:   u.AccessKey,
+			SecretKey:   u.SecretKey.Raw(),
+			Admin:       u.Admin,
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	if store.path == "" {
+		return store, nil
+	}
+	db, err := readDatabase(store.path)
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range db.Users {
+		if err := store.addUser(u); err != nil {
+			return nil, fmt.Errorf("invalid user in %s: %v", store.path, err)
+		}
+		store.fileUsers = append(store.fileUsers, u)
+	}
+	for bucket, owner := range db.Buckets {
+		store.owners[bucket] = owner
+	}
+	return store, nil
+}
+
+func (store *Store) addUser(u User) error {
+	if u.Name == "" {
+		return fmt.Errorf("user name cannot be empty")
+	}
+	if u.AccessKey == "" || u.SecretKey == "" {
+		return fmt.Errorf("user %s has no credentials", u.Name)
+	}
+	if u.DisplayName == "" {
+		u.DisplayName = u.Name
+	}
+	if u.CanonicalID == "" {
+		u.CanonicalID = CanonicalIDFor(u.Name)
+	}
+	if _, ok := store.byAccessKey[u.AccessKey]; ok {
+		return fmt.Errorf("duplicate access key %s", u.AccessKey)
+	}
+	if _, ok := store.byCanonicalID[u.CanonicalID]; ok {
+		return fmt.Errorf("duplicate canonical id for user %s", u.Name)
+	}
+	store.byAccessKey[u.AccessKey] = &u
+	store.byCanonicalID[u.CanonicalID] = &u
+	return nil
+}
+
+// CanonicalIDFor 根据用户名生成一个稳定的、S3 格式的 CanonicalID
+func CanonicalIDFor(name string) string {
+	sum := sha256.Sum256([]byte("s3proxy-user:" + name))
+	return hex.EncodeToString(sum[:])
+}
+
+// Enabled 是否配置了用户，没有用户时不做鉴权
+func (store *Store) Enabled() bool {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	return len(store.byAccessKey) > 0
+}
+
+// LookupAccessKey 按 AccessKey 查找用户
+func (store *Store) LookupAccessKey(accessKey string) (*User, bool) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	u, ok := store.byAccessKey[accessKey]
+	return u, ok
+}
+
+// LookupCanonicalID 按 CanonicalID 查找用户
+func (store *Store) LookupCanonicalID(canonicalID string) (*User, bool) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	u, ok := store.byCanonicalID[canonicalID]
+	return u, ok
+}
+
+// LookupName 按用户名查找用户
+func (store *Store) LookupName(name string) (*User, bool) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	for _, u := range store.byAccessKey {
+		if u.Name == name {
+			return u, true
+		}
+	}
+	return nil, false
+}
+
+// Users 返回所有用户，按用户名排序
+func (store *Store) Users() []User {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	users := make([]User, 0, len(store.byAccessKey))
+	for _, u := range store.byAccessKey {
+		users = append(users, *u)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Name < users[j].Name })
+	return users
+}
+
+// BucketOwner 返回存储桶所有者的 CanonicalID
+// 在启用用户之前创建的存储桶没有所有者
+func (store *Store) BucketOwner(bucketName string) (string, bool) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	owner, ok := store.owners[bucketName]
+	return owner, ok
+}
+
+// SetBucketOwner 记录存储桶的所有者
+func (store *Store) SetBucketOwner(bucketName, canonicalID string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.owners[bucketName] = canonicalID
+	return store.save()
+}
+
+// DeleteBucketOwner 删除存储桶的归属记录
+func (store *Store) DeleteBucketOwner(bucketName string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if _, ok := store.owners[bucketName]; !ok {
+		return nil
+	}
+	delete(store.owners, bucketName)
+	return store.save()
+}
+
+// CanAccessBucket 判断用户是否可以访问存储桶
+// 没有所有者的存储桶对所有用户可见，以兼容启用用户之前创建的存储桶
+func (store *Store) CanAccessBucket(u *User, bucketName string) bool {
+	owner, ok := store.BucketOwner(bucketName)
+	return !ok || owner == u.CanonicalID
+}
+
+// save 将文件数据库写回磁盘，调用方需持有写锁
+func (store *Store) save() error {
+	if store.path == "" {
+		return nil
+	}
+	db := database{
+		Users:   store.fileUsers,
+		Buckets: store.owners,
+	}
+	raw, err := json.MarshalIndent(db, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode identity database: %v", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(store.path), 0o755); err != nil {
+		return fmt.Errorf("failed to create directory for identity database: %v", err)
+	}
+	// 先写临时文件再重命名，避免写到一半时进程退出导致数据库损坏
+	tmp := store.path + ".tmp"
+	if err := os.WriteFile(tmp, raw, 0o600); err != nil {
+		return fmt.Errorf("failed to write identity database: %v", err)
+	}
+	if err := os.Rename(tmp, store.path); err != nil {
+		return fmt.Errorf("failed to write identity database: %v", err)
+	}
+	return nil
+}
+
+func readDatabase(path string) (*database, error) {
+	raw, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &database{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read identity database %s: %v", path, err)
+	}
+	db := &database{}
+	if err := json.Unmarshal(raw, db); err != nil {
+		return nil, fmt.Errorf("failed to decode identity database %s: %v", path, err)
+	}
+	return db, nil
+}
@@ -0,0 +1,123 @@
+package identity
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Grey0520/s3proxy/internal/config"
+)
+
+func testConfig(db string) config.IdentityConfig {
+	return config.IdentityConfig{
+		Database: db,
+		Users: []config.UserConfig{
+			{Name: "alice", AccessKey: "alice-key", SecretKey: "alice-secret"},
+			{Name: "bob", DisplayName: "Bob", AccessKey: "bob-key", SecretKey: "bob-secret"},
+		},
+	}
+}
+
+func TestNewStore(t *testing.T) {
+	store, err := NewStore(testConfig(""))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !store.Enabled() {
+		t.Fatal("Expected store with users to be enabled")
+	}
+
+	alice, ok := store.LookupAccessKey("alice-key")
+	if !ok {
+		t.Fatal("Expected to find alice")
+	}
+	if alice.DisplayName != "alice" {
+		t.Errorf("Expected display name to default to user name, got %s", alice.DisplayName)
+	}
+	if alice.CanonicalID != CanonicalIDFor("alice") {
+		t.Errorf("Expected generated canonical id, got %s", alice.CanonicalID)
+	}
+	if u, ok := store.LookupCanonicalID(alice.CanonicalID); !ok || u.Name != "alice" {
+		t.Errorf("Expected to find alice by canonical id, got %v", u)
+	}
+	if _, ok := store.LookupAccessKey("unknown"); ok {
+		t.Error("Expected unknown access key to be missing")
+	}
+}
+
+func TestNewStoreDuplicateAccessKey(t *testing.T) {
+	cfg := testConfig("")
+	cfg.Users[1].AccessKey = cfg.Users[0].AccessKey
+	if _, err := NewStore(cfg); err == nil {
+		t.Fatal("Expected error for duplicate access key")
+	}
+}
+
+func TestStoreDisabled(t *testing.T) {
+	store, err := NewStore(config.IdentityConfig{})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if store.Enabled() {
+		t.Error("Expected store without users to be disabled")
+	}
+}
+
+func TestBucketOwnership(t *testing.T) {
+	db := filepath.Join(t.TempDir(), "identity.json")
+	store, err := NewStore(testConfig(db))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	alice, _ := store.LookupAccessKey("alice-key")
+	bob, _ := store.LookupAccessKey("bob-key")
+
+	if !store.CanAccessBucket(bob, "shared") {
+		t.Error("Expected bucket without owner to be accessible")
+	}
+	if err := store.SetBucketOwner("alice-bucket", alice.CanonicalID); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !store.CanAccessBucket(alice, "alice-bucket") {
+		t.Error("Expected owner to access bucket")
+	}
+	if store.CanAccessBucket(bob, "alice-bucket") {
+		t.Error("Expected other user to be denied")
+	}
+
+	// 归属关系需要在重启后保留
+	reloaded, err := NewStore(testConfig(db))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if owner, ok := reloaded.BucketOwner("alice-bucket"); !ok || owner != alice.CanonicalID {
+		t.Errorf("Expected owner %s after reload, got %s", alice.CanonicalID, owner)
+	}
+
+	if err := reloaded.DeleteBucketOwner("alice-bucket"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, ok := reloaded.BucketOwner("alice-bucket"); ok {
+		t.Error("Expected owner to be removed")
+	}
+}
+
+func TestUsersFromDatabase(t *testing.T) {
+	db := filepath.Join(t.TempDir(), "identity.json")
+	raw := `{"users":[{"name":"carol","accessKey":"carol-key","secretKey":"carol-secret"}],"buckets":{"logs":"` + CanonicalIDFor("carol") + `"}}`
+	if err := os.WriteFile(db, []byte(raw), 0o600); err != nil {
+		t.Fatalf("failed to write database: %v", err)
+	}
+
+	store, err := NewStore(config.IdentityConfig{Database: db})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	carol, ok := store.LookupAccessKey("carol-key")
+	if !ok {
+		t.Fatal("Expected to find user from database")
+	}
+	if !store.CanAccessBucket(carol, "logs") {
+		t.Error("Expected carol to own logs")
+	}
+}
@@ -0,0 +1,520 @@
+package quota
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/Grey0520/s3proxy/internal/config"
+	"github.com/Grey0520/s3proxy/internal/s3err"
+	"github.com/Grey0520/s3proxy/internal/storage"
+)
+
+// Limit 是一个存储桶或用户的配额，为 0 的字段不限制
+type Limit struct {
+	MaxBytes   int64 `json:"maxBytes"`
+	MaxObjects int64 `json:"maxObjects"`
+}
+
+// Usage 是已经使用的字节数和对象数量
+type Usage struct {
+	Bytes   int64 `json:"bytes"`
+	Objects int64 `json:"objects"`
+}
+
+func (u Usage) add(o Usage) Usage {
+	return Usage{Bytes: u.Bytes + o.Bytes, Objects: u.Objects + o.Objects}
+}
+
+func (u Usage) sub(o Usage) Usage {
+	return Usage{Bytes: u.Bytes - o.Bytes, Objects: u.Objects - o.Objects}
+}
+
+// exceeds 判断用量增加 delta 后是否超出配额，只检查增加的部分，已经超出配额时仍然可以删除或缩小对象
+func (l Limit) exceeds(usage, delta Usage) bool {
+	return l.MaxBytes > 0 && delta.Bytes > 0 && usage.Bytes+delta.Bytes > l.MaxBytes ||
+		l.MaxObjects > 0 && delta.Objects > 0 && usage.Objects+delta.Objects > l.MaxObjects
+}
+
+// BucketQuota 是一个存储桶的配额和用量
+type BucketQuota struct {
+	Bucket string `json:"bucket"`
+	// 所有者的 CanonicalID，没有所有者时为空
+	Owner string `json:"owner,omitempty"`
+	Limit Limit  `json:"limit"`
+	// 是否单独设置了配额，为 false 时使用默认配额
+	Custom bool  `json:"custom"`
+	Usage  Usage `json:"usage"`
+}
+
+// UserQuota 是一个用户的配额，用量为用户拥有的所有存储桶的总和
+type UserQuota struct {
+	Owner  string `json:"owner"`
+	Limit  Limit  `json:"limit"`
+	Custom bool   `json:"custom"`
+	Usage  Usage  `json:"usage"`
+}
+
+// database 是保存单独设置的配额的文件的内容
+type database struct {
+	Buckets map[string]Limit `json:"buckets"`
+	// 用户的 CanonicalID -> 配额
+	Users map[string]Limit `json:"users"`
+}
+
+// Manager 在写入对象前检查存储桶和用户的配额
+// 用量在启动时列出所有存储桶得到，之后随着写入和删除增量更新，不写入磁盘
+// 每次写入和删除都要多 HEAD 一次对象来读取它原来的大小
+// 只统计 PutObject、CopyObject 和 DeleteObject，s3proxy 没有实现分段上传，因此也不处理 CompleteMultipartUpload
+type Manager struct {
+	mu      sync.Mutex
+	enabled bool
+	path    string
+	stg     storage.StorageProvider
+	// 返回存储桶所有者的 CanonicalID
+	owner func(bucketName string) (string, bool)
+
+	bucketDefault Limit
+	userDefault   Limit
+	limits        database
+	usage         map[string]Usage
+	// 正在预留的对象，键为存储桶和对象的键，见 lockKey
+	keysMu sync.Mutex
+	keys   map[string]*keyLock
+}
+
+// keyLock 是一个对象的锁，refs 为持有和等待它的预留数量
+type keyLock struct {
+	sync.Mutex
+	refs int
+}
+
+// NewManager 加载单独设置的配额，并统计所有存储桶的用量
+// 没有启用配额时返回的 Manager 不做任何检查
+func NewManager(cfg config.QuotaConfig, stg storage.StorageProvider, owner func(string) (string, bool)) (*Manager, error) {
+	m := &Manager{
+		enabled:       cfg.Enabled,
+		path:          cfg.Database,
+		stg:           stg,
+		owner:         owner,
+		bucketDefault: Limit{MaxBytes: cfg.Bucket.MaxBytes, MaxObjects: cfg.Bucket.MaxObjects},
+		userDefault:   Limit{MaxBytes: cfg.User.MaxBytes, MaxObjects: cfg.User.MaxObjects},
+		limits:        database{Buckets: make(map[string]Limit), Users: make(map[string]Limit)},
+		usage:         make(map[string]Usage),
+		keys:          make(map[string]*keyLock),
+	}
+	if !m.enabled {
+		return m, nil
+	}
+	if m.path != "" {
+		if err := m.load(); err != nil {
+			return nil, err
+		}
+	}
+	if err := m.scan(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Enabled 是否启用了配额
+func (m *Manager) Enabled() bool {
+	return m.enabled
+}
+
+// scan 列出所有存储桶中的对象，统计每个存储桶的用量
+func (m *Manager) scan() error {
+	buckets, err := m.stg.ListAllMyBuckets()
+	if err != nil {
+		return fmt.Errorf("failed to list buckets for quota usage: %v", err)
+	}
+	for _, b := range buckets.Buckets.Bucket {
+		var usage Usage
+		marker := ""
+		for {
+			result, err := m.stg.ListBucket(b.Name, storage.WithMarker(marker), storage.WithMaxKeys(1000))
+			if err != nil {
+				return fmt.Errorf("failed to list bucket %s for quota usage: %v", b.Name, err)
+			}
+			for _, c := range result.Contents {
+				usage = usage.add(Usage{Bytes: c.Size, Objects: 1})
+			}
+			if !result.IsTruncated || len(result.Contents) == 0 {
+				break
+			}
+			marker = result.Contents[len(result.Contents)-1].Key
+		}
+		m.add(b.Name, usage)
+	}
+	return nil
+}
+
+// objectSize 返回对象当前的大小，对象不存在时返回 false
+func (m *Manager) objectSize(bucketName, objectKey string) (int64, bool) {
+	head, err := m.stg.HeadObject(bucketName, objectKey)
+	if err == nil {
+		size, err := strconv.ParseInt(head["Size"], 10, 64)
+		return size, err == nil
+	}
+	if errors.Is(err, s3err.ErrNoSuchKey) || errors.Is(err, s3err.ErrNoSuchBucket) {
+		return 0, false
+	}
+	// SSE-C 对象没有密钥时无法 HEAD，只能从列表中找到它的大小
+	result, err := m.stg.ListBucket(bucketName, storage.WithPrefix(objectKey), storage.WithMaxKeys(1))
+	if err != nil || len(result.Contents) == 0 || result.Contents[0].Key != objectKey {
+		return 0, false
+	}
+	return result.Contents[0].Size, true
+}
+
+// add 修改存储桶的用量，调用方需持有锁或在启动阶段调用
+func (m *Manager) add(bucketName string, delta Usage) {
+	usage := m.usage[bucketName].add(delta)
+	if usage == (Usage{}) {
+		delete(m.usage, bucketName)
+		return
+	}
+	m.usage[bucketName] = usage
+}
+
+func (m *Manager) bucketLimit(bucketName string) (Limit, bool) {
+	if l, ok := m.limits.Buckets[bucketName]; ok {
+		return l, true
+	}
+	return m.bucketDefault, false
+}
+
+func (m *Manager) userLimit(owner string) (Limit, bool) {
+	if l, ok := m.limits.Users[owner]; ok {
+		return l, true
+	}
+	return m.userDefault, false
+}
+
+// ownerUsage 返回用户拥有的所有存储桶的用量，调用方需持有锁
+func (m *Manager) ownerUsage(owner string) Usage {
+	var usage Usage
+	for bucket, u := range m.usage {
+		if o, ok := m.owner(bucket); ok && o == owner {
+			usage = usage.add(u)
+		}
+	}
+	return usage
+}
+
+// lockKey 锁定存储桶中的一个对象，返回解锁的函数
+// 同一个对象的预留从读取原来的大小到 Commit 或 Abort 按顺序进行，并发写入同一个新对象时只计入一个对象
+func (m *Manager) lockKey(bucketName, objectKey string) func() {
+	name := bucketName + "\x00" + objectKey
+	m.keysMu.Lock()
+	l, ok := m.keys[name]
+	if !ok {
+		l = &keyLock{}
+		m.keys[name] = l
+	}
+	l.refs++
+	m.keysMu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		m.keysMu.Lock()
+		defer m.keysMu.Unlock()
+		if l.refs--; l.refs == 0 {
+			delete(m.keys, name)
+		}
+	}
+}
+
+// Reservation 是一次写入或删除预先计入的用量，成功后调用 Commit，失败时调用 Abort
+// 两者必须调用其中一个，在此之前同一个对象的其他预留会等待
+// 没有启用配额时为 nil，所有方法都可以在 nil 上调用
+type Reservation struct {
+	m      *Manager
+	bucket string
+	unlock func()
+	// 预先计入的用量
+	reserved Usage
+	// 写入成功后的用量变化，大小未知时还要加上 Wrap 读到的字节数
+	delta Usage
+
+	counting bool
+	// Wrap 读到的字节数和允许写入的字节数，limit 为 -1 时不限制
+	read, limit int64
+	exceeded    bool
+}
+
+// Reserve 检查写入 size 字节的对象后是否超出存储桶或所有者的配额，超出时返回 QuotaExceeded
+// 覆盖已有的对象时只计算大小的差值；size 为 -1 表示大小未知，此时写入的字节数由 Wrap 限制
+func (m *Manager) Reserve(bucketName, objectKey string, size int64) (*Reservation, error) {
+	if !m.enabled {
+		return nil, nil
+	}
+	unlock := m.lockKey(bucketName, objectKey)
+	old, exists := m.objectSize(bucketName, objectKey)
+	r := &Reservation{m: m, bucket: bucketName, unlock: unlock, limit: -1}
+	if !exists {
+		r.delta.Objects = 1
+	}
+	if size < 0 {
+		r.counting = true
+		r.delta.Bytes = -old
+	} else {
+		r.delta.Bytes = size - old
+	}
+	r.reserved = Usage{Objects: r.delta.Objects, Bytes: max(r.delta.Bytes, 0)}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	owner, hasOwner := m.owner(bucketName)
+	limits := []Limit{}
+	usages := []Usage{}
+	if l, _ := m.bucketLimit(bucketName); l != (Limit{}) {
+		limits = append(limits, l)
+		usages = append(usages, m.usage[bucketName])
+	}
+	if hasOwner {
+		if l, _ := m.userLimit(owner); l != (Limit{}) {
+			limits = append(limits, l)
+			usages = append(usages, m.ownerUsage(owner))
+		}
+	}
+	for i, l := range limits {
+		if l.exceeds(usages[i], r.reserved) {
+			unlock()
+			return nil, s3err.ErrQuotaExceeded
+		}
+		if r.counting && l.MaxBytes > 0 {
+			remaining := max(l.MaxBytes-usages[i].Bytes, 0) + old
+			if r.limit < 0 || remaining < r.limit {
+				r.limit = remaining
+			}
+		}
+	}
+	m.add(bucketName, r.reserved)
+	return r, nil
+}
+
+// ReserveCopy 与 Reserve 相同，对象的大小为源对象的大小
+func (m *Manager) ReserveCopy(srcBucketName, srcObjectKey, bucketName, objectKey string) (*Reservation, error) {
+	if !m.enabled {
+		return nil, nil
+	}
+	size, _ := m.objectSize(srcBucketName, srcObjectKey)
+	return m.Reserve(bucketName, objectKey, size)
+}
+
+// Remove 返回删除对象时的用量变化，删除成功后调用 Commit，失败时调用 Abort
+func (m *Manager) Remove(bucketName, objectKey string) *Reservation {
+	if !m.enabled {
+		return nil
+	}
+	r := &Reservation{m: m, bucket: bucketName, unlock: m.lockKey(bucketName, objectKey), limit: -1}
+	if size, ok := m.objectSize(bucketName, objectKey); ok {
+		r.delta = Usage{Bytes: -size, Objects: -1}
+	}
+	return r
+}
+
+// Wrap 在大小未知时统计写入的字节数，超出配额时返回 QuotaExceeded
+func (r *Reservation) Wrap(body io.ReadCloser) io.ReadCloser {
+	if r == nil || !r.counting {
+		return body
+	}
+	return &limitedReader{ReadCloser: body, r: r}
+}
+
+// Commit 写入成功后计入实际的用量
+func (r *Reservation) Commit() {
+	if r == nil {
+		return
+	}
+	delta := r.delta
+	if r.counting {
+		delta.Bytes += r.read
+	}
+	r.m.mu.Lock()
+	r.m.add(r.bucket, delta.sub(r.reserved))
+	r.m.mu.Unlock()
+	r.unlock()
+}
+
+// Abort 在写入失败后退回预先计入的用量
+// 因为超出配额而失败时返回 QuotaExceeded，否则返回 err
+func (r *Reservation) Abort(err error) error {
+	if r == nil {
+		return err
+	}
+	r.m.mu.Lock()
+	r.m.add(r.bucket, Usage{}.sub(r.reserved))
+	r.m.mu.Unlock()
+	r.unlock()
+	if r.exceeded {
+		return s3err.ErrQuotaExceeded
+	}
+	return err
+}
+
+type limitedReader struct {
+	io.ReadCloser
+	r *Reservation
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	n, err := l.ReadCloser.Read(p)
+	l.r.read += int64(n)
+	if l.r.limit >= 0 && l.r.read > l.r.limit {
+		l.r.exceeded = true
+		return n, s3err.ErrQuotaExceeded
+	}
+	return n, err
+}
+
+// DeleteBucket 删除存储桶的用量和单独设置的配额
+func (m *Manager) DeleteBucket(bucketName string) error {
+	if !m.enabled {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.usage, bucketName)
+	if _, ok := m.limits.Buckets[bucketName]; !ok {
+		return nil
+	}
+	delete(m.limits.Buckets, bucketName)
+	return m.save()
+}
+
+// Bucket 返回存储桶的配额和用量
+func (m *Manager) Bucket(bucketName string) BucketQuota {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.bucketQuota(bucketName)
+}
+
+func (m *Manager) bucketQuota(bucketName string) BucketQuota {
+	limit, custom := m.bucketLimit(bucketName)
+	owner, _ := m.owner(bucketName)
+	return BucketQuota{Bucket: bucketName, Owner: owner, Limit: limit, Custom: custom, Usage: m.usage[bucketName]}
+}
+
+// Buckets 返回有用量或单独设置了配额的存储桶，按名称排序
+func (m *Manager) Buckets() []BucketQuota {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	names := make(map[string]bool)
+	for name := range m.usage {
+		names[name] = true
+	}
+	for name := range m.limits.Buckets {
+		names[name] = true
+	}
+	buckets := make([]BucketQuota, 0, len(names))
+	for name := range names {
+		buckets = append(buckets, m.bucketQuota(name))
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].Bucket < buckets[j].Bucket })
+	return buckets
+}
+
+// User 返回用户的配额和用量
+func (m *Manager) User(owner string) UserQuota {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	limit, custom := m.userLimit(owner)
+	return UserQuota{Owner: owner, Limit: limit, Custom: custom, Usage: m.ownerUsage(owner)}
+}
+
+// Users 返回拥有存储桶或单独设置了配额的用户，按 CanonicalID 排序
+func (m *Manager) Users() []UserQuota {
+	m.mu.Lock()
+	owners := make(map[string]bool)
+	for bucket := range m.usage {
+		if owner, ok := m.owner(bucket); ok {
+			owners[owner] = true
+		}
+	}
+	for owner := range m.limits.Users {
+		owners[owner] = true
+	}
+	m.mu.Unlock()
+
+	users := make([]UserQuota, 0, len(owners))
+	for owner := range owners {
+		users = append(users, m.User(owner))
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Owner < users[j].Owner })
+	return users
+}
+
+// SetBucketLimit 单独设置存储桶的配额，limit 为 nil 时恢复默认配额
+func (m *Manager) SetBucketLimit(bucketName string, limit *Limit) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	setLimit(m.limits.Buckets, bucketName, limit)
+	return m.save()
+}
+
+// SetUserLimit 单独设置用户的配额，limit 为 nil 时恢复默认配额
+func (m *Manager) SetUserLimit(owner string, limit *Limit) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	setLimit(m.limits.Users, owner, limit)
+	return m.save()
+}
+
+func setLimit(limits map[string]Limit, name string, limit *Limit) {
+	if limit == nil {
+		delete(limits, name)
+		return
+	}
+	limits[name] = *limit
+}
+
+// save 将单独设置的配额写回磁盘，调用方需持有锁
+func (m *Manager) save() error {
+	if m.path == "" {
+		return nil
+	}
+	raw, err := json.MarshalIndent(m.limits, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode quota database: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(m.path), 0o755); err != nil {
+		return fmt.Errorf("failed to create directory for quota database: %v", err)
+	}
+	tmp := m.path + ".tmp"
+	if err := os.WriteFile(tmp, raw, 0o600); err != nil {
+		return fmt.Errorf("failed to write quota database: %v", err)
+	}
+	if err := os.Rename(tmp, m.path); err != nil {
+		return fmt.Errorf("failed to write quota database: %v", err)
+	}
+	return nil
+}
+
+func (m *Manager) load() error {
+	raw, err := os.ReadFile(m.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read quota database %s: %v", m.path, err)
+	}
+	if err := json.Unmarshal(raw, &m.limits); err != nil {
+		return fmt.Errorf("failed to decode quota database %s: %v", m.path, err)
+	}
+	if m.limits.Buckets == nil {
+		m.limits.Buckets = make(map[string]Limit)
+	}
+	if m.limits.Users == nil {
+		m.limits.Users = make(map[string]Limit)
+	}
+	return nil
+}
@@ -0,0 +1,310 @@
+package quota
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Grey0520/s3proxy/internal/config"
+	"github.com/Grey0520/s3proxy/internal/s3err"
+	"github.com/Grey0520/s3proxy/internal/storage"
+)
+
+func putString(t *testing.T, stg storage.StorageProvider, bucketName, objectKey, content string) {
+	t.Helper()
+	err := stg.PutObject(bucketName, objectKey, &storage.Object{Data: io.NopCloser(strings.NewReader(content))})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+}
+
+// newTestManager 创建 alice 拥有 a 和 b、c 没有所有者的存储
+func newTestManager(t *testing.T, cfg config.QuotaConfig) (*Manager, storage.StorageProvider) {
+	stg, err := storage.NewMemoryStore(0)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	for _, b := range []string{"a", "b", "c"} {
+		stg.CreateBucket(b)
+	}
+	putString(t, stg, "a", "one", "12345")
+	putString(t, stg, "b", "two", "1234567890")
+	owners := map[string]string{"a": "alice", "b": "alice"}
+	cfg.Enabled = true
+	m, err := NewManager(cfg, stg, func(bucketName string) (string, bool) {
+		owner, ok := owners[bucketName]
+		return owner, ok
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	return m, stg
+}
+
+// put 像 PutObject 的处理函数一样预留用量并写入
+func put(m *Manager, stg storage.StorageProvider, bucketName, objectKey, content string, size int64) error {
+	r, err := m.Reserve(bucketName, objectKey, size)
+	if err != nil {
+		return err
+	}
+	data := r.Wrap(io.NopCloser(strings.NewReader(content)))
+	if err := stg.PutObject(bucketName, objectKey, &storage.Object{Data: data}); err != nil {
+		return r.Abort(err)
+	}
+	r.Commit()
+	return nil
+}
+
+func TestManagerScan(t *testing.T) {
+	m, _ := newTestManager(t, config.QuotaConfig{})
+	if got := m.Bucket("a").Usage; got != (Usage{Bytes: 5, Objects: 1}) {
+		t.Errorf("Unexpected usage of a: %+v", got)
+	}
+	if got := m.User("alice").Usage; got != (Usage{Bytes: 15, Objects: 2}) {
+		t.Errorf("Unexpected usage of alice: %+v", got)
+	}
+	if buckets := m.Buckets(); len(buckets) != 2 || buckets[0].Bucket != "a" || buckets[1].Owner != "alice" {
+		t.Errorf("Unexpected buckets %+v", buckets)
+	}
+}
+
+func TestManagerBucketLimit(t *testing.T) {
+	m, stg := newTestManager(t, config.QuotaConfig{Bucket: config.QuotaLimitConfig{MaxObjects: 2, MaxBytes: 10}})
+
+	if err := put(m, stg, "a", "two", "abcde", 5); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := put(m, stg, "a", "three", "x", 1); !errors.Is(err, s3err.ErrQuotaExceeded) {
+		t.Errorf("Expected QuotaExceeded for too many objects, got %v", err)
+	}
+	// 覆盖已有的对象只计算大小的差值
+	if err := put(m, stg, "a", "one", "1", 1); err != nil {
+		t.Errorf("Expected no error overwriting an object, got %v", err)
+	}
+	if err := put(m, stg, "a", "two", "abcdefghij", 10); !errors.Is(err, s3err.ErrQuotaExceeded) {
+		t.Errorf("Expected QuotaExceeded for too many bytes, got %v", err)
+	}
+	if got := m.Bucket("a").Usage; got != (Usage{Bytes: 6, Objects: 2}) {
+		t.Errorf("Unexpected usage %+v", got)
+	}
+
+	r := m.Remove("a", "one")
+	stg.DeleteObject("a", "one")
+	r.Commit()
+	if got := m.Bucket("a").Usage; got != (Usage{Bytes: 5, Objects: 1}) {
+		t.Errorf("Unexpected usage after delete %+v", got)
+	}
+
+	// 单独设置的配额优先于默认配额
+	m.SetBucketLimit("c", &Limit{MaxBytes: 3})
+	if err := put(m, stg, "c", "key", "abcd", 4); !errors.Is(err, s3err.ErrQuotaExceeded) {
+		t.Errorf("Expected QuotaExceeded, got %v", err)
+	}
+	if q := m.Bucket("c"); !q.Custom || q.Limit != (Limit{MaxBytes: 3}) || q.Usage != (Usage{}) {
+		t.Errorf("Unexpected quota %+v", q)
+	}
+}
+
+func TestManagerUserLimit(t *testing.T) {
+	m, stg := newTestManager(t, config.QuotaConfig{User: config.QuotaLimitConfig{MaxBytes: 20}})
+
+	if err := put(m, stg, "a", "more", "abcde", 5); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := put(m, stg, "b", "more", "x", 1); !errors.Is(err, s3err.ErrQuotaExceeded) {
+		t.Errorf("Expected QuotaExceeded across alice's buckets, got %v", err)
+	}
+	// 没有所有者的存储桶不受用户配额限制
+	if err := put(m, stg, "c", "more", "abcdefghijklmnopqrstuvwxyz", 26); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+	// 写入失败时退回预留的用量
+	if err := put(m, stg, "missing", "key", "x", 1); !errors.Is(err, s3err.ErrNoSuchBucket) {
+		t.Errorf("Expected NoSuchBucket, got %v", err)
+	}
+	if users := m.Users(); len(users) != 1 || users[0].Usage != (Usage{Bytes: 20, Objects: 3}) {
+		t.Errorf("Unexpected users %+v", users)
+	}
+	if buckets := m.Buckets(); len(buckets) != 3 {
+		t.Errorf("Unexpected buckets %+v", buckets)
+	}
+}
+
+func TestManagerUnknownSize(t *testing.T) {
+	m, stg := newTestManager(t, config.QuotaConfig{Bucket: config.QuotaLimitConfig{MaxBytes: 10}})
+
+	if err := put(m, stg, "a", "key", "abcdef", -1); !errors.Is(err, s3err.ErrQuotaExceeded) {
+		t.Errorf("Expected QuotaExceeded, got %v", err)
+	}
+	if err := put(m, stg, "a", "one", "0123456789", -1); err != nil {
+		t.Errorf("Expected no error replacing an object, got %v", err)
+	}
+	if got := m.Bucket("a").Usage; got != (Usage{Bytes: 10, Objects: 1}) {
+		t.Errorf("Unexpected usage %+v", got)
+	}
+}
+
+// listCountingStore 统计 ListBucket 的调用次数
+type listCountingStore struct {
+	storage.StorageProvider
+	lists *int
+}
+
+func (s listCountingStore) ListBucket(bucketName string, opts ...storage.ListOption) (*storage.ListBucketResult, error) {
+	*s.lists++
+	return s.StorageProvider.ListBucket(bucketName, opts...)
+}
+
+// 读取对象原来的大小时不列出存储桶
+func TestManagerObjectSize(t *testing.T) {
+	m, stg := newTestManager(t, config.QuotaConfig{})
+	putString(t, stg, "a", "one0", "x")
+	lists := 0
+	m.stg = listCountingStore{StorageProvider: stg, lists: &lists}
+
+	if size, ok := m.objectSize("a", "one"); !ok || size != 5 {
+		t.Errorf("Expected size 5, got %d, %v", size, ok)
+	}
+	if _, ok := m.objectSize("a", "on"); ok {
+		t.Error("Expected missing object")
+	}
+	if _, ok := m.objectSize("missing", "one"); ok {
+		t.Error("Expected missing bucket")
+	}
+	if lists != 0 {
+		t.Errorf("Expected no ListBucket calls, got %d", lists)
+	}
+
+	// 没有密钥无法 HEAD 的 SSE-C 对象从列表中读取大小
+	lfs, err := storage.NewLFSStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	defer lfs.Close()
+	lfs.CreateBucket("bucket")
+	raw := strings.Repeat("k", 32)
+	sum := md5.Sum([]byte(raw))
+	key, err := storage.ParseSSECustomerKey(storage.SSEAlgorithmAES256, base64.StdEncoding.EncodeToString([]byte(raw)), base64.StdEncoding.EncodeToString(sum[:]))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	err = lfs.PutObject("bucket", "secret", &storage.Object{Data: io.NopCloser(strings.NewReader("abc"))}, storage.WithSSECustomerKey(key))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	m.stg = lfs
+	if size, ok := m.objectSize("bucket", "secret"); !ok || size != 3 {
+		t.Errorf("Expected size 3, got %d, %v", size, ok)
+	}
+}
+
+// slowStore 延迟写入和删除，让并发的预留在读取原来的大小和写入之间交错
+type slowStore struct {
+	storage.StorageProvider
+}
+
+func (s slowStore) PutObject(bucketName, objectKey string, data *storage.Object, opts ...storage.ObjectOption) error {
+	time.Sleep(time.Millisecond)
+	return s.StorageProvider.PutObject(bucketName, objectKey, data, opts...)
+}
+
+func (s slowStore) DeleteObject(bucketName, objectKey string) error {
+	time.Sleep(time.Millisecond)
+	return s.StorageProvider.DeleteObject(bucketName, objectKey)
+}
+
+// 同一个对象的并发写入和删除按顺序预留，用量与存储中的对象一致
+func TestManagerConcurrent(t *testing.T) {
+	m, backend := newTestManager(t, config.QuotaConfig{})
+	stg := slowStore{backend}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := put(m, stg, "c", "key", "abc", 3); err != nil {
+				t.Errorf("Expected no error, got %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := m.Bucket("c").Usage; got != (Usage{Bytes: 3, Objects: 1}) {
+		t.Errorf("Expected one object, got %+v", got)
+	}
+
+	for i := 0; i < 16; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			put(m, stg, "c", "key", "abcdef", 6)
+		}()
+		go func() {
+			defer wg.Done()
+			r := m.Remove("c", "key")
+			if err := stg.DeleteObject("c", "key"); err != nil {
+				r.Abort(err)
+				return
+			}
+			r.Commit()
+		}()
+	}
+	wg.Wait()
+	var want Usage
+	if size, ok := m.objectSize("c", "key"); ok {
+		want = Usage{Bytes: size, Objects: 1}
+	}
+	if got := m.Bucket("c").Usage; got != want {
+		t.Errorf("Expected usage %+v, got %+v", want, got)
+	}
+}
+
+func TestManagerDatabase(t *testing.T) {
+	db := filepath.Join(t.TempDir(), "quota.json")
+	m, _ := newTestManager(t, config.QuotaConfig{Database: db})
+	if err := m.SetBucketLimit("a", &Limit{MaxObjects: 5}); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	m.SetBucketLimit("b", &Limit{MaxObjects: 5})
+	m.SetUserLimit("alice", &Limit{MaxBytes: 100})
+	if err := m.DeleteBucket("b"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	m, _ = newTestManager(t, config.QuotaConfig{Database: db})
+	if q := m.Bucket("a"); !q.Custom || q.Limit.MaxObjects != 5 {
+		t.Errorf("Expected limit to be loaded, got %+v", q)
+	}
+	if q := m.Bucket("b"); q.Custom {
+		t.Errorf("Expected limit of deleted bucket to be removed, got %+v", q)
+	}
+	if q := m.User("alice"); !q.Custom || q.Limit.MaxBytes != 100 {
+		t.Errorf("Expected user limit to be loaded, got %+v", q)
+	}
+}
+
+func TestManagerDisabled(t *testing.T) {
+	m, err := NewManager(config.QuotaConfig{}, nil, nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	r, err := m.Reserve("bucket", "key", 1<<40)
+	if err != nil || r != nil {
+		t.Fatalf("Expected no reservation, got %v (%v)", r, err)
+	}
+	body := io.NopCloser(strings.NewReader("x"))
+	if r.Wrap(body) != body {
+		t.Errorf("Expected body to be unchanged")
+	}
+	r.Commit()
+	m.Remove("bucket", "key").Commit()
+	if err := r.Abort(io.EOF); err != io.EOF {
+		t.Errorf("Expected original error, got %v", err)
+	}
+}
@@ -0,0 +1,165 @@
+package s3err
+
+import (
+	"encoding/xml"
+	"net/http"
+)
+
+// Error 是返回给客户端的 S3 错误，序列化后即为 S3 的 <Error> 响应体
+type Error struct {
+	XMLName    xml.Name `xml:"Error"`
+	Code       string   `xml:"Code"`
+	Message    string   `xml:"Message"`
+	Resource   string   `xml:"Resource,omitempty"`
+	StatusCode int      `xml:"-"`
+}
+
+func (e *Error) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+// Is 按错误码比较，使 errors.Is 能匹配 WithMessage 派生出来的错误
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+// WithMessage 返回一个错误码相同、描述不同的副本
+func (e *Error) WithMessage(message string) *Error {
+	cp := *e
+	cp.Message = message
+	return &cp
+}
+
+// WithResource 返回一个带有资源路径的副本
+func (e *Error) WithResource(resource string) *Error {
+	cp := *e
+	cp.Resource = resource
+	return &cp
+}
+
+// 常用的 S3 错误码，参考 https://docs.aws.amazon.com/AmazonS3/latest/API/ErrorResponses.html
+var (
+	ErrAccessDenied = &Error{
+		Code:       "AccessDenied",
+		Message:    "Access Denied",
+		StatusCode: http.StatusForbidden,
+	}
+	ErrInvalidAccessKeyID = &Error{
+		Code:       "InvalidAccessKeyId",
+		Message:    "The AWS access key Id you provided does not exist in our records.",
+		StatusCode: http.StatusForbidden,
+	}
+	ErrSignatureDoesNotMatch = &Error{
+		Code:       "SignatureDoesNotMatch",
+		Message:    "The request signature we calculated does not match the signature you provided.",
+		StatusCode: http.StatusForbidden,
+	}
+	ErrInvalidToken = &Error{
+		Code:       "InvalidToken",
+		Message:    "The provided token is malformed or otherwise invalid.",
+		StatusCode: http.StatusBadRequest,
+	}
+	ErrRequestTimeTooSkewed = &Error{
+		Code:       "RequestTimeTooSkewed",
+		Message:    "The difference between the request time and the server's time is too large.",
+		StatusCode: http.StatusForbidden,
+	}
+	ErrAuthorizationHeaderMalformed = &Error{
+		Code:       "AuthorizationHeaderMalformed",
+		Message:    "The authorization header is malformed.",
+		StatusCode: http.StatusBadRequest,
+	}
+	ErrInvalidRequest = &Error{
+		Code:       "InvalidRequest",
+		Message:    "Invalid Request",
+		StatusCode: http.StatusBadRequest,
+	}
+	ErrInvalidArgument = &Error{
+		Code:       "InvalidArgument",
+		Message:    "Invalid Argument",
+		StatusCode: http.StatusBadRequest,
+	}
+	ErrXAmzContentSHA256Mismatch = &Error{
+		Code:       "XAmzContentSHA256Mismatch",
+		Message:    "The provided 'x-amz-content-sha256' header does not match what was computed.",
+		StatusCode: http.StatusBadRequest,
+	}
+	ErrMalformedXML = &Error{
+		Code:       "MalformedXML",
+		Message:    "The XML you provided was not well-formed or did not validate against our published schema.",
+		StatusCode: http.StatusBadRequest,
+	}
+	ErrInvalidBucketName = &Error{
+		Code:       "InvalidBucketName",
+		Message:    "The specified bucket is not valid.",
+		StatusCode: http.StatusBadRequest,
+	}
+	ErrKeyTooLong = &Error{
+		Code:       "KeyTooLongError",
+		Message:    "Your key is too long.",
+		StatusCode: http.StatusBadRequest,
+	}
+	// 不是 AWS 的错误码，与 Ceph RGW 相同，表示超出了 s3proxy 中设置的配额
+	ErrQuotaExceeded = &Error{
+		Code:       "QuotaExceeded",
+		Message:    "The bucket or user quota has been exceeded.",
+		StatusCode: http.StatusForbidden,
+	}
+	// 本地存储的剩余空间低于下限时返回，客户端可以在清理空间后重试
+	ErrInsufficientStorage = &Error{
+		Code:       "InsufficientStorage",
+		Message:    "The local store does not have enough free space and only accepts reads and deletes.",
+		StatusCode: http.StatusServiceUnavailable,
+	}
+	ErrNoSuchBucket = &Error{
+		Code:       "NoSuchBucket",
+		Message:    "The specified bucket does not exist.",
+		StatusCode: http.StatusNotFound,
+	}
+	ErrNoSuchKey = &Error{
+		Code:       "NoSuchKey",
+		Message:    "The specified key does not exist.",
+		StatusCode: http.StatusNotFound,
+	}
+	ErrBucketAlreadyExists = &Error{
+		Code:       "BucketAlreadyExists",
+		Message:    "The requested bucket name is not available.",
+		StatusCode: http.StatusConflict,
+	}
+	ErrBucketAlreadyOwnedByYou = &Error{
+		Code:       "BucketAlreadyOwnedByYou",
+		Message:    "The bucket you tried to create already exists, and you own it.",
+		StatusCode: http.StatusConflict,
+	}
+	ErrBucketNotEmpty = &Error{
+		Code:       "BucketNotEmpty",
+		Message:    "The bucket you tried to delete is not empty.",
+		StatusCode: http.StatusConflict,
+	}
+	ErrEntityTooLarge = &Error{
+		Code:       "EntityTooLarge",
+		Message:    "Your proposed upload exceeds the maximum allowed object size.",
+		StatusCode: http.StatusBadRequest,
+	}
+	ErrNoSuchEncryptionConfiguration = &Error{
+		Code:       "ServerSideEncryptionConfigurationNotFoundError",
+		Message:    "The server side encryption configuration was not found.",
+		StatusCode: http.StatusNotFound,
+	}
+	ErrInvalidRange = &Error{
+		Code:       "InvalidRange",
+		Message:    "The requested range is not satisfiable.",
+		StatusCode: http.StatusRequestedRangeNotSatisfiable,
+	}
+	ErrNotImplemented = &Error{
+		Code:       "NotImplemented",
+		Message:    "A header you provided implies functionality that is not implemented.",
+		StatusCode: http.StatusNotImplemented,
+	}
+	ErrInternalError = &Error{
+		Code:       "InternalError",
+		Message:    "We encountered an internal error. Please try again.",
+		StatusCode: http.StatusInternalServerError,
+	}
+)
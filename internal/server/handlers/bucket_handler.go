@@ -1,9 +1,14 @@
 package handlers
 
 import (
+	"encoding/xml"
 	"net/http"
+	"strconv"
 
+	"github.com/Grey0520/s3proxy/internal/auth"
+	"github.com/Grey0520/s3proxy/internal/s3err"
 	s "github.com/Grey0520/s3proxy/internal/server"
+	"github.com/Grey0520/s3proxy/internal/storage"
 	"github.com/labstack/echo/v4"
 )
 
@@ -17,12 +22,206 @@ func NewBucketHandlers(server *s.Server) *BucketHandler {
 
 func (h *BucketHandler) CreateBucket(c echo.Context) error {
 	bucketName := c.Param("bucketName")
+	if _, ok := c.QueryParams()["encryption"]; ok {
+		return h.putBucketEncryption(c, bucketName)
+	}
+	user := auth.CurrentUser(c)
+
+	if user != nil {
+		if owner, ok := h.server.Identity.BucketOwner(bucketName); ok && owner == user.CanonicalID {
+			return s3err.ErrBucketAlreadyOwnedByYou
+		}
+	}
 
 	stg := *h.server.Storage
 	err := stg.CreateBucket(bucketName)
 	if err != nil {
-		return c.XML(http.StatusInternalServerError, err.Error())
+		return err
+	}
+
+	// 记录存储桶的所有者
+	if user != nil {
+		if err := h.server.Identity.SetBucketOwner(bucketName, user.CanonicalID); err != nil {
+			return err
+		}
 	}
 
 	return c.XML(http.StatusOK, "Bucket created")
 }
+
+func (h *BucketHandler) DeleteBucket(c echo.Context) error {
+	bucketName := c.Param("bucketName")
+	if err := authorizeBucket(h.server, c, bucketName); err != nil {
+		return err
+	}
+	if _, ok := c.QueryParams()["encryption"]; ok {
+		return h.deleteBucketEncryption(c, bucketName)
+	}
+
+	stg := *h.server.Storage
+	if err := stg.DeleteBucket(bucketName); err != nil {
+		return err
+	}
+	if err := h.server.Quota.DeleteBucket(bucketName); err != nil {
+		return err
+	}
+	if err := h.server.Identity.DeleteBucketOwner(bucketName); err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// GetBucket 处理 GET /BUCKETNAME，带 ?acl 时返回 ACL，否则列出对象
+func (h *BucketHandler) GetBucket(c echo.Context) error {
+	bucketName := c.Param("bucketName")
+	if err := authorizeBucket(h.server, c, bucketName); err != nil {
+		return err
+	}
+
+	if _, ok := c.QueryParams()["acl"]; ok {
+		return h.getBucketAcl(c, bucketName)
+	}
+	if _, ok := c.QueryParams()["encryption"]; ok {
+		return h.getBucketEncryption(c, bucketName)
+	}
+
+	opts, maxKeys, err := listOptions(c)
+	if err != nil {
+		return err
+	}
+	stg := *h.server.Storage
+	result, err := stg.ListBucket(bucketName, opts...)
+	if err != nil {
+		return err
+	}
+	// max-keys=0 时只检查存储桶是否存在，与 S3 一样返回空的结果
+	if maxKeys == 0 {
+		result.Contents = nil
+		result.IsTruncated = false
+		result.MaxKeys = 0
+	}
+	if owner, ok := bucketOwner(h.server, bucketName); ok {
+		for i := range result.Contents {
+			result.Contents[i].Owner = owner
+		}
+	}
+
+	return c.XML(http.StatusOK, result)
+}
+
+// listOptions 读取 ListObjects 的 prefix、marker 和 max-keys 参数，与 S3 一样默认最多返回 1000 个对象
+// 同时返回请求的 max-keys，存储层的 MaxKeys 为 0 表示不限制，因此 max-keys=0 时只列出 1 个对象，由调用者返回空的结果
+func listOptions(c echo.Context) ([]storage.ListOption, int, error) {
+	maxKeys := 1000
+	if v := c.QueryParam("max-keys"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, 0, s3err.ErrInvalidArgument.WithMessage("Provided max-keys not an integer or within integer range")
+		}
+		maxKeys = min(n, 1000)
+	}
+	return []storage.ListOption{
+		storage.WithPrefix(c.QueryParam("prefix")),
+		storage.WithMarker(c.QueryParam("marker")),
+		storage.WithMaxKeys(max(maxKeys, 1)),
+	}, maxKeys, nil
+}
+
+func (h *BucketHandler) getBucketAcl(c echo.Context, bucketName string) error {
+	stg := *h.server.Storage
+	acp, err := stg.GetBucketAcl(bucketName)
+	if err != nil {
+		return err
+	}
+
+	// 把后端的所有者替换成 s3proxy 中的所有者
+	if owner, ok := bucketOwner(h.server, bucketName); ok {
+		backendOwnerID := acp.Owner.ID
+		acp.Owner = owner
+		for i, grant := range acp.AccessControlList.Grant {
+			if grant.Grantee.ID == backendOwnerID {
+				acp.AccessControlList.Grant[i].Grantee.ID = owner.ID
+				acp.AccessControlList.Grant[i].Grantee.DisplayName = owner.DisplayName
+			}
+		}
+	}
+
+	return c.XML(http.StatusOK, acp)
+}
+
+// encryptionConfigurer 返回支持默认加密的后端，不支持时返回 NotImplemented
+func (h *BucketHandler) encryptionConfigurer() (storage.BucketEncryptionConfigurer, error) {
+	configurer, ok := (*h.server.Storage).(storage.BucketEncryptionConfigurer)
+	if !ok {
+		return nil, s3err.ErrNotImplemented.WithMessage("bucket encryption is not supported by this backend")
+	}
+	return configurer, nil
+}
+
+func (h *BucketHandler) putBucketEncryption(c echo.Context, bucketName string) error {
+	if err := authorizeBucket(h.server, c, bucketName); err != nil {
+		return err
+	}
+	configurer, err := h.encryptionConfigurer()
+	if err != nil {
+		return err
+	}
+
+	cfg := &storage.ServerSideEncryptionConfiguration{}
+	if err := xml.NewDecoder(c.Request().Body).Decode(cfg); err != nil {
+		return s3err.ErrMalformedXML
+	}
+	if err := configurer.PutBucketEncryption(bucketName, cfg); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusOK)
+}
+
+func (h *BucketHandler) getBucketEncryption(c echo.Context, bucketName string) error {
+	configurer, err := h.encryptionConfigurer()
+	if err != nil {
+		return err
+	}
+	cfg, err := configurer.GetBucketEncryption(bucketName)
+	if err != nil {
+		return err
+	}
+	return c.XML(http.StatusOK, cfg)
+}
+
+func (h *BucketHandler) deleteBucketEncryption(c echo.Context, bucketName string) error {
+	configurer, err := h.encryptionConfigurer()
+	if err != nil {
+		return err
+	}
+	if err := configurer.DeleteBucketEncryption(bucketName); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// ListAllMyBuckets 处理 GET /，只返回当前用户可以访问的存储桶
+func (h *BucketHandler) ListAllMyBuckets(c echo.Context) error {
+	stg := *h.server.Storage
+	result, err := stg.ListAllMyBuckets()
+	if err != nil {
+		return err
+	}
+
+	user := auth.CurrentUser(c)
+	if user == nil {
+		return c.XML(http.StatusOK, result)
+	}
+
+	var buckets []storage.Bucket
+	for _, b := range result.Buckets.Bucket {
+		if h.server.Identity.CanAccessBucket(user, b.Name) {
+			buckets = append(buckets, b)
+		}
+	}
+	result.Owner = ownerOf(user)
+	result.Buckets.Bucket = buckets
+
+	return c.XML(http.StatusOK, result)
+}
@@ -0,0 +1,55 @@
+package handlers
+
+import (
+	"encoding/xml"
+	"net/http"
+	"testing"
+
+	"github.com/Grey0520/s3proxy/internal/storage"
+)
+
+func TestListObjectsPagination(t *testing.T) {
+	server := newTestServer(t)
+	server.Echo.GET("/:bucketName", NewBucketHandlers(server).GetBucket)
+	serve(server, http.MethodPut, "/bucket", "", nil)
+	for _, key := range []string{"a", "b", "c", "other"} {
+		serve(server, http.MethodPut, "/bucket/"+key, key, nil)
+	}
+
+	rec := serve(server, http.MethodGet, "/bucket?max-keys=2&marker=a", "", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200 listing objects, got %d: %s", rec.Code, rec.Body)
+	}
+	var result storage.ListBucketResult
+	if err := xml.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(result.Contents) != 2 || result.Contents[0].Key != "b" || !result.IsTruncated || result.MaxKeys != 2 {
+		t.Errorf("Unexpected listing %+v", result)
+	}
+
+	rec = serve(server, http.MethodGet, "/bucket?prefix=o", "", nil)
+	result = storage.ListBucketResult{}
+	xml.Unmarshal(rec.Body.Bytes(), &result)
+	if len(result.Contents) != 1 || result.Contents[0].Key != "other" || result.MaxKeys != 1000 {
+		t.Errorf("Unexpected listing %+v", result)
+	}
+
+	// max-keys=0 返回空的结果，而不是所有对象
+	rec = serve(server, http.MethodGet, "/bucket?max-keys=0", "", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200 listing objects, got %d: %s", rec.Code, rec.Body)
+	}
+	result = storage.ListBucketResult{}
+	xml.Unmarshal(rec.Body.Bytes(), &result)
+	if len(result.Contents) != 0 || result.IsTruncated || result.MaxKeys != 0 {
+		t.Errorf("Expected empty listing, got %+v", result)
+	}
+	if rec := serve(server, http.MethodGet, "/missing?max-keys=0", "", nil); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for missing bucket, got %d", rec.Code)
+	}
+
+	if rec := serve(server, http.MethodGet, "/bucket?max-keys=x", "", nil); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for invalid max-keys, got %d", rec.Code)
+	}
+}
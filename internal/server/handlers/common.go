@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/Grey0520/s3proxy/internal/auth"
+	"github.com/Grey0520/s3proxy/internal/identity"
+	"github.com/Grey0520/s3proxy/internal/s3err"
+	s "github.com/Grey0520/s3proxy/internal/server"
+	"github.com/Grey0520/s3proxy/internal/storage"
+	"github.com/labstack/echo/v4"
+)
+
+// HTTPErrorHandler 把 handler 返回的错误转换成 S3 的 XML 错误响应
+func HTTPErrorHandler(err error, c echo.Context) {
+	if c.Response().Committed {
+		return
+	}
+
+	var he *echo.HTTPError
+	if errors.As(err, &he) {
+		c.Echo().DefaultHTTPErrorHandler(err, c)
+		return
+	}
+
+	var s3Err *s3err.Error
+	if !errors.As(err, &s3Err) {
+		s3Err = s3err.ErrInternalError.WithMessage(err.Error())
+	}
+	s3Err = s3Err.WithResource(c.Request().URL.Path)
+	switch {
+	case isSTSRequest(c.Request()):
+		// STS 客户端只认 Query 协议格式的错误
+		err = c.XML(s3Err.StatusCode, newSTSError(s3Err.StatusCode, s3Err.Code, s3Err.Message))
+	case c.Request().Method == http.MethodHead:
+		err = c.NoContent(s3Err.StatusCode)
+	default:
+		err = c.XML(s3Err.StatusCode, s3Err)
+	}
+	if err != nil {
+		c.Logger().Error(err)
+	}
+}
+
+func isSTSRequest(r *http.Request) bool {
+	return r.Method == http.MethodPost && r.URL.Path == "/"
+}
+
+// authorizeBucket 检查当前用户能否访问存储桶
+func authorizeBucket(server *s.Server, c echo.Context, bucketName string) error {
+	user := auth.CurrentUser(c)
+	if user == nil {
+		return nil
+	}
+	if !server.Identity.CanAccessBucket(user, bucketName) {
+		return s3err.ErrAccessDenied
+	}
+	return nil
+}
+
+func ownerOf(user *identity.User) storage.Owner {
+	return storage.Owner{
+		ID:          user.CanonicalID,
+		DisplayName: user.DisplayName,
+	}
+}
+
+// bucketOwner 返回存储桶在 s3proxy 中的所有者
+func bucketOwner(server *s.Server, bucketName string) (storage.Owner, bool) {
+	id, ok := server.Identity.BucketOwner(bucketName)
+	if !ok {
+		return storage.Owner{}, false
+	}
+	user, ok := server.Identity.LookupCanonicalID(id)
+	if !ok {
+		return storage.Owner{ID: id}, true
+	}
+	return ownerOf(user), true
+}
@@ -0,0 +1,49 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/Grey0520/s3proxy/internal/auth"
+	"github.com/Grey0520/s3proxy/internal/s3err"
+	s "github.com/Grey0520/s3proxy/internal/server"
+	"github.com/Grey0520/s3proxy/internal/storage"
+	"github.com/labstack/echo/v4"
+)
+
+// HealthHandler 处理 GET /_s3proxy/health，不需要鉴权
+// 本地存储因为空间不足只读时 status 为 degraded，状态码为 503，负载均衡可以把写入转到其它实例
+// 路径和剩余空间等详细信息只返回给通过鉴权的请求
+type HealthHandler struct {
+	server *s.Server
+}
+
+func NewHealthHandlers(server *s.Server) *HealthHandler {
+	return &HealthHandler{server: server}
+}
+
+type healthResponse struct {
+	// ok 或 degraded
+	Status string `json:"status"`
+	// degraded 的原因，目前只有 InsufficientStorage
+	Reason string `json:"reason,omitempty"`
+	// 键为后端名称，只包含开启了剩余空间检查的本地存储
+	Space map[string]storage.SpaceStatus `json:"space,omitempty"`
+}
+
+func (h *HealthHandler) Handle(c echo.Context) error {
+	space := storage.SpaceStatistics(*h.server.Storage)
+	resp := healthResponse{Status: "ok"}
+	code := http.StatusOK
+	for _, status := range space {
+		if status.ReadOnly {
+			resp.Status = "degraded"
+			resp.Reason = s3err.ErrInsufficientStorage.Code
+			code = http.StatusServiceUnavailable
+		}
+	}
+	// 没有配置用户时所有接口都不需要鉴权
+	if !h.server.Identity.Enabled() || auth.CurrentUser(c) != nil {
+		resp.Space = space
+	}
+	return c.JSON(code, resp)
+}
@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/Grey0520/s3proxy/internal/auth"
+	"github.com/Grey0520/s3proxy/internal/config"
+	s "github.com/Grey0520/s3proxy/internal/server"
+)
+
+func TestHealth(t *testing.T) {
+	server := newTestServerWithConfig(t, config.CloudsConfig{
+		Provider: "local",
+		Filesystem: config.FilesystemConfig{
+			Basedir: t.TempDir(),
+			Space:   config.SpaceConfig{MinFreeBytes: 1 << 62},
+		},
+	})
+	server.Echo.GET("/_s3proxy/health", NewHealthHandlers(server).Handle)
+
+	rec := serve(server, http.MethodPut, "/bucket", "", nil)
+	if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), "<Code>InsufficientStorage</Code>") {
+		t.Errorf("Expected InsufficientStorage, got %d: %s", rec.Code, rec.Body)
+	}
+
+	rec = serve(server, http.MethodGet, "/_s3proxy/health", "", nil)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected 503, got %d: %s", rec.Code, rec.Body)
+	}
+	var resp healthResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if resp.Status != "degraded" || !resp.Space["default"].ReadOnly {
+		t.Errorf("Unexpected health %+v", resp)
+	}
+
+	// 鉴权开启时只有签名的请求可以看到详细信息
+	server = s.NewServer(&config.Config{
+		Cloud: config.CloudsConfig{
+			Provider: "local",
+			Filesystem: config.FilesystemConfig{
+				Basedir: t.TempDir(),
+				Space:   config.SpaceConfig{MinFreeBytes: 1 << 62},
+			},
+		},
+		Identity: config.IdentityConfig{Users: []config.UserConfig{{Name: "alice", AccessKey: "alice", SecretKey: "alice-secret"}}},
+	})
+	server.Echo.HTTPErrorHandler = HTTPErrorHandler
+	server.Echo.Use(auth.Middleware(server.Identity, server.STS))
+	server.Echo.GET("/_s3proxy/health", NewHealthHandlers(server).Handle)
+	rec = serve(server, http.MethodGet, "/_s3proxy/health", "", nil)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected 503, got %d: %s", rec.Code, rec.Body)
+	}
+	if body := strings.TrimSpace(rec.Body.String()); body != `{"status":"degraded","reason":"InsufficientStorage"}` {
+		t.Errorf("Expected no details without authentication, got %s", body)
+	}
+	rec = serveSigned(server, http.MethodGet, "/_s3proxy/health", "", "s3", "alice", "alice-secret")
+	resp = healthResponse{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if resp.Reason != "InsufficientStorage" || !resp.Space["default"].ReadOnly {
+		t.Errorf("Expected details for authenticated request, got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := serveSigned(server, http.MethodGet, "/_s3proxy/health", "", "s3", "alice", "wrong"); rec.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for a bad signature, got %d: %s", rec.Code, rec.Body)
+	}
+
+	server = newTestServer(t)
+	server.Echo.GET("/_s3proxy/health", NewHealthHandlers(server).Handle)
+	rec = serve(server, http.MethodGet, "/_s3proxy/health", "", nil)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"status":"ok"`) {
+		t.Errorf("Unexpected health %d: %s", rec.Code, rec.Body)
+	}
+}
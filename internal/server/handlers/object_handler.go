@@ -1,9 +1,14 @@
 package handlers
 
 import (
+	"fmt"
+	"io"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/Grey0520/s3proxy/internal/s3err"
 	s "github.com/Grey0520/s3proxy/internal/server"
 	"github.com/Grey0520/s3proxy/internal/storage"
 	"github.com/labstack/echo/v4"
@@ -20,25 +25,120 @@ func NewObjectHandlers(server *s.Server) *ObjectHandlers {
 func (h *ObjectHandlers) GetObject(c echo.Context) error {
 	bucketName := c.Param("bucketName")
 	objectName := c.Param("objectName")
+	if err := authorizeBucket(h.server, c, bucketName); err != nil {
+		return err
+	}
 
-	storage := *h.server.Storage
-	obj, err := storage.GetObject(bucketName, objectName)
+	key, err := sseCustomerKey(c.Request(), ssecHeaderPrefix)
+	if err != nil {
+		return err
+	}
+
+	stg := *h.server.Storage
+	obj, err := stg.GetObject(bucketName, objectName, storage.WithSSECustomerKey(key))
 	if err != nil {
-		return c.XML(http.StatusInternalServerError, err.Error())
+		return err
+	}
+	defer obj.Data.Close()
+
+	header := c.Response().Header()
+	if !obj.LastModified.IsZero() {
+		header.Set("Last-Modified", obj.LastModified.UTC().Format(http.TimeFormat))
+	}
+	if obj.ETag != "" {
+		header.Set("ETag", obj.ETag)
+	}
+	if obj.ServerSideEncryption != "" {
+		header.Set("x-amz-server-side-encryption", obj.ServerSideEncryption)
+	}
+	if obj.SSECustomerAlgorithm != "" {
+		header.Set(ssecHeaderPrefix+"Algorithm", obj.SSECustomerAlgorithm)
+		header.Set(ssecHeaderPrefix+"Key-MD5", obj.SSECustomerKeyMD5)
 	}
 
-	// c.Response().Header().Set("Content-Type", obj.ContentType)
-	// c.Response().Header().Set("Content-Length", fmt.Sprintf("%d", obj.Size))
-	// c.Response().Header().Set("Last-Modified", obj.LastModified.UTC().Format(http.TimeFormat))
+	// 数据流支持 Seek 时才处理 Range，否则返回整个对象
+	seeker, ok := obj.Data.(io.Seeker)
+	if !ok {
+		return c.Stream(http.StatusOK, obj.ContentType, obj.Data)
+	}
+	header.Set("Accept-Ranges", "bytes")
+	rangeHeader := c.Request().Header.Get("Range")
+	if rangeHeader == "" {
+		header.Set("Content-Length", strconv.FormatInt(obj.Size, 10))
+		return c.Stream(http.StatusOK, obj.ContentType, obj.Data)
+	}
 
-	return c.Stream(http.StatusOK, obj.ContentType, obj.Data)
+	start, length, err := parseRange(rangeHeader, obj.Size)
+	if err != nil {
+		return err
+	}
+	if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+		return err
+	}
+	header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, start+length-1, obj.Size))
+	header.Set("Content-Length", strconv.FormatInt(length, 10))
+	return c.Stream(http.StatusPartialContent, obj.ContentType, io.LimitReader(obj.Data, length))
+}
+
+// HeadObject 处理 HEAD /BUCKETNAME/OBJECTNAME
+func (h *ObjectHandlers) HeadObject(c echo.Context) error {
+	bucketName := c.Param("bucketName")
+	objectName := c.Param("objectName")
+	if err := authorizeBucket(h.server, c, bucketName); err != nil {
+		return err
+	}
+
+	key, err := sseCustomerKey(c.Request(), ssecHeaderPrefix)
+	if err != nil {
+		return err
+	}
+
+	stg := *h.server.Storage
+	attrs, err := stg.HeadObject(bucketName, objectName, storage.WithSSECustomerKey(key))
+	if err != nil {
+		return err
+	}
+
+	header := c.Response().Header()
+	for k, v := range attrs {
+		switch k {
+		case "Size":
+			header.Set("Content-Length", v)
+		case "LastModified":
+			if t, err := time.Parse(time.RFC3339, v); err == nil {
+				header.Set("Last-Modified", t.UTC().Format(http.TimeFormat))
+			}
+		case "ContentType":
+			header.Set("Content-Type", v)
+		case "ETag":
+			header.Set("ETag", v)
+		case "ServerSideEncryption":
+			header.Set("x-amz-server-side-encryption", v)
+		case "SSECustomerAlgorithm":
+			header.Set(ssecHeaderPrefix+"Algorithm", v)
+		case "SSECustomerKeyMD5":
+			header.Set(ssecHeaderPrefix+"Key-MD5", v)
+		case "StorageClass":
+			header.Set("x-amz-storage-class", v)
+		default:
+			header.Set("x-amz-meta-"+k, v)
+		}
+	}
+	return c.NoContent(http.StatusOK)
 }
 
 func (h *ObjectHandlers) PutObject(c echo.Context) error {
 	bucketName := c.Param("bucketName")
 	objectName := c.Param("objectName")
+	if err := authorizeBucket(h.server, c, bucketName); err != nil {
+		return err
+	}
 
 	stg := *h.server.Storage
+	key, err := sseCustomerKey(c.Request(), ssecHeaderPrefix)
+	if err != nil {
+		return err
+	}
 
 	// 处理 Copy Object 请求
 	if srcPath := c.Request().Header.Get("x-amz-copy-source"); len(srcPath) != 0 {
@@ -54,37 +154,68 @@ func (h *ObjectHandlers) PutObject(c echo.Context) error {
 		desObjectName := c.Param("objectName")
 		srcBucketName := parts[0]
 		srcObjectName := parts[1]
+		if err := authorizeBucket(h.server, c, srcBucketName); err != nil {
+			return err
+		}
 
+		srcKey, err := sseCustomerKey(c.Request(), copySourceSSECHeaderPrefix)
+		if err != nil {
+			return err
+		}
+
+		reservation, err := h.server.Quota.ReserveCopy(srcBucketName, srcObjectName, desBucketName, desObjectName)
+		if err != nil {
+			return err
+		}
 		stg := *h.server.Storage
-		err := stg.CopyObject(srcBucketName, srcObjectName, desBucketName, desObjectName)
+		err = stg.CopyObject(srcBucketName, srcObjectName, desBucketName, desObjectName,
+			storage.WithSSECustomerKey(key), storage.WithCopySourceSSECustomerKey(srcKey))
 		if err != nil {
-			return c.XML(http.StatusInternalServerError, err.Error())
+			return reservation.Abort(err)
 		}
+		reservation.Commit()
 		return nil
 	}
 
 	// 剩下的是从请求体中读取数据的请求
+	reservation, err := h.server.Quota.Reserve(bucketName, objectName, c.Request().ContentLength)
+	if err != nil {
+		return err
+	}
 	obj := &storage.Object{
-		ContentType: c.Request().Header.Get("Content-Type"),
-		Data:        c.Request().Body,
+		// 没有 Content-Length 时为 0，后端不能预先检查空间
+		Size:                 max(c.Request().ContentLength, 0),
+		ContentType:          c.Request().Header.Get("Content-Type"),
+		Data:                 reservation.Wrap(c.Request().Body),
+		ServerSideEncryption: c.Request().Header.Get("x-amz-server-side-encryption"),
 	}
-	err := stg.PutObject(bucketName, objectName, obj)
+	err = stg.PutObject(bucketName, objectName, obj, storage.WithSSECustomerKey(key))
 	if err != nil {
-		return c.XML(http.StatusInternalServerError, err.Error())
+		return reservation.Abort(err)
 	}
+	reservation.Commit()
 
+	if key != nil {
+		c.Response().Header().Set(ssecHeaderPrefix+"Algorithm", key.Algorithm)
+		c.Response().Header().Set(ssecHeaderPrefix+"Key-MD5", key.KeyMD5)
+	}
 	return c.NoContent(http.StatusOK)
 }
 
 func (h *ObjectHandlers) DeleteObject(c echo.Context) error {
 	bucketName := c.Param("bucketName")
 	objectName := c.Param("objectName")
+	if err := authorizeBucket(h.server, c, bucketName); err != nil {
+		return err
+	}
 
+	removal := h.server.Quota.Remove(bucketName, objectName)
 	stg := *h.server.Storage
 	err := stg.DeleteObject(bucketName, objectName)
 	if err != nil {
-		return c.XML(http.StatusInternalServerError, err.Error())
+		return removal.Abort(err)
 	}
+	removal.Commit()
 
 	return c.NoContent(http.StatusOK)
 }
@@ -103,11 +234,87 @@ func (h *ObjectHandlers) CopyObject(c echo.Context) error {
 	desObjectName := c.Param("objectName")
 	srcBucketName := parts[0]
 	srcObjectName := parts[1]
+	if err := authorizeBucket(h.server, c, srcBucketName); err != nil {
+		return err
+	}
+	if err := authorizeBucket(h.server, c, desBucketName); err != nil {
+		return err
+	}
+	key, err := sseCustomerKey(c.Request(), ssecHeaderPrefix)
+	if err != nil {
+		return err
+	}
+	srcKey, err := sseCustomerKey(c.Request(), copySourceSSECHeaderPrefix)
+	if err != nil {
+		return err
+	}
 
+	reservation, err := h.server.Quota.ReserveCopy(srcBucketName, srcObjectName, desBucketName, desObjectName)
+	if err != nil {
+		return err
+	}
 	stg := *h.server.Storage
-	err := stg.CopyObject(srcBucketName, srcObjectName, desBucketName, desObjectName)
+	err = stg.CopyObject(srcBucketName, srcObjectName, desBucketName, desObjectName,
+		storage.WithSSECustomerKey(key), storage.WithCopySourceSSECustomerKey(srcKey))
 	if err != nil {
-		return c.XML(http.StatusInternalServerError, err.Error())
+		return reservation.Abort(err)
 	}
+	reservation.Commit()
 	return nil
 }
+
+// SSE-C 相关请求头的前缀
+const (
+	ssecHeaderPrefix           = "X-Amz-Server-Side-Encryption-Customer-"
+	copySourceSSECHeaderPrefix = "X-Amz-Copy-Source-Server-Side-Encryption-Customer-"
+)
+
+// sseCustomerKey 读取请求中的 SSE-C 密钥，没有提供时返回 nil
+func sseCustomerKey(r *http.Request, prefix string) (*storage.SSECustomerKey, error) {
+	return storage.ParseSSECustomerKey(
+		r.Header.Get(prefix+"Algorithm"),
+		r.Header.Get(prefix+"Key"),
+		r.Header.Get(prefix+"Key-MD5"),
+	)
+}
+
+// parseRange 解析单个区间的 Range 头，返回起始位置和长度
+// 不支持多个区间，无法满足的区间返回 InvalidRange
+func parseRange(header string, size int64) (start, length int64, err error) {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return 0, 0, s3err.ErrInvalidRange.WithMessage("unsupported range " + header)
+	}
+	first, last, ok := strings.Cut(spec, "-")
+	if !ok {
+		return 0, 0, s3err.ErrInvalidRange.WithMessage("invalid range " + header)
+	}
+
+	if first == "" {
+		// bytes=-N 表示最后 N 个字节
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 || size == 0 {
+			return 0, 0, s3err.ErrInvalidRange.WithMessage("invalid range " + header)
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, n, nil
+	}
+
+	start, err = strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, s3err.ErrInvalidRange.WithMessage("invalid range " + header)
+	}
+	end := size - 1
+	if last != "" {
+		end, err = strconv.ParseInt(last, 10, 64)
+		if err != nil || end < start {
+			return 0, 0, s3err.ErrInvalidRange.WithMessage("invalid range " + header)
+		}
+		if end > size-1 {
+			end = size - 1
+		}
+	}
+	return start, end - start + 1, nil
+}
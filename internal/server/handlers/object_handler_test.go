@@ -0,0 +1,118 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Grey0520/s3proxy/internal/config"
+	s "github.com/Grey0520/s3proxy/internal/server"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+)
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		header     string
+		start, len int64
+		wantErr    bool
+	}{
+		{"bytes=0-9", 0, 10, false},
+		{"bytes=10-", 10, 90, false},
+		{"bytes=-10", 90, 10, false},
+		{"bytes=-200", 0, 100, false},
+		{"bytes=95-200", 95, 5, false},
+		{"bytes=100-", 0, 0, true},
+		{"bytes=9-3", 0, 0, true},
+		{"bytes=0-1,5-6", 0, 0, true},
+		{"items=0-1", 0, 0, true},
+	}
+	for _, tt := range tests {
+		start, length, err := parseRange(tt.header, 100)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: unexpected error %v", tt.header, err)
+			continue
+		}
+		if !tt.wantErr && (start != tt.start || length != tt.len) {
+			t.Errorf("%s: got (%d, %d), want (%d, %d)", tt.header, start, length, tt.start, tt.len)
+		}
+	}
+}
+
+// newTestServer 使用内存存储创建不需要鉴权的服务
+func newTestServer(t *testing.T) *s.Server {
+	return newTestServerWithConfig(t, config.CloudsConfig{Provider: "memory"})
+}
+
+func newTestServerWithConfig(t *testing.T, cloud config.CloudsConfig) *s.Server {
+	server := s.NewServer(&config.Config{Cloud: cloud})
+	objects := NewObjectHandlers(server)
+	buckets := NewBucketHandlers(server)
+	server.Echo.HTTPErrorHandler = HTTPErrorHandler
+	server.Echo.GET("/:bucketName/:objectName", objects.GetObject)
+	server.Echo.HEAD("/:bucketName/:objectName", objects.HeadObject)
+	server.Echo.PUT("/:bucketName/:objectName", objects.PutObject)
+	server.Echo.DELETE("/:bucketName/:objectName", objects.DeleteObject)
+	server.Echo.PUT("/:bucketName", buckets.CreateBucket)
+	server.Echo.GET("/_s3proxy/stats", NewStatsHandlers(server).Handle)
+	return server
+}
+
+func serve(server *s.Server, method, target, body string, header map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	rec := httptest.NewRecorder()
+	server.Echo.ServeHTTP(rec, req)
+	return rec
+}
+
+// serveSigned 与 serve 相同，请求使用 service 服务的 SigV4 签名
+func serveSigned(server *s.Server, method, target, body, service, accessKey, secretKey string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	if method == http.MethodPost {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	signer := v4.NewSigner(credentials.NewStaticCredentials(accessKey, secretKey, ""))
+	signer.DisableURIPathEscaping = true
+	signer.Sign(req, strings.NewReader(body), service, "us-east-1", time.Now())
+	rec := httptest.NewRecorder()
+	server.Echo.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestObjectRoundTrip(t *testing.T) {
+	server := newTestServer(t)
+
+	if rec := serve(server, http.MethodPut, "/bucket", "", nil); rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200 creating bucket, got %d: %s", rec.Code, rec.Body)
+	}
+	rec := serve(server, http.MethodPut, "/bucket/key.txt", "hello handlers", map[string]string{"Content-Type": "text/plain"})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200 putting object, got %d: %s", rec.Code, rec.Body)
+	}
+
+	rec = serve(server, http.MethodGet, "/bucket/key.txt", "", map[string]string{"Range": "bytes=6-"})
+	if rec.Code != http.StatusPartialContent || rec.Body.String() != "handlers" {
+		t.Errorf("Unexpected range response %d %q", rec.Code, rec.Body)
+	}
+	if got := rec.Header().Get("Content-Range"); got != "bytes 6-13/14" {
+		t.Errorf("Unexpected Content-Range %s", got)
+	}
+
+	rec = serve(server, http.MethodHead, "/bucket/key.txt", "", nil)
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Length") != "14" || rec.Header().Get("ETag") == "" {
+		t.Errorf("Unexpected head response %d %v", rec.Code, rec.Header())
+	}
+
+	if rec := serve(server, http.MethodDelete, "/bucket/key.txt", "", nil); rec.Code/100 != 2 {
+		t.Errorf("Expected success deleting object, got %d: %s", rec.Code, rec.Body)
+	}
+	rec = serve(server, http.MethodGet, "/bucket/key.txt", "", nil)
+	if rec.Code != http.StatusNotFound || !strings.Contains(rec.Body.String(), "<Code>NoSuchKey</Code>") {
+		t.Errorf("Expected NoSuchKey, got %d: %s", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,166 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/Grey0520/s3proxy/internal/auth"
+	"github.com/Grey0520/s3proxy/internal/quota"
+	"github.com/Grey0520/s3proxy/internal/s3err"
+	s "github.com/Grey0520/s3proxy/internal/server"
+	"github.com/labstack/echo/v4"
+)
+
+// QuotaHandler 处理 /_s3proxy/quotas 下查看和修改配额的管理接口
+// 启用鉴权时只有管理员可以使用，并且不接受临时凭证
+type QuotaHandler struct {
+	server *s.Server
+}
+
+func NewQuotaHandlers(server *s.Server) *QuotaHandler {
+	return &QuotaHandler{server: server}
+}
+
+type quotasResponse struct {
+	Buckets []quota.BucketQuota `json:"buckets"`
+	Users   []userQuota         `json:"users"`
+}
+
+// userQuota 在配额中加上用户名，所有者已经不存在时为空
+type userQuota struct {
+	User string `json:"user,omitempty"`
+	quota.UserQuota
+}
+
+func (h *QuotaHandler) authorize(c echo.Context) error {
+	if user := auth.CurrentUser(c); user != nil && (!user.Admin || auth.CurrentSession(c) != nil) {
+		return s3err.ErrAccessDenied
+	}
+	if !h.server.Quota.Enabled() {
+		return s3err.ErrNotImplemented.WithMessage("quotas are not enabled")
+	}
+	return nil
+}
+
+func (h *QuotaHandler) userQuota(q quota.UserQuota) userQuota {
+	u := userQuota{UserQuota: q}
+	if user, ok := h.server.Identity.LookupCanonicalID(q.Owner); ok {
+		u.User = user.Name
+	}
+	return u
+}
+
+// List 处理 GET /_s3proxy/quotas，返回所有存储桶和用户的配额与用量
+func (h *QuotaHandler) List(c echo.Context) error {
+	if err := h.authorize(c); err != nil {
+		return err
+	}
+	resp := quotasResponse{Buckets: h.server.Quota.Buckets(), Users: []userQuota{}}
+	for _, q := range h.server.Quota.Users() {
+		resp.Users = append(resp.Users, h.userQuota(q))
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+// GetBucket 处理 GET /_s3proxy/quotas/buckets/BUCKETNAME
+func (h *QuotaHandler) GetBucket(c echo.Context) error {
+	if err := h.authorize(c); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, h.server.Quota.Bucket(c.Param("bucketName")))
+}
+
+// PutBucket 处理 PUT /_s3proxy/quotas/buckets/BUCKETNAME，请求体为 {"maxBytes": 0, "maxObjects": 0}
+func (h *QuotaHandler) PutBucket(c echo.Context) error {
+	if err := h.authorize(c); err != nil {
+		return err
+	}
+	limit, err := readLimit(c)
+	if err != nil {
+		return err
+	}
+	bucketName := c.Param("bucketName")
+	if err := h.server.Quota.SetBucketLimit(bucketName, limit); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, h.server.Quota.Bucket(bucketName))
+}
+
+// DeleteBucket 处理 DELETE /_s3proxy/quotas/buckets/BUCKETNAME，恢复默认配额
+func (h *QuotaHandler) DeleteBucket(c echo.Context) error {
+	if err := h.authorize(c); err != nil {
+		return err
+	}
+	if err := h.server.Quota.SetBucketLimit(c.Param("bucketName"), nil); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// lookupUser 按路径中的用户名返回用户的 CanonicalID
+func (h *QuotaHandler) lookupUser(c echo.Context) (string, error) {
+	user, ok := h.server.Identity.LookupName(c.Param("userName"))
+	if !ok {
+		return "", s3err.ErrInvalidArgument.WithMessage("unknown user " + c.Param("userName"))
+	}
+	return user.CanonicalID, nil
+}
+
+// GetUser 处理 GET /_s3proxy/quotas/users/USERNAME
+func (h *QuotaHandler) GetUser(c echo.Context) error {
+	if err := h.authorize(c); err != nil {
+		return err
+	}
+	owner, err := h.lookupUser(c)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, h.userQuota(h.server.Quota.User(owner)))
+}
+
+// PutUser 处理 PUT /_s3proxy/quotas/users/USERNAME，请求体与 PutBucket 相同
+func (h *QuotaHandler) PutUser(c echo.Context) error {
+	if err := h.authorize(c); err != nil {
+		return err
+	}
+	owner, err := h.lookupUser(c)
+	if err != nil {
+		return err
+	}
+	limit, err := readLimit(c)
+	if err != nil {
+		return err
+	}
+	if err := h.server.Quota.SetUserLimit(owner, limit); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, h.userQuota(h.server.Quota.User(owner)))
+}
+
+// DeleteUser 处理 DELETE /_s3proxy/quotas/users/USERNAME，恢复默认配额
+func (h *QuotaHandler) DeleteUser(c echo.Context) error {
+	if err := h.authorize(c); err != nil {
+		return err
+	}
+	owner, err := h.lookupUser(c)
+	if err != nil {
+		return err
+	}
+	if err := h.server.Quota.SetUserLimit(owner, nil); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func readLimit(c echo.Context) (*quota.Limit, error) {
+	limit := &quota.Limit{}
+	dec := json.NewDecoder(c.Request().Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(limit); err != nil {
+		return nil, s3err.ErrInvalidArgument.WithMessage("invalid quota: " + err.Error())
+	}
+	if limit.MaxBytes < 0 || limit.MaxObjects < 0 {
+		return nil, s3err.ErrInvalidArgument.WithMessage("quota cannot be negative")
+	}
+	return limit, nil
+}
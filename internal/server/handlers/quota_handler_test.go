@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/Grey0520/s3proxy/internal/config"
+	"github.com/Grey0520/s3proxy/internal/quota"
+	s "github.com/Grey0520/s3proxy/internal/server"
+)
+
+func newQuotaTestServer(t *testing.T) *s.Server {
+	server := s.NewServer(&config.Config{
+		Cloud: config.CloudsConfig{Provider: "memory"},
+		Quota: config.QuotaConfig{Enabled: true, Bucket: config.QuotaLimitConfig{MaxObjects: 10}},
+	})
+	objects := NewObjectHandlers(server)
+	buckets := NewBucketHandlers(server)
+	quotas := NewQuotaHandlers(server)
+	server.Echo.HTTPErrorHandler = HTTPErrorHandler
+	server.Echo.PUT("/:bucketName/:objectName", objects.PutObject)
+	server.Echo.DELETE("/:bucketName/:objectName", objects.DeleteObject)
+	server.Echo.PUT("/:bucketName", buckets.CreateBucket)
+	server.Echo.GET("/_s3proxy/quotas", quotas.List)
+	server.Echo.GET("/_s3proxy/quotas/buckets/:bucketName", quotas.GetBucket)
+	server.Echo.PUT("/_s3proxy/quotas/buckets/:bucketName", quotas.PutBucket)
+	server.Echo.DELETE("/_s3proxy/quotas/buckets/:bucketName", quotas.DeleteBucket)
+	return server
+}
+
+func TestQuota(t *testing.T) {
+	server := newQuotaTestServer(t)
+	serve(server, http.MethodPut, "/bucket", "", nil)
+	serve(server, http.MethodPut, "/bucket/a", "12345", nil)
+
+	rec := serve(server, http.MethodPut, "/_s3proxy/quotas/buckets/bucket", `{"maxBytes": 8}`, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200 setting quota, got %d: %s", rec.Code, rec.Body)
+	}
+	var q quota.BucketQuota
+	if err := json.Unmarshal(rec.Body.Bytes(), &q); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !q.Custom || q.Limit.MaxBytes != 8 || q.Usage != (quota.Usage{Bytes: 5, Objects: 1}) {
+		t.Errorf("Unexpected quota %+v", q)
+	}
+
+	rec = serve(server, http.MethodPut, "/bucket/b", "abcd", nil)
+	if rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), "<Code>QuotaExceeded</Code>") {
+		t.Errorf("Expected QuotaExceeded, got %d: %s", rec.Code, rec.Body)
+	}
+	rec = serve(server, http.MethodPut, "/bucket/b", "", map[string]string{"x-amz-copy-source": "/bucket/a"})
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("Expected QuotaExceeded copying an object, got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := serve(server, http.MethodDelete, "/bucket/a", "", nil); rec.Code/100 != 2 {
+		t.Fatalf("Expected success deleting object, got %d: %s", rec.Code, rec.Body)
+	}
+	if rec := serve(server, http.MethodPut, "/bucket/b", "abcd", nil); rec.Code != http.StatusOK {
+		t.Errorf("Expected 200 after freeing space, got %d: %s", rec.Code, rec.Body)
+	}
+
+	rec = serve(server, http.MethodGet, "/_s3proxy/quotas", "", nil)
+	var resp quotasResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(resp.Buckets) != 1 || resp.Buckets[0].Usage != (quota.Usage{Bytes: 4, Objects: 1}) || len(resp.Users) != 0 {
+		t.Errorf("Unexpected quotas %+v", resp)
+	}
+
+	if rec := serve(server, http.MethodDelete, "/_s3proxy/quotas/buckets/bucket", "", nil); rec.Code != http.StatusNoContent {
+		t.Fatalf("Expected 204 removing quota, got %d: %s", rec.Code, rec.Body)
+	}
+	rec = serve(server, http.MethodGet, "/_s3proxy/quotas/buckets/bucket", "", nil)
+	q = quota.BucketQuota{}
+	json.Unmarshal(rec.Body.Bytes(), &q)
+	if q.Custom || q.Limit != (quota.Limit{MaxObjects: 10}) {
+		t.Errorf("Expected default quota, got %+v", q)
+	}
+
+	for _, body := range []string{`{"maxBytes": -1}`, `{"maxSize": 1}`, `nope`} {
+		if rec := serve(server, http.MethodPut, "/_s3proxy/quotas/buckets/bucket", body, nil); rec.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for %s, got %d", body, rec.Code)
+		}
+	}
+}
+
+func TestQuotaDisabled(t *testing.T) {
+	server := newTestServer(t)
+	server.Echo.GET("/_s3proxy/quotas", NewQuotaHandlers(server).List)
+	if rec := serve(server, http.MethodGet, "/_s3proxy/quotas", "", nil); rec.Code != http.StatusNotImplemented {
+		t.Errorf("Expected 501, got %d: %s", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,29 @@
+package handlers
+
+import (
+	"net/http"
+
+	s "github.com/Grey0520/s3proxy/internal/server"
+	"github.com/Grey0520/s3proxy/internal/storage"
+	"github.com/labstack/echo/v4"
+)
+
+// StatsHandler 处理 GET /_s3proxy/stats，返回代理自身的运行统计
+type StatsHandler struct {
+	server *s.Server
+}
+
+func NewStatsHandlers(server *s.Server) *StatsHandler {
+	return &StatsHandler{server: server}
+}
+
+type statsResponse struct {
+	// 键为后端名称，没有配置缓存时为空
+	Cache map[string]storage.CacheStats `json:"cache"`
+}
+
+func (h *StatsHandler) Handle(c echo.Context) error {
+	return c.JSON(http.StatusOK, statsResponse{
+		Cache: storage.CacheStatistics(*h.server.Storage),
+	})
+}
@@ -0,0 +1,36 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/Grey0520/s3proxy/internal/config"
+)
+
+func TestStats(t *testing.T) {
+	server := newTestServerWithConfig(t, config.CloudsConfig{
+		Provider: "memory",
+		Cache:    config.CacheConfig{Dir: t.TempDir()},
+	})
+	serve(server, http.MethodPut, "/bucket", "", nil)
+	serve(server, http.MethodPut, "/bucket/key", "cached", nil)
+	for i := 0; i < 3; i++ {
+		if rec := serve(server, http.MethodGet, "/bucket/key", "", nil); rec.Body.String() != "cached" {
+			t.Fatalf("Unexpected body %q", rec.Body)
+		}
+	}
+
+	rec := serve(server, http.MethodGet, "/_s3proxy/stats", "", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+	var resp statsResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	stats := resp.Cache["default"]
+	if stats.Hits != 2 || stats.Misses != 1 || stats.Objects != 1 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+}
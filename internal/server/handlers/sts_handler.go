@@ -0,0 +1,161 @@
+package handlers
+
+import (
+	"encoding/xml"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Grey0520/s3proxy/internal/auth"
+	s "github.com/Grey0520/s3proxy/internal/server"
+	"github.com/labstack/echo/v4"
+)
+
+const stsXmlns = "https://sts.amazonaws.com/doc/2011-06-15/"
+
+// STSHandler 实现与 AWS STS 兼容的 AssumeRole / GetSessionToken
+// 签发的凭证继承调用者的权限，并可以通过内联策略进一步收窄
+// s3proxy 没有角色，AssumeRole 的 RoleArn 只检查格式并原样写入 AssumedRoleUser，不影响凭证的权限
+type STSHandler struct {
+	server *s.Server
+}
+
+func NewSTSHandlers(server *s.Server) *STSHandler {
+	return &STSHandler{server: server}
+}
+
+type stsCredentials struct {
+	AccessKeyId     string    `xml:"AccessKeyId"`
+	SecretAccessKey string    `xml:"SecretAccessKey"`
+	SessionToken    string    `xml:"SessionToken"`
+	Expiration      time.Time `xml:"Expiration"`
+}
+
+type assumedRoleUser struct {
+	Arn           string `xml:"Arn"`
+	AssumedRoleId string `xml:"AssumedRoleId"`
+}
+
+type assumeRoleResponse struct {
+	XMLName xml.Name `xml:"AssumeRoleResponse"`
+	Xmlns   string   `xml:"xmlns,attr"`
+	Result  struct {
+		Credentials     stsCredentials  `xml:"Credentials"`
+		AssumedRoleUser assumedRoleUser `xml:"AssumedRoleUser"`
+	} `xml:"AssumeRoleResult"`
+}
+
+type getSessionTokenResponse struct {
+	XMLName xml.Name `xml:"GetSessionTokenResponse"`
+	Xmlns   string   `xml:"xmlns,attr"`
+	Result  struct {
+		Credentials stsCredentials `xml:"Credentials"`
+	} `xml:"GetSessionTokenResult"`
+}
+
+// stsError 是 STS（Query 协议）格式的错误响应
+type stsError struct {
+	XMLName xml.Name `xml:"ErrorResponse"`
+	Xmlns   string   `xml:"xmlns,attr"`
+	Error   struct {
+		Type    string `xml:"Type"`
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	} `xml:"Error"`
+	statusCode int
+}
+
+func newSTSError(statusCode int, code, message string) *stsError {
+	e := &stsError{Xmlns: stsXmlns, statusCode: statusCode}
+	e.Error.Type = "Sender"
+	e.Error.Code = code
+	e.Error.Message = message
+	return e
+}
+
+func (h *STSHandler) writeError(c echo.Context, e *stsError) error {
+	return c.XML(e.statusCode, e)
+}
+
+// Handle 处理 POST /，根据 Action 参数分发
+func (h *STSHandler) Handle(c echo.Context) error {
+	if h.server.STS == nil {
+		return h.writeError(c, newSTSError(http.StatusNotImplemented, "NotImplemented", "STS is not enabled on this server"))
+	}
+	user := auth.CurrentUser(c)
+	if user == nil {
+		return h.writeError(c, newSTSError(http.StatusForbidden, "AccessDenied", "STS requires an authenticated user"))
+	}
+	// 与 AWS 一致，不允许用临时凭证再签发临时凭证
+	if auth.CurrentSession(c) != nil {
+		return h.writeError(c, newSTSError(http.StatusForbidden, "AccessDenied", "Cannot call STS with session credentials"))
+	}
+
+	duration, stsErr := parseDuration(c.FormValue("DurationSeconds"))
+	if stsErr != nil {
+		return h.writeError(c, stsErr)
+	}
+
+	switch action := c.FormValue("Action"); action {
+	case "AssumeRole":
+		roleArn := c.FormValue("RoleArn")
+		sessionName := c.FormValue("RoleSessionName")
+		if roleArn == "" || sessionName == "" {
+			return h.writeError(c, newSTSError(http.StatusBadRequest, "MissingParameter", "RoleArn and RoleSessionName are required"))
+		}
+		if !validRoleArn(roleArn) {
+			return h.writeError(c, newSTSError(http.StatusBadRequest, "ValidationError", "RoleArn "+roleArn+" is not a valid role ARN"))
+		}
+		creds, err := h.server.STS.Issue(user.CanonicalID, sessionName, duration, c.FormValue("Policy"), time.Now())
+		if err != nil {
+			return h.writeError(c, newSTSError(http.StatusBadRequest, "MalformedPolicyDocument", err.Error()))
+		}
+
+		resp := &assumeRoleResponse{Xmlns: stsXmlns}
+		resp.Result.Credentials = toSTSCredentials(creds.AccessKey, creds.SecretKey, creds.SessionToken, creds.Expiration)
+		resp.Result.AssumedRoleUser = assumedRoleUser{
+			Arn:           roleArn + "/" + sessionName,
+			AssumedRoleId: creds.AccessKey + ":" + sessionName,
+		}
+		return c.XML(http.StatusOK, resp)
+	case "GetSessionToken":
+		creds, err := h.server.STS.Issue(user.CanonicalID, "", duration, c.FormValue("Policy"), time.Now())
+		if err != nil {
+			return h.writeError(c, newSTSError(http.StatusBadRequest, "MalformedPolicyDocument", err.Error()))
+		}
+
+		resp := &getSessionTokenResponse{Xmlns: stsXmlns}
+		resp.Result.Credentials = toSTSCredentials(creds.AccessKey, creds.SecretKey, creds.SessionToken, creds.Expiration)
+		return c.XML(http.StatusOK, resp)
+	default:
+		return h.writeError(c, newSTSError(http.StatusBadRequest, "InvalidAction", "Unsupported action "+action))
+	}
+}
+
+// validRoleArn 检查 RoleArn 是否为 arn:<partition>:iam::<account>:role/<name> 的形式
+func validRoleArn(arn string) bool {
+	parts := strings.SplitN(arn, ":", 6)
+	return len(parts) == 6 && parts[0] == "arn" && parts[1] != "" && parts[2] == "iam" && parts[3] == "" &&
+		strings.HasPrefix(parts[5], "role/") && len(parts[5]) > len("role/")
+}
+
+func parseDuration(value string) (time.Duration, *stsError) {
+	if value == "" {
+		return 0, nil
+	}
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds <= 0 {
+		return 0, newSTSError(http.StatusBadRequest, "InvalidParameterValue", "DurationSeconds must be a positive integer")
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+func toSTSCredentials(accessKey, secretKey, token string, expiration time.Time) stsCredentials {
+	return stsCredentials{
+		AccessKeyId:     accessKey,
+		SecretAccessKey: secretKey,
+		SessionToken:    token,
+		Expiration:      expiration,
+	}
+}
@@ -0,0 +1,65 @@
+package handlers
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/Grey0520/s3proxy/internal/auth"
+	"github.com/Grey0520/s3proxy/internal/config"
+	s "github.com/Grey0520/s3proxy/internal/server"
+)
+
+func newSTSTestServer(t *testing.T) *s.Server {
+	server := s.NewServer(&config.Config{
+		Cloud: config.CloudsConfig{Provider: "memory"},
+		Identity: config.IdentityConfig{
+			Users: []config.UserConfig{{Name: "alice", AccessKey: "alice", SecretKey: "alice-secret"}},
+			STS:   config.STSConfig{SigningKey: "signing-key"},
+		},
+	})
+	server.Echo.HTTPErrorHandler = HTTPErrorHandler
+	server.Echo.Use(auth.Middleware(server.Identity, server.STS))
+	server.Echo.POST("/", NewSTSHandlers(server).Handle)
+	return server
+}
+
+func TestAssumeRole(t *testing.T) {
+	server := newSTSTestServer(t)
+	assumeRole := func(roleArn string) string {
+		form := url.Values{
+			"Action":          {"AssumeRole"},
+			"Version":         {"2011-06-15"},
+			"RoleArn":         {roleArn},
+			"RoleSessionName": {"session"},
+		}
+		return form.Encode()
+	}
+
+	rec := serveSigned(server, http.MethodPost, "/", assumeRole("arn:aws:iam::123456789012:role/reader"), "sts", "alice", "alice-secret")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+	var resp assumeRoleResponse
+	if err := xml.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if resp.Result.Credentials.SessionToken == "" || resp.Result.AssumedRoleUser.Arn != "arn:aws:iam::123456789012:role/reader/session" {
+		t.Errorf("Unexpected response %+v", resp.Result)
+	}
+
+	for roleArn, code := range map[string]string{
+		"":                                 "MissingParameter",
+		"reader":                           "ValidationError",
+		"arn:aws:s3:::bucket":              "ValidationError",
+		"arn:aws:iam::123456789012:user/x": "ValidationError",
+		"arn:aws:iam::123456789012:role/":  "ValidationError",
+	} {
+		rec := serveSigned(server, http.MethodPost, "/", assumeRole(roleArn), "sts", "alice", "alice-secret")
+		if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "<Code>"+code+"</Code>") {
+			t.Errorf("Expected %s for RoleArn %q, got %d: %s", code, roleArn, rec.Code, rec.Body)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package routes
 
 import (
+	"github.com/Grey0520/s3proxy/internal/auth"
 	s "github.com/Grey0520/s3proxy/internal/server"
 	"github.com/Grey0520/s3proxy/internal/server/handlers"
 	"github.com/labstack/echo/v4/middleware"
@@ -9,13 +10,38 @@ import (
 func ConfigureRoutes(server *s.Server) {
 	objectHanlder := handlers.NewObjectHandlers(server)
 	bucketHandler := handlers.NewBucketHandlers(server)
+	stsHandler := handlers.NewSTSHandlers(server)
+	statsHandler := handlers.NewStatsHandlers(server)
+	quotaHandler := handlers.NewQuotaHandlers(server)
+	healthHandler := handlers.NewHealthHandlers(server)
 
-	// object
+	server.Echo.HTTPErrorHandler = handlers.HTTPErrorHandler
 	server.Echo.Use(middleware.Logger())
+	server.Echo.Use(auth.Middleware(server.Identity, server.STS))
+
+	// object
 	server.Echo.GET("/:bucketName/:objectName", objectHanlder.GetObject)
+	server.Echo.HEAD("/:bucketName/:objectName", objectHanlder.HeadObject)
 	server.Echo.PUT("/:bucketName/:objectName", objectHanlder.PutObject)
 	server.Echo.DELETE("/:bucketName/:objectName", objectHanlder.DeleteObject)
 
 	// bucket
+	server.Echo.GET("/", bucketHandler.ListAllMyBuckets)
+	server.Echo.GET("/:bucketName", bucketHandler.GetBucket)
 	server.Echo.PUT("/:bucketName", bucketHandler.CreateBucket)
+	server.Echo.DELETE("/:bucketName", bucketHandler.DeleteBucket)
+
+	// sts
+	server.Echo.POST("/", stsHandler.Handle)
+
+	// 代理自身的接口，存储桶名称不能含有 _，不会与存储桶冲突
+	server.Echo.GET("/_s3proxy/stats", statsHandler.Handle)
+	server.Echo.GET(auth.HealthPath, healthHandler.Handle)
+	server.Echo.GET("/_s3proxy/quotas", quotaHandler.List)
+	server.Echo.GET("/_s3proxy/quotas/buckets/:bucketName", quotaHandler.GetBucket)
+	server.Echo.PUT("/_s3proxy/quotas/buckets/:bucketName", quotaHandler.PutBucket)
+	server.Echo.DELETE("/_s3proxy/quotas/buckets/:bucketName", quotaHandler.DeleteBucket)
+	server.Echo.GET("/_s3proxy/quotas/users/:userName", quotaHandler.GetUser)
+	server.Echo.PUT("/_s3proxy/quotas/users/:userName", quotaHandler.PutUser)
+	server.Echo.DELETE("/_s3proxy/quotas/users/:userName", quotaHandler.DeleteUser)
 }
@@ -2,14 +2,20 @@ package server
 
 import (
 	"github.com/Grey0520/s3proxy/internal/config"
+	"github.com/Grey0520/s3proxy/internal/identity"
+	"github.com/Grey0520/s3proxy/internal/quota"
 	"github.com/Grey0520/s3proxy/internal/storage"
+	"github.com/Grey0520/s3proxy/internal/sts"
 	"github.com/labstack/echo/v4"
 )
 
 type Server struct {
-	Echo    *echo.Echo
-	Storage *storage.StorageProvider
-	Config  *config.Config
+	Echo     *echo.Echo
+	Storage  *storage.StorageProvider
+	Identity *identity.Store
+	Quota    *quota.Manager
+	STS      *sts.Issuer
+	Config   *config.Config
 }
 
 func NewServer(cfg *config.Config) *Server {
@@ -17,10 +23,21 @@ func NewServer(cfg *config.Config) *Server {
 	if err != nil {
 		panic(err)
 	}
+	id, err := identity.NewStore(cfg.Identity)
+	if err != nil {
+		panic(err)
+	}
+	q, err := quota.NewManager(cfg.Quota, stg, id.BucketOwner)
+	if err != nil {
+		panic(err)
+	}
 	return &Server{
-		Echo:    echo.New(),
-		Storage: &stg,
-		Config:  cfg,
+		Echo:     echo.New(),
+		Storage:  &stg,
+		Identity: id,
+		Quota:    q,
+		STS:      sts.NewIssuer(cfg.Identity.STS),
+		Config:   cfg,
 	}
 }
 
@@ -1,18 +1,25 @@
 package storage
 
 import (
+	"bytes"
 	"context"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
+	"os"
+	"strings"
 	"time"
 
+	"github.com/Grey0520/s3proxy/internal/s3err"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"gocloud.dev/blob"
-	_ "gocloud.dev/blob/s3blob"
+	"gocloud.dev/blob/s3blob"
 )
 
 type AWSStore struct {
@@ -20,21 +27,115 @@ type AWSStore struct {
 	ctx     context.Context
 }
 
-func NewAWSStore(accessKeyID, secretAccessKey, region string) (*AWSStore, error) {
-	sess, err := session.NewSession(&aws.Config{
-		Region:      aws.String(region),
-		Credentials: credentials.NewStaticCredentials(accessKeyID, secretAccessKey, ""),
-	})
+// AWSOption 是 NewAWSStore 的可选配置，用于连接 MinIO、Ceph、R2 等兼容 S3 的服务
+type AWSOption func(*awsOptions) error
+
+type awsOptions struct {
+	config      *aws.Config
+	caBundle    []byte
+	signatureV2 bool
+}
+
+// WithEndpoint 连接指定地址的 S3 服务，可以不带协议，此时默认使用 https
+func WithEndpoint(endpoint string) AWSOption {
+	return func(o *awsOptions) error {
+		o.config.Endpoint = aws.String(endpoint)
+		return nil
+	}
+}
+
+// WithPathStyle 使用 http://endpoint/bucket/key 形式的地址，大多数自建的服务都需要打开
+func WithPathStyle(pathStyle bool) AWSOption {
+	return func(o *awsOptions) error {
+		o.config.S3ForcePathStyle = aws.Bool(pathStyle)
+		return nil
+	}
+}
+
+// WithDisableSSL 在 endpoint 没有指定协议时使用 http
+func WithDisableSSL(disableSSL bool) AWSOption {
+	return func(o *awsOptions) error {
+		o.config.DisableSSL = aws.Bool(disableSSL)
+		return nil
+	}
+}
+
+// WithCABundle 使用 PEM 格式的 CA 证书文件校验服务端证书，用于自签名证书的服务
+func WithCABundle(path string) AWSOption {
+	return func(o *awsOptions) error {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read CA bundle: %v", err)
+		}
+		o.caBundle = data
+		return nil
+	}
+}
+
+// WithSignatureVersion 设置请求的签名版本，v2 用于不支持 SigV4 的旧版 Ceph
+// 使用 v2 时总是使用路径风格的地址
+func WithSignatureVersion(version string) AWSOption {
+	return func(o *awsOptions) error {
+		switch strings.ToLower(version) {
+		case "", "v4":
+			o.signatureV2 = false
+		case "v2":
+			o.signatureV2 = true
+			o.config.S3ForcePathStyle = aws.Bool(true)
+		default:
+			return fmt.Errorf("unsupported signature version %q", version)
+		}
+		return nil
+	}
+}
+
+func NewAWSStore(accessKeyID, secretAccessKey, region string, opts ...AWSOption) (*AWSStore, error) {
+	o := &awsOptions{
+		config: &aws.Config{
+			Region:      aws.String(region),
+			Credentials: credentials.NewStaticCredentials(accessKeyID, secretAccessKey, ""),
+		},
+	}
+	for _, opt := range opts {
+		if err := opt(o); err != nil {
+			return nil, err
+		}
+	}
+	// 兼容 S3 的服务一般不关心区域，但 SDK 要求必须有
+	if region == "" && aws.StringValue(o.config.Endpoint) != "" {
+		o.config.Region = aws.String("us-east-1")
+	}
+
+	sessOpts := session.Options{Config: *o.config}
+	if o.caBundle != nil {
+		sessOpts.CustomCABundle = bytes.NewReader(o.caBundle)
+	}
+	sess, err := session.NewSessionWithOptions(sessOpts)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create session: %v", err)
 	}
+	if o.signatureV2 {
+		// 在发送前用 SigV2 重新签名，覆盖 S3 客户端默认添加的 SigV4 签名
+		sess.Handlers.Send.PushFrontNamed(signV2Handler)
+	}
 	return &AWSStore{
 		Session: sess,
 		ctx:     context.Background(),
 	}, nil
 }
 
+func (store *AWSStore) openBucket(bucketName string) (*blob.Bucket, error) {
+	b, err := s3blob.OpenBucket(store.ctx, store.Session, bucketName, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open bucket: %v", err)
+	}
+	return b, nil
+}
+
 func (store *AWSStore) CreateBucket(bucketName string) error {
+	if err := checkBucketName(bucketName); err != nil {
+		return err
+	}
 	s3Client := s3.New(store.Session)
 
 	_, err := s3Client.CreateBucket(&s3.CreateBucketInput{
@@ -65,15 +166,28 @@ func (store *AWSStore) DeleteBucket(bucketName string) error {
 	return nil
 }
 
-func (store *AWSStore) ListBucket(bucketName string) (*ListBucketResult, error) {
+func (store *AWSStore) ListBucket(bucketName string, opts ...ListOption) (*ListBucketResult, error) {
+	o := newListOptions(opts)
+	maxKeys := int64(1000)
+	if o.MaxKeys > 0 {
+		maxKeys = int64(o.MaxKeys)
+	}
+
 	// 使用结构体中的Session创建一个S3服务客户端
 	s3Client := s3.New(store.Session)
 
-	// 调用ListObjectsV2 API
-	output, err := s3Client.ListObjectsV2(&s3.ListObjectsV2Input{
+	// 调用ListObjectsV2 API，前缀和分页由 S3 完成
+	input := &s3.ListObjectsV2Input{
 		Bucket:  aws.String(bucketName),
-		MaxKeys: aws.Int64(1000),
-	})
+		MaxKeys: aws.Int64(maxKeys),
+	}
+	if o.Prefix != "" {
+		input.Prefix = aws.String(o.Prefix)
+	}
+	if o.Marker != "" {
+		input.StartAfter = aws.String(o.Marker)
+	}
+	output, err := s3Client.ListObjectsV2(input)
 	if err != nil {
 		// 如果有错误发生，返回错误
 		return nil, fmt.Errorf("failed to list objects: %v", err)
@@ -81,7 +195,12 @@ func (store *AWSStore) ListBucket(bucketName string) (*ListBucketResult, error)
 
 	// 创建一个ListBucketResult类型的实例
 	result := &ListBucketResult{
-		XMLName: xml.Name{Local: "ListBucketResult"},
+		XMLName:     xml.Name{Local: "ListBucketResult"},
+		Name:        bucketName,
+		Prefix:      o.Prefix,
+		Marker:      o.Marker,
+		MaxKeys:     o.MaxKeys,
+		IsTruncated: aws.BoolValue(output.IsTruncated),
 	}
 
 	// 遍历ListObjectsV2Output中的Contents，将每个对象的Key和LastModified添加到ListBucketResult中
@@ -198,22 +317,41 @@ func (store *AWSStore) GetBucketAcl(bucketName string) (*AccessControlPolicy, er
 	return &policy, nil
 }
 
-func (store *AWSStore) PutObject(bucketName, objectKey string, data *Object) error {
-	bucket, err := blob.OpenBucket(store.ctx, fmt.Sprintf("s3://%s", bucketName))
+func (store *AWSStore) PutObject(bucketName, objectKey string, data *Object, opts ...ObjectOption) error {
+	if err := checkObjectKey(objectKey); err != nil {
+		return err
+	}
+	o := newObjectOptions(opts)
+	bucket, err := store.openBucket(bucketName)
 	if err != nil {
-		return fmt.Errorf("failed to open bucket: %v", err)
+		return err
 	}
 	defer bucket.Close()
 
 	currentDate := time.Now().Format(time.RFC3339)
-	opts := &blob.WriterOptions{
+	wopts := &blob.WriterOptions{
 		Metadata: map[string]string{
 			"creation-date": currentDate,
 		},
 		ContentType: data.ContentType,
+		BeforeWrite: func(as func(interface{}) bool) error {
+			var in *s3manager.UploadInput
+			if !as(&in) {
+				return nil
+			}
+			if data.ServerSideEncryption != "" {
+				in.ServerSideEncryption = aws.String(data.ServerSideEncryption)
+			}
+			if key := o.SSECustomerKey; key != nil {
+				in.SSECustomerAlgorithm = aws.String(key.Algorithm)
+				in.SSECustomerKey = aws.String(string(key.Key))
+				in.SSECustomerKeyMD5 = aws.String(key.KeyMD5)
+			}
+			return nil
+		},
 	}
 
-	w, err := bucket.NewWriter(store.ctx, objectKey, opts)
+	w, err := bucket.NewWriter(store.ctx, objectKey, wopts)
 	if err != nil {
 		return fmt.Errorf("failed to obtain writer: %v", err)
 	}
@@ -223,38 +361,50 @@ func (store *AWSStore) PutObject(bucketName, objectKey string, data *Object) err
 	}
 
 	if err := w.Close(); err != nil {
-		return fmt.Errorf("failed to close writer: %v", err)
+		return awsError(err, "failed to close writer")
 	}
 
 	return nil
 }
 
-func (store *AWSStore) GetObject(bucketName, objectKey string) (*Object, error) {
-	bucket, err := blob.OpenBucket(store.ctx, fmt.Sprintf("s3://%s", bucketName))
+func (store *AWSStore) GetObject(bucketName, objectKey string, opts ...ObjectOption) (*Object, error) {
+	if err := checkObjectKey(objectKey); err != nil {
+		return nil, err
+	}
+	key := newObjectOptions(opts).SSECustomerKey
+	bucket, err := store.openBucket(bucketName)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open bucket: %v", err)
+		return nil, err
 	}
 	defer bucket.Close()
 
-	r, err := bucket.NewReader(store.ctx, objectKey, nil)
+	r, err := bucket.NewReader(store.ctx, objectKey, &blob.ReaderOptions{BeforeRead: beforeReadSSEC(key)})
 	if err != nil {
-		return nil, fmt.Errorf("failed to obtain reader: %v", err)
+		return nil, awsError(err, "failed to obtain reader")
 	}
 
-	defer r.Close()
-
-	return &Object{
+	// 由调用者关闭 Data
+	obj := &Object{
+		Key:          objectKey,
 		Size:         r.Size(),
 		LastModified: r.ModTime(),
 		ContentType:  r.ContentType(),
 		Data:         r,
-	}, nil
+	}
+	if key != nil {
+		obj.SSECustomerAlgorithm = key.Algorithm
+		obj.SSECustomerKeyMD5 = key.KeyMD5
+	}
+	return obj, nil
 }
 
 func (store *AWSStore) DeleteObject(bucketName, objectKey string) error {
-	bucket, err := blob.OpenBucket(store.ctx, fmt.Sprintf("s3://%s", bucketName))
+	if err := checkObjectKey(objectKey); err != nil {
+		return err
+	}
+	bucket, err := store.openBucket(bucketName)
 	if err != nil {
-		return fmt.Errorf("failed to open bucket: %v", err)
+		return err
 	}
 	defer bucket.Close()
 
@@ -265,26 +415,43 @@ func (store *AWSStore) DeleteObject(bucketName, objectKey string) error {
 	return nil
 }
 
-func (store *AWSStore) CopyObject(srcBucketName, srcObjectKey, destBucketName, destObjcetKey string) error {
-	bucket, err := blob.OpenBucket(store.ctx, fmt.Sprintf("s3://%s", srcBucketName))
+func (store *AWSStore) CopyObject(srcBucketName, srcObjectKey, destBucketName, destObjcetKey string, opts ...ObjectOption) error {
+	if err := checkObjectKey(srcObjectKey); err != nil {
+		return err
+	}
+	if err := checkObjectKey(destObjcetKey); err != nil {
+		return err
+	}
+	o := newObjectOptions(opts)
+	bucket, err := store.openBucket(srcBucketName)
 	if err != nil {
-		return fmt.Errorf("failed to open source bucket: %v", err)
+		return err
 	}
 	defer bucket.Close()
 
-	r, err := bucket.NewReader(store.ctx, srcObjectKey, nil)
+	r, err := bucket.NewReader(store.ctx, srcObjectKey, &blob.ReaderOptions{BeforeRead: beforeReadSSEC(o.CopySourceSSECustomerKey)})
 	if err != nil {
-		return fmt.Errorf("failed to obtain reader: %v", err)
+		return awsError(err, "failed to obtain reader")
 	}
 	defer r.Close()
 
-	destBucket, err := blob.OpenBucket(store.ctx, fmt.Sprintf("s3://%s", destBucketName))
+	destBucket, err := store.openBucket(destBucketName)
 	if err != nil {
-		return fmt.Errorf("failed to open destination bucket: %v", err)
+		return err
 	}
 	defer destBucket.Close()
 
-	w, err := destBucket.NewWriter(store.ctx, destObjcetKey, nil)
+	w, err := destBucket.NewWriter(store.ctx, destObjcetKey, &blob.WriterOptions{
+		BeforeWrite: func(as func(interface{}) bool) error {
+			var in *s3manager.UploadInput
+			if key := o.SSECustomerKey; key != nil && as(&in) {
+				in.SSECustomerAlgorithm = aws.String(key.Algorithm)
+				in.SSECustomerKey = aws.String(string(key.Key))
+				in.SSECustomerKeyMD5 = aws.String(key.KeyMD5)
+			}
+			return nil
+		},
+	})
 	if err != nil {
 		return fmt.Errorf("failed to obtain writer: %v", err)
 	}
@@ -312,28 +479,68 @@ func (store *AWSStore) MoveObject(srcBucketName, srcObjectKey, destBucketName, d
 	return nil
 }
 
-func (store *AWSStore) HeadObject(bucketName, objectKey string) (map[string]string, error) {
-	// Open the bucket
-	bucket, err := blob.OpenBucket(store.ctx, fmt.Sprintf("s3://%s", bucketName))
-	if err != nil {
-		return nil, fmt.Errorf("failed to open bucket: %v", err)
+// HeadObject 直接调用 S3 的 HeadObject，以便传递 SSE-C 请求头
+func (store *AWSStore) HeadObject(bucketName, objectKey string, opts ...ObjectOption) (map[string]string, error) {
+	if err := checkObjectKey(objectKey); err != nil {
+		return nil, err
 	}
-	defer bucket.Close()
-
-	attrs, err := bucket.Attributes(store.ctx, objectKey)
+	key := newObjectOptions(opts).SSECustomerKey
+	in := &s3.HeadObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(objectKey),
+	}
+	if key != nil {
+		in.SSECustomerAlgorithm = aws.String(key.Algorithm)
+		in.SSECustomerKey = aws.String(string(key.Key))
+		in.SSECustomerKeyMD5 = aws.String(key.KeyMD5)
+	}
+	out, err := s3.New(store.Session).HeadObjectWithContext(store.ctx, in)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get object attributes: %v", err)
+		return nil, awsError(err, "failed to get object attributes")
 	}
 
 	metadata := make(map[string]string)
-	metadata["Size"] = fmt.Sprintf("%d", attrs.Size)
-	metadata["LastModified"] = attrs.ModTime.Format(time.RFC3339)
-	metadata["ContentType"] = attrs.ContentType
-
-	// 其他的信息也加进去吧
-	for key, value := range attrs.Metadata {
-		metadata[key] = value
+	// 其他的信息也加进去吧，键名与 gocloud 一致使用小写
+	for key, value := range out.Metadata {
+		metadata[strings.ToLower(key)] = aws.StringValue(value)
+	}
+	metadata["Size"] = fmt.Sprintf("%d", aws.Int64Value(out.ContentLength))
+	metadata["LastModified"] = aws.TimeValue(out.LastModified).Format(time.RFC3339)
+	metadata["ContentType"] = aws.StringValue(out.ContentType)
+	metadata["ETag"] = aws.StringValue(out.ETag)
+	if out.ServerSideEncryption != nil {
+		metadata["ServerSideEncryption"] = *out.ServerSideEncryption
+	}
+	if out.SSECustomerAlgorithm != nil {
+		metadata["SSECustomerAlgorithm"] = *out.SSECustomerAlgorithm
+		metadata["SSECustomerKeyMD5"] = aws.StringValue(out.SSECustomerKeyMD5)
 	}
 
 	return metadata, nil
 }
+
+// beforeReadSSEC 把 SSE-C 密钥加到 s3blob 的 GetObject 请求中
+func beforeReadSSEC(key *SSECustomerKey) func(func(interface{}) bool) error {
+	return func(as func(interface{}) bool) error {
+		var in *s3.GetObjectInput
+		if key != nil && as(&in) {
+			in.SSECustomerAlgorithm = aws.String(key.Algorithm)
+			in.SSECustomerKey = aws.String(string(key.Key))
+			in.SSECustomerKeyMD5 = aws.String(key.KeyMD5)
+		}
+		return nil
+	}
+}
+
+// awsError 把 S3 返回的错误原样转换成 s3err，使客户端能看到真实的错误码
+func awsError(err error, msg string) error {
+	var reqErr awserr.RequestFailure
+	if errors.As(err, &reqErr) && reqErr.StatusCode() >= 400 && reqErr.StatusCode() < 500 {
+		return &s3err.Error{
+			Code:       reqErr.Code(),
+			Message:    reqErr.Message(),
+			StatusCode: reqErr.StatusCode(),
+		}
+	}
+	return fmt.Errorf("%s: %v", msg, err)
+}
@@ -0,0 +1,108 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// signV2Handler 用 S3 的 SigV2 对请求重新签名
+// SigV2 的规范见 https://docs.aws.amazon.com/AmazonS3/latest/userguide/RESTAuthentication.html
+var signV2Handler = request.NamedHandler{
+	Name: "s3proxy.SignV2Handler",
+	Fn: func(r *request.Request) {
+		creds, err := r.Config.Credentials.GetWithContext(r.Context())
+		if err != nil {
+			r.Error = err
+			return
+		}
+		if creds.SessionToken != "" {
+			r.HTTPRequest.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+		}
+		signV2(r.HTTPRequest, creds.AccessKeyID, creds.SecretAccessKey, time.Now())
+	},
+}
+
+// s3V2SubResources 是需要参与 SigV2 签名的查询参数
+var s3V2SubResources = map[string]bool{
+	"acl": true, "cors": true, "delete": true, "lifecycle": true, "location": true,
+	"logging": true, "notification": true, "partNumber": true, "policy": true,
+	"requestPayment": true, "restore": true, "tagging": true, "torrent": true,
+	"uploadId": true, "uploads": true, "versionId": true, "versioning": true,
+	"versions": true, "website": true,
+	"response-cache-control": true, "response-content-disposition": true,
+	"response-content-encoding": true, "response-content-language": true,
+	"response-content-type": true, "response-expires": true,
+}
+
+// signV2 计算 SigV2 签名并设置 Authorization，请求必须使用路径风格的地址
+// SigV4 添加的请求头会被去掉，避免干扰签名
+func signV2(req *http.Request, accessKeyID, secretAccessKey string, now time.Time) {
+	req.Header.Del("Authorization")
+	req.Header.Del("X-Amz-Date")
+	req.Header.Del("X-Amz-Content-Sha256")
+	req.Header.Set("Date", now.UTC().Format(http.TimeFormat))
+	req.Header.Set("Authorization", "AWS "+accessKeyID+":"+signatureV2(req, secretAccessKey))
+}
+
+// signatureV2 按请求当前的请求头计算签名
+func signatureV2(req *http.Request, secretAccessKey string) string {
+	mac := hmac.New(sha1.New, []byte(secretAccessKey))
+	mac.Write([]byte(stringToSignV2(req)))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func stringToSignV2(req *http.Request) string {
+	var b strings.Builder
+	b.WriteString(req.Method + "\n")
+	b.WriteString(req.Header.Get("Content-MD5") + "\n")
+	b.WriteString(req.Header.Get("Content-Type") + "\n")
+	// 有 x-amz-date 时 Date 留空，x-amz-date 会出现在下面的请求头中
+	if req.Header.Get("X-Amz-Date") == "" {
+		b.WriteString(req.Header.Get("Date"))
+	}
+	b.WriteString("\n")
+
+	var amzHeaders []string
+	for k := range req.Header {
+		if k := strings.ToLower(k); strings.HasPrefix(k, "x-amz-") {
+			amzHeaders = append(amzHeaders, k)
+		}
+	}
+	sort.Strings(amzHeaders)
+	for _, k := range amzHeaders {
+		var values []string
+		for _, v := range req.Header.Values(k) {
+			values = append(values, strings.TrimSpace(v))
+		}
+		b.WriteString(k + ":" + strings.Join(values, ",") + "\n")
+	}
+
+	b.WriteString(req.URL.EscapedPath())
+	query := req.URL.Query()
+	var subResources []string
+	for k := range query {
+		if s3V2SubResources[k] {
+			subResources = append(subResources, k)
+		}
+	}
+	sort.Strings(subResources)
+	for i, k := range subResources {
+		if i == 0 {
+			b.WriteString("?")
+		} else {
+			b.WriteString("&")
+		}
+		b.WriteString(k)
+		if v := query.Get(k); v != "" {
+			b.WriteString("=" + v)
+		}
+	}
+	return b.String()
+}
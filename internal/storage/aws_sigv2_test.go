@@ -0,0 +1,59 @@
+package storage
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 示例来自 AWS 文档 RESTAuthentication 一节
+func TestSignatureV2(t *testing.T) {
+	const secretAccessKey = "wJalrXUtnFEMI/K7MDENG/bPxRfiCYEXAMPLEKEY"
+	tests := []struct {
+		method      string
+		url         string
+		contentType string
+		date        string
+		want        string
+	}{
+		{"GET", "https://s3.amazonaws.com/awsexamplebucket1/photos/puppy.jpg", "", "Tue, 27 Mar 2007 19:36:42 +0000", "qgk2+6Sv9/oM7G3qLEjTH1a1l1g="},
+		{"PUT", "https://s3.amazonaws.com/awsexamplebucket1/photos/puppy.jpg", "image/jpeg", "Tue, 27 Mar 2007 21:15:45 +0000", "iqRzw+ileNPu1fhspnRs8nOjjIA="},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(tt.method, tt.url, nil)
+		req.Header.Set("Date", tt.date)
+		if tt.contentType != "" {
+			req.Header.Set("Content-Type", tt.contentType)
+		}
+		if got := signatureV2(req, secretAccessKey); got != tt.want {
+			t.Errorf("Expected signature %s for %s %s, got %s", tt.want, tt.method, tt.url, got)
+		}
+	}
+}
+
+func TestStringToSignV2(t *testing.T) {
+	req, _ := http.NewRequest("PUT", "http://127.0.0.1:9000/bucket/key?uploadId=abc&partNumber=2&x-id=UploadPart", nil)
+	req.Header.Set("Content-MD5", "md5")
+	req.Header.Set("X-Amz-Meta-B", " two ")
+	req.Header.Add("X-Amz-Meta-A", "1")
+	req.Header.Add("X-Amz-Meta-A", "2")
+	req.Header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+
+	signV2(req, "ak", "sk", time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC))
+	want := strings.Join([]string{
+		"PUT",
+		"md5",
+		"",
+		"Fri, 01 Mar 2024 08:00:00 GMT",
+		"x-amz-meta-a:1,2",
+		"x-amz-meta-b:two",
+		"/bucket/key?partNumber=2&uploadId=abc",
+	}, "\n")
+	if got := stringToSignV2(req); got != want {
+		t.Errorf("Expected string to sign %q, got %q", want, got)
+	}
+	if !strings.HasPrefix(req.Header.Get("Authorization"), "AWS ak:") {
+		t.Errorf("Unexpected authorization %s", req.Header.Get("Authorization"))
+	}
+}
@@ -0,0 +1,399 @@
+package storage
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/service"
+	"github.com/Grey0520/s3proxy/internal/s3err"
+	"gocloud.dev/blob"
+	"gocloud.dev/blob/azureblob"
+)
+
+// 上传时每个块的大小，超过一个块的对象以多个块上传后再提交块列表
+const azureBlockSize = 8 * 1024 * 1024
+
+// AzureStore 通过 gocloud 的 azureblob 读写 Azure Blob Storage 中的对象，
+// 一个容器对应一个存储桶，容器的创建、删除、列举和访问策略使用 Azure 的客户端
+type AzureStore struct {
+	Client *service.Client
+	// 上传使用的块大小，为 0 时使用 azureBlockSize
+	BlockSize int
+	account   string
+	ctx       context.Context
+}
+
+// NewAzureStore 使用存储账户名和账户密钥创建 AzureStore
+// endpoint 为 http(s) 地址时连接到该地址（例如 Azurite），否则连接到账户默认的 Blob 服务地址
+func NewAzureStore(account, accountKey, endpoint string) (*AzureStore, error) {
+	cred, err := azblob.NewSharedKeyCredential(account, accountKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid azure credential: %v", err)
+	}
+
+	serviceURL := fmt.Sprintf("https://%s.blob.core.windows.net/", account)
+	if strings.HasPrefix(endpoint, "http://") || strings.HasPrefix(endpoint, "https://") {
+		serviceURL = strings.TrimSuffix(endpoint, "/") + "/"
+	}
+	client, err := service.NewClientWithSharedKeyCredential(serviceURL, cred, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create azure client: %v", err)
+	}
+	return &AzureStore{
+		Client:  client,
+		account: account,
+		ctx:     context.Background(),
+	}, nil
+}
+
+func (store *AzureStore) openBucket(bucketName string) (*blob.Bucket, error) {
+	b, err := azureblob.OpenBucket(store.ctx, store.Client.NewContainerClient(bucketName), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open bucket: %v", err)
+	}
+	return b, nil
+}
+
+func (store *AzureStore) CreateBucket(bucketName string) error {
+	if _, err := store.Client.CreateContainer(store.ctx, bucketName, nil); err != nil {
+		return azureError(err, "failed to create bucket", s3err.ErrNoSuchBucket)
+	}
+	return nil
+}
+
+// DeleteBucket 删除容器，Azure 会直接删除非空的容器，这里先检查是否为空
+func (store *AzureStore) DeleteBucket(bucketName string) error {
+	client := store.Client.NewContainerClient(bucketName)
+	pager := client.NewListBlobsFlatPager(&container.ListBlobsFlatOptions{MaxResults: to.Ptr[int32](1)})
+	page, err := pager.NextPage(store.ctx)
+	if err != nil {
+		return azureError(err, "failed to delete bucket", s3err.ErrNoSuchBucket)
+	}
+	if page.Segment != nil && len(page.Segment.BlobItems) > 0 {
+		return s3err.ErrBucketNotEmpty
+	}
+
+	if _, err := client.Delete(store.ctx, nil); err != nil {
+		return azureError(err, "failed to delete bucket", s3err.ErrNoSuchBucket)
+	}
+	return nil
+}
+
+func (store *AzureStore) ListBucket(bucketName string, opts ...ListOption) (*ListBucketResult, error) {
+	o := newListOptions(opts)
+	bucket, err := store.openBucket(bucketName)
+	if err != nil {
+		return nil, err
+	}
+	defer bucket.Close()
+
+	result := &ListBucketResult{
+		XMLName: xml.Name{Local: "ListBucketResult"},
+		Name:    bucketName,
+	}
+	iter := bucket.List(&blob.ListOptions{Prefix: o.Prefix})
+	for {
+		obj, err := iter.Next(store.ctx)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, azureError(err, "failed to list objects", s3err.ErrNoSuchBucket)
+		}
+		var item container.BlobItem
+		etag := ""
+		if obj.As(&item) && item.Properties != nil && item.Properties.ETag != nil {
+			etag = string(*item.Properties.ETag)
+		}
+		result.Contents = append(result.Contents, Content{
+			Key:          obj.Key,
+			LastModified: obj.ModTime,
+			ETag:         azureETag(obj.MD5, etag),
+			Size:         obj.Size,
+			StorageClass: "STANDARD",
+		})
+	}
+	return o.paginate(result), nil
+}
+
+func (store *AzureStore) ListAllMyBuckets() (*ListAllMyBucketsResult, error) {
+	var buckets Buckets
+	pager := store.Client.NewListContainersPager(nil)
+	for pager.More() {
+		page, err := pager.NextPage(store.ctx)
+		if err != nil {
+			return nil, azureError(err, "failed to list buckets", s3err.ErrNoSuchBucket)
+		}
+		for _, item := range page.ContainerItems {
+			b := Bucket{Name: *item.Name}
+			if item.Properties != nil && item.Properties.LastModified != nil {
+				b.CreationDate = *item.Properties.LastModified
+			}
+			buckets.Bucket = append(buckets.Bucket, b)
+		}
+	}
+
+	return &ListAllMyBucketsResult{
+		XMLName: xml.Name{Local: "ListAllMyBucketsResult"},
+		Xmlns:   "http://s3.amazonaws.com/doc/2006-03-01/",
+		Owner:   store.owner(),
+		Buckets: buckets,
+	}, nil
+}
+
+// GetBucketAcl 把容器的公共访问级别转换为 S3 的 ACL
+// 存储账户总是拥有完全控制权限，允许公共访问的容器额外授予 AllUsers 读权限
+func (store *AzureStore) GetBucketAcl(bucketName string) (*AccessControlPolicy, error) {
+	resp, err := store.Client.NewContainerClient(bucketName).GetAccessPolicy(store.ctx, nil)
+	if err != nil {
+		return nil, azureError(err, "failed to get bucket ACL", s3err.ErrNoSuchBucket)
+	}
+
+	owner := store.owner()
+	policy := &AccessControlPolicy{
+		Xmlns: "http://s3.amazonaws.com/doc/2006-03-01/",
+		Owner: owner,
+	}
+	policy.AccessControlList.Grant = append(policy.AccessControlList.Grant, Grant{
+		Grantee: Grantee{
+			XmlnsXsi:    "http://www.w3.org/2001/XMLSchema-instance",
+			XsiType:     "CanonicalUser",
+			ID:          owner.ID,
+			DisplayName: owner.DisplayName,
+		},
+		Permission: "FULL_CONTROL",
+	})
+	if resp.BlobPublicAccess != nil {
+		policy.AccessControlList.Grant = append(policy.AccessControlList.Grant, Grant{
+			Grantee: Grantee{
+				XmlnsXsi: "http://www.w3.org/2001/XMLSchema-instance",
+				XsiType:  "Group",
+				ID:       "http://acs.amazonaws.com/groups/global/AllUsers",
+			},
+			Permission: "READ",
+		})
+	}
+	return policy, nil
+}
+
+// owner 返回 Azure 中容器的所有者，即存储账户
+func (store *AzureStore) owner() Owner {
+	return Owner{
+		ID:          store.account,
+		DisplayName: store.account,
+	}
+}
+
+func (store *AzureStore) PutObject(bucketName, objectKey string, data *Object, opts ...ObjectOption) error {
+	if err := checkAzureEncryption(data.ServerSideEncryption, newObjectOptions(opts)); err != nil {
+		return err
+	}
+
+	bucket, err := store.openBucket(bucketName)
+	if err != nil {
+		return err
+	}
+	defer bucket.Close()
+
+	return store.write(bucket, objectKey, data.ContentType, data.Data)
+}
+
+// write 以块的方式上传对象，BufferSize 即块大小
+func (store *AzureStore) write(bucket *blob.Bucket, objectKey, contentType string, r io.Reader) error {
+	blockSize := store.BlockSize
+	if blockSize == 0 {
+		blockSize = azureBlockSize
+	}
+	w, err := bucket.NewWriter(store.ctx, objectKey, &blob.WriterOptions{
+		ContentType: contentType,
+		BufferSize:  blockSize,
+	})
+	if err != nil {
+		return azureError(err, "failed to obtain writer", s3err.ErrNoSuchBucket)
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return fmt.Errorf("failed to write object: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		return azureError(err, "failed to close writer", s3err.ErrNoSuchBucket)
+	}
+	return nil
+}
+
+func (store *AzureStore) GetObject(bucketName, objectKey string, opts ...ObjectOption) (*Object, error) {
+	if err := checkAzureEncryption("", newObjectOptions(opts)); err != nil {
+		return nil, err
+	}
+
+	bucket, err := store.openBucket(bucketName)
+	if err != nil {
+		return nil, err
+	}
+	defer bucket.Close()
+
+	attrs, err := bucket.Attributes(store.ctx, objectKey)
+	if err != nil {
+		return nil, azureError(err, "failed to get object attributes", s3err.ErrNoSuchKey)
+	}
+	r, err := bucket.NewReader(store.ctx, objectKey, nil)
+	if err != nil {
+		return nil, azureError(err, "failed to obtain reader", s3err.ErrNoSuchKey)
+	}
+
+	// 由调用者关闭 Data
+	return &Object{
+		Key:          objectKey,
+		Size:         r.Size(),
+		LastModified: r.ModTime(),
+		ContentType:  r.ContentType(),
+		ETag:         azureETag(attrs.MD5, attrs.ETag),
+		Data:         r,
+	}, nil
+}
+
+func (store *AzureStore) DeleteObject(bucketName, objectKey string) error {
+	bucket, err := store.openBucket(bucketName)
+	if err != nil {
+		return err
+	}
+	defer bucket.Close()
+
+	if err := bucket.Delete(store.ctx, objectKey); err != nil {
+		return azureError(err, "failed to delete object", s3err.ErrNoSuchKey)
+	}
+	return nil
+}
+
+// CopyObject 在同一个容器内使用 Azure 的服务端复制，跨容器时读出后重新上传
+func (store *AzureStore) CopyObject(srcBucketName, srcObjectKey, destBucketName, destObjectKey string, opts ...ObjectOption) error {
+	o := newObjectOptions(opts)
+	if err := checkAzureEncryption("", o); err != nil {
+		return err
+	}
+	if o.CopySourceSSECustomerKey != nil {
+		return s3err.ErrNotImplemented.WithMessage("customer-provided encryption keys are not supported")
+	}
+
+	bucket, err := store.openBucket(srcBucketName)
+	if err != nil {
+		return err
+	}
+	defer bucket.Close()
+
+	if srcBucketName == destBucketName {
+		if err := bucket.Copy(store.ctx, destObjectKey, srcObjectKey, nil); err != nil {
+			return azureError(err, "failed to copy object", s3err.ErrNoSuchKey)
+		}
+		return nil
+	}
+
+	r, err := bucket.NewReader(store.ctx, srcObjectKey, nil)
+	if err != nil {
+		return azureError(err, "failed to obtain reader", s3err.ErrNoSuchKey)
+	}
+	defer r.Close()
+
+	destBucket, err := store.openBucket(destBucketName)
+	if err != nil {
+		return err
+	}
+	defer destBucket.Close()
+
+	return store.write(destBucket, destObjectKey, r.ContentType(), r)
+}
+
+func (store *AzureStore) MoveObject(srcBucketName, srcObjectKey, destBucketName, destObjectKey string) error {
+	if err := store.CopyObject(srcBucketName, srcObjectKey, destBucketName, destObjectKey); err != nil {
+		return err
+	}
+	return store.DeleteObject(srcBucketName, srcObjectKey)
+}
+
+func (store *AzureStore) HeadObject(bucketName, objectKey string, opts ...ObjectOption) (map[string]string, error) {
+	if err := checkAzureEncryption("", newObjectOptions(opts)); err != nil {
+		return nil, err
+	}
+
+	bucket, err := store.openBucket(bucketName)
+	if err != nil {
+		return nil, err
+	}
+	defer bucket.Close()
+
+	attrs, err := bucket.Attributes(store.ctx, objectKey)
+	if err != nil {
+		return nil, azureError(err, "failed to get object attributes", s3err.ErrNoSuchKey)
+	}
+
+	metadata := make(map[string]string)
+	for k, v := range attrs.Metadata {
+		metadata[strings.ToLower(k)] = v
+	}
+	metadata["Size"] = strconv.FormatInt(attrs.Size, 10)
+	metadata["LastModified"] = attrs.ModTime.UTC().Format(time.RFC3339)
+	metadata["ContentType"] = attrs.ContentType
+	metadata["ETag"] = azureETag(attrs.MD5, attrs.ETag)
+	return metadata, nil
+}
+
+// checkAzureEncryption 检查请求的加密方式，Azure 总是加密数据，不支持 SSE-C 和 KMS
+func checkAzureEncryption(algorithm string, o *ObjectOptions) error {
+	if o.SSECustomerKey != nil {
+		return s3err.ErrNotImplemented.WithMessage("customer-provided encryption keys are not supported")
+	}
+	if algorithm != "" && algorithm != SSEAlgorithmAES256 {
+		return s3err.ErrNotImplemented.WithMessage("only AES256 server-side encryption is supported")
+	}
+	return nil
+}
+
+// azureETag 优先使用内容的 MD5，分块上传的对象没有 MD5 时使用 Azure 的 ETag
+func azureETag(md5 []byte, etag string) string {
+	if len(md5) > 0 {
+		return formatETag(md5)
+	}
+	return `"` + strings.Trim(etag, `"`) + `"`
+}
+
+// azureError 把 Azure 的错误转换为 s3err，notFound 是资源不存在时返回的错误
+func azureError(err error, msg string, notFound *s3err.Error) error {
+	switch {
+	case bloberror.HasCode(err, bloberror.ContainerNotFound, bloberror.ContainerBeingDeleted):
+		return fmt.Errorf("%s: %w", msg, s3err.ErrNoSuchBucket)
+	case bloberror.HasCode(err, bloberror.BlobNotFound):
+		return fmt.Errorf("%s: %w", msg, s3err.ErrNoSuchKey)
+	case bloberror.HasCode(err, bloberror.ContainerAlreadyExists):
+		// 容器名在存储账户内唯一，已存在的容器一定属于当前账户
+		return s3err.ErrBucketAlreadyOwnedByYou
+	case bloberror.HasCode(err, bloberror.InvalidRange):
+		return s3err.ErrInvalidRange
+	}
+
+	var rerr *azcore.ResponseError
+	if errors.As(err, &rerr) {
+		switch rerr.StatusCode {
+		case http.StatusNotFound:
+			return fmt.Errorf("%s: %w", msg, notFound)
+		case http.StatusForbidden:
+			return s3err.ErrAccessDenied.WithMessage(rerr.ErrorCode)
+		case http.StatusConflict:
+			return s3err.ErrInvalidRequest.WithMessage(rerr.ErrorCode)
+		case http.StatusBadRequest:
+			return s3err.ErrInvalidRequest.WithMessage(rerr.ErrorCode)
+		}
+	}
+	return fmt.Errorf("%s: %v", msg, err)
+}
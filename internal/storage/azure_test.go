@@ -0,0 +1,208 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blockblob"
+	"github.com/Grey0520/s3proxy/internal/s3err"
+)
+
+// Azurite 默认的存储账户和密钥
+const (
+	azuriteAccount = "devstoreaccount1"
+	azuriteKey     = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+)
+
+// newTestAzureStore 连接 AZURITE_ENDPOINT 指定的 Azurite，例如 http://127.0.0.1:10000/devstoreaccount1
+// 没有设置时跳过测试
+func newTestAzureStore(t *testing.T) (*AzureStore, string) {
+	endpoint := os.Getenv("AZURITE_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("AZURITE_ENDPOINT is not set")
+	}
+	store, err := NewAzureStore(azuriteAccount, azuriteKey, endpoint)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	bucketName := fmt.Sprintf("s3proxy-%d", time.Now().UnixNano())
+	if err := store.CreateBucket(bucketName); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	t.Cleanup(func() {
+		store.Client.DeleteContainer(store.ctx, bucketName, nil)
+	})
+	return store, bucketName
+}
+
+func TestAzureError(t *testing.T) {
+	tests := []struct {
+		err      error
+		notFound *s3err.Error
+		want     *s3err.Error
+	}{
+		{&azcore.ResponseError{ErrorCode: "ContainerNotFound", StatusCode: http.StatusNotFound}, s3err.ErrNoSuchKey, s3err.ErrNoSuchBucket},
+		{&azcore.ResponseError{ErrorCode: "BlobNotFound", StatusCode: http.StatusNotFound}, s3err.ErrNoSuchBucket, s3err.ErrNoSuchKey},
+		{&azcore.ResponseError{StatusCode: http.StatusNotFound}, s3err.ErrNoSuchKey, s3err.ErrNoSuchKey},
+		{&azcore.ResponseError{ErrorCode: "ContainerAlreadyExists", StatusCode: http.StatusConflict}, s3err.ErrNoSuchBucket, s3err.ErrBucketAlreadyOwnedByYou},
+		{&azcore.ResponseError{ErrorCode: "AuthenticationFailed", StatusCode: http.StatusForbidden}, s3err.ErrNoSuchKey, s3err.ErrAccessDenied},
+		{&azcore.ResponseError{ErrorCode: "InvalidRange", StatusCode: http.StatusRequestedRangeNotSatisfiable}, s3err.ErrNoSuchKey, s3err.ErrInvalidRange},
+	}
+	for _, tt := range tests {
+		err := azureError(fmt.Errorf("wrapped: %w", tt.err), "failed", tt.notFound)
+		if !errors.Is(err, tt.want) {
+			t.Errorf("Expected %v for %v, got %v", tt.want, tt.err, err)
+		}
+	}
+
+	if err := azureError(errors.New("boom"), "failed", s3err.ErrNoSuchKey); errors.Is(err, s3err.ErrNoSuchKey) {
+		t.Errorf("Expected unknown errors not to map to NoSuchKey, got %v", err)
+	}
+}
+
+func TestAzureStoreBuckets(t *testing.T) {
+	store, bucketName := newTestAzureStore(t)
+
+	if err := store.CreateBucket(bucketName); !errors.Is(err, s3err.ErrBucketAlreadyOwnedByYou) {
+		t.Errorf("Expected BucketAlreadyOwnedByYou, got %v", err)
+	}
+
+	result, err := store.ListAllMyBuckets()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	found := false
+	for _, b := range result.Buckets.Bucket {
+		found = found || b.Name == bucketName
+	}
+	if !found {
+		t.Errorf("Expected %s in %+v", bucketName, result.Buckets.Bucket)
+	}
+
+	acp, err := store.GetBucketAcl(bucketName)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(acp.AccessControlList.Grant) != 1 || acp.AccessControlList.Grant[0].Permission != "FULL_CONTROL" {
+		t.Errorf("Unexpected grants %+v", acp.AccessControlList.Grant)
+	}
+
+	store.PutObject(bucketName, "key", &Object{Data: io.NopCloser(strings.NewReader("x"))})
+	if err := store.DeleteBucket(bucketName); !errors.Is(err, s3err.ErrBucketNotEmpty) {
+		t.Errorf("Expected BucketNotEmpty, got %v", err)
+	}
+	store.DeleteObject(bucketName, "key")
+	if err := store.DeleteBucket(bucketName); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, err := store.GetBucketAcl(bucketName); !errors.Is(err, s3err.ErrNoSuchBucket) {
+		t.Errorf("Expected NoSuchBucket, got %v", err)
+	}
+}
+
+func TestAzureStoreObjects(t *testing.T) {
+	store, bucketName := newTestAzureStore(t)
+
+	err := store.PutObject(bucketName, "dir/key.txt", &Object{
+		ContentType: "text/plain",
+		Data:        io.NopCloser(strings.NewReader("hello from azure")),
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	obj, err := store.GetObject(bucketName, "dir/key.txt")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	data, _ := io.ReadAll(obj.Data)
+	obj.Data.Close()
+	if string(data) != "hello from azure" || obj.ContentType != "text/plain" {
+		t.Errorf("Unexpected object %q with content type %s", data, obj.ContentType)
+	}
+
+	head, err := store.HeadObject(bucketName, "dir/key.txt")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if head["Size"] != "16" || head["ETag"] != obj.ETag {
+		t.Errorf("Unexpected head result %v", head)
+	}
+
+	other := bucketName + "-dst"
+	if err := store.CreateBucket(other); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	defer store.Client.DeleteContainer(store.ctx, other, nil)
+
+	if err := store.CopyObject(bucketName, "dir/key.txt", bucketName, "copy.txt"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := store.MoveObject(bucketName, "dir/key.txt", other, "moved.txt"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	result, err := store.ListBucket(bucketName)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(result.Contents) != 1 || result.Contents[0].Key != "copy.txt" {
+		t.Errorf("Unexpected listing %+v", result.Contents)
+	}
+	if _, err := store.HeadObject(other, "moved.txt"); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+	if _, err := store.GetObject(bucketName, "dir/key.txt"); !errors.Is(err, s3err.ErrNoSuchKey) {
+		t.Errorf("Expected NoSuchKey, got %v", err)
+	}
+
+	key := newTestCustomerKey(t, 1)
+	err = store.PutObject(bucketName, "ssec", &Object{Data: io.NopCloser(strings.NewReader("x"))}, WithSSECustomerKey(key))
+	if !errors.Is(err, s3err.ErrNotImplemented) {
+		t.Errorf("Expected NotImplemented, got %v", err)
+	}
+}
+
+func TestAzureStoreBlockUpload(t *testing.T) {
+	store, bucketName := newTestAzureStore(t)
+	store.BlockSize = 64 * 1024
+
+	content := make([]byte, 4*store.BlockSize+100)
+	rand.Read(content)
+	err := store.PutObject(bucketName, "large.bin", &Object{Data: io.NopCloser(bytes.NewReader(content))})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	client := store.Client.NewContainerClient(bucketName).NewBlockBlobClient("large.bin")
+	blocks, err := client.GetBlockList(store.ctx, blockblob.BlockListTypeCommitted, nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(blocks.CommittedBlocks) != 5 {
+		t.Errorf("Expected 5 committed blocks, got %d", len(blocks.CommittedBlocks))
+	}
+
+	obj, err := store.GetObject(bucketName, "large.bin")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	defer obj.Data.Close()
+	obj.Data.(io.Seeker).Seek(int64(store.BlockSize)-10, io.SeekStart)
+	part := make([]byte, 20)
+	if _, err := io.ReadFull(obj.Data, part); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !bytes.Equal(part, content[store.BlockSize-10:store.BlockSize+10]) {
+		t.Errorf("Unexpected content across block boundary")
+	}
+}
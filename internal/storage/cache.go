@@ -0,0 +1,501 @@
+package storage
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CacheStore 在任意后端前面加一层磁盘读缓存
+//
+// 缓存按存储桶、键和 ETag 保存对象，命中前用 HeadObject 确认后端的 ETag 没有变化，
+// 通过代理写入、删除的对象会立即失效。缓存总大小超过 maxSize 时淘汰最久没有读取的对象
+type CacheStore struct {
+	StorageProvider
+	dir     string
+	maxSize int64
+	// 距上次确认不到 revalidate 时直接使用缓存，不访问后端
+	revalidate time.Duration
+
+	mu      sync.Mutex
+	size    int64
+	lru     *list.List
+	entries map[string]*list.Element
+	stats   CacheStats
+	// 正在从后端下载的对象，期间有写入时下载的可能是旧版本，不放进缓存
+	fills map[string]*cacheFill
+}
+
+// cacheFill 记录同一个对象正在进行的下载，gen 在每次写入时增加
+type cacheFill struct {
+	refs int
+	gen  uint64
+}
+
+// CacheStats 是缓存的统计信息
+type CacheStats struct {
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Evictions int64 `json:"evictions"`
+	// 从缓存读出的字节数，即节省的下载量
+	HitBytes int64 `json:"hitBytes"`
+	Size     int64 `json:"size"`
+	Objects  int   `json:"objects"`
+}
+
+// cacheEntry 同时保存在数据文件旁边的 .json 中，重启后用来恢复索引
+type cacheEntry struct {
+	Bucket      string    `json:"bucket"`
+	Key         string    `json:"key"`
+	ETag        string    `json:"etag"`
+	Size        int64     `json:"size"`
+	ContentType string    `json:"contentType"`
+	Modified    time.Time `json:"lastModified"`
+	SSE         string    `json:"sse,omitempty"`
+	validated   time.Time
+}
+
+func (e *cacheEntry) name() string {
+	sum := sha256.Sum256([]byte(e.Bucket + "\x00" + e.Key + "\x00" + e.ETag))
+	return hex.EncodeToString(sum[:])
+}
+
+func cacheKey(bucketName, objectKey string) string {
+	return bucketName + "\x00" + objectKey
+}
+
+// NewCacheStore 在 backend 前加一层缓存，缓存文件保存在 dir，maxSize 为 0 时不限制大小
+func NewCacheStore(backend StorageProvider, dir string, maxSize int64, revalidate time.Duration) (*CacheStore, error) {
+	if maxSize < 0 {
+		return nil, fmt.Errorf("invalid cache size %d", maxSize)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create cache directory: %v", err)
+	}
+	c := &CacheStore{
+		StorageProvider: backend,
+		dir:             dir,
+		maxSize:         maxSize,
+		revalidate:      revalidate,
+		lru:             list.New(),
+		entries:         make(map[string]*list.Element),
+		fills:           make(map[string]*cacheFill),
+	}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// load 从磁盘恢复索引，按文件修改时间恢复淘汰顺序
+func (c *CacheStore) load() error {
+	// 上次退出时没有写完的文件
+	tmps, _ := filepath.Glob(filepath.Join(c.dir, "tmp-*"))
+	for _, tmp := range tmps {
+		os.Remove(tmp)
+	}
+
+	files, err := filepath.Glob(filepath.Join(c.dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	type loaded struct {
+		entry *cacheEntry
+		used  time.Time
+	}
+	var all []loaded
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		entry := &cacheEntry{}
+		if err == nil {
+			err = json.Unmarshal(data, entry)
+		}
+		info, statErr := os.Stat(c.path(entry))
+		if err != nil || statErr != nil || info.Size() != entry.Size {
+			// 不完整的缓存直接丢弃
+			os.Remove(file)
+			os.Remove(c.path(entry))
+			continue
+		}
+		all = append(all, loaded{entry, info.ModTime()})
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].used.Before(all[j].used) })
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, l := range all {
+		c.insert(l.entry)
+	}
+	c.evict()
+	return nil
+}
+
+func (c *CacheStore) path(e *cacheEntry) string {
+	return filepath.Join(c.dir, e.name())
+}
+
+// Stats 返回缓存的统计信息
+func (c *CacheStore) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.stats
+	stats.Size = c.size
+	stats.Objects = c.lru.Len()
+	return stats
+}
+
+func (c *CacheStore) GetObject(bucketName, objectKey string, opts ...ObjectOption) (*Object, error) {
+	// 用客户提供的密钥加密的对象不缓存
+	if newObjectOptions(opts).SSECustomerKey != nil {
+		return c.StorageProvider.GetObject(bucketName, objectKey, opts...)
+	}
+
+	entry, err := c.lookup(bucketName, objectKey)
+	if err != nil {
+		return nil, err
+	}
+	if entry != nil {
+		if obj := c.open(entry); obj != nil {
+			return obj, nil
+		}
+	}
+
+	c.mu.Lock()
+	c.stats.Misses++
+	c.mu.Unlock()
+	return c.fill(bucketName, objectKey)
+}
+
+// lookup 返回仍然有效的缓存，必要时用 HeadObject 向后端确认
+func (c *CacheStore) lookup(bucketName, objectKey string) (*cacheEntry, error) {
+	c.mu.Lock()
+	elem, ok := c.entries[cacheKey(bucketName, objectKey)]
+	var entry cacheEntry
+	if ok {
+		entry = *elem.Value.(*cacheEntry)
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil, nil
+	}
+	if c.revalidate > 0 && time.Since(entry.validated) < c.revalidate {
+		return &entry, nil
+	}
+
+	head, err := c.StorageProvider.HeadObject(bucketName, objectKey)
+	if err != nil {
+		c.invalidate(bucketName, objectKey)
+		return nil, err
+	}
+	if head["ETag"] != entry.ETag {
+		c.invalidate(bucketName, objectKey)
+		return nil, nil
+	}
+
+	c.mu.Lock()
+	if elem, ok := c.entries[cacheKey(bucketName, objectKey)]; ok && elem.Value.(*cacheEntry).ETag == entry.ETag {
+		elem.Value.(*cacheEntry).validated = time.Now()
+	}
+	c.mu.Unlock()
+	return &entry, nil
+}
+
+// open 打开缓存文件，文件已被淘汰时返回 nil
+func (c *CacheStore) open(entry *cacheEntry) *Object {
+	f, err := os.Open(c.path(entry))
+	if err != nil {
+		c.invalidate(entry.Bucket, entry.Key)
+		return nil
+	}
+	now := time.Now()
+	os.Chtimes(f.Name(), now, now)
+
+	c.mu.Lock()
+	if elem, ok := c.entries[cacheKey(entry.Bucket, entry.Key)]; ok {
+		c.lru.MoveToFront(elem)
+	}
+	c.stats.Hits++
+	c.stats.HitBytes += entry.Size
+	c.mu.Unlock()
+
+	return &Object{
+		Key:                  entry.Key,
+		Size:                 entry.Size,
+		LastModified:         entry.Modified,
+		ContentType:          entry.ContentType,
+		ETag:                 entry.ETag,
+		ServerSideEncryption: entry.SSE,
+		Data:                 f,
+	}
+}
+
+// fill 从后端下载整个对象写入缓存，再从缓存文件返回，这样未命中时也支持范围读取
+// 放不进缓存的对象直接返回后端的数据流
+func (c *CacheStore) fill(bucketName, objectKey string) (*Object, error) {
+	gen := c.beginFill(cacheKey(bucketName, objectKey))
+	defer c.endFill(cacheKey(bucketName, objectKey))
+	obj, err := c.StorageProvider.GetObject(bucketName, objectKey)
+	if err != nil {
+		return nil, err
+	}
+	if obj.ETag == "" || (c.maxSize > 0 && obj.Size > c.maxSize) {
+		return obj, nil
+	}
+	defer obj.Data.Close()
+
+	entry := &cacheEntry{
+		Bucket:      bucketName,
+		Key:         objectKey,
+		ETag:        obj.ETag,
+		Size:        obj.Size,
+		ContentType: obj.ContentType,
+		Modified:    obj.LastModified,
+		SSE:         obj.ServerSideEncryption,
+		validated:   time.Now(),
+	}
+	tmp, err := os.CreateTemp(c.dir, "tmp-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cache file: %v", err)
+	}
+	n, err := io.Copy(tmp, obj.Data)
+	if err == nil && obj.Size > 0 && n != obj.Size {
+		err = fmt.Errorf("expected %d bytes, got %d", obj.Size, n)
+	}
+	entry.Size = n
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, fmt.Errorf("failed to read object %s: %v", objectKey, err)
+	}
+
+	meta, _ := json.Marshal(entry)
+	if err := os.WriteFile(c.path(entry)+".json", meta, 0644); err != nil {
+		os.Remove(tmp.Name())
+		return nil, fmt.Errorf("failed to write cache metadata: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), c.path(entry)); err != nil {
+		os.Remove(tmp.Name())
+		return nil, fmt.Errorf("failed to write cache file: %v", err)
+	}
+	f, err := os.Open(c.path(entry))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open cache file: %v", err)
+	}
+
+	c.mu.Lock()
+	elem, ok := c.entries[cacheKey(bucketName, objectKey)]
+	switch {
+	case c.fills[cacheKey(bucketName, objectKey)].gen != gen:
+		// 下载期间对象被修改，读到的版本可能已经过时，只返回给这次请求
+		if !ok || elem.Value.(*cacheEntry).ETag != entry.ETag {
+			os.Remove(c.path(entry))
+			os.Remove(c.path(entry) + ".json")
+		}
+	case ok && elem.Value.(*cacheEntry).ETag == entry.ETag:
+		// 并发的未命中已经写入了同一个文件，只替换索引
+		c.lru.Remove(elem)
+		c.size -= elem.Value.(*cacheEntry).Size
+		c.insert(entry)
+		c.evict()
+	default:
+		c.remove(cacheKey(bucketName, objectKey))
+		c.insert(entry)
+		c.evict()
+	}
+	c.mu.Unlock()
+
+	return &Object{
+		Key:                  objectKey,
+		Size:                 entry.Size,
+		LastModified:         entry.Modified,
+		ContentType:          entry.ContentType,
+		ETag:                 entry.ETag,
+		ServerSideEncryption: entry.SSE,
+		Data:                 f,
+	}, nil
+}
+
+// insert 把 entry 加入索引，调用者需持有锁
+func (c *CacheStore) insert(entry *cacheEntry) {
+	c.entries[cacheKey(entry.Bucket, entry.Key)] = c.lru.PushFront(entry)
+	c.size += entry.Size
+}
+
+// remove 从索引和磁盘删除缓存，调用者需持有锁
+// 已经打开的缓存文件仍然可以读完
+func (c *CacheStore) remove(key string) {
+	elem, ok := c.entries[key]
+	if !ok {
+		return
+	}
+	entry := elem.Value.(*cacheEntry)
+	c.lru.Remove(elem)
+	delete(c.entries, key)
+	c.size -= entry.Size
+	os.Remove(c.path(entry))
+	os.Remove(c.path(entry) + ".json")
+}
+
+// evict 淘汰最久没有读取的对象直到总大小不超过上限，调用者需持有锁
+func (c *CacheStore) evict() {
+	for c.maxSize > 0 && c.size > c.maxSize {
+		entry := c.lru.Back().Value.(*cacheEntry)
+		c.remove(cacheKey(entry.Bucket, entry.Key))
+		c.stats.Evictions++
+	}
+}
+
+// beginFill 登记一次下载，返回对象当前的写入代数
+func (c *CacheStore) beginFill(key string) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f, ok := c.fills[key]
+	if !ok {
+		f = &cacheFill{}
+		c.fills[key] = f
+	}
+	f.refs++
+	return f.gen
+}
+
+func (c *CacheStore) endFill(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f := c.fills[key]
+	if f.refs--; f.refs == 0 {
+		delete(c.fills, key)
+	}
+}
+
+// invalidate 删除缓存，并让正在进行的下载不再写入缓存
+// 写入前后各调用一次：写入期间开始的下载可能读到旧版本，在写入完成之后才放进缓存
+func (c *CacheStore) invalidate(bucketName, objectKey string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.remove(cacheKey(bucketName, objectKey))
+	if f, ok := c.fills[cacheKey(bucketName, objectKey)]; ok {
+		f.gen++
+	}
+}
+
+func (c *CacheStore) invalidateBucket(bucketName string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, elem := range c.entries {
+		if entry := elem.Value.(*cacheEntry); entry.Bucket == bucketName {
+			c.remove(cacheKey(entry.Bucket, entry.Key))
+		}
+	}
+	for key, f := range c.fills {
+		if strings.HasPrefix(key, bucketName+"\x00") {
+			f.gen++
+		}
+	}
+}
+
+func (c *CacheStore) DeleteBucket(bucketName string) error {
+	c.invalidateBucket(bucketName)
+	defer c.invalidateBucket(bucketName)
+	return c.StorageProvider.DeleteBucket(bucketName)
+}
+
+func (c *CacheStore) PutObject(bucketName, objectKey string, data *Object, opts ...ObjectOption) error {
+	c.invalidate(bucketName, objectKey)
+	defer c.invalidate(bucketName, objectKey)
+	return c.StorageProvider.PutObject(bucketName, objectKey, data, opts...)
+}
+
+func (c *CacheStore) DeleteObject(bucketName, objectKey string) error {
+	c.invalidate(bucketName, objectKey)
+	defer c.invalidate(bucketName, objectKey)
+	return c.StorageProvider.DeleteObject(bucketName, objectKey)
+}
+
+func (c *CacheStore) CopyObject(srcBucketName, srcObjectKey, destBucketName, destObjectKey string, opts ...ObjectOption) error {
+	c.invalidate(destBucketName, destObjectKey)
+	defer c.invalidate(destBucketName, destObjectKey)
+	return c.StorageProvider.CopyObject(srcBucketName, srcObjectKey, destBucketName, destObjectKey, opts...)
+}
+
+func (c *CacheStore) MoveObject(srcBucketName, srcObjectKey, destBucketName, destObjectKey string) error {
+	c.invalidate(srcBucketName, srcObjectKey)
+	c.invalidate(destBucketName, destObjectKey)
+	defer c.invalidate(srcBucketName, srcObjectKey)
+	defer c.invalidate(destBucketName, destObjectKey)
+	return c.StorageProvider.MoveObject(srcBucketName, srcObjectKey, destBucketName, destObjectKey)
+}
+
+// HeadObject 在确认有效期内直接使用缓存的元数据
+func (c *CacheStore) HeadObject(bucketName, objectKey string, opts ...ObjectOption) (map[string]string, error) {
+	if c.revalidate > 0 && newObjectOptions(opts).SSECustomerKey == nil {
+		c.mu.Lock()
+		elem, ok := c.entries[cacheKey(bucketName, objectKey)]
+		var entry cacheEntry
+		if ok {
+			entry = *elem.Value.(*cacheEntry)
+		}
+		c.mu.Unlock()
+		if ok && time.Since(entry.validated) < c.revalidate {
+			head := map[string]string{
+				"Size":         strconv.FormatInt(entry.Size, 10),
+				"LastModified": entry.Modified.UTC().Format(time.RFC3339),
+				"ContentType":  entry.ContentType,
+				"ETag":         entry.ETag,
+			}
+			if entry.SSE != "" {
+				head["ServerSideEncryption"] = entry.SSE
+			}
+			return head, nil
+		}
+	}
+	return c.StorageProvider.HeadObject(bucketName, objectKey, opts...)
+}
+
+func (c *CacheStore) PutBucketEncryption(bucketName string, cfg *ServerSideEncryptionConfiguration) error {
+	configurer, err := encryptionConfigurer(c.StorageProvider)
+	if err != nil {
+		return err
+	}
+	return configurer.PutBucketEncryption(bucketName, cfg)
+}
+
+func (c *CacheStore) GetBucketEncryption(bucketName string) (*ServerSideEncryptionConfiguration, error) {
+	configurer, err := encryptionConfigurer(c.StorageProvider)
+	if err != nil {
+		return nil, err
+	}
+	return configurer.GetBucketEncryption(bucketName)
+}
+
+func (c *CacheStore) DeleteBucketEncryption(bucketName string) error {
+	configurer, err := encryptionConfigurer(c.StorageProvider)
+	if err != nil {
+		return err
+	}
+	return configurer.DeleteBucketEncryption(bucketName)
+}
+
+// CacheStatistics 返回 p 及其下层后端中所有缓存的统计信息，键为后端名称
+func CacheStatistics(p StorageProvider) map[string]CacheStats {
+	stats := make(map[string]CacheStats)
+	WalkProviders(p, func(name string, p StorageProvider) {
+		if c, ok := p.(*CacheStore); ok {
+			stats[name] = c.Stats()
+		}
+	})
+	return stats
+}
@@ -0,0 +1,217 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Grey0520/s3proxy/internal/s3err"
+)
+
+// countingStore 记录读取后端的次数
+type countingStore struct {
+	*MemoryStore
+	gets, heads atomic.Int64
+	// 读取后端之后、返回之前调用，用于构造并发的写入
+	afterGet func()
+}
+
+func (s *countingStore) GetObject(bucketName, objectKey string, opts ...ObjectOption) (*Object, error) {
+	s.gets.Add(1)
+	obj, err := s.MemoryStore.GetObject(bucketName, objectKey, opts...)
+	if s.afterGet != nil {
+		s.afterGet()
+	}
+	return obj, err
+}
+
+func (s *countingStore) HeadObject(bucketName, objectKey string, opts ...ObjectOption) (map[string]string, error) {
+	s.heads.Add(1)
+	return s.MemoryStore.HeadObject(bucketName, objectKey, opts...)
+}
+
+func newTestCacheStore(t *testing.T, maxSize int64, revalidate time.Duration) (*CacheStore, *countingStore) {
+	backend := &countingStore{MemoryStore: newTestMemoryStore(t, 0)}
+	c, err := NewCacheStore(backend, t.TempDir(), maxSize, revalidate)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	return c, backend
+}
+
+func TestCacheStoreHitMiss(t *testing.T) {
+	c, backend := newTestCacheStore(t, 0, 0)
+	putString(t, c, "bucket", "data.bin", "0123456789")
+
+	if got := readString(t, c, "bucket", "data.bin"); got != "0123456789" {
+		t.Fatalf("Unexpected content %q", got)
+	}
+	obj, err := c.GetObject("bucket", "data.bin")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	obj.Data.(io.Seeker).Seek(5, io.SeekStart)
+	data, _ := io.ReadAll(obj.Data)
+	obj.Data.Close()
+	if string(data) != "56789" || obj.ContentType != "text/plain" || obj.Size != 10 {
+		t.Errorf("Unexpected object %q %+v", data, obj)
+	}
+	if backend.gets.Load() != 1 || backend.heads.Load() != 1 {
+		t.Errorf("Expected 1 download and 1 revalidation, got %d and %d", backend.gets.Load(), backend.heads.Load())
+	}
+
+	// 绕过代理修改的对象在确认 ETag 时发现
+	putString(t, backend, "bucket", "data.bin", "changed")
+	if got := readString(t, c, "bucket", "data.bin"); got != "changed" {
+		t.Errorf("Expected changed content, got %q", got)
+	}
+	// 通过代理删除的对象立即失效
+	c.DeleteObject("bucket", "data.bin")
+	if _, err := c.GetObject("bucket", "data.bin"); !errors.Is(err, s3err.ErrNoSuchKey) {
+		t.Errorf("Expected NoSuchKey, got %v", err)
+	}
+
+	stats := c.Stats()
+	if stats.Hits != 1 || stats.Misses != 3 || stats.HitBytes != 10 || stats.Objects != 0 || stats.Size != 0 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+	if s := CacheStatistics(c); s[DefaultBackend] != stats {
+		t.Errorf("Unexpected statistics %v", s)
+	}
+}
+
+func TestCacheStoreInvalidate(t *testing.T) {
+	c, _ := newTestCacheStore(t, 0, time.Hour)
+	putString(t, c, "bucket", "key", "old")
+	readString(t, c, "bucket", "key")
+
+	putString(t, c, "bucket", "key", "new")
+	if got := readString(t, c, "bucket", "key"); got != "new" {
+		t.Errorf("Expected PUT to invalidate cache, got %q", got)
+	}
+	c.CreateBucket("other")
+	c.MoveObject("bucket", "key", "other", "key")
+	if _, err := c.GetObject("bucket", "key"); !errors.Is(err, s3err.ErrNoSuchKey) {
+		t.Errorf("Expected NoSuchKey after move, got %v", err)
+	}
+	if c.Stats().Objects != 0 {
+		t.Errorf("Expected empty cache, got %+v", c.Stats())
+	}
+}
+
+func TestCacheStoreRevalidate(t *testing.T) {
+	c, backend := newTestCacheStore(t, 0, time.Hour)
+	putString(t, c, "bucket", "key", "x")
+
+	for i := 0; i < 3; i++ {
+		readString(t, c, "bucket", "key")
+	}
+	if _, err := c.HeadObject("bucket", "key"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if backend.gets.Load() != 1 || backend.heads.Load() != 0 {
+		t.Errorf("Expected 1 download and no revalidation, got %d and %d", backend.gets.Load(), backend.heads.Load())
+	}
+}
+
+func TestCacheStoreEviction(t *testing.T) {
+	c, backend := newTestCacheStore(t, 10, 0)
+	putString(t, c, "bucket", "a", "aaaa")
+	putString(t, c, "bucket", "b", "bbbb")
+	putString(t, c, "bucket", "c", "cccc")
+	putString(t, c, "bucket", "big", "0123456789abc")
+
+	readString(t, c, "bucket", "a")
+	readString(t, c, "bucket", "b")
+	readString(t, c, "bucket", "a")
+	readString(t, c, "bucket", "c")
+	stats := c.Stats()
+	if stats.Evictions != 1 || stats.Size != 8 || stats.Objects != 2 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+
+	// b 最久没有读取，已被淘汰
+	gets := backend.gets.Load()
+	readString(t, c, "bucket", "a")
+	if backend.gets.Load() != gets {
+		t.Errorf("Expected a to be cached")
+	}
+	readString(t, c, "bucket", "b")
+	if backend.gets.Load() != gets+1 {
+		t.Errorf("Expected b to be evicted")
+	}
+
+	// 超过上限的对象不缓存
+	if got := readString(t, c, "bucket", "big"); got != "0123456789abc" {
+		t.Errorf("Unexpected content %q", got)
+	}
+	if c.Stats().Size > 10 {
+		t.Errorf("Expected cache size within limit, got %+v", c.Stats())
+	}
+}
+
+func TestCacheStorePersistence(t *testing.T) {
+	backend := &countingStore{MemoryStore: newTestMemoryStore(t, 0)}
+	dir := t.TempDir()
+	c, _ := NewCacheStore(backend, dir, 0, 0)
+	putString(t, c, "bucket", "key", "persisted")
+	readString(t, c, "bucket", "key")
+	os.WriteFile(filepath.Join(dir, "tmp-123"), []byte("partial"), 0644)
+
+	c, err := NewCacheStore(backend, dir, 0, 0)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if got := readString(t, c, "bucket", "key"); got != "persisted" {
+		t.Errorf("Unexpected content %q", got)
+	}
+	if backend.gets.Load() != 1 || c.Stats().Hits != 1 {
+		t.Errorf("Expected cache to survive restart, got %d downloads, stats %+v", backend.gets.Load(), c.Stats())
+	}
+	if _, err := os.Stat(filepath.Join(dir, "tmp-123")); !os.IsNotExist(err) {
+		t.Errorf("Expected partial file to be removed, got %v", err)
+	}
+}
+
+func TestCacheStoreFillDuringPut(t *testing.T) {
+	c, backend := newTestCacheStore(t, 0, time.Hour)
+	putString(t, c, "bucket", "key", "old")
+
+	var once sync.Once
+	downloading, release := make(chan struct{}), make(chan struct{})
+	backend.afterGet = func() {
+		once.Do(func() {
+			close(downloading)
+			<-release
+		})
+	}
+	done := make(chan string)
+	go func() {
+		obj, err := c.GetObject("bucket", "key")
+		if err != nil {
+			done <- err.Error()
+			return
+		}
+		defer obj.Data.Close()
+		data, _ := io.ReadAll(obj.Data)
+		done <- string(data)
+	}()
+
+	// 下载已经读到旧版本时写入新版本
+	<-downloading
+	if err := putString(t, c, "bucket", "key", "new"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	close(release)
+	if got := <-done; got != "old" {
+		t.Errorf("Expected the concurrent read to see the old version, got %q", got)
+	}
+	if got := readString(t, c, "bucket", "key"); got != "new" {
+		t.Errorf("Expected the old version not to be cached, got %q", got)
+	}
+}
@@ -0,0 +1,329 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// 压缩后的对象由一组独立压缩的帧组成，每帧对应 compressFrameSize 字节的原始数据，
+// 末尾是帧索引和 footer。范围读取时根据索引只解压覆盖到的帧。
+//
+//	frame 0 | frame 1 | ... | index (每帧 8 字节) | footer (32 字节)
+//
+// 索引中每一项是帧的存储长度和原始长度（各 4 字节），存储长度等于原始长度时该帧未压缩。
+// footer 依次是原始大小（8 字节）、原始数据的 MD5（16 字节）、帧数（4 字节）和 compressMagic。
+const (
+	CompressionZstd = "zstd"
+	CompressionGzip = "gzip"
+
+	compressFrameSize  = 1024 * 1024
+	compressIndexEntry = 8
+	compressFooterSize = 32
+	compressMagic      = "S3PZ"
+)
+
+var errCompressCorrupted = errors.New("compressed object is corrupted")
+
+// frameCodec 压缩和解压单个帧
+type frameCodec interface {
+	encode(dst, src []byte) ([]byte, error)
+	decode(dst, src []byte) ([]byte, error)
+}
+
+func newFrameCodec(algorithm string) (frameCodec, error) {
+	switch algorithm {
+	case CompressionZstd:
+		return zstdCodec{}, nil
+	case CompressionGzip:
+		return gzipCodec{}, nil
+	default:
+		return nil, fmt.Errorf("unsupported compression algorithm %q", algorithm)
+	}
+}
+
+// zstd 的编码器和解码器可以并发使用，全局共享一份
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+type zstdCodec struct{}
+
+func (zstdCodec) encode(dst, src []byte) ([]byte, error) {
+	return zstdEncoder.EncodeAll(src, dst), nil
+}
+
+func (zstdCodec) decode(dst, src []byte) ([]byte, error) {
+	return zstdDecoder.DecodeAll(src, dst)
+}
+
+type gzipCodec struct{}
+
+func (gzipCodec) encode(dst, src []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+	zw := gzip.NewWriter(buf)
+	if _, err := zw.Write(src); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCodec) decode(dst, src []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	buf := bytes.NewBuffer(dst)
+	if _, err := io.Copy(buf, zr); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+type frameInfo struct {
+	stored uint32
+	raw    uint32
+}
+
+// compressWriter 把写入的数据按帧压缩后写到下层 writer
+// Close 写出最后一帧和索引，但不会关闭下层 writer
+type compressWriter struct {
+	w      io.Writer
+	codec  frameCodec
+	buf    []byte
+	n      int
+	out    []byte
+	frames []frameInfo
+	size   int64
+	md5    hash.Hash
+}
+
+func newCompressWriter(w io.Writer, algorithm string) (*compressWriter, error) {
+	codec, err := newFrameCodec(algorithm)
+	if err != nil {
+		return nil, err
+	}
+	return &compressWriter{
+		w:     w,
+		codec: codec,
+		buf:   make([]byte, compressFrameSize),
+		md5:   md5.New(),
+	}, nil
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := copy(cw.buf[cw.n:], p)
+		cw.n += n
+		written += n
+		p = p[n:]
+		if cw.n == compressFrameSize {
+			if err := cw.flush(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (cw *compressWriter) flush() error {
+	raw := cw.buf[:cw.n]
+	out, err := cw.codec.encode(cw.out[:0], raw)
+	if err != nil {
+		return err
+	}
+	cw.out = out
+	// 压缩没有收益时直接保存原始数据
+	if len(out) >= len(raw) {
+		out = raw
+	}
+	if _, err := cw.w.Write(out); err != nil {
+		return err
+	}
+	cw.md5.Write(raw)
+	cw.frames = append(cw.frames, frameInfo{stored: uint32(len(out)), raw: uint32(len(raw))})
+	cw.size += int64(len(raw))
+	cw.n = 0
+	return nil
+}
+
+func (cw *compressWriter) Close() error {
+	if cw.n > 0 {
+		if err := cw.flush(); err != nil {
+			return err
+		}
+	}
+
+	trailer := make([]byte, 0, len(cw.frames)*compressIndexEntry+compressFooterSize)
+	for _, f := range cw.frames {
+		trailer = binary.BigEndian.AppendUint32(trailer, f.stored)
+		trailer = binary.BigEndian.AppendUint32(trailer, f.raw)
+	}
+	trailer = binary.BigEndian.AppendUint64(trailer, uint64(cw.size))
+	trailer = cw.md5.Sum(trailer)
+	trailer = binary.BigEndian.AppendUint32(trailer, uint32(len(cw.frames)))
+	trailer = append(trailer, compressMagic...)
+	_, err := cw.w.Write(trailer)
+	return err
+}
+
+// decompressReader 读取 compressWriter 写出的数据，支持 Seek，读取时只解压用到的帧
+type decompressReader struct {
+	src    io.ReadSeekCloser
+	codec  frameCodec
+	size   int64
+	md5    []byte
+	frames []frameInfo
+	// 每一帧在存储数据和原始数据中的起始位置
+	storedOffsets []int64
+	rawOffsets    []int64
+
+	offset int64
+	frame  []byte
+	stored []byte
+	loaded int
+}
+
+// newDecompressReader 读取索引，srcSize 为下层数据的总长度
+func newDecompressReader(src io.ReadSeekCloser, srcSize int64, algorithm string) (*decompressReader, error) {
+	codec, err := newFrameCodec(algorithm)
+	if err != nil {
+		return nil, err
+	}
+	if srcSize < compressFooterSize {
+		return nil, errCompressCorrupted
+	}
+
+	footer := make([]byte, compressFooterSize)
+	if _, err := src.Seek(srcSize-compressFooterSize, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(src, footer); err != nil {
+		return nil, errCompressCorrupted
+	}
+	if string(footer[28:]) != compressMagic {
+		return nil, errCompressCorrupted
+	}
+	r := &decompressReader{
+		src:    src,
+		codec:  codec,
+		size:   int64(binary.BigEndian.Uint64(footer[0:8])),
+		md5:    append([]byte(nil), footer[8:24]...),
+		loaded: -1,
+	}
+
+	count := int64(binary.BigEndian.Uint32(footer[24:28]))
+	indexStart := srcSize - compressFooterSize - count*compressIndexEntry
+	if indexStart < 0 {
+		return nil, errCompressCorrupted
+	}
+	index := make([]byte, count*compressIndexEntry)
+	if _, err := src.Seek(indexStart, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(src, index); err != nil {
+		return nil, errCompressCorrupted
+	}
+
+	var stored, raw int64
+	for i := int64(0); i < count; i++ {
+		f := frameInfo{
+			stored: binary.BigEndian.Uint32(index[i*compressIndexEntry:]),
+			raw:    binary.BigEndian.Uint32(index[i*compressIndexEntry+4:]),
+		}
+		r.frames = append(r.frames, f)
+		r.storedOffsets = append(r.storedOffsets, stored)
+		r.rawOffsets = append(r.rawOffsets, raw)
+		stored += int64(f.stored)
+		raw += int64(f.raw)
+	}
+	if stored != indexStart || raw != r.size {
+		return nil, errCompressCorrupted
+	}
+	return r, nil
+}
+
+// Size 返回原始数据的长度
+func (r *decompressReader) Size() int64 {
+	return r.size
+}
+
+// MD5 返回原始数据的 MD5
+func (r *decompressReader) MD5() []byte {
+	return r.md5
+}
+
+func (r *decompressReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	// 帧除了最后一个都是等长的，可以直接算出所在的帧
+	index := int(r.offset / compressFrameSize)
+	if index != r.loaded {
+		if err := r.load(index); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.frame[r.offset-r.rawOffsets[index]:])
+	r.offset += int64(n)
+	return n, nil
+}
+
+func (r *decompressReader) load(index int) error {
+	f := r.frames[index]
+	if _, err := r.src.Seek(r.storedOffsets[index], io.SeekStart); err != nil {
+		return err
+	}
+	if cap(r.stored) < int(f.stored) {
+		r.stored = make([]byte, f.stored)
+	}
+	stored := r.stored[:f.stored]
+	if _, err := io.ReadFull(r.src, stored); err != nil {
+		return errCompressCorrupted
+	}
+
+	if f.stored == f.raw {
+		r.frame = append(r.frame[:0], stored...)
+	} else {
+		frame, err := r.codec.decode(r.frame[:0], stored)
+		if err != nil || len(frame) != int(f.raw) {
+			return errCompressCorrupted
+		}
+		r.frame = frame
+	}
+	r.loaded = index
+	return nil
+}
+
+func (r *decompressReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative position %d", offset)
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+func (r *decompressReader) Close() error {
+	return r.src.Close()
+}
@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"io"
+	"testing"
+)
+
+func compressForTest(t *testing.T, algorithm string, plain []byte) []byte {
+	var buf bytes.Buffer
+	cw, err := newCompressWriter(&buf, algorithm)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, err := cw.Write(plain); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := cw.Close(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	return buf.Bytes()
+}
+
+// testData 前半部分可压缩，后半部分是随机数据
+func testData(size int) []byte {
+	data := bytes.Repeat([]byte("2024-01-01 INFO request handled\n"), size/64+1)[:size/2]
+	random := make([]byte, size-len(data))
+	rand.Read(random)
+	return append(data, random...)
+}
+
+func TestCompressRoundTrip(t *testing.T) {
+	for _, algorithm := range []string{CompressionZstd, CompressionGzip} {
+		for _, size := range []int{0, 1, compressFrameSize, compressFrameSize + 1, 3*compressFrameSize + 100} {
+			plain := testData(size)
+			stored := compressForTest(t, algorithm, plain)
+
+			cr, err := newDecompressReader(nopSeekCloser{bytes.NewReader(stored)}, int64(len(stored)), algorithm)
+			if err != nil {
+				t.Fatalf("%s/%d: expected no error, got %v", algorithm, size, err)
+			}
+			sum := md5.Sum(plain)
+			if cr.Size() != int64(size) || !bytes.Equal(cr.MD5(), sum[:]) {
+				t.Errorf("%s/%d: unexpected size %d or MD5", algorithm, size, cr.Size())
+			}
+			out, err := io.ReadAll(cr)
+			if err != nil || !bytes.Equal(out, plain) {
+				t.Fatalf("%s/%d: decompressed data does not match (%v)", algorithm, size, err)
+			}
+		}
+	}
+}
+
+func TestCompressSeek(t *testing.T) {
+	plain := testData(4*compressFrameSize + 10)
+	stored := compressForTest(t, CompressionZstd, plain)
+	if len(stored) >= len(plain) {
+		t.Errorf("Expected compressed size %d to be smaller than %d", len(stored), len(plain))
+	}
+
+	cr, err := newDecompressReader(nopSeekCloser{bytes.NewReader(stored)}, int64(len(stored)), CompressionZstd)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	for _, r := range [][2]int64{{3*compressFrameSize + 5, 5}, {10, 100}, {compressFrameSize - 3, 6}} {
+		cr.Seek(r[0], io.SeekStart)
+		out := make([]byte, r[1])
+		if _, err := io.ReadFull(cr, out); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if !bytes.Equal(out, plain[r[0]:r[0]+r[1]]) {
+			t.Errorf("range %v: decompressed data does not match", r)
+		}
+	}
+}
+
+func TestCompressCorrupted(t *testing.T) {
+	stored := compressForTest(t, CompressionZstd, testData(1000))
+	if _, err := newDecompressReader(nopSeekCloser{bytes.NewReader(stored[:len(stored)-1])}, int64(len(stored)-1), CompressionZstd); err == nil {
+		t.Error("Expected error for truncated object")
+	}
+	if _, err := newCompressWriter(io.Discard, "lz4"); err == nil {
+		t.Error("Expected error for unsupported algorithm")
+	}
+}
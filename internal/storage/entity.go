@@ -12,7 +12,14 @@ type Object struct {
 	Size         int64         // 对象的大小，以字节为单位
 	LastModified time.Time     // 对象最后被修改的时间
 	ContentType  string        // 对象的MIME类型
-	Data         io.ReadCloser // 对象的数据流
+	ETag         string        // 对象的 ETag，带引号
+	Data         io.ReadCloser // 对象的数据流，实现了 io.Seeker 时支持范围读取
+
+	// 服务端加密算法，写入时为空则使用存储桶的默认设置
+	ServerSideEncryption string
+	// 读取 SSE-C 对象时返回给客户端的算法和密钥 MD5
+	SSECustomerAlgorithm string
+	SSECustomerKeyMD5    string
 }
 
 // ListAllMyBucketsResult 是 GET / 的根 xml 元素
@@ -43,6 +50,22 @@ type AccessControlPolicy struct {
 	AccessControlList AccessControlList `xml:"AccessControlList"`
 }
 
+// ServerSideEncryptionConfiguration 是 GET/PUT /BUCKETNAME?encryption 的根 xml 元素
+type ServerSideEncryptionConfiguration struct {
+	XMLName xml.Name                   `xml:"ServerSideEncryptionConfiguration"`
+	Xmlns   string                     `xml:"xmlns,attr,omitempty"`
+	Rules   []ServerSideEncryptionRule `xml:"Rule"`
+}
+
+type ServerSideEncryptionRule struct {
+	ApplyServerSideEncryptionByDefault ServerSideEncryptionByDefault `xml:"ApplyServerSideEncryptionByDefault"`
+}
+
+type ServerSideEncryptionByDefault struct {
+	SSEAlgorithm   string `xml:"SSEAlgorithm"`
+	KMSMasterKeyID string `xml:"KMSMasterKeyID,omitempty"`
+}
+
 // ListPartsResult 是 GET /BUCKETNAME/OBJECTNAME?uploadId=UPLOADID 的根 xml 元素
 type ListPartsResult struct {
 	XMLName      xml.Name  `xml:"ListPartsResult"`
@@ -0,0 +1,850 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Grey0520/s3proxy/internal/s3err"
+	"github.com/klauspost/reedsolomon"
+)
+
+const (
+	// 编码的单位，每块数据分成 data 个分片，再计算 parity 个校验分片
+	erasureBlockSize = 1 << 20
+
+	// 每个目录下保存写入中的分片的目录，不会被当作存储桶
+	erasureTempDir = ".s3proxy-tmp"
+)
+
+// 可用的分片少于数据分片数量，对象无法恢复
+var errShardsUnavailable = errors.New("not enough shards available")
+
+// ErasureStore 用 Reed-Solomon 编码把每个对象分成 data+parity 个分片，每个目录（磁盘）保存一个分片，
+// 任意 parity 个目录损坏时仍然可以读写，更换磁盘后用 Heal 重建分片
+//
+// 对象在每个目录上是一个文件 <dir>/<bucket>/<sha256(key)>，内容为分片数据，
+// 之后是 JSON 格式的 erasureMeta，最后 4 字节为 JSON 的长度。写入时先写临时文件再重命名，
+// 分片和元数据总是一起更新
+type ErasureStore struct {
+	dirs   []string
+	data   int
+	parity int
+	enc    reedsolomon.Encoder
+
+	// 按对象加锁，保证读取时打开的分片属于同一次写入
+	locks [64]sync.RWMutex
+
+	// 每个目录的剩余空间检查，没有开启时为 nil
+	space []*spaceGuard
+}
+
+// ErasureOption 用于配置 ErasureStore 的可选功能
+type ErasureOption func(*ErasureStore) error
+
+// WithErasureSpaceGuard 分别检查每个目录的剩余空间，参数与 WithSpaceGuard 相同
+// 低于下限的目录不再写入新的分片，可写的目录少于写入数量时返回 InsufficientStorage
+func WithErasureSpaceGuard(minFreeBytes, minFreeInodes int64, interval time.Duration) ErasureOption {
+	return func(s *ErasureStore) error {
+		s.space = make([]*spaceGuard, len(s.dirs))
+		for d, dir := range s.dirs {
+			g, err := newSpaceGuard("erasure", dir, minFreeBytes, minFreeInodes, interval)
+			if err != nil {
+				return err
+			}
+			if err := g.init(); err != nil {
+				return err
+			}
+			s.space[d] = g
+		}
+		return nil
+	}
+}
+
+// erasureMeta 是对象在一个目录上的元数据
+type erasureMeta struct {
+	Key          string    `json:"key"`
+	Version      string    `json:"version"`
+	Size         int64     `json:"size"`
+	ETag         string    `json:"etag"`
+	ContentType  string    `json:"contentType"`
+	LastModified time.Time `json:"lastModified"`
+	DataShards   int       `json:"dataShards"`
+	ParityShards int       `json:"parityShards"`
+	// 这个目录保存的分片序号以及分片数据的 SHA-256
+	Index    int    `json:"index"`
+	Checksum string `json:"checksum"`
+}
+
+// NewErasureStore 创建 ErasureStore，data 为 0 时使用 len(dirs)-parity
+func NewErasureStore(dirs []string, data, parity int, opts ...ErasureOption) (*ErasureStore, error) {
+	if data == 0 {
+		data = len(dirs) - parity
+	}
+	if parity < 1 || data < 1 || data+parity != len(dirs) {
+		return nil, fmt.Errorf("invalid erasure layout %d+%d for %d directories", data, parity, len(dirs))
+	}
+	enc, err := reedsolomon.New(data, parity)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create erasure encoder: %v", err)
+	}
+	for _, dir := range dirs {
+		// 损坏的磁盘不影响启动，之后的写入跳过这个目录
+		tmp := filepath.Join(dir, erasureTempDir)
+		if err := os.RemoveAll(tmp); err != nil {
+			log.Printf("erasure: %v", err)
+		}
+		if err := createDir(tmp); err != nil {
+			log.Printf("erasure: %v", err)
+		}
+	}
+	s := &ErasureStore{
+		dirs:   dirs,
+		data:   data,
+		parity: parity,
+		enc:    enc,
+	}
+	for _, opt := range opts {
+		if err := opt(s); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// SpaceStatus 返回每个目录最近一次检查的结果，按目录排列，没有开启剩余空间检查时返回 false
+func (s *ErasureStore) SpaceStatus() ([]SpaceStatus, bool) {
+	if s.space == nil {
+		return nil, false
+	}
+	stats := make([]SpaceStatus, len(s.space))
+	for d, g := range s.space {
+		stats[d] = g.current()
+	}
+	return stats, true
+}
+
+// writeQuorum 是写入成功至少需要的目录数量
+// 数据和校验分片一样多时需要多写一个，否则两半目录上可能各有一个完整的版本
+func (s *ErasureStore) writeQuorum() int {
+	if s.data == s.parity {
+		return s.data + 1
+	}
+	return s.data
+}
+
+func (s *ErasureStore) lock(bucketName, name string) *sync.RWMutex {
+	h := fnv.New32a()
+	h.Write([]byte(bucketName + "\x00" + name))
+	return &s.locks[h.Sum32()%uint32(len(s.locks))]
+}
+
+func (s *ErasureStore) bucketPath(disk int, bucketName string) string {
+	return filepath.Join(s.dirs[disk], bucketName)
+}
+
+func (s *ErasureStore) objectPath(disk int, bucketName, name string) string {
+	return filepath.Join(s.dirs[disk], bucketName, name)
+}
+
+// erasureName 返回对象在目录中的文件名
+func erasureName(objectKey string) string {
+	sum := sha256.Sum256([]byte(objectKey))
+	return hex.EncodeToString(sum[:])
+}
+
+// shardIndex 返回第 disk 个目录保存的分片序号，按对象错开，校验分片不会总是落在同几块磁盘上
+func shardIndex(name string, disk, n int) int {
+	offset, _ := strconv.ParseUint(name[:2], 16, 8)
+	return (disk + int(offset)) % n
+}
+
+// shardSize 返回大小为 size 的对象每个分片的数据长度
+func shardSize(size int64, data int) int64 {
+	full := size / erasureBlockSize
+	n := full * ceilDiv(erasureBlockSize, int64(data))
+	if rest := size % erasureBlockSize; rest > 0 {
+		n += ceilDiv(rest, int64(data))
+	}
+	return n
+}
+
+func ceilDiv(a, b int64) int64 {
+	return (a + b - 1) / b
+}
+
+func checkErasureEncryption(algorithm string, o *ObjectOptions) error {
+	if o.SSECustomerKey != nil || o.CopySourceSSECustomerKey != nil {
+		return s3err.ErrNotImplemented.WithMessage("customer-provided encryption keys are not supported")
+	}
+	if algorithm != "" {
+		return s3err.ErrNotImplemented.WithMessage("server-side encryption is not supported by the erasure backend")
+	}
+	return nil
+}
+
+func (s *ErasureStore) bucketExists(bucketName string) bool {
+	// .. 这样的名称会指向数据目录本身或者它的上级目录
+	if !validLocalBucketName(bucketName) {
+		return false
+	}
+	for d := range s.dirs {
+		if info, err := os.Stat(s.bucketPath(d, bucketName)); err == nil && info.IsDir() {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *ErasureStore) checkBucket(bucketName string) error {
+	if !s.bucketExists(bucketName) {
+		return fmt.Errorf("bucket %s does not exist: %w", bucketName, s3err.ErrNoSuchBucket)
+	}
+	return nil
+}
+
+func (s *ErasureStore) CreateBucket(bucketName string) error {
+	if err := checkBucketName(bucketName); err != nil {
+		return err
+	}
+	if s.bucketExists(bucketName) {
+		return fmt.Errorf("bucket %s already exists: %w", bucketName, s3err.ErrBucketAlreadyOwnedByYou)
+	}
+	created := 0
+	for d := range s.dirs {
+		if err := os.MkdirAll(s.bucketPath(d, bucketName), 0o755); err == nil {
+			created++
+		}
+	}
+	if created < s.writeQuorum() {
+		return fmt.Errorf("failed to create bucket %s: only %d of %d directories are writable", bucketName, created, len(s.dirs))
+	}
+	return nil
+}
+
+func (s *ErasureStore) DeleteBucket(bucketName string) error {
+	if err := s.checkBucket(bucketName); err != nil {
+		return err
+	}
+	for d := range s.dirs {
+		entries, _ := os.ReadDir(s.bucketPath(d, bucketName))
+		if len(entries) > 0 {
+			return fmt.Errorf("bucket %s is not empty: %w", bucketName, s3err.ErrBucketNotEmpty)
+		}
+	}
+	for d := range s.dirs {
+		if err := os.RemoveAll(s.bucketPath(d, bucketName)); err != nil {
+			return fmt.Errorf("failed to delete bucket %s: %v", bucketName, err)
+		}
+	}
+	return nil
+}
+
+func (s *ErasureStore) ListBucket(bucketName string, opts ...ListOption) (*ListBucketResult, error) {
+	if err := s.checkBucket(bucketName); err != nil {
+		return nil, err
+	}
+
+	// 每个目录上都可能缺少部分对象，合并所有目录的结果，同一个对象取最新的版本
+	latest := make(map[string]*erasureMeta)
+	for d := range s.dirs {
+		entries, _ := os.ReadDir(s.bucketPath(d, bucketName))
+		for _, entry := range entries {
+			if entry.IsDir() {
+				continue
+			}
+			meta, err := readShardMeta(filepath.Join(s.bucketPath(d, bucketName), entry.Name()))
+			if err != nil {
+				continue
+			}
+			if m := latest[entry.Name()]; m == nil || meta.LastModified.After(m.LastModified) {
+				latest[entry.Name()] = meta
+			}
+		}
+	}
+
+	result := &ListBucketResult{
+		XMLName: xml.Name{Local: "ListBucketResult"},
+		Name:    bucketName,
+	}
+	for _, meta := range latest {
+		result.Contents = append(result.Contents, Content{
+			Key:          meta.Key,
+			LastModified: meta.LastModified,
+			ETag:         meta.ETag,
+			Size:         meta.Size,
+			StorageClass: "STANDARD",
+			Owner:        newFakeOwner(),
+		})
+	}
+	return newListOptions(opts).paginate(result), nil
+}
+
+func (s *ErasureStore) ListAllMyBuckets() (*ListAllMyBucketsResult, error) {
+	created := make(map[string]time.Time)
+	for _, dir := range s.dirs {
+		entries, _ := os.ReadDir(dir)
+		for _, entry := range entries {
+			if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil {
+				continue
+			}
+			if t, ok := created[entry.Name()]; !ok || info.ModTime().Before(t) {
+				created[entry.Name()] = info.ModTime()
+			}
+		}
+	}
+
+	var buckets []Bucket
+	for name, t := range created {
+		buckets = append(buckets, Bucket{
+			Name:         name,
+			CreationDate: t,
+		})
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].Name < buckets[j].Name })
+
+	return &ListAllMyBucketsResult{
+		XMLName: xml.Name{Local: "ListAllMyBucketsResult"},
+		Owner:   newFakeOwner(),
+		Buckets: Buckets{
+			Bucket: buckets,
+		},
+	}, nil
+}
+
+func (s *ErasureStore) GetBucketAcl(bucketName string) (*AccessControlPolicy, error) {
+	if err := s.checkBucket(bucketName); err != nil {
+		return nil, err
+	}
+	owner := newFakeOwner()
+	return &AccessControlPolicy{
+		Owner: owner,
+		AccessControlList: AccessControlList{
+			Grant: []Grant{
+				{
+					Grantee: Grantee{
+						ID:          owner.ID,
+						DisplayName: owner.DisplayName,
+					},
+					Permission: "FULL_CONTROL",
+				},
+			},
+		},
+	}, nil
+}
+
+func (s *ErasureStore) PutObject(bucketName, objectKey string, data *Object, opts ...ObjectOption) error {
+	if err := checkErasureEncryption(data.ServerSideEncryption, newObjectOptions(opts)); err != nil {
+		return err
+	}
+	if err := s.checkBucket(bucketName); err != nil {
+		return err
+	}
+	return s.write(bucketName, objectKey, data.ContentType, data.Data, data.Size)
+}
+
+// write 把数据编码后写入每个目录的临时文件，至少 writeQuorum 个目录写入成功时提交
+// 没有写入成功的目录上保留旧的版本，读取时会被忽略，由 Heal 修复
+// declared 为请求声明的对象大小，用于检查剩余空间，为 0 表示大小未知
+func (s *ErasureStore) write(bucketName, objectKey, contentType string, r io.Reader, declared int64) error {
+	name := erasureName(objectKey)
+	n := len(s.dirs)
+	writers := make([]*shardWriter, n)
+	defer func() {
+		for _, w := range writers {
+			if w != nil {
+				w.abort()
+			}
+		}
+	}()
+	full := 0
+	for d := range s.dirs {
+		// 空间不足的目录和损坏的磁盘一样跳过
+		if s.space != nil {
+			if err := s.space[d].check(shardSize(declared, s.data)); err != nil {
+				full++
+				continue
+			}
+		}
+		if w, err := newShardWriter(filepath.Join(s.dirs[d], erasureTempDir)); err == nil {
+			writers[d] = w
+		}
+	}
+	if full > 0 && countWriters(writers) < s.writeQuorum() {
+		return s3err.ErrInsufficientStorage.WithMessage(fmt.Sprintf("Not enough free space: %d of %d directories are below the watermark", full, n))
+	}
+
+	sum := md5.New()
+	var size int64
+	buf := make([]byte, erasureBlockSize)
+	for {
+		k, err := io.ReadFull(r, buf)
+		if k > 0 {
+			sum.Write(buf[:k])
+			size += int64(k)
+			parts, err := s.enc.Split(buf[:k])
+			if err != nil {
+				return fmt.Errorf("failed to encode object %s: %v", objectKey, err)
+			}
+			if err := s.enc.Encode(parts); err != nil {
+				return fmt.Errorf("failed to encode object %s: %v", objectKey, err)
+			}
+			for d, w := range writers {
+				if w == nil {
+					continue
+				}
+				if _, err := w.Write(parts[shardIndex(name, d, n)]); err != nil {
+					w.abort()
+					writers[d] = nil
+				}
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to create object %s: %v", objectKey, err)
+		}
+	}
+
+	// 在提交之前检查，避免部分目录上出现没有达到写入数量的版本
+	if written := countWriters(writers); written < s.writeQuorum() {
+		return fmt.Errorf("failed to create object %s: only %d of %d shards written", objectKey, written, n)
+	}
+
+	meta := erasureMeta{
+		Key:          objectKey,
+		Version:      newErasureVersion(),
+		Size:         size,
+		ETag:         formatETag(sum.Sum(nil)),
+		ContentType:  contentType,
+		LastModified: time.Now().UTC(),
+		DataShards:   s.data,
+		ParityShards: s.parity,
+	}
+	lock := s.lock(bucketName, name)
+	lock.Lock()
+	defer lock.Unlock()
+	committed := 0
+	for d, w := range writers {
+		if w == nil {
+			continue
+		}
+		m := meta
+		m.Index = shardIndex(name, d, n)
+		if err := s.commitShard(d, bucketName, name, w, &m); err == nil {
+			committed++
+		}
+		writers[d] = nil
+	}
+	if committed < s.writeQuorum() {
+		return fmt.Errorf("failed to create object %s: only %d of %d shards written", objectKey, committed, n)
+	}
+	return nil
+}
+
+func countWriters(writers []*shardWriter) int {
+	n := 0
+	for _, w := range writers {
+		if w != nil {
+			n++
+		}
+	}
+	return n
+}
+
+// commitShard 写入分片的元数据并把临时文件移动到对象的位置，调用时必须持有对象的锁
+func (s *ErasureStore) commitShard(disk int, bucketName, name string, w *shardWriter, meta *erasureMeta) error {
+	if err := w.finish(meta); err != nil {
+		w.abort()
+		return err
+	}
+	// 更换的磁盘上可能还没有这个存储桶
+	if err := os.MkdirAll(s.bucketPath(disk, bucketName), 0o755); err != nil {
+		w.abort()
+		return err
+	}
+	if err := os.Rename(w.f.Name(), s.objectPath(disk, bucketName, name)); err != nil {
+		w.abort()
+		return err
+	}
+	return nil
+}
+
+// open 打开每个目录上最新版本的分片，返回的文件和元数据按目录排列，不可用的目录为 nil
+func (s *ErasureStore) open(bucketName, objectKey, name string) ([]*os.File, []*erasureMeta, *erasureMeta, error) {
+	files := make([]*os.File, len(s.dirs))
+	metas := make([]*erasureMeta, len(s.dirs))
+	var latest *erasureMeta
+	for d := range s.dirs {
+		f, err := os.Open(s.objectPath(d, bucketName, name))
+		if err != nil {
+			continue
+		}
+		meta, _, err := shardMeta(f)
+		if err != nil {
+			f.Close()
+			continue
+		}
+		files[d], metas[d] = f, meta
+		if latest == nil || meta.LastModified.After(latest.LastModified) {
+			latest = meta
+		}
+	}
+	if latest == nil {
+		return nil, nil, nil, fmt.Errorf("object %s does not exist: %w", objectKey, s3err.ErrNoSuchKey)
+	}
+	for d, meta := range metas {
+		if meta != nil && (meta.Version != latest.Version || meta.Index >= latest.DataShards+latest.ParityShards) {
+			files[d].Close()
+			files[d], metas[d] = nil, nil
+		}
+	}
+	return files, metas, latest, nil
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		if f != nil {
+			f.Close()
+		}
+	}
+}
+
+// encoder 返回对象使用的编码器，对象可能是在修改数据和校验分片数量之前写入的
+func (s *ErasureStore) encoder(meta *erasureMeta) (reedsolomon.Encoder, error) {
+	if meta.DataShards == s.data && meta.ParityShards == s.parity {
+		return s.enc, nil
+	}
+	return reedsolomon.New(meta.DataShards, meta.ParityShards)
+}
+
+func (s *ErasureStore) GetObject(bucketName, objectKey string, opts ...ObjectOption) (*Object, error) {
+	if err := checkErasureEncryption("", newObjectOptions(opts)); err != nil {
+		return nil, err
+	}
+	if err := s.checkBucket(bucketName); err != nil {
+		return nil, err
+	}
+
+	name := erasureName(objectKey)
+	lock := s.lock(bucketName, name)
+	lock.RLock()
+	files, metas, meta, err := s.open(bucketName, objectKey, name)
+	lock.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	shards := make([]*os.File, meta.DataShards+meta.ParityShards)
+	available := 0
+	for d, m := range metas {
+		if m != nil {
+			shards[m.Index] = files[d]
+			available++
+		}
+	}
+	if available < meta.DataShards {
+		closeFiles(files)
+		return nil, fmt.Errorf("failed to get object %s: %w", objectKey, errShardsUnavailable)
+	}
+	enc, err := s.encoder(meta)
+	if err != nil {
+		closeFiles(files)
+		return nil, err
+	}
+	return &Object{
+		Key:          objectKey,
+		Size:         meta.Size,
+		LastModified: meta.LastModified,
+		ContentType:  meta.ContentType,
+		ETag:         meta.ETag,
+		Data: &erasureReader{
+			enc:     enc,
+			shards:  shards,
+			data:    meta.DataShards,
+			size:    meta.Size,
+			current: -1,
+		},
+	}, nil
+}
+
+func (s *ErasureStore) DeleteObject(bucketName, objectKey string) error {
+	if err := s.checkBucket(bucketName); err != nil {
+		return err
+	}
+	name := erasureName(objectKey)
+	lock := s.lock(bucketName, name)
+	lock.Lock()
+	defer lock.Unlock()
+	// 与 S3 一样，删除不存在的对象不是错误
+	// 不可用的目录上还留着分片，确认删除的目录达不到写入数量时对象可能在目录恢复后重新出现
+	deleted := 0
+	for d := range s.dirs {
+		err := os.Remove(s.objectPath(d, bucketName, name))
+		if err == nil || os.IsNotExist(err) && s.online(d) {
+			deleted++
+		} else if err != nil && !os.IsNotExist(err) {
+			log.Printf("erasure: %v", err)
+		}
+	}
+	if deleted < s.writeQuorum() {
+		return fmt.Errorf("failed to delete object %s: only %d of %d directories are available", objectKey, deleted, len(s.dirs))
+	}
+	return nil
+}
+
+// online 判断目录是否可用，目录本身不存在时说明磁盘没有挂载
+func (s *ErasureStore) online(disk int) bool {
+	info, err := os.Stat(s.dirs[disk])
+	return err == nil && info.IsDir()
+}
+
+func (s *ErasureStore) CopyObject(srcBucketName, srcObjectKey, destBucketName, destObjectKey string, opts ...ObjectOption) error {
+	if err := checkErasureEncryption("", newObjectOptions(opts)); err != nil {
+		return err
+	}
+	src, err := s.GetObject(srcBucketName, srcObjectKey)
+	if err != nil {
+		return err
+	}
+	defer src.Data.Close()
+	if err := s.checkBucket(destBucketName); err != nil {
+		return err
+	}
+	return s.write(destBucketName, destObjectKey, src.ContentType, src.Data, src.Size)
+}
+
+func (s *ErasureStore) MoveObject(srcBucketName, srcObjectKey, destBucketName, destObjectKey string) error {
+	if err := s.CopyObject(srcBucketName, srcObjectKey, destBucketName, destObjectKey); err != nil {
+		return err
+	}
+	return s.DeleteObject(srcBucketName, srcObjectKey)
+}
+
+func (s *ErasureStore) HeadObject(bucketName, objectKey string, opts ...ObjectOption) (map[string]string, error) {
+	if err := checkErasureEncryption("", newObjectOptions(opts)); err != nil {
+		return nil, err
+	}
+	if err := s.checkBucket(bucketName); err != nil {
+		return nil, err
+	}
+	name := erasureName(objectKey)
+	lock := s.lock(bucketName, name)
+	lock.RLock()
+	files, _, meta, err := s.open(bucketName, objectKey, name)
+	lock.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	closeFiles(files)
+	return map[string]string{
+		"Size":         strconv.FormatInt(meta.Size, 10),
+		"LastModified": meta.LastModified.Format(time.RFC3339),
+		"ContentType":  meta.ContentType,
+		"ETag":         meta.ETag,
+	}, nil
+}
+
+func newErasureVersion() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// shardWriter 写入一个分片的临时文件并计算校验和
+type shardWriter struct {
+	f    *os.File
+	hash hash.Hash
+}
+
+func newShardWriter(dir string) (*shardWriter, error) {
+	// 更换的磁盘上还没有临时目录
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp(dir, "shard-*")
+	if err != nil {
+		return nil, err
+	}
+	return &shardWriter{f: f, hash: sha256.New()}, nil
+}
+
+func (w *shardWriter) Write(p []byte) (int, error) {
+	w.hash.Write(p)
+	return w.f.Write(p)
+}
+
+// finish 在分片数据之后写入元数据并关闭文件
+func (w *shardWriter) finish(meta *erasureMeta) error {
+	meta.Checksum = hex.EncodeToString(w.hash.Sum(nil))
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	data = binary.BigEndian.AppendUint32(data, uint32(len(data)))
+	if _, err := w.f.Write(data); err != nil {
+		return err
+	}
+	return w.f.Close()
+}
+
+func (w *shardWriter) abort() {
+	w.f.Close()
+	os.Remove(w.f.Name())
+}
+
+// shardMeta 读取分片文件末尾的元数据，同时返回分片数据的长度
+func shardMeta(f *os.File) (*erasureMeta, int64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	if info.Size() < 4 {
+		return nil, 0, fmt.Errorf("shard %s is truncated", f.Name())
+	}
+	var length [4]byte
+	if _, err := f.ReadAt(length[:], info.Size()-4); err != nil {
+		return nil, 0, err
+	}
+	n := int64(binary.BigEndian.Uint32(length[:]))
+	if n > info.Size()-4 {
+		return nil, 0, fmt.Errorf("shard %s is truncated", f.Name())
+	}
+	data := make([]byte, n)
+	if _, err := f.ReadAt(data, info.Size()-4-n); err != nil {
+		return nil, 0, err
+	}
+	meta := &erasureMeta{}
+	if err := json.Unmarshal(data, meta); err != nil {
+		return nil, 0, fmt.Errorf("invalid shard %s: %v", f.Name(), err)
+	}
+	dataSize := info.Size() - 4 - n
+	if meta.DataShards < 1 || dataSize != shardSize(meta.Size, meta.DataShards) {
+		return nil, 0, fmt.Errorf("shard %s is truncated", f.Name())
+	}
+	return meta, dataSize, nil
+}
+
+func readShardMeta(path string) (*erasureMeta, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	meta, _, err := shardMeta(f)
+	return meta, err
+}
+
+// erasureReader 按块读取分片并解码，数据分片不可用时用校验分片恢复
+// 读取时不检查校验和，损坏的分片由 Heal 发现
+type erasureReader struct {
+	enc    reedsolomon.Encoder
+	shards []*os.File // 按分片序号排列，nil 表示不可用
+	data   int
+	size   int64
+	offset int64
+
+	block   []byte
+	current int64 // block 对应的块序号，-1 表示还没有读取
+}
+
+func (r *erasureReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	idx := r.offset / erasureBlockSize
+	if idx != r.current {
+		if err := r.load(idx); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.block[r.offset-idx*erasureBlockSize:])
+	r.offset += int64(n)
+	return n, nil
+}
+
+// load 读取并解码第 idx 块
+func (r *erasureReader) load(idx int64) error {
+	blockLen := min(erasureBlockSize, r.size-idx*erasureBlockSize)
+	length := ceilDiv(blockLen, int64(r.data))
+	offset := idx * ceilDiv(erasureBlockSize, int64(r.data))
+
+	parts := make([][]byte, len(r.shards))
+	missing := false
+	for i, f := range r.shards {
+		// 数据分片都可用时不需要读取校验分片
+		if i >= r.data && !missing {
+			break
+		}
+		if f != nil {
+			buf := make([]byte, length)
+			if _, err := f.ReadAt(buf, offset); err == nil {
+				parts[i] = buf
+				continue
+			}
+			// 读取失败的分片之后不再使用
+			f.Close()
+			r.shards[i] = nil
+		}
+		if i < r.data {
+			missing = true
+		}
+	}
+	if missing {
+		if err := r.enc.ReconstructData(parts); err != nil {
+			return fmt.Errorf("failed to reconstruct block %d: %w", idx, errShardsUnavailable)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := r.enc.Join(&buf, parts, int(blockLen)); err != nil {
+		return err
+	}
+	r.block, r.current = buf.Bytes(), idx
+	return nil
+}
+
+func (r *erasureReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative position %d", offset)
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+func (r *erasureReader) Close() error {
+	closeFiles(r.shards)
+	return nil
+}
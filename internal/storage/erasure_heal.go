@@ -0,0 +1,183 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/Grey0520/s3proxy/internal/s3err"
+)
+
+// ErasureHealResult 是 Heal 的结果
+type ErasureHealResult struct {
+	// 在目录上重新创建的存储桶
+	Buckets int
+	// 重建的分片
+	Shards int
+	// 可用的分片不足、无法恢复的对象，格式为 bucket/key
+	Lost []string
+}
+
+// Heal 检查所有对象的分片，重建丢失、损坏或者版本落后的分片，用于更换磁盘之后或者定期执行
+func (s *ErasureStore) Heal() (*ErasureHealResult, error) {
+	result := &ErasureHealResult{}
+	for _, dir := range s.dirs {
+		if err := createDir(filepath.Join(dir, erasureTempDir)); err != nil {
+			return result, err
+		}
+	}
+	buckets, err := s.ListAllMyBuckets()
+	if err != nil {
+		return result, err
+	}
+
+	for _, b := range buckets.Buckets.Bucket {
+		names := make(map[string]bool)
+		for d := range s.dirs {
+			entries, err := os.ReadDir(s.bucketPath(d, b.Name))
+			if os.IsNotExist(err) {
+				if err := createDir(s.bucketPath(d, b.Name)); err != nil {
+					return result, err
+				}
+				result.Buckets++
+				continue
+			}
+			for _, entry := range entries {
+				if !entry.IsDir() {
+					names[entry.Name()] = true
+				}
+			}
+		}
+
+		sorted := make([]string, 0, len(names))
+		for name := range names {
+			sorted = append(sorted, name)
+		}
+		sort.Strings(sorted)
+		for _, name := range sorted {
+			if err := s.healObject(b.Name, name, result); err != nil {
+				return result, err
+			}
+		}
+	}
+	return result, nil
+}
+
+// healObject 重建一个对象不可用的分片，结果记录在 result 中
+func (s *ErasureStore) healObject(bucketName, name string, result *ErasureHealResult) error {
+	lock := s.lock(bucketName, name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	files, metas, meta, err := s.open(bucketName, name, name)
+	if errors.Is(err, s3err.ErrNoSuchKey) {
+		// 所有目录上的元数据都不可读，无法知道对象的键
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer closeFiles(files)
+
+	// 校验和不一致的分片与丢失的分片一样需要重建
+	n := meta.DataShards + meta.ParityShards
+	shards := make([]*os.File, n)
+	available := 0
+	for d, m := range metas {
+		if m == nil {
+			continue
+		}
+		if ok, err := verifyShard(files[d], m); err != nil || !ok {
+			metas[d] = nil
+			continue
+		}
+		shards[m.Index] = files[d]
+		available++
+	}
+	if available == n {
+		return nil
+	}
+	if available < meta.DataShards {
+		result.Lost = append(result.Lost, bucketName+"/"+meta.Key)
+		return nil
+	}
+	enc, err := s.encoder(meta)
+	if err != nil {
+		return err
+	}
+
+	writers := make([]*shardWriter, len(s.dirs))
+	defer func() {
+		for _, w := range writers {
+			if w != nil {
+				w.abort()
+			}
+		}
+	}()
+	for d, m := range metas {
+		if m != nil {
+			continue
+		}
+		w, err := newShardWriter(filepath.Join(s.dirs[d], erasureTempDir))
+		if err != nil {
+			return fmt.Errorf("failed to heal object %s: %v", meta.Key, err)
+		}
+		writers[d] = w
+	}
+
+	stride := ceilDiv(erasureBlockSize, int64(meta.DataShards))
+	for offset, remaining := int64(0), meta.Size; remaining > 0; offset, remaining = offset+stride, remaining-erasureBlockSize {
+		length := ceilDiv(min(erasureBlockSize, remaining), int64(meta.DataShards))
+		parts := make([][]byte, n)
+		for i, f := range shards {
+			if f == nil {
+				continue
+			}
+			buf := make([]byte, length)
+			if _, err := f.ReadAt(buf, offset); err != nil {
+				return fmt.Errorf("failed to heal object %s: %v", meta.Key, err)
+			}
+			parts[i] = buf
+		}
+		if err := enc.Reconstruct(parts); err != nil {
+			return fmt.Errorf("failed to heal object %s: %v", meta.Key, err)
+		}
+		for d, w := range writers {
+			if w == nil {
+				continue
+			}
+			if _, err := w.Write(parts[shardIndex(name, d, len(s.dirs))]); err != nil {
+				return fmt.Errorf("failed to heal object %s: %v", meta.Key, err)
+			}
+		}
+	}
+
+	for d, w := range writers {
+		if w == nil {
+			continue
+		}
+		m := *meta
+		m.Index = shardIndex(name, d, len(s.dirs))
+		writers[d] = nil
+		if err := s.commitShard(d, bucketName, name, w, &m); err != nil {
+			return fmt.Errorf("failed to heal object %s: %v", meta.Key, err)
+		}
+		result.Shards++
+	}
+	return nil
+}
+
+// verifyShard 检查分片数据的校验和
+func verifyShard(f *os.File, meta *erasureMeta) (bool, error) {
+	h := sha256.New()
+	size := shardSize(meta.Size, meta.DataShards)
+	if _, err := io.Copy(h, io.NewSectionReader(f, 0, size)); err != nil {
+		return false, err
+	}
+	return hex.EncodeToString(h.Sum(nil)) == meta.Checksum, nil
+}
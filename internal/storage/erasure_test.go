@@ -0,0 +1,311 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Grey0520/s3proxy/internal/config"
+	"github.com/Grey0520/s3proxy/internal/s3err"
+)
+
+func newTestErasureStore(t *testing.T, dirs, parity int) *ErasureStore {
+	var paths []string
+	for i := 0; i < dirs; i++ {
+		paths = append(paths, t.TempDir())
+	}
+	store, err := NewErasureStore(paths, 0, parity)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := store.CreateBucket("bucket"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	return store
+}
+
+func putBytes(t *testing.T, store StorageProvider, bucketName, objectKey string, data []byte) {
+	t.Helper()
+	err := store.PutObject(bucketName, objectKey, &Object{
+		ContentType: "application/octet-stream",
+		Data:        io.NopCloser(bytes.NewReader(data)),
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+}
+
+// wipeDisk 模拟更换为一块空的磁盘
+func wipeDisk(t *testing.T, store *ErasureStore, disk int) {
+	os.RemoveAll(store.dirs[disk])
+	os.MkdirAll(store.dirs[disk], 0o755)
+}
+
+func TestErasureStoreLayout(t *testing.T) {
+	if _, err := NewErasureStore([]string{t.TempDir(), t.TempDir()}, 0, 2); err == nil {
+		t.Errorf("Expected error without data shards")
+	}
+	if _, err := NewErasureStore([]string{t.TempDir(), t.TempDir(), t.TempDir()}, 2, 2); err == nil {
+		t.Errorf("Expected error when shards do not match directories")
+	}
+	store, err := NewErasureStore([]string{t.TempDir(), t.TempDir(), t.TempDir()}, 0, 1)
+	if err != nil || store.data != 2 {
+		t.Errorf("Expected 2 data shards, got %v", err)
+	}
+}
+
+func TestErasureStoreObjects(t *testing.T) {
+	store := newTestErasureStore(t, 6, 2)
+	large := make([]byte, 2*erasureBlockSize+12345)
+	rand.New(rand.NewSource(1)).Read(large)
+	putBytes(t, store, "bucket", "dir/large.bin", large)
+	putBytes(t, store, "bucket", "empty", nil)
+	putString(t, store, "bucket", "small.txt", "hello")
+
+	obj, err := store.GetObject("bucket", "dir/large.bin")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	data, _ := io.ReadAll(obj.Data)
+	if !bytes.Equal(data, large) || obj.ETag != fmt.Sprintf(`"%x"`, md5.Sum(large)) || obj.Size != int64(len(large)) {
+		t.Errorf("Unexpected object %+v", obj)
+	}
+	// 跨块的范围读取
+	obj.Data.(io.Seeker).Seek(erasureBlockSize-5, io.SeekStart)
+	part := make([]byte, 10)
+	io.ReadFull(obj.Data, part)
+	obj.Data.Close()
+	if !bytes.Equal(part, large[erasureBlockSize-5:erasureBlockSize+5]) {
+		t.Errorf("Unexpected range %x", part)
+	}
+	if got := readString(t, store, "bucket", "empty"); got != "" {
+		t.Errorf("Unexpected content %q", got)
+	}
+
+	head, err := store.HeadObject("bucket", "small.txt")
+	if err != nil || head["Size"] != "5" || head["ContentType"] != "text/plain" {
+		t.Errorf("Unexpected head result %v, %v", head, err)
+	}
+	result, _ := store.ListBucket("bucket")
+	if len(result.Contents) != 3 || result.Contents[0].Key != "dir/large.bin" || result.Contents[2].Size != 5 {
+		t.Errorf("Unexpected listing %+v", result.Contents)
+	}
+
+	if err := store.DeleteBucket("bucket"); !errors.Is(err, s3err.ErrBucketNotEmpty) {
+		t.Errorf("Expected BucketNotEmpty, got %v", err)
+	}
+	store.CreateBucket("other")
+	if err := store.MoveObject("bucket", "small.txt", "other", "moved.txt"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, err := store.GetObject("bucket", "small.txt"); !errors.Is(err, s3err.ErrNoSuchKey) {
+		t.Errorf("Expected NoSuchKey, got %v", err)
+	}
+	if got := readString(t, store, "other", "moved.txt"); got != "hello" {
+		t.Errorf("Unexpected content %q", got)
+	}
+	if err := store.PutObject("bucket", "x", &Object{ServerSideEncryption: SSEAlgorithmAES256}); !errors.Is(err, s3err.ErrNotImplemented) {
+		t.Errorf("Expected NotImplemented, got %v", err)
+	}
+}
+
+func TestErasureStoreMissingShards(t *testing.T) {
+	store := newTestErasureStore(t, 5, 2)
+	large := make([]byte, erasureBlockSize+1000)
+	rand.New(rand.NewSource(2)).Read(large)
+	putBytes(t, store, "bucket", "key", large)
+
+	// 丢失 parity 个分片仍然可以读取
+	wipeDisk(t, store, 0)
+	wipeDisk(t, store, 3)
+	obj, err := store.GetObject("bucket", "key")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	data, err := io.ReadAll(obj.Data)
+	obj.Data.Close()
+	if err != nil || !bytes.Equal(data, large) {
+		t.Fatalf("Expected reconstructed content, got %v", err)
+	}
+	if _, err := store.ListAllMyBuckets(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	// 更换的空磁盘上也可以直接写入
+	if err := putString(t, store, "bucket", "new", "written while degraded"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	os.Remove(store.objectPath(1, "bucket", erasureName("key")))
+	if _, err := store.GetObject("bucket", "key"); !errors.Is(err, errShardsUnavailable) {
+		t.Errorf("Expected not enough shards, got %v", err)
+	}
+	result, err := store.Heal()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(result.Lost) != 1 || result.Lost[0] != "bucket/key" {
+		t.Errorf("Expected lost object to be reported, got %+v", result)
+	}
+}
+
+func TestErasureStoreDeleteQuorum(t *testing.T) {
+	store := newTestErasureStore(t, 4, 2)
+	putString(t, store, "bucket", "key", "hello")
+	putString(t, store, "bucket", "other", "world")
+
+	// 模拟两个目录没有挂载，剩下的目录达不到写入数量
+	for _, d := range []int{0, 1} {
+		if err := os.Rename(store.dirs[d], store.dirs[d]+".offline"); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	}
+	if err := store.DeleteObject("bucket", "key"); err == nil {
+		t.Error("Expected error when too few directories confirm the delete")
+	}
+	os.Rename(store.dirs[0]+".offline", store.dirs[0])
+	if err := store.DeleteObject("bucket", "other"); err != nil {
+		t.Errorf("Expected no error with one directory offline, got %v", err)
+	}
+	os.Rename(store.dirs[1]+".offline", store.dirs[1])
+	if _, err := store.GetObject("bucket", "other"); !errors.Is(err, s3err.ErrNoSuchKey) && !errors.Is(err, errShardsUnavailable) {
+		t.Errorf("Expected deleted object to stay unreadable, got %v", err)
+	}
+}
+
+func TestErasureStoreHeal(t *testing.T) {
+	store := newTestErasureStore(t, 4, 2)
+	large := make([]byte, 3*erasureBlockSize)
+	rand.New(rand.NewSource(3)).Read(large)
+	putBytes(t, store, "bucket", "large", large)
+	putString(t, store, "bucket", "small", "small object")
+
+	// 更换一块磁盘，并且另一块磁盘上的分片损坏
+	wipeDisk(t, store, 1)
+	f, _ := os.OpenFile(store.objectPath(2, "bucket", erasureName("small")), os.O_RDWR, 0)
+	f.WriteAt([]byte("X"), 0)
+	f.Close()
+
+	result, err := store.Heal()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if result.Buckets != 1 || result.Shards != 3 || len(result.Lost) != 0 {
+		t.Errorf("Unexpected heal result %+v", result)
+	}
+	if result, _ := store.Heal(); result.Shards != 0 {
+		t.Errorf("Expected nothing to heal, got %+v", result)
+	}
+
+	// 重建后可以承受另外两块磁盘损坏
+	wipeDisk(t, store, 0)
+	wipeDisk(t, store, 3)
+	if got := readString(t, store, "bucket", "small"); got != "small object" {
+		t.Errorf("Unexpected content %q", got)
+	}
+	obj, err := store.GetObject("bucket", "large")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	data, _ := io.ReadAll(obj.Data)
+	obj.Data.Close()
+	if !bytes.Equal(data, large) {
+		t.Errorf("Expected healed content")
+	}
+}
+
+func TestErasureStoreStaleShard(t *testing.T) {
+	store := newTestErasureStore(t, 3, 1)
+	putString(t, store, "bucket", "key", "old")
+
+	// 写入时一个目录不可用，上面保留旧版本
+	block := func(disk int) {
+		tmp := filepath.Join(store.dirs[disk], erasureTempDir)
+		os.RemoveAll(tmp)
+		os.WriteFile(tmp, nil, 0o644)
+	}
+	block(0)
+	if err := putString(t, store, "bucket", "key", "new"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	os.Remove(filepath.Join(store.dirs[0], erasureTempDir))
+
+	if got := readString(t, store, "bucket", "key"); got != "new" {
+		t.Errorf("Expected latest version, got %q", got)
+	}
+	if result, err := store.Heal(); err != nil || result.Shards != 1 {
+		t.Errorf("Expected stale shard to be rebuilt, got %+v, %v", result, err)
+	}
+	wipeDisk(t, store, 1)
+	if got := readString(t, store, "bucket", "key"); got != "new" {
+		t.Errorf("Expected latest version, got %q", got)
+	}
+
+	// 可写的目录不够时写入失败，也不会留下新版本
+	block(0)
+	block(1)
+	if err := putString(t, store, "bucket", "key", "x"); err == nil {
+		t.Errorf("Expected error without write quorum")
+	}
+	if got := readString(t, store, "bucket", "key"); got != "new" {
+		t.Errorf("Expected previous version, got %q", got)
+	}
+}
+
+func TestNewStorageProviderErasure(t *testing.T) {
+	cfg := config.Config{Cloud: config.CloudsConfig{Provider: "local"}}
+	cfg.Cloud.Filesystem.Dirs = []string{t.TempDir(), t.TempDir(), t.TempDir()}
+	cfg.Cloud.Filesystem.Erasure.ParityShards = 1
+	stg, err := NewStorageProvider(cfg)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, ok := stg.(*ErasureStore); !ok {
+		t.Errorf("Expected *ErasureStore, got %T", stg)
+	}
+
+	cfg.Cloud.Filesystem.Compression.Algorithm = "zstd"
+	if _, err := NewStorageProvider(cfg); err == nil {
+		t.Errorf("Expected error for compression with multiple directories")
+	}
+}
+
+func TestErasureStoreSpaceGuard(t *testing.T) {
+	paths := []string{t.TempDir(), t.TempDir(), t.TempDir()}
+	store, err := NewErasureStore(paths, 0, 1, WithErasureSpaceGuard(1, 0, 0))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	store.CreateBucket("bucket")
+
+	// 一个目录空间不足时跳过这个目录，其余目录仍然达到写入数量
+	store.space[0].minFreeBytes = 1 << 62
+	store.space[0].refresh()
+	putBytes(t, store, "bucket", "key", []byte("content"))
+	if _, err := os.Stat(store.objectPath(0, "bucket", erasureName("key"))); !os.IsNotExist(err) {
+		t.Errorf("Expected no shard on the full directory, got %v", err)
+	}
+	if got := readString(t, store, "bucket", "key"); got != "content" {
+		t.Errorf("Expected content, got %q", got)
+	}
+
+	stats := SpaceStatistics(store)
+	if len(stats) != 3 || !stats[DefaultBackend+".0"].ReadOnly || stats[DefaultBackend+".1"].ReadOnly || stats[DefaultBackend+".0"].Path != paths[0] {
+		t.Errorf("Expected per-directory statistics, got %+v", stats)
+	}
+
+	store.space[1].minFreeBytes = 1 << 62
+	store.space[1].refresh()
+	err = store.PutObject("bucket", "other", &Object{Data: io.NopCloser(bytes.NewReader([]byte("x")))})
+	if !errors.Is(err, s3err.ErrInsufficientStorage) {
+		t.Errorf("Expected InsufficientStorage, got %v", err)
+	}
+	if _, err := store.GetObject("bucket", "other"); !errors.Is(err, s3err.ErrNoSuchKey) {
+		t.Errorf("Expected rejected object not to exist, got %v", err)
+	}
+}
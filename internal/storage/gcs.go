@@ -0,0 +1,415 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	gcs "cloud.google.com/go/storage"
+	"github.com/Grey0520/s3proxy/internal/s3err"
+	"gocloud.dev/blob"
+	"gocloud.dev/blob/gcsblob"
+	"gocloud.dev/gcerrors"
+	"gocloud.dev/gcp"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+)
+
+// GCSStore 通过 gocloud 的 gcsblob 读写 Google Cloud Storage 中的对象，
+// 存储桶的创建、删除、列举和 ACL 使用 GCS 的客户端
+//
+// 设置了 STORAGE_EMULATOR_HOST 环境变量时连接到该地址的模拟器，并且不做认证
+type GCSStore struct {
+	Client     *gcs.Client
+	httpClient *gcp.HTTPClient
+	projectID  string
+	ctx        context.Context
+}
+
+// NewGCSStore 创建 GCSStore
+// credential 是服务账号的 JSON，也可以是 JSON 文件的路径；projectID 为空时使用服务账号所在的项目
+func NewGCSStore(credential, projectID string) (*GCSStore, error) {
+	ctx := context.Background()
+
+	var clientOpts []option.ClientOption
+	httpClient := &gcp.HTTPClient{Client: *http.DefaultClient}
+	if os.Getenv("STORAGE_EMULATOR_HOST") == "" {
+		creds, err := gcsCredentials(ctx, credential)
+		if err != nil {
+			return nil, err
+		}
+		if projectID == "" {
+			projectID = creds.ProjectID
+		}
+		if httpClient, err = gcp.NewHTTPClient(gcp.DefaultTransport(), gcp.CredentialsTokenSource(creds)); err != nil {
+			return nil, fmt.Errorf("failed to create http client: %v", err)
+		}
+		clientOpts = append(clientOpts, option.WithCredentials(creds))
+	}
+
+	client, err := gcs.NewClient(ctx, clientOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create gcs client: %v", err)
+	}
+	return &GCSStore{
+		Client:     client,
+		httpClient: httpClient,
+		projectID:  projectID,
+		ctx:        ctx,
+	}, nil
+}
+
+func gcsCredentials(ctx context.Context, credential string) (*google.Credentials, error) {
+	if credential == "" {
+		return nil, fmt.Errorf("gcs credential is required")
+	}
+	data := []byte(credential)
+	if !strings.HasPrefix(strings.TrimSpace(credential), "{") {
+		var err error
+		if data, err = os.ReadFile(credential); err != nil {
+			return nil, fmt.Errorf("failed to read gcs credential: %v", err)
+		}
+	}
+	creds, err := google.CredentialsFromJSON(ctx, data, gcs.ScopeFullControl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid gcs credential: %v", err)
+	}
+	return creds, nil
+}
+
+func (store *GCSStore) openBucket(bucketName string) (*blob.Bucket, error) {
+	b, err := gcsblob.OpenBucket(store.ctx, store.httpClient, bucketName, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open bucket: %v", err)
+	}
+	return b, nil
+}
+
+func (store *GCSStore) CreateBucket(bucketName string) error {
+	if err := store.Client.Bucket(bucketName).Create(store.ctx, store.projectID, nil); err != nil {
+		return gcsError(err, "failed to create bucket", s3err.ErrNoSuchBucket)
+	}
+	return nil
+}
+
+func (store *GCSStore) DeleteBucket(bucketName string) error {
+	if err := store.Client.Bucket(bucketName).Delete(store.ctx); err != nil {
+		return gcsError(err, "failed to delete bucket", s3err.ErrNoSuchBucket)
+	}
+	return nil
+}
+
+func (store *GCSStore) ListBucket(bucketName string, opts ...ListOption) (*ListBucketResult, error) {
+	o := newListOptions(opts)
+	bucket, err := store.openBucket(bucketName)
+	if err != nil {
+		return nil, err
+	}
+	defer bucket.Close()
+
+	result := &ListBucketResult{
+		XMLName: xml.Name{Local: "ListBucketResult"},
+		Name:    bucketName,
+	}
+	iter := bucket.List(&blob.ListOptions{Prefix: o.Prefix})
+	for {
+		obj, err := iter.Next(store.ctx)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, gcsError(err, "failed to list objects", s3err.ErrNoSuchBucket)
+		}
+		result.Contents = append(result.Contents, Content{
+			Key:          obj.Key,
+			LastModified: obj.ModTime,
+			ETag:         formatETag(obj.MD5),
+			Size:         obj.Size,
+			StorageClass: "STANDARD",
+		})
+	}
+	return o.paginate(result), nil
+}
+
+func (store *GCSStore) ListAllMyBuckets() (*ListAllMyBucketsResult, error) {
+	var buckets Buckets
+	it := store.Client.Buckets(store.ctx, store.projectID)
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, gcsError(err, "failed to list buckets", s3err.ErrNoSuchBucket)
+		}
+		buckets.Bucket = append(buckets.Bucket, Bucket{
+			Name:         attrs.Name,
+			CreationDate: attrs.Created,
+		})
+	}
+
+	return &ListAllMyBucketsResult{
+		XMLName: xml.Name{Local: "ListAllMyBucketsResult"},
+		Xmlns:   "http://s3.amazonaws.com/doc/2006-03-01/",
+		Owner:   store.owner(),
+		Buckets: buckets,
+	}, nil
+}
+
+// GetBucketAcl 把 GCS 的 ACL 转换为 S3 的格式
+// allUsers 和 allAuthenticatedUsers 对应 S3 的全局用户组，其他实体都作为 CanonicalUser
+func (store *GCSStore) GetBucketAcl(bucketName string) (*AccessControlPolicy, error) {
+	rules, err := store.Client.Bucket(bucketName).ACL().List(store.ctx)
+	if err != nil {
+		return nil, gcsError(err, "failed to get bucket ACL", s3err.ErrNoSuchBucket)
+	}
+
+	policy := &AccessControlPolicy{
+		Xmlns: "http://s3.amazonaws.com/doc/2006-03-01/",
+		Owner: store.owner(),
+	}
+	for _, rule := range rules {
+		grantee := Grantee{
+			XmlnsXsi: "http://www.w3.org/2001/XMLSchema-instance",
+			XsiType:  "CanonicalUser",
+			ID:       string(rule.Entity),
+		}
+		switch rule.Entity {
+		case gcs.AllUsers:
+			grantee.XsiType = "Group"
+			grantee.ID = "http://acs.amazonaws.com/groups/global/AllUsers"
+		case gcs.AllAuthenticatedUsers:
+			grantee.XsiType = "Group"
+			grantee.ID = "http://acs.amazonaws.com/groups/global/AuthenticatedUsers"
+		default:
+			grantee.DisplayName = rule.Email
+		}
+		policy.AccessControlList.Grant = append(policy.AccessControlList.Grant, Grant{
+			Grantee:    grantee,
+			Permission: gcsPermission(rule.Role),
+		})
+	}
+	return policy, nil
+}
+
+func gcsPermission(role gcs.ACLRole) string {
+	switch role {
+	case gcs.RoleOwner:
+		return "FULL_CONTROL"
+	case gcs.RoleWriter:
+		return "WRITE"
+	default:
+		return "READ"
+	}
+}
+
+// owner 返回 GCS 中存储桶的所有者，即所在的项目
+func (store *GCSStore) owner() Owner {
+	return Owner{
+		ID:          "project-owners-" + store.projectID,
+		DisplayName: store.projectID,
+	}
+}
+
+func (store *GCSStore) PutObject(bucketName, objectKey string, data *Object, opts ...ObjectOption) error {
+	o := newObjectOptions(opts)
+	// GCS 总是加密数据，AES256 不需要额外处理
+	if data.ServerSideEncryption != "" && data.ServerSideEncryption != SSEAlgorithmAES256 {
+		return s3err.ErrNotImplemented.WithMessage("only AES256 server-side encryption is supported")
+	}
+
+	bucket, err := store.openBucket(bucketName)
+	if err != nil {
+		return err
+	}
+	defer bucket.Close()
+
+	w, err := bucket.NewWriter(store.ctx, objectKey, &blob.WriterOptions{
+		ContentType: data.ContentType,
+		BeforeWrite: beforeGCSCustomerKey(o.SSECustomerKey),
+	})
+	if err != nil {
+		return gcsError(err, "failed to obtain writer", s3err.ErrNoSuchBucket)
+	}
+	if _, err := io.Copy(w, data.Data); err != nil {
+		w.Close()
+		return fmt.Errorf("failed to write object: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		return gcsError(err, "failed to close writer", s3err.ErrNoSuchBucket)
+	}
+	return nil
+}
+
+func (store *GCSStore) GetObject(bucketName, objectKey string, opts ...ObjectOption) (*Object, error) {
+	key := newObjectOptions(opts).SSECustomerKey
+	attrs, err := store.objectAttrs(bucketName, objectKey, key)
+	if err != nil {
+		return nil, err
+	}
+
+	bucket, err := store.openBucket(bucketName)
+	if err != nil {
+		return nil, err
+	}
+	defer bucket.Close()
+
+	r, err := bucket.NewReader(store.ctx, objectKey, &blob.ReaderOptions{BeforeRead: beforeGCSCustomerKey(key)})
+	if err != nil {
+		return nil, gcsError(err, "failed to obtain reader", s3err.ErrNoSuchKey)
+	}
+
+	// 由调用者关闭 Data
+	obj := &Object{
+		Key:          objectKey,
+		Size:         r.Size(),
+		LastModified: r.ModTime(),
+		ContentType:  r.ContentType(),
+		ETag:         formatETag(attrs.MD5),
+		Data:         r,
+	}
+	if key != nil {
+		obj.SSECustomerAlgorithm = key.Algorithm
+		obj.SSECustomerKeyMD5 = key.KeyMD5
+	}
+	return obj, nil
+}
+
+func (store *GCSStore) DeleteObject(bucketName, objectKey string) error {
+	bucket, err := store.openBucket(bucketName)
+	if err != nil {
+		return err
+	}
+	defer bucket.Close()
+
+	if err := bucket.Delete(store.ctx, objectKey); err != nil {
+		return gcsError(err, "failed to delete object", s3err.ErrNoSuchKey)
+	}
+	return nil
+}
+
+// CopyObject 使用 GCS 的 rewrite 在服务端复制，支持跨存储桶
+func (store *GCSStore) CopyObject(srcBucketName, srcObjectKey, destBucketName, destObjectKey string, opts ...ObjectOption) error {
+	o := newObjectOptions(opts)
+	src := store.Client.Bucket(srcBucketName).Object(srcObjectKey)
+	if o.CopySourceSSECustomerKey != nil {
+		src = src.Key(o.CopySourceSSECustomerKey.Key)
+	}
+	dst := store.Client.Bucket(destBucketName).Object(destObjectKey)
+	if o.SSECustomerKey != nil {
+		dst = dst.Key(o.SSECustomerKey.Key)
+	}
+
+	if _, err := dst.CopierFrom(src).Run(store.ctx); err != nil {
+		return gcsError(err, "failed to copy object", s3err.ErrNoSuchKey)
+	}
+	return nil
+}
+
+func (store *GCSStore) MoveObject(srcBucketName, srcObjectKey, destBucketName, destObjectKey string) error {
+	if err := store.CopyObject(srcBucketName, srcObjectKey, destBucketName, destObjectKey); err != nil {
+		return err
+	}
+	return store.DeleteObject(srcBucketName, srcObjectKey)
+}
+
+func (store *GCSStore) HeadObject(bucketName, objectKey string, opts ...ObjectOption) (map[string]string, error) {
+	key := newObjectOptions(opts).SSECustomerKey
+	attrs, err := store.objectAttrs(bucketName, objectKey, key)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata := make(map[string]string)
+	for k, v := range attrs.Metadata {
+		metadata[strings.ToLower(k)] = v
+	}
+	metadata["Size"] = strconv.FormatInt(attrs.Size, 10)
+	metadata["LastModified"] = attrs.Updated.UTC().Format(time.RFC3339)
+	metadata["ContentType"] = attrs.ContentType
+	metadata["ETag"] = formatETag(attrs.MD5)
+	if key != nil {
+		metadata["SSECustomerAlgorithm"] = key.Algorithm
+		metadata["SSECustomerKeyMD5"] = key.KeyMD5
+	}
+	return metadata, nil
+}
+
+// objectAttrs 读取对象的属性，并按 S3 的语义检查 SSE-C 密钥
+// GCS 读取元数据时不要求提供密钥，这里自行比较密钥的 SHA256
+func (store *GCSStore) objectAttrs(bucketName, objectKey string, key *SSECustomerKey) (*gcs.ObjectAttrs, error) {
+	attrs, err := store.Client.Bucket(bucketName).Object(objectKey).Attrs(store.ctx)
+	if err != nil {
+		return nil, gcsError(err, "failed to get object attributes", s3err.ErrNoSuchKey)
+	}
+	if attrs.CustomerKeySHA256 == "" {
+		if key != nil {
+			return nil, s3err.ErrInvalidRequest.WithMessage("The encryption parameters are not applicable to this object.")
+		}
+		return attrs, nil
+	}
+	if key == nil {
+		return nil, s3err.ErrInvalidRequest.WithMessage("The object was stored using a form of Server Side Encryption. The correct parameters must be provided to retrieve the object.")
+	}
+	sum := sha256.Sum256(key.Key)
+	if attrs.CustomerKeySHA256 != base64.StdEncoding.EncodeToString(sum[:]) {
+		return nil, s3err.ErrAccessDenied.WithMessage("The provided encryption key does not match the key used to encrypt the object.")
+	}
+	return attrs, nil
+}
+
+// beforeGCSCustomerKey 把 SSE-C 密钥转换为 GCS 的客户提供的加密密钥（CSEK）
+func beforeGCSCustomerKey(key *SSECustomerKey) func(func(interface{}) bool) error {
+	return func(as func(interface{}) bool) error {
+		var objp **gcs.ObjectHandle
+		if key != nil && as(&objp) {
+			*objp = (*objp).Key(key.Key)
+		}
+		return nil
+	}
+}
+
+// gcsError 把 GCS 的错误转换为 s3err，notFound 是资源不存在时返回的错误
+func gcsError(err error, msg string, notFound *s3err.Error) error {
+	if errors.Is(err, gcs.ErrBucketNotExist) {
+		return fmt.Errorf("%s: %w", msg, s3err.ErrNoSuchBucket)
+	}
+	if errors.Is(err, gcs.ErrObjectNotExist) {
+		return fmt.Errorf("%s: %w", msg, s3err.ErrNoSuchKey)
+	}
+
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) {
+		switch gerr.Code {
+		case http.StatusNotFound:
+			return fmt.Errorf("%s: %w", msg, notFound)
+		case http.StatusConflict:
+			if notFound == s3err.ErrNoSuchBucket && strings.Contains(gerr.Message, "already own") {
+				return s3err.ErrBucketAlreadyOwnedByYou
+			}
+			if notFound == s3err.ErrNoSuchBucket && strings.Contains(gerr.Message, "not empty") {
+				return s3err.ErrBucketNotEmpty
+			}
+			return s3err.ErrBucketAlreadyExists
+		case http.StatusForbidden:
+			return s3err.ErrAccessDenied.WithMessage(gerr.Message)
+		case http.StatusBadRequest:
+			return s3err.ErrInvalidRequest.WithMessage(gerr.Message)
+		}
+	}
+	if gcerrors.Code(err) == gcerrors.NotFound {
+		return fmt.Errorf("%s: %w", msg, notFound)
+	}
+	return fmt.Errorf("%s: %v", msg, err)
+}
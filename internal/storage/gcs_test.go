@@ -0,0 +1,427 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Grey0520/s3proxy/internal/s3err"
+)
+
+// fakeGCS 是一个最小的 GCS JSON/XML API 实现，只覆盖 GCSStore 用到的接口
+type fakeGCS struct {
+	mu      sync.Mutex
+	buckets map[string]*fakeGCSBucket
+}
+
+type fakeGCSBucket struct {
+	created time.Time
+	objects map[string]*fakeGCSObject
+}
+
+type fakeGCSObject struct {
+	data        []byte
+	contentType string
+	metadata    map[string]string
+	updated     time.Time
+	generation  int64
+	// CSEK 的 SHA256，为空表示未使用客户密钥
+	keySHA256 string
+}
+
+func newFakeGCS(t *testing.T) *httptest.Server {
+	f := &fakeGCS{buckets: map[string]*fakeGCSBucket{}}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	t.Setenv("STORAGE_EMULATOR_HOST", srv.Listener.Addr().String())
+	return srv
+}
+
+func (f *fakeGCS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var segs []string
+	for _, s := range strings.Split(strings.Trim(r.URL.EscapedPath(), "/"), "/") {
+		u, _ := url.PathUnescape(s)
+		segs = append(segs, u)
+	}
+
+	switch {
+	case len(segs) >= 3 && segs[0] == "upload" && r.Method == http.MethodPost:
+		f.upload(w, r, segs[4])
+	case len(segs) >= 2 && segs[0] == "storage" && segs[1] == "v1":
+		f.jsonAPI(w, r, segs[2:])
+	case r.Method == http.MethodGet && len(segs) >= 2:
+		// XML API 的下载请求：/bucket/object
+		f.download(w, r, segs[0], strings.Join(segs[1:], "/"))
+	default:
+		gcsFail(w, http.StatusBadRequest, "unsupported request "+r.Method+" "+r.URL.Path)
+	}
+}
+
+func (f *fakeGCS) jsonAPI(w http.ResponseWriter, r *http.Request, segs []string) {
+	switch {
+	case len(segs) == 1 && r.Method == http.MethodPost:
+		var body struct{ Name string }
+		json.NewDecoder(r.Body).Decode(&body)
+		if _, ok := f.buckets[body.Name]; ok {
+			gcsFail(w, http.StatusConflict, "You already own this bucket. Please select another name.")
+			return
+		}
+		f.buckets[body.Name] = &fakeGCSBucket{created: time.Now().UTC(), objects: map[string]*fakeGCSObject{}}
+		gcsJSON(w, bucketResource(body.Name, f.buckets[body.Name]))
+	case len(segs) == 1 && r.Method == http.MethodGet:
+		var items []interface{}
+		for _, name := range sortedKeys(f.buckets) {
+			items = append(items, bucketResource(name, f.buckets[name]))
+		}
+		gcsJSON(w, map[string]interface{}{"kind": "storage#buckets", "items": items})
+	default:
+		b, ok := f.buckets[segs[1]]
+		if !ok {
+			gcsFail(w, http.StatusNotFound, "The specified bucket does not exist.")
+			return
+		}
+		f.bucketAPI(w, r, segs[1], b, segs[2:])
+	}
+}
+
+func (f *fakeGCS) bucketAPI(w http.ResponseWriter, r *http.Request, name string, b *fakeGCSBucket, segs []string) {
+	switch {
+	case len(segs) == 0 && r.Method == http.MethodDelete:
+		if len(b.objects) > 0 {
+			gcsFail(w, http.StatusConflict, "The bucket you tried to delete is not empty.")
+			return
+		}
+		delete(f.buckets, name)
+		w.WriteHeader(http.StatusNoContent)
+	case len(segs) == 1 && segs[0] == "acl":
+		gcsJSON(w, map[string]interface{}{"items": []interface{}{
+			map[string]string{"entity": "project-owners-123", "role": "OWNER"},
+			map[string]string{"entity": "user-dev@example.com", "role": "WRITER", "email": "dev@example.com"},
+			map[string]string{"entity": "allUsers", "role": "READER"},
+		}})
+	case len(segs) == 1 && segs[0] == "o":
+		var items []interface{}
+		for _, key := range sortedKeys(b.objects) {
+			if strings.HasPrefix(key, r.URL.Query().Get("prefix")) {
+				items = append(items, objectResource(name, key, b.objects[key]))
+			}
+		}
+		gcsJSON(w, map[string]interface{}{"kind": "storage#objects", "items": items})
+	case len(segs) >= 2 && segs[0] == "o" && rewriteIndex(segs) > 0:
+		// 客户端不会转义 rewrite 路径里对象名中的 /
+		i := rewriteIndex(segs)
+		f.rewrite(w, r, b.objects[strings.Join(segs[1:i], "/")], segs[i+2], strings.Join(segs[i+4:], "/"))
+	case len(segs) >= 2 && segs[0] == "o":
+		key := strings.Join(segs[1:], "/")
+		obj, ok := b.objects[key]
+		if !ok {
+			gcsFail(w, http.StatusNotFound, "No such object.")
+			return
+		}
+		switch {
+		case r.Method == http.MethodDelete:
+			delete(b.objects, key)
+			w.WriteHeader(http.StatusNoContent)
+		case r.URL.Query().Get("alt") == "media":
+			f.download(w, r, name, key)
+		default:
+			gcsJSON(w, objectResource(name, key, obj))
+		}
+	default:
+		gcsFail(w, http.StatusBadRequest, "unsupported request "+r.Method+" "+r.URL.Path)
+	}
+}
+
+func (f *fakeGCS) upload(w http.ResponseWriter, r *http.Request, bucket string) {
+	b, ok := f.buckets[bucket]
+	if !ok {
+		gcsFail(w, http.StatusNotFound, "The specified bucket does not exist.")
+		return
+	}
+	_, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	mr := multipart.NewReader(r.Body, params["boundary"])
+	part, err := mr.NextPart()
+	if err != nil {
+		gcsFail(w, http.StatusBadRequest, "only multipart uploads are supported")
+		return
+	}
+	var meta struct {
+		Name        string            `json:"name"`
+		ContentType string            `json:"contentType"`
+		Metadata    map[string]string `json:"metadata"`
+	}
+	json.NewDecoder(part).Decode(&meta)
+	part, _ = mr.NextPart()
+	data, _ := io.ReadAll(part)
+
+	obj := &fakeGCSObject{
+		data:        data,
+		contentType: meta.ContentType,
+		metadata:    meta.Metadata,
+		updated:     time.Now().UTC(),
+		generation:  time.Now().UnixNano(),
+		keySHA256:   r.Header.Get("X-Goog-Encryption-Key-Sha256"),
+	}
+	b.objects[meta.Name] = obj
+	gcsJSON(w, objectResource(bucket, meta.Name, obj))
+}
+
+func (f *fakeGCS) download(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	b, ok := f.buckets[bucket]
+	if !ok {
+		gcsFail(w, http.StatusNotFound, "The specified bucket does not exist.")
+		return
+	}
+	obj, ok := b.objects[key]
+	if !ok {
+		gcsFail(w, http.StatusNotFound, "No such object.")
+		return
+	}
+	if obj.keySHA256 != r.Header.Get("X-Goog-Encryption-Key-Sha256") {
+		gcsFail(w, http.StatusBadRequest, "The provided encryption key is incorrect.")
+		return
+	}
+	w.Header().Set("Content-Type", obj.contentType)
+	w.Header().Set("X-Goog-Generation", strconv.FormatInt(obj.generation, 10))
+	w.Header().Set("X-Goog-Metageneration", "1")
+	http.ServeContent(w, r, key, obj.updated, bytes.NewReader(obj.data))
+}
+
+func (f *fakeGCS) rewrite(w http.ResponseWriter, r *http.Request, src *fakeGCSObject, dstBucket, dstKey string) {
+	if src == nil {
+		gcsFail(w, http.StatusNotFound, "No such object.")
+		return
+	}
+	if src.keySHA256 != r.Header.Get("X-Goog-Copy-Source-Encryption-Key-Sha256") {
+		gcsFail(w, http.StatusBadRequest, "The provided encryption key is incorrect.")
+		return
+	}
+	b, ok := f.buckets[dstBucket]
+	if !ok {
+		gcsFail(w, http.StatusNotFound, "The specified bucket does not exist.")
+		return
+	}
+	dst := *src
+	dst.updated = time.Now().UTC()
+	dst.keySHA256 = r.Header.Get("X-Goog-Encryption-Key-Sha256")
+	b.objects[dstKey] = &dst
+	size := strconv.Itoa(len(dst.data))
+	gcsJSON(w, map[string]interface{}{
+		"kind":                "storage#rewriteResponse",
+		"done":                true,
+		"totalBytesRewritten": size,
+		"objectSize":          size,
+		"resource":            objectResource(dstBucket, dstKey, &dst),
+	})
+}
+
+func rewriteIndex(segs []string) int {
+	for i, s := range segs {
+		if s == "rewriteTo" && i+4 < len(segs) {
+			return i
+		}
+	}
+	return -1
+}
+
+func bucketResource(name string, b *fakeGCSBucket) map[string]interface{} {
+	return map[string]interface{}{
+		"kind":        "storage#bucket",
+		"name":        name,
+		"timeCreated": b.created.Format(time.RFC3339Nano),
+	}
+}
+
+func objectResource(bucket, key string, obj *fakeGCSObject) map[string]interface{} {
+	sum := md5.Sum(obj.data)
+	res := map[string]interface{}{
+		"kind":           "storage#object",
+		"bucket":         bucket,
+		"name":           key,
+		"size":           strconv.Itoa(len(obj.data)),
+		"contentType":    obj.contentType,
+		"metadata":       obj.metadata,
+		"generation":     strconv.FormatInt(obj.generation, 10),
+		"metageneration": "1",
+		"updated":        obj.updated.Format(time.RFC3339Nano),
+		"timeCreated":    obj.updated.Format(time.RFC3339Nano),
+	}
+	if obj.keySHA256 == "" {
+		res["md5Hash"] = base64.StdEncoding.EncodeToString(sum[:])
+	} else {
+		res["customerEncryption"] = map[string]string{"encryptionAlgorithm": "AES256", "keySha256": obj.keySHA256}
+	}
+	return res
+}
+
+func gcsJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func gcsFail(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	fmt.Fprintf(w, `{"error":{"code":%d,"message":%q}}`, code, message)
+}
+
+func newTestGCSStore(t *testing.T) *GCSStore {
+	newFakeGCS(t)
+	store, err := NewGCSStore("", "test-project")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	return store
+}
+
+func TestGCSStoreBuckets(t *testing.T) {
+	store := newTestGCSStore(t)
+
+	if err := store.CreateBucket("bucket-a"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := store.CreateBucket("bucket-a"); !errors.Is(err, s3err.ErrBucketAlreadyOwnedByYou) {
+		t.Errorf("Expected BucketAlreadyOwnedByYou, got %v", err)
+	}
+	store.CreateBucket("bucket-b")
+
+	result, err := store.ListAllMyBuckets()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(result.Buckets.Bucket) != 2 || result.Buckets.Bucket[0].Name != "bucket-a" {
+		t.Errorf("Unexpected buckets %+v", result.Buckets.Bucket)
+	}
+
+	acp, err := store.GetBucketAcl("bucket-a")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	grants := acp.AccessControlList.Grant
+	if len(grants) != 3 || grants[0].Permission != "FULL_CONTROL" || grants[1].Permission != "WRITE" {
+		t.Errorf("Unexpected grants %+v", grants)
+	}
+	if grants[2].Grantee.XsiType != "Group" || grants[2].Grantee.ID != "http://acs.amazonaws.com/groups/global/AllUsers" {
+		t.Errorf("Expected allUsers to map to AllUsers group, got %+v", grants[2].Grantee)
+	}
+
+	store.PutObject("bucket-b", "key", &Object{Data: io.NopCloser(strings.NewReader("x"))})
+	if err := store.DeleteBucket("bucket-b"); !errors.Is(err, s3err.ErrBucketNotEmpty) {
+		t.Errorf("Expected BucketNotEmpty, got %v", err)
+	}
+	if err := store.DeleteBucket("bucket-a"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, err := store.ListBucket("bucket-a"); !errors.Is(err, s3err.ErrNoSuchBucket) {
+		t.Errorf("Expected NoSuchBucket, got %v", err)
+	}
+}
+
+func TestGCSStoreObjects(t *testing.T) {
+	store := newTestGCSStore(t)
+	store.CreateBucket("bucket")
+
+	content := []byte("hello from gcs")
+	err := store.PutObject("bucket", "dir/key.txt", &Object{
+		ContentType: "text/plain",
+		Data:        io.NopCloser(bytes.NewReader(content)),
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	obj, err := store.GetObject("bucket", "dir/key.txt")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	sum := md5.Sum(content)
+	if obj.ETag != `"`+fmt.Sprintf("%x", sum)+`"` || obj.ContentType != "text/plain" {
+		t.Errorf("Unexpected ETag %s or content type %s", obj.ETag, obj.ContentType)
+	}
+	obj.Data.(io.Seeker).Seek(6, io.SeekStart)
+	data, _ := io.ReadAll(obj.Data)
+	obj.Data.Close()
+	if string(data) != "from gcs" {
+		t.Errorf("Unexpected content %q", data)
+	}
+
+	head, err := store.HeadObject("bucket", "dir/key.txt")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if head["Size"] != strconv.Itoa(len(content)) {
+		t.Errorf("Unexpected head result %v", head)
+	}
+
+	if err := store.MoveObject("bucket", "dir/key.txt", "bucket", "moved.txt"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	result, err := store.ListBucket("bucket")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(result.Contents) != 1 || result.Contents[0].Key != "moved.txt" || result.Contents[0].Size != int64(len(content)) {
+		t.Errorf("Unexpected listing %+v", result.Contents)
+	}
+
+	if _, err := store.GetObject("bucket", "dir/key.txt"); !errors.Is(err, s3err.ErrNoSuchKey) {
+		t.Errorf("Expected NoSuchKey, got %v", err)
+	}
+}
+
+func TestGCSStoreCustomerKey(t *testing.T) {
+	store := newTestGCSStore(t)
+	store.CreateBucket("bucket")
+	key := newTestCustomerKey(t, 1)
+
+	err := store.PutObject("bucket", "key", &Object{Data: io.NopCloser(strings.NewReader("secret"))}, WithSSECustomerKey(key))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if _, err := store.GetObject("bucket", "key"); !errors.Is(err, s3err.ErrInvalidRequest) {
+		t.Errorf("Expected InvalidRequest without key, got %v", err)
+	}
+	if _, err := store.HeadObject("bucket", "key", WithSSECustomerKey(newTestCustomerKey(t, 2))); !errors.Is(err, s3err.ErrAccessDenied) {
+		t.Errorf("Expected AccessDenied with wrong key, got %v", err)
+	}
+
+	obj, err := store.GetObject("bucket", "key", WithSSECustomerKey(key))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	data, _ := io.ReadAll(obj.Data)
+	obj.Data.Close()
+	if string(data) != "secret" {
+		t.Errorf("Unexpected content %q", data)
+	}
+
+	err = store.CopyObject("bucket", "key", "bucket", "plain", WithCopySourceSSECustomerKey(key))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	head, err := store.HeadObject("bucket", "plain")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if head["Size"] != "6" || head["SSECustomerAlgorithm"] != "" {
+		t.Errorf("Unexpected head result %v", head)
+	}
+}
@@ -0,0 +1,70 @@
+package storage
+
+import (
+	"sort"
+	"strings"
+)
+
+// ListOptions 是列出对象时的附加参数
+type ListOptions struct {
+	// 只返回键以 Prefix 开头的对象
+	Prefix string
+	// 只返回键在 Marker 之后的对象，用于分页
+	Marker string
+	// 最多返回的对象数量，为 0 时不限制
+	MaxKeys int
+}
+
+type ListOption func(*ListOptions)
+
+func WithPrefix(prefix string) ListOption {
+	return func(o *ListOptions) {
+		o.Prefix = prefix
+	}
+}
+
+func WithMarker(marker string) ListOption {
+	return func(o *ListOptions) {
+		o.Marker = marker
+	}
+}
+
+func WithMaxKeys(maxKeys int) ListOption {
+	return func(o *ListOptions) {
+		o.MaxKeys = maxKeys
+	}
+}
+
+func newListOptions(opts []ListOption) *ListOptions {
+	o := &ListOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// match 判断键是否在这次列出的范围内
+func (o *ListOptions) match(key string) bool {
+	return strings.HasPrefix(key, o.Prefix) && key > o.Marker
+}
+
+// paginate 按键排序，过滤出范围内的对象，超过 MaxKeys 时截断
+// 用于不能在后端完成过滤和分页的存储
+func (o *ListOptions) paginate(result *ListBucketResult) *ListBucketResult {
+	contents := result.Contents[:0]
+	for _, c := range result.Contents {
+		if o.match(c.Key) {
+			contents = append(contents, c)
+		}
+	}
+	sort.Slice(contents, func(i, j int) bool { return contents[i].Key < contents[j].Key })
+	if o.MaxKeys > 0 && len(contents) > o.MaxKeys {
+		contents = contents[:o.MaxKeys]
+		result.IsTruncated = true
+	}
+	result.Contents = contents
+	result.Prefix = o.Prefix
+	result.Marker = o.Marker
+	result.MaxKeys = o.MaxKeys
+	return result
+}
@@ -2,38 +2,236 @@ package storage
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/xml"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/Grey0520/s3proxy/internal/s3err"
+	bolt "go.etcd.io/bbolt"
 	"gocloud.dev/blob"
 	"gocloud.dev/blob/fileblob"
+	"gocloud.dev/gcerrors"
 )
 
 // Local File System (LFS) Store
 type LFSStore struct {
-	Bucket   *blob.Bucket
 	ctx      context.Context
 	basePath string
+
+	// 每个存储桶对应一个 fileblob，第一次使用时打开，之后复用，删除存储桶时关闭
+	// 请求是并发处理的，每个操作都使用自己存储桶的 handle，不能共用一个可变的字段
+	mu      sync.RWMutex
+	buckets map[string]*blob.Bucket
+	// 所有存储桶以及创建时间，见 local_registry.go
+	registry map[string]time.Time
+	// 每个存储桶的元数据索引，见 local_index.go
+	index   bool
+	indexes map[string]*bolt.DB
+	// 按存储桶和键分片的锁，修改对象时持有，见 indexed
+	locks [64]sync.Mutex
+	// 按存储桶分片的读写锁，修改对象时持有读锁，删除存储桶时持有写锁，见 indexed 和 deleteBucket
+	bucketLocks [16]sync.RWMutex
+
+	// 写入对象的持久化级别，见 local_write.go
+	durability string
+	// 打开时不清理临时文件，见 WithoutRecovery
+	noRecovery bool
+	opened     time.Time
+
+	// 后台完整性检查的间隔，为 0 时不检查，见 local_scrub.go
+	scrubInterval   time.Duration
+	scrubQuarantine bool
+
+	// 发现不经过 s3proxy 的修改，见 local_watch.go
+	watch          bool
+	rescanInterval time.Duration
+	onChange       func(ChangeEvent)
+
+	// 剩余空间的下限，低于下限时只读，没有开启时为 nil，见 local_space.go
+	space *spaceGuard
+
+	// 服务端加密的主密钥，为空时不支持加密
+	masterKey []byte
+
+	// 透明压缩的算法和适用范围，算法为空时不压缩
+	compression     string
+	compressBuckets map[string]bool
+	compressTypes   []string
+
+	// 按内容去重，见 local_cas.go
+	cas           bool
+	casGCInterval time.Duration
+	// 保护引用计数以及指针的修改，读取去重对象时持有读锁，内容不会在打开之前被回收
+	casMu      sync.RWMutex
+	casRefs    map[string]int
+	casUploads map[string]bool
+
+	// 关闭时停止后台任务，并等待正在执行的任务结束
+	done       chan struct{}
+	closeOnce  sync.Once
+	background sync.WaitGroup
+	// basePath/.s3proxy/lock，打开期间持有，见 local_lock.go
+	lockFile *os.File
+}
+
+// LFSOption 用于配置 LFSStore 的可选功能
+type LFSOption func(*LFSStore) error
+
+// WithMasterKey 设置服务端加密使用的主密钥，key 为 base64 编码的 32 字节密钥
+func WithMasterKey(key string) LFSOption {
+	return func(local *LFSStore) error {
+		raw, err := base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			return fmt.Errorf("invalid master key: %v", err)
+		}
+		if len(raw) != sseKeySize {
+			return fmt.Errorf("invalid master key: expected %d bytes, got %d", sseKeySize, len(raw))
+		}
+		local.masterKey = raw
+		return nil
+	}
+}
+
+// WithCompression 开启透明压缩，压缩 buckets 中的存储桶以及 Content-Type 匹配 contentTypes 的对象
+func WithCompression(algorithm string, buckets, contentTypes []string) LFSOption {
+	return func(local *LFSStore) error {
+		if _, err := newFrameCodec(algorithm); err != nil {
+			return err
+		}
+		local.compression = algorithm
+		local.compressBuckets = make(map[string]bool)
+		for _, b := range buckets {
+			local.compressBuckets[b] = true
+		}
+		local.compressTypes = normalizeContentTypes(contentTypes)
+		return nil
+	}
 }
 
-func NewLFSStore(basePath string) (*LFSStore, error) {
+func NewLFSStore(basePath string, opts ...LFSOption) (*LFSStore, error) {
 	err := createDirIfNotExist(basePath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create dir: %v", err)
 	}
 
-	b, err := fileblob.OpenBucket(basePath, nil)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open bucket: %v", err)
+	local := &LFSStore{
+		ctx:        context.Background(),
+		basePath:   basePath,
+		buckets:    make(map[string]*blob.Bucket),
+		indexes:    make(map[string]*bolt.DB),
+		durability: DurabilityFile,
+		done:       make(chan struct{}),
 	}
-	return &LFSStore{
-		Bucket:   b,
-		ctx:      context.Background(),
-		basePath: basePath,
-	}, nil
+	for _, opt := range opts {
+		if err := opt(local); err != nil {
+			return nil, err
+		}
+	}
+	if err := local.validate(); err != nil {
+		return nil, err
+	}
+	if err := local.lockBasePath(); err != nil {
+		return nil, err
+	}
+	if err := local.open(); err != nil {
+		// 释放 basePath 的锁并停止已经启动的后台任务
+		local.Close()
+		return nil, err
+	}
+	return local, nil
+}
+
+// validate 检查选项的取值以及选项之间的组合，在锁定 basePath 之前调用
+func (local *LFSStore) validate() error {
+	switch {
+	case local.scrubInterval < 0:
+		return fmt.Errorf("scrub interval cannot be negative")
+	case local.scrubQuarantine && local.scrubInterval == 0:
+		return fmt.Errorf("scrub quarantine requires a scrub interval")
+	case local.casGCInterval < 0:
+		return fmt.Errorf("dedup garbage collection interval cannot be negative")
+	case local.rescanInterval < 0:
+		return fmt.Errorf("watch rescan interval cannot be negative")
+	}
+	return nil
+}
+
+// open 完成中断的写入，加载存储桶并启动后台任务，调用前需要锁定 basePath
+func (local *LFSStore) open() error {
+	local.opened = time.Now()
+	if !local.noRecovery {
+		if err := local.recoverWrites(); err != nil {
+			return err
+		}
+	}
+	if err := local.loadRegistry(); err != nil {
+		return err
+	}
+	if local.cas {
+		if err := local.initCAS(); err != nil {
+			return err
+		}
+	}
+	if local.space != nil {
+		if err := local.initSpace(); err != nil {
+			return err
+		}
+	}
+	// 离线命令只做检查，不启动会修改数据的后台任务
+	if local.noRecovery {
+		return nil
+	}
+	if local.scrubInterval > 0 {
+		local.background.Add(1)
+		go local.runEvery(local.scrubInterval, local.scrubOnce)
+	}
+	if local.watch {
+		local.background.Add(1)
+		go local.watchLoop()
+	}
+	return nil
+}
+
+// runEvery 每隔 interval 执行一次 fn，直到 Close
+func (local *LFSStore) runEvery(interval time.Duration, fn func()) {
+	defer local.background.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-local.done:
+			return
+		case <-ticker.C:
+			fn()
+		}
+	}
+}
+
+// Close 停止后台任务，关闭所有索引并释放 basePath 的锁，之后其他 LFSStore 可以打开 basePath
+func (local *LFSStore) Close() error {
+	local.closeOnce.Do(func() {
+		close(local.done)
+		local.background.Wait()
+
+		local.mu.Lock()
+		defer local.mu.Unlock()
+		for name := range local.indexes {
+			local.closeIndex(name)
+		}
+		if local.lockFile != nil {
+			local.lockFile.Close()
+		}
+	})
+	return nil
 }
 
 func (local *LFSStore) CreateBucket(bucketName string) error {
@@ -44,8 +242,8 @@ func (local *LFSStore) DeleteBucket(bucketName string) error {
 	return local.deleteBucket(bucketName)
 }
 
-func (local *LFSStore) ListBucket(bucketName string) (*ListBucketResult, error) {
-	return local.listBucket(bucketName)
+func (local *LFSStore) ListBucket(bucketName string, opts ...ListOption) (*ListBucketResult, error) {
+	return local.listBucket(bucketName, newListOptions(opts))
 }
 
 func (local *LFSStore) ListAllMyBuckets() (*ListAllMyBucketsResult, error) {
@@ -56,119 +254,182 @@ func (local *LFSStore) GetBucketAcl(bucketName string) (*AccessControlPolicy, er
 	return local.getBucketAcl(bucketName)
 }
 
-func (local *LFSStore) PutObject(bucketName, objectKey string, data *Object) error {
-	return local.putObject(bucketName, objectKey, data)
+func (local *LFSStore) PutObject(bucketName, objectKey string, data *Object, opts ...ObjectOption) error {
+	return local.putObject(bucketName, objectKey, data, newObjectOptions(opts))
 }
 
-func (local *LFSStore) GetObject(bucketName, objectKey string) (*Object, error) {
-	return local.getObject(bucketName, objectKey)
+func (local *LFSStore) GetObject(bucketName, objectKey string, opts ...ObjectOption) (*Object, error) {
+	return local.getObject(bucketName, objectKey, newObjectOptions(opts).SSECustomerKey)
 }
 
 func (local *LFSStore) DeleteObject(bucketName, objectKey string) error {
 	return local.deleteObject(bucketName, objectKey)
 }
 
-func (local *LFSStore) CopyObject(srcBucketName, srcObjectKey, destBucketName, destObjectKey string) error {
-	return local.copyObject(srcBucketName, srcObjectKey, destBucketName, destObjectKey)
+func (local *LFSStore) CopyObject(srcBucketName, srcObjectKey, destBucketName, destObjectKey string, opts ...ObjectOption) error {
+	return local.copyObject(srcBucketName, srcObjectKey, destBucketName, destObjectKey, newObjectOptions(opts))
 }
 
 func (local *LFSStore) MoveObject(srcBucketName, srcObjectKey, destBucketName, destObjectKey string) error {
 	return local.moveObject(srcBucketName, srcObjectKey, destBucketName, destObjectKey)
 }
 
-func (local *LFSStore) HeadObject(bucketName, objectKey string) (map[string]string, error) {
-	return local.headObject(bucketName, objectKey)
+func (local *LFSStore) HeadObject(bucketName, objectKey string, opts ...ObjectOption) (map[string]string, error) {
+	return local.headObject(bucketName, objectKey, newObjectOptions(opts).SSECustomerKey)
 }
 
 func (local *LFSStore) createBucket(bucketName string) error {
-	dir := fmt.Sprintf("%s/%s", local.basePath, bucketName)
-
-	// 确保不存在同名的目录
-	if _, err := os.Stat(dir); !os.IsNotExist(err) {
-		return fmt.Errorf("bucket %s already exists", bucketName)
+	if err := checkBucketName(bucketName); err != nil {
+		return err
 	}
-
-	if err := createDir(dir); err != nil {
+	if err := local.checkSpace(0); err != nil {
 		return err
 	}
-
-	b, err := fileblob.OpenBucket(dir, nil)
-	if err != nil {
+	local.mu.Lock()
+	defer local.mu.Unlock()
+	if _, ok := local.registry[bucketName]; ok {
+		return fmt.Errorf("bucket %s already exists: %w", bucketName, s3err.ErrBucketAlreadyExists)
+	}
+	// 不在列表中的同名目录可能保存着其他数据，不能当作新的存储桶
+	if err := os.Mkdir(local.bucketPath(bucketName), 0o755); err != nil {
+		if os.IsExist(err) {
+			return fmt.Errorf("bucket %s already exists: %w", bucketName, s3err.ErrBucketAlreadyExists)
+		}
 		return fmt.Errorf("failed to create bucket %s: %v", bucketName, err)
 	}
-	local.Bucket = b
-	defer b.Close()
-
+	local.registry[bucketName] = time.Now().UTC()
+	if err := local.saveRegistry(); err != nil {
+		delete(local.registry, bucketName)
+		os.Remove(local.bucketPath(bucketName))
+		return err
+	}
 	return nil
 }
 
 func (local *LFSStore) deleteBucket(bucketName string) error {
-	dir := fmt.Sprintf("%s/%s", local.basePath, bucketName)
+	dir := local.bucketPath(bucketName)
+
+	// 从检查是否为空到删除目录期间不能有对象写入，否则写入成功的对象会随目录一起删除
+	bucketLock := local.bucketLock(bucketName)
+	bucketLock.Lock()
+	defer bucketLock.Unlock()
 
 	// 桶内有对象则不允许删除
-	result, err := local.ListBucket(bucketName)
+	result, err := local.ListBucket(bucketName, WithMaxKeys(1))
 	if err != nil {
-		return fmt.Errorf("failed to get bucket %s: %v", bucketName, err)
+		return err
 	}
 	if len(result.Contents) > 0 {
-		return fmt.Errorf("bucket %s is not empty", bucketName)
+		return fmt.Errorf("bucket %s is not empty: %w", bucketName, s3err.ErrBucketNotEmpty)
 	}
 
+	local.mu.Lock()
+	defer local.mu.Unlock()
+	if b, ok := local.buckets[bucketName]; ok {
+		b.Close()
+		delete(local.buckets, bucketName)
+	}
+	local.closeIndex(bucketName)
+	if _, ok := local.registry[bucketName]; !ok {
+		return fmt.Errorf("bucket %s does not exist: %w", bucketName, s3err.ErrNoSuchBucket)
+	}
+	delete(local.registry, bucketName)
+	if err := local.saveRegistry(); err != nil {
+		return err
+	}
 	if err := os.RemoveAll(dir); err != nil {
 		return fmt.Errorf("failed to delete bucket %s: %v", bucketName, err)
 	}
+	if err := os.Remove(local.bucketConfigPath(bucketName)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete bucket %s config: %v", bucketName, err)
+	}
+	if err := os.Remove(local.indexPath(bucketName)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete bucket %s index: %v", bucketName, err)
+	}
 	return nil
 }
 
-func (local *LFSStore) listBucket(bucketName string) (*ListBucketResult, error) {
-	if local.Bucket == nil {
-		return nil, fmt.Errorf("bucket %s is not initialized", bucketName)
+func (local *LFSStore) listBucket(bucketName string, o *ListOptions) (*ListBucketResult, error) {
+	b, err := local.bucket(bucketName)
+	if err != nil {
+		return nil, err
 	}
-
-	if err := local.checkoutBucket(bucketName); err != nil {
+	if local.index {
+		db, err := local.indexDB(bucketName, b)
+		if err != nil {
+			return nil, err
+		}
+		return local.listIndex(bucketName, db, o)
+	}
+	objs, err := local.listObjects(b, o.Prefix)
+	if err != nil {
 		return nil, err
 	}
-	iter := local.Bucket.List(&blob.ListOptions{})
 
 	result := &ListBucketResult{
 		XMLName: xml.Name{Local: "ListBucketResult"},
 		Name:    bucketName,
 	}
-	for {
-		obj, err := iter.Next(local.ctx)
-		if err == io.EOF {
-			break
+	for _, obj := range objs {
+		if !o.match(obj.Key) {
+			continue
+		}
+		// 加密和压缩后磁盘上的大小与原始大小不同，需要读取属性计算
+		entry, err := local.objectEntry(b, obj.Key)
+		if gcerrors.Code(err) == gcerrors.NotFound {
+			// 列出之后被并发的请求删除了
+			continue
 		}
 		if err != nil {
-			return nil, fmt.Errorf("failed to list objects: %v", err)
+			return nil, fmt.Errorf("failed to get object %s: %v", obj.Key, err)
 		}
 		content := Content{
 			Key:          obj.Key,
 			LastModified: obj.ModTime,
-			ETag:         string(obj.MD5),
-			Size:         obj.Size,
+			ETag:         entry.ETag,
+			Size:         entry.Size,
 			StorageClass: "STANDARD",
 			Owner:        newFakeOwner(),
 		}
 		result.Contents = append(result.Contents, content)
 	}
 
-	return result, nil
+	return o.paginate(result), nil
+}
+
+// listObjects 列出存储桶中键以 prefix 开头的对象
+// fileblob 遍历目录时遇到被并发删除的文件会返回 NotFound，这时重新遍历
+func (local *LFSStore) listObjects(b *blob.Bucket, prefix string) ([]*blob.ListObject, error) {
+	for attempt := 1; ; attempt++ {
+		var objs []*blob.ListObject
+		iter := b.List(&blob.ListOptions{Prefix: prefix})
+		for {
+			obj, err := iter.Next(local.ctx)
+			if err == io.EOF {
+				return objs, nil
+			}
+			if gcerrors.Code(err) == gcerrors.NotFound && attempt < 3 {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to list objects: %v", err)
+			}
+			objs = append(objs, obj)
+		}
+	}
 }
 
 func (local *LFSStore) listAllMyBuckets() (*ListAllMyBucketsResult, error) {
+	local.mu.RLock()
+	entries := local.registryEntries()
+	local.mu.RUnlock()
+
 	var buckets []Bucket
-	err := filepath.Walk(local.basePath, func(path string, info os.FileInfo, err error) error {
-		if info.IsDir() {
-			buckets = append(buckets, Bucket{
-				Name:         info.Name(),
-				CreationDate: info.ModTime(),
-			})
-		}
-		return nil
-	})
-	if err != nil {
-		return nil, err
+	for _, e := range entries {
+		buckets = append(buckets, Bucket{
+			Name:         e.Name,
+			CreationDate: e.CreationDate,
+		})
 	}
 	return &ListAllMyBucketsResult{
 		XMLName: xml.Name{Local: "ListAllMyBucketsResult"},
@@ -180,14 +441,15 @@ func (local *LFSStore) listAllMyBuckets() (*ListAllMyBucketsResult, error) {
 }
 
 func (local *LFSStore) getBucketAcl(bucketName string) (*AccessControlPolicy, error) {
+	owner := newFakeOwner()
 	acp := &AccessControlPolicy{
-		Owner: newFakeOwner(),
+		Owner: owner,
 		AccessControlList: AccessControlList{
 			Grant: []Grant{
 				{
 					Grantee: Grantee{
-						ID:          "fake-owner-id",
-						DisplayName: "fake-owner-name",
+						ID:          owner.ID,
+						DisplayName: owner.DisplayName,
 					},
 					Permission: "FULL_CONTROL",
 				},
@@ -197,89 +459,176 @@ func (local *LFSStore) getBucketAcl(bucketName string) (*AccessControlPolicy, er
 	return acp, nil
 }
 
-func (local *LFSStore) putObject(bucketName, objectKey string, data *Object) error {
-	if err := local.checkoutBucket(bucketName); err != nil {
+func (local *LFSStore) putObject(bucketName, objectKey string, data *Object, o *ObjectOptions) error {
+	b, err := local.object(bucketName, objectKey)
+	if err != nil {
 		return err
 	}
-
-	opts := &blob.WriterOptions{
-		ContentType: data.ContentType,
+	if err := local.checkSpace(data.Size); err != nil {
+		return err
 	}
-	writer, err := local.Bucket.NewWriter(local.ctx, objectKey, opts)
+
+	dataKey, metadata, err := local.encryptionFor(bucketName, data, o)
 	if err != nil {
-		return fmt.Errorf("failed to create object %s: %v", objectKey, err)
+		return err
+	}
+	compression := local.compressionFor(bucketName, data.ContentType, o)
+	if compression != "" {
+		if metadata == nil {
+			metadata = map[string]string{}
+		}
+		metadata[metaCompression] = compression
+	}
+	if local.cas && dataKey == nil && compression == "" {
+		return local.putCAS(bucketName, b, objectKey, data)
 	}
 
-	// if data.ContentType != "" {
-	// 	writer.ContentType = data.ContentType
-	// }
-	if _, err := io.Copy(writer, data.Data); err != nil {
-		writer.Close()
+	writer, err := local.newObjectWriter(bucketName, objectKey, data.ContentType, metadata)
+	if err != nil {
 		return err
 	}
 
-	if err = writer.Close(); err != nil {
+	// 先压缩再加密，数据没有完整写入时丢弃临时文件，不会覆盖原来的对象
+	w, finish, err := encodeObject(writer, dataKey, compression)
+	if err != nil {
+		writer.abort()
 		return err
 	}
-	return nil
+	if _, err := io.Copy(w, data.Data); err != nil {
+		writer.abort()
+		return err
+	}
+	if err := finish(); err != nil {
+		writer.abort()
+		return err
+	}
+
+	err = local.indexed(bucketName, b, objectKey, func() error {
+		return local.replaceObject(b, objectKey, writer.commit)
+	})
+	if err != nil {
+		// 存储桶在写入期间被删除时没有执行 commit，临时文件需要在这里删除
+		writer.abort()
+	}
+	return err
 }
 
-func (local *LFSStore) getObject(bucketName, objectKey string) (*Object, error) {
-	if err := local.checkoutBucket(bucketName); err != nil {
+func (local *LFSStore) getObject(bucketName, objectKey string, key *SSECustomerKey) (*Object, error) {
+	b, err := local.object(bucketName, objectKey)
+	if err != nil {
 		return nil, err
 	}
+	// 读取指针之后、打开内容之前对象可能被删除，内容随之被回收，打开之后再删除不影响读取
+	if local.cas {
+		local.casMu.RLock()
+		defer local.casMu.RUnlock()
+	}
 
-	reader, err := local.Bucket.NewReader(local.ctx, objectKey, nil)
+	attrs, err := b.Attributes(local.ctx, objectKey)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get object %s: %v", objectKey, err)
+		return nil, objectError(objectKey, err)
+	}
+	dataKey, err := local.decryptionFor(attrs, key)
+	if err != nil {
+		return nil, err
 	}
-	// defer reader.Close()
 
-	contentType := reader.ContentType()
+	var data io.ReadSeekCloser
+	var size int64
+	var etag string
+	if attrs.Metadata[metaCAS] != "" {
+		if size, etag, err = casDescribe(attrs); err != nil {
+			return nil, fmt.Errorf("failed to get object %s: %v", objectKey, err)
+		}
+		if data, err = local.openCAS(objectKey, attrs); err != nil {
+			return nil, err
+		}
+	} else {
+		reader, err := b.NewReader(local.ctx, objectKey, nil)
+		if err != nil {
+			return nil, objectError(objectKey, err)
+		}
+		if data, size, etag, err = decodeObject(reader, attrs, dataKey); err != nil {
+			reader.Close()
+			return nil, fmt.Errorf("failed to get object %s: %v", objectKey, err)
+		}
+	}
 
-	return &Object{
-		Key:         objectKey,
-		ContentType: contentType,
-		Data:        reader,
-	}, nil
+	obj := &Object{
+		Key:          objectKey,
+		Size:         size,
+		LastModified: attrs.ModTime,
+		ContentType:  attrs.ContentType,
+		ETag:         etag,
+		Data:         data,
+	}
+	obj.ServerSideEncryption = attrs.Metadata[metaSSE]
+	if key != nil {
+		obj.SSECustomerAlgorithm = key.Algorithm
+		obj.SSECustomerKeyMD5 = key.KeyMD5
+	}
+	return obj, nil
 }
 
 func (local *LFSStore) deleteObject(bucketName, objectKey string) error {
-	if err := local.checkoutBucket(bucketName); err != nil {
+	b, err := local.object(bucketName, objectKey)
+	if err != nil {
 		return err
 	}
 
-	if err := local.Bucket.Delete(local.ctx, objectKey); err != nil {
-		return fmt.Errorf("failed to delete object %s: %v", objectKey, err)
-	}
-	return nil
+	return local.indexed(bucketName, b, objectKey, func() error {
+		return local.replaceObject(b, objectKey, func() error {
+			if err := b.Delete(local.ctx, objectKey); err != nil {
+				return fmt.Errorf("failed to delete object %s: %v", objectKey, err)
+			}
+			return local.syncObjectDir(bucketName, objectKey)
+		})
+	})
 }
 
-func (local *LFSStore) copyObject(srcBucket, srcObject, dstBucket, dstObject string) error {
-	if err := local.checkoutBucket(srcBucket); err != nil {
+func (local *LFSStore) copyObject(srcBucket, srcObject, dstBucket, dstObject string, o *ObjectOptions) error {
+	src, err := local.object(srcBucket, srcObject)
+	if err != nil {
+		return err
+	}
+	dst, err := local.object(dstBucket, dstObject)
+	if err != nil {
 		return err
 	}
-	if err := local.checkoutBucket(dstBucket); err != nil {
+	if err := local.checkSpace(0); err != nil {
 		return err
 	}
+	// 去重的对象只需要复制指针
+	if local.cas {
+		copied := false
+		err := local.indexed(dstBucket, dst, dstObject, func() (err error) {
+			copied, err = local.copyCAS(src, srcObject, dst, dstBucket, dstObject, o)
+			return err
+		})
+		if copied || err != nil {
+			return err
+		}
+	}
 
-	srcData, err := local.getObject(srcBucket, srcObject)
+	srcData, err := local.getObject(srcBucket, srcObject, o.CopySourceSSECustomerKey)
 	if err != nil {
-		return fmt.Errorf("failed to get object %s: %v", srcObject, err)
+		return err
 	}
+	defer srcData.Data.Close()
 	dstData := &Object{
 		Key:         dstObject,
+		Size:        srcData.Size,
 		ContentType: srcData.ContentType,
 		Data:        srcData.Data,
 	}
-	if err := local.putObject(dstBucket, dstObject, dstData); err != nil {
-		return fmt.Errorf("failed to put object %s: %v", dstObject, err)
+	if err := local.putObject(dstBucket, dstObject, dstData, &ObjectOptions{SSECustomerKey: o.SSECustomerKey}); err != nil {
+		return err
 	}
 	return nil
 }
 
 func (local *LFSStore) moveObject(srcBucketName, srcObjectKey, destBucketName, destObjectKey string) error {
-	err := local.copyObject(srcBucketName, srcObjectKey, destBucketName, destObjectKey)
+	err := local.copyObject(srcBucketName, srcObjectKey, destBucketName, destObjectKey, &ObjectOptions{})
 	if err != nil {
 		return fmt.Errorf("failed to copy object %s to %s: %v", srcObjectKey, destObjectKey, err)
 	}
@@ -292,24 +641,65 @@ func (local *LFSStore) moveObject(srcBucketName, srcObjectKey, destBucketName, d
 	return nil
 }
 
-func (local *LFSStore) headObject(bucketName, objectKey string) (map[string]string, error) {
-	// if err := local.checkoutBucket(bucketName); err != nil {
-	// 	return nil, err
-	// }
+// headObject 返回对象的属性，键名与 AWSStore.HeadObject 一致，其余为用户元数据
+func (local *LFSStore) headObject(bucketName, objectKey string, key *SSECustomerKey) (map[string]string, error) {
+	b, err := local.object(bucketName, objectKey)
+	if err != nil {
+		return nil, err
+	}
 
-	// attrs, err := local.Bucket.Attrs(local.ctx, objectKey)
-	// if err != nil {
-	// 	return nil, fmt.Errorf("failed to get object %s: %v", objectKey, err)
-	// }
+	attrs, err := b.Attributes(local.ctx, objectKey)
+	if err != nil {
+		return nil, objectError(objectKey, err)
+	}
+	// 与 S3 一样，SSE-C 对象的 HEAD 也需要提供正确的密钥
+	dataKey, err := local.decryptionFor(attrs, key)
+	if err != nil {
+		return nil, err
+	}
+	size, etag, err := local.describeObject(b, objectKey, attrs, dataKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get object %s: %v", objectKey, err)
+	}
 
-	// return map[string]string{
-	// 	"Content-Length": strconv.FormatInt(attrs.Size, 10),
-	// 	"Content-Type":   attrs.ContentType,
-	// }, nil
-	return nil, nil
+	result := map[string]string{}
+	for k, v := range attrs.Metadata {
+		if !strings.HasPrefix(k, metaPrefix) {
+			result[k] = v
+		}
+	}
+	result["Size"] = strconv.FormatInt(size, 10)
+	result["LastModified"] = attrs.ModTime.UTC().Format(time.RFC3339)
+	result["ContentType"] = attrs.ContentType
+	result["ETag"] = etag
+	if sse := attrs.Metadata[metaSSE]; sse != "" {
+		result["ServerSideEncryption"] = sse
+	}
+	if key != nil {
+		result["SSECustomerAlgorithm"] = key.Algorithm
+		result["SSECustomerKeyMD5"] = key.KeyMD5
+	}
+	return result, nil
 }
 
 // Some Utils
+
+// objectError 把对象不存在的错误转换为 NoSuchKey
+func objectError(objectKey string, err error) error {
+	if gcerrors.Code(err) == gcerrors.NotFound {
+		return fmt.Errorf("object %s does not exist: %w", objectKey, s3err.ErrNoSuchKey)
+	}
+	return fmt.Errorf("failed to get object %s: %v", objectKey, err)
+}
+
+// formatETag 把 MD5 转换为 S3 格式的 ETag（带引号的十六进制）
+func formatETag(md5 []byte) string {
+	if len(md5) == 0 {
+		return ""
+	}
+	return `"` + hex.EncodeToString(md5) + `"`
+}
+
 func createDir(dir string) error {
 	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
 		return fmt.Errorf("failed to create directory %s: %v", dir, err)
@@ -324,30 +714,75 @@ func createDirIfNotExist(dir string) error {
 	return nil
 }
 
-func (local *LFSStore) checkoutBucket(bucketName string) error {
+func (local *LFSStore) bucketPath(bucketName string) string {
+	return filepath.Join(local.basePath, bucketName)
+}
+
+// validLocalBucketName 检查存储桶名称可以直接作为 basePath 下的目录名
+// 不能包含路径分隔符，也不能与 .s3proxy、.cas 这样的内部目录冲突
+// 之前的版本创建的存储桶不一定符合 checkBucketName 的规则，访问已有的存储桶时只要求这一点
+func validLocalBucketName(bucketName string) bool {
+	return bucketName != "" && !strings.HasPrefix(bucketName, ".") && !strings.ContainsAny(bucketName, `/\`)
+}
+
+// bucket 返回存储桶的 handle，存储桶不存在时返回 NoSuchBucket
+// 存储桶是否存在只查询内存中的列表，handle 打开后缓存在 buckets 中
+func (local *LFSStore) bucket(bucketName string) (*blob.Bucket, error) {
 	if local.basePath == "" {
-		return fmt.Errorf("basePath cannot be empty")
+		return nil, fmt.Errorf("basePath cannot be empty")
 	}
 
-	//假设不存在这个桶
-	exist := false
-	filepath.Walk(local.basePath, func(path string, info os.FileInfo, err error) error {
-		if info.IsDir() && info.Name() == bucketName {
-			exist = true
-		}
-		return nil
-	})
+	local.mu.RLock()
+	b, ok := local.buckets[bucketName]
+	_, exists := local.registry[bucketName]
+	local.mu.RUnlock()
+	if ok {
+		return b, nil
+	}
+	if !exists {
+		return nil, fmt.Errorf("bucket %s does not exist: %w", bucketName, s3err.ErrNoSuchBucket)
+	}
 
-	if exist {
-		dir := fmt.Sprintf("%s/%s", local.basePath, bucketName)
-		b, err := fileblob.OpenBucket(dir, nil)
-		if err != nil {
-			return fmt.Errorf("failed to open bucket %s: %v", bucketName, err)
-		}
-		local.Bucket = b
-		return nil
+	local.mu.Lock()
+	defer local.mu.Unlock()
+	if b, ok := local.buckets[bucketName]; ok {
+		return b, nil
+	}
+	// 等待写锁时存储桶可能被删除了
+	if _, ok := local.registry[bucketName]; !ok {
+		return nil, fmt.Errorf("bucket %s does not exist: %w", bucketName, s3err.ErrNoSuchBucket)
+	}
+	b, err := fileblob.OpenBucket(local.bucketPath(bucketName), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open bucket %s: %v", bucketName, err)
+	}
+	local.buckets[bucketName] = b
+	return b, nil
+}
+
+func (local *LFSStore) lock(bucketName, objectKey string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(bucketName + "\x00" + objectKey))
+	return &local.locks[h.Sum32()%uint32(len(local.locks))]
+}
+
+func (local *LFSStore) bucketLock(bucketName string) *sync.RWMutex {
+	h := fnv.New32a()
+	h.Write([]byte(bucketName))
+	return &local.bucketLocks[h.Sum32()%uint32(len(local.bucketLocks))]
+}
+
+// object 返回对象所在存储桶的 handle，并检查键在磁盘上的路径不会离开存储桶目录
+// fileblob 直接使用键拼接路径，所有访问对象的操作都要先经过这里
+func (local *LFSStore) object(bucketName, objectKey string) (*blob.Bucket, error) {
+	b, err := local.bucket(bucketName)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := escapeKey(objectKey); err != nil {
+		return nil, err
 	}
-	return fmt.Errorf("bucket %s does not exist", bucketName)
+	return b, nil
 }
 
 func newFakeOwner() Owner {
@@ -0,0 +1,294 @@
+package storage
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"gocloud.dev/blob"
+	"gocloud.dev/blob/fileblob"
+)
+
+const (
+	// 去重模式下对象内容保存在 basePath/.cas/<前两位>/<sha256>，上传中的临时文件在 .cas/tmp
+	casDirName = ".cas"
+
+	// 去重的对象在存储桶中只是一个空文件，通过元数据指向 .cas 中的内容
+	metaCAS     = metaPrefix + "cas"
+	metaCASSize = metaPrefix + "cas-size"
+	metaCASMD5  = metaPrefix + "cas-md5"
+)
+
+// WithDedup 开启按内容去重，interval 大于 0 时定期回收不再被引用的内容
+// 加密或压缩的对象仍然单独保存
+func WithDedup(interval time.Duration) LFSOption {
+	return func(local *LFSStore) error {
+		local.cas = true
+		local.casGCInterval = interval
+		return nil
+	}
+}
+
+func (local *LFSStore) casDir() string {
+	return filepath.Join(local.basePath, casDirName)
+}
+
+func (local *LFSStore) casBlobPath(hash string) string {
+	return filepath.Join(local.casDir(), hash[:2], hash)
+}
+
+// initCAS 统计每份内容被引用的次数并启动回收任务
+// 引用计数只保存在内存中，以存储桶中的指针为准，因此不会因为异常退出而不一致
+func (local *LFSStore) initCAS() error {
+	// 上次退出时没有完成的上传不会再被引用
+	tmp := filepath.Join(local.casDir(), "tmp")
+	if !local.noRecovery {
+		if err := os.RemoveAll(tmp); err != nil {
+			return fmt.Errorf("failed to remove temp files: %v", err)
+		}
+	}
+	if err := createDir(tmp); err != nil {
+		return err
+	}
+	local.casRefs = make(map[string]int)
+	local.casUploads = make(map[string]bool)
+
+	result, err := local.listAllMyBuckets()
+	if err != nil {
+		return err
+	}
+	for _, b := range result.Buckets.Bucket {
+		bucket, err := fileblob.OpenBucket(filepath.Join(local.basePath, b.Name), nil)
+		if err != nil {
+			return fmt.Errorf("failed to open bucket %s: %v", b.Name, err)
+		}
+		iter := bucket.List(nil)
+		for {
+			obj, err := iter.Next(local.ctx)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				bucket.Close()
+				return fmt.Errorf("failed to list bucket %s: %v", b.Name, err)
+			}
+			attrs, err := bucket.Attributes(local.ctx, obj.Key)
+			if err != nil {
+				bucket.Close()
+				return fmt.Errorf("failed to get object %s: %v", obj.Key, err)
+			}
+			if hash := attrs.Metadata[metaCAS]; hash != "" {
+				local.casRefs[hash]++
+			}
+		}
+		bucket.Close()
+	}
+
+	if local.casGCInterval > 0 && !local.noRecovery {
+		local.background.Add(1)
+		go local.runEvery(local.casGCInterval, func() { local.CollectGarbage() })
+	}
+	return nil
+}
+
+// CollectGarbage 删除没有被引用的内容以及中断的上传留下的临时文件，返回删除的内容数量和字节数
+// 整个过程持有 casMu，与正在提交的上传互斥；还在写入的临时文件记录在 casUploads 中，不会被删除
+func (local *LFSStore) CollectGarbage() (int, int64, error) {
+	if !local.cas {
+		return 0, 0, nil
+	}
+	local.casMu.Lock()
+	defer local.casMu.Unlock()
+
+	var count int
+	var freed int64
+	err := filepath.Walk(local.casDir(), func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		if filepath.Base(filepath.Dir(path)) == "tmp" {
+			if !local.casUploads[path] {
+				os.Remove(path)
+			}
+			return nil
+		}
+		if local.casRefs[info.Name()] > 0 {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		count++
+		freed += info.Size()
+		return nil
+	})
+	if err != nil {
+		return count, freed, fmt.Errorf("failed to collect garbage: %v", err)
+	}
+	return count, freed, nil
+}
+
+// casHash 返回对象指向的内容，对象不存在或者没有去重时返回空字符串
+func (local *LFSStore) casHash(b *blob.Bucket, objectKey string) string {
+	attrs, err := b.Attributes(local.ctx, objectKey)
+	if err != nil {
+		return ""
+	}
+	return attrs.Metadata[metaCAS]
+}
+
+func (local *LFSStore) release(hash string) {
+	if hash == "" {
+		return
+	}
+	// 引用为 0 的内容留给 CollectGarbage 删除，期间再次上传相同的内容可以直接使用
+	if local.casRefs[hash]--; local.casRefs[hash] <= 0 {
+		delete(local.casRefs, hash)
+	}
+}
+
+// replaceObject 在 casMu 保护下执行修改对象的 fn，成功后释放对象原来引用的内容
+// 没有开启去重时直接执行 fn
+func (local *LFSStore) replaceObject(b *blob.Bucket, objectKey string, fn func() error) error {
+	if !local.cas {
+		return fn()
+	}
+	local.casMu.Lock()
+	defer local.casMu.Unlock()
+	prev := local.casHash(b, objectKey)
+	if err := fn(); err != nil {
+		return err
+	}
+	local.release(prev)
+	return nil
+}
+
+// writePointer 写入指向 hash 的对象并增加引用，调用时必须持有 casMu
+func (local *LFSStore) writePointer(bucketName, objectKey, hash, contentType string, size int64, md5sum string) error {
+	writer, err := local.newObjectWriter(bucketName, objectKey, contentType, map[string]string{
+		metaCAS:     hash,
+		metaCASSize: strconv.FormatInt(size, 10),
+		metaCASMD5:  md5sum,
+	})
+	if err != nil {
+		return err
+	}
+	if err := writer.commit(); err != nil {
+		return fmt.Errorf("failed to create object %s: %v", objectKey, err)
+	}
+	local.casRefs[hash]++
+	return nil
+}
+
+// putCAS 把数据写入临时文件并计算 SHA-256，相同的内容已经存在时丢弃临时文件
+func (local *LFSStore) putCAS(bucketName string, b *blob.Bucket, objectKey string, data *Object) error {
+	local.casMu.Lock()
+	tmp, err := os.CreateTemp(filepath.Join(local.casDir(), "tmp"), "upload-*")
+	if err == nil {
+		local.casUploads[tmp.Name()] = true
+	}
+	local.casMu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to create object %s: %v", objectKey, err)
+	}
+	defer func() {
+		local.casMu.Lock()
+		delete(local.casUploads, tmp.Name())
+		local.casMu.Unlock()
+		os.Remove(tmp.Name())
+	}()
+
+	sha, sum := sha256.New(), md5.New()
+	size, err := io.Copy(io.MultiWriter(tmp, sha, sum), data.Data)
+	if err == nil && local.durability != DurabilityNone {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create object %s: %v", objectKey, err)
+	}
+	hash := hex.EncodeToString(sha.Sum(nil))
+
+	commit := func() error {
+		path := local.casBlobPath(hash)
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			if err := createDirIfNotExist(filepath.Dir(path)); err != nil {
+				return err
+			}
+			if err := os.Rename(tmp.Name(), path); err != nil {
+				return fmt.Errorf("failed to create object %s: %v", objectKey, err)
+			}
+			if local.durability == DurabilityFull {
+				if err := syncDir(filepath.Dir(path)); err != nil {
+					return fmt.Errorf("failed to create object %s: %v", objectKey, err)
+				}
+			}
+		}
+		return local.writePointer(bucketName, objectKey, hash, data.ContentType, size, hex.EncodeToString(sum.Sum(nil)))
+	}
+	return local.indexed(bucketName, b, objectKey, func() error {
+		return local.replaceObject(b, objectKey, commit)
+	})
+}
+
+// copyCAS 复制去重的对象，只写入新的指针，不复制内容
+// 源对象不存在或者没有去重时返回 false
+// 目标需要加密或压缩时也返回 false，由调用者按普通对象复制
+func (local *LFSStore) copyCAS(src *blob.Bucket, srcObject string, dst *blob.Bucket, dstBucket, dstObject string, o *ObjectOptions) (bool, error) {
+	if o.SSECustomerKey != nil {
+		return false, nil
+	}
+	local.casMu.Lock()
+	defer local.casMu.Unlock()
+
+	attrs, err := src.Attributes(local.ctx, srcObject)
+	if err != nil || attrs.Metadata[metaCAS] == "" {
+		return false, nil
+	}
+	if _, err := local.decryptionFor(attrs, o.CopySourceSSECustomerKey); err != nil {
+		return false, err
+	}
+	if local.compressionFor(dstBucket, attrs.ContentType, o) != "" {
+		return false, nil
+	}
+	if algorithm, err := local.resolveEncryption(dstBucket, ""); err != nil || algorithm != "" {
+		return false, err
+	}
+	size, err := strconv.ParseInt(attrs.Metadata[metaCASSize], 10, 64)
+	if err != nil {
+		return false, fmt.Errorf("invalid object size: %v", err)
+	}
+
+	prev := local.casHash(dst, dstObject)
+	if err := local.writePointer(dstBucket, dstObject, attrs.Metadata[metaCAS], attrs.ContentType, size, attrs.Metadata[metaCASMD5]); err != nil {
+		return false, err
+	}
+	local.release(prev)
+	return true, nil
+}
+
+// openCAS 打开去重对象的内容
+func (local *LFSStore) openCAS(objectKey string, attrs *blob.Attributes) (*os.File, error) {
+	f, err := os.Open(local.casBlobPath(attrs.Metadata[metaCAS]))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get object %s: %v", objectKey, err)
+	}
+	return f, nil
+}
+
+// casDescribe 返回去重对象的原始大小和 ETag
+func casDescribe(attrs *blob.Attributes) (int64, string, error) {
+	size, err := strconv.ParseInt(attrs.Metadata[metaCASSize], 10, 64)
+	if err != nil {
+		return 0, "", fmt.Errorf("invalid object size: %v", err)
+	}
+	return size, `"` + attrs.Metadata[metaCASMD5] + `"`, nil
+}
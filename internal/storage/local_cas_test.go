@@ -0,0 +1,228 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/Grey0520/s3proxy/internal/s3err"
+)
+
+func newDedupStore(t *testing.T, dir string, opts ...LFSOption) *LFSStore {
+	store, err := NewLFSStore(dir, append(opts, WithDedup(0))...)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// casBlobs 返回 .cas 中保存的内容数量，不包括临时文件
+func casBlobs(t *testing.T, store *LFSStore) int {
+	count := 0
+	filepath.Walk(store.casDir(), func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && filepath.Base(filepath.Dir(path)) != "tmp" {
+			count++
+		}
+		return nil
+	})
+	return count
+}
+
+func TestLFSStoreDedup(t *testing.T) {
+	store := newDedupStore(t, t.TempDir())
+	store.CreateBucket("ci-a")
+	store.CreateBucket("ci-b")
+
+	putString(t, store, "ci-a", "toolchain.tar", "toolchain")
+	putString(t, store, "ci-b", "v1/toolchain.tar", "toolchain")
+	putString(t, store, "ci-b", "other", "other")
+	if n := casBlobs(t, store); n != 2 {
+		t.Fatalf("Expected 2 blobs, got %d", n)
+	}
+
+	if got := readString(t, store, "ci-b", "v1/toolchain.tar"); got != "toolchain" {
+		t.Errorf("Unexpected content %q", got)
+	}
+	head, err := store.HeadObject("ci-a", "toolchain.tar")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if head["ETag"] != fmt.Sprintf(`"%x"`, md5.Sum([]byte("toolchain"))) || head["Size"] != "9" || head["ContentType"] != "text/plain" {
+		t.Errorf("Unexpected head result %v", head)
+	}
+	result, _ := store.ListBucket("ci-b")
+	if len(result.Contents) != 2 || result.Contents[1].Size != 9 {
+		t.Errorf("Unexpected listing %+v", result.Contents)
+	}
+	if _, err := store.GetObject("ci-a", "missing"); !errors.Is(err, s3err.ErrNoSuchKey) {
+		t.Errorf("Expected NoSuchKey, got %v", err)
+	}
+
+	// 复制只写入指针
+	if err := store.CopyObject("ci-a", "toolchain.tar", "ci-a", "copy.tar"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := store.MoveObject("ci-b", "other", "ci-a", "moved"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if n := casBlobs(t, store); n != 2 || store.casRefs[fmt.Sprintf("%x", sha256.Sum256([]byte("toolchain")))] != 3 {
+		t.Errorf("Expected copies to share content, got %d blobs, refs %v", n, store.casRefs)
+	}
+	if got := readString(t, store, "ci-a", "moved"); got != "other" {
+		t.Errorf("Unexpected content %q", got)
+	}
+}
+
+func TestLFSStoreDedupGarbageCollect(t *testing.T) {
+	dir := t.TempDir()
+	store := newDedupStore(t, dir)
+	store.CreateBucket("bucket")
+	putString(t, store, "bucket", "a", "shared")
+	putString(t, store, "bucket", "b", "shared")
+	putString(t, store, "bucket", "c", "old")
+	os.WriteFile(filepath.Join(store.casDir(), "tmp", "upload-1"), []byte("partial"), 0o644)
+
+	// 覆盖和删除之后才没有引用
+	putString(t, store, "bucket", "c", "new")
+	store.DeleteObject("bucket", "a")
+	if count, freed, err := store.CollectGarbage(); err != nil || count != 1 || freed != 3 {
+		t.Errorf("Expected old content to be collected, got %d, %d, %v", count, freed, err)
+	}
+	if _, err := os.Stat(filepath.Join(store.casDir(), "tmp", "upload-1")); !os.IsNotExist(err) {
+		t.Errorf("Expected partial upload to be removed, got %v", err)
+	}
+
+	// 引用计数在重新打开时根据指针恢复
+	store.Close()
+	store = newDedupStore(t, dir)
+	if count, _, _ := store.CollectGarbage(); count != 0 {
+		t.Errorf("Expected referenced content to be kept, got %d collected", count)
+	}
+	if got := readString(t, store, "bucket", "b"); got != "shared" {
+		t.Errorf("Unexpected content %q", got)
+	}
+	store.DeleteObject("bucket", "b")
+	store.DeleteObject("bucket", "c")
+	if count, _, _ := store.CollectGarbage(); count != 2 || casBlobs(t, store) != 0 {
+		t.Errorf("Expected all content to be collected, got %d", count)
+	}
+}
+
+func TestLFSStoreDedupConcurrentGarbageCollect(t *testing.T) {
+	store := newDedupStore(t, t.TempDir())
+	store.CreateBucket("bucket")
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				store.CollectGarbage()
+			}
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		// 相同内容反复删除和上传，回收不能删除刚被重新引用的内容
+		key := fmt.Sprintf("key-%d", i%5)
+		store.DeleteObject("bucket", key)
+		if err := putString(t, store, "bucket", key, fmt.Sprintf("content-%d", i%3)); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	store.CollectGarbage()
+	for i := 45; i < 50; i++ {
+		key := fmt.Sprintf("key-%d", i%5)
+		if got := readString(t, store, "bucket", key); got != fmt.Sprintf("content-%d", i%3) {
+			t.Errorf("Unexpected content %q for %s", got, key)
+		}
+	}
+}
+
+func TestLFSStoreDedupConcurrentGet(t *testing.T) {
+	store := newDedupStore(t, t.TempDir())
+	store.CreateBucket("bucket")
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			// 每次使用不同的内容，删除后内容会被回收
+			putString(t, store, "bucket", "key", fmt.Sprintf("content-%d", i))
+			store.DeleteObject("bucket", "key")
+			store.CollectGarbage()
+		}
+	}()
+	for i := 0; i < 2000; i++ {
+		obj, err := store.GetObject("bucket", "key")
+		if err != nil {
+			// 读取期间对象被删除时只能是 NoSuchKey，不能是内容已经被回收的内部错误
+			if !errors.Is(err, s3err.ErrNoSuchKey) {
+				t.Errorf("Expected NoSuchKey, got %v", err)
+				break
+			}
+			continue
+		}
+		obj.Data.Close()
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestLFSStoreDedupEncrypted(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, sseKeySize))
+	store := newDedupStore(t, t.TempDir(), WithMasterKey(key))
+	store.CreateBucket("bucket")
+	putString(t, store, "bucket", "plain", "content")
+
+	// 加密的对象不参与去重，复制到加密的对象时需要复制内容
+	err := store.PutObject("bucket", "secret", &Object{
+		Data:                 io.NopCloser(bytes.NewReader([]byte("content"))),
+		ServerSideEncryption: SSEAlgorithmAES256,
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	store.PutBucketEncryption("bucket", &ServerSideEncryptionConfiguration{
+		Rules: []ServerSideEncryptionRule{{ApplyServerSideEncryptionByDefault: ServerSideEncryptionByDefault{SSEAlgorithm: SSEAlgorithmAES256}}},
+	})
+	if err := store.CopyObject("bucket", "plain", "bucket", "copy"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if n := casBlobs(t, store); n != 1 || store.casRefs[fmt.Sprintf("%x", sha256.Sum256([]byte("content")))] != 1 {
+		t.Errorf("Expected only the plain object to be deduplicated, got %d blobs", n)
+	}
+	head, _ := store.HeadObject("bucket", "copy")
+	if head["ServerSideEncryption"] != SSEAlgorithmAES256 || readString(t, store, "bucket", "copy") != "content" {
+		t.Errorf("Expected encrypted copy, got %v", head)
+	}
+
+	// 覆盖去重的对象后原来的内容不再被引用
+	store.PutObject("bucket", "plain", &Object{Data: io.NopCloser(bytes.NewReader([]byte("x")))})
+	if count, _, _ := store.CollectGarbage(); count != 1 {
+		t.Errorf("Expected 1 blob collected, got %d", count)
+	}
+}
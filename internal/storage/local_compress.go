@@ -0,0 +1,115 @@
+package storage
+
+import (
+	"io"
+	"mime"
+	"path"
+	"strings"
+
+	"gocloud.dev/blob"
+)
+
+const metaCompression = metaPrefix + "compression"
+
+// compressionFor 决定新对象使用的压缩算法，不压缩时返回空字符串
+func (local *LFSStore) compressionFor(bucketName, contentType string, o *ObjectOptions) string {
+	// SSE-C 对象没有密钥就无法读取索引，列举时拿不到原始大小，所以不压缩
+	if local.compression == "" || o.SSECustomerKey != nil {
+		return ""
+	}
+	if local.compressBuckets[bucketName] {
+		return local.compression
+	}
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+		for _, pattern := range local.compressTypes {
+			if ok, _ := path.Match(pattern, mediaType); ok {
+				return local.compression
+			}
+		}
+	}
+	return ""
+}
+
+// encodeObject 在 w 之上叠加压缩和加密，返回供写入原始数据的 writer
+// 写完后必须调用 finish 写出各层剩余的数据，finish 不会关闭 w
+func encodeObject(w io.Writer, dataKey []byte, compression string) (io.Writer, func() error, error) {
+	var closers []io.Closer
+	if dataKey != nil {
+		ew, err := newEncryptWriter(w, dataKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		w = ew
+		closers = append(closers, ew)
+	}
+	if compression != "" {
+		cw, err := newCompressWriter(w, compression)
+		if err != nil {
+			return nil, nil, err
+		}
+		w = cw
+		closers = append(closers, cw)
+	}
+
+	finish := func() error {
+		// 从最外层开始关闭
+		for i := len(closers) - 1; i >= 0; i-- {
+			if err := closers[i].Close(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return w, finish, nil
+}
+
+// decodeObject 在磁盘上的数据之上叠加解密和解压，返回客户端看到的数据流、大小和 ETag
+func decodeObject(reader *blob.Reader, attrs *blob.Attributes, dataKey []byte) (io.ReadSeekCloser, int64, string, error) {
+	var data io.ReadSeekCloser = reader
+	size := attrs.Size
+	etag := formatETag(attrs.MD5)
+
+	if dataKey != nil {
+		dr, err := newDecryptReader(data, dataKey, size)
+		if err != nil {
+			return nil, 0, "", err
+		}
+		data, size = dr, dr.Size()
+	}
+	if algorithm := attrs.Metadata[metaCompression]; algorithm != "" {
+		cr, err := newDecompressReader(data, size, algorithm)
+		if err != nil {
+			return nil, 0, "", err
+		}
+		// 压缩对象的 ETag 使用原始数据的 MD5，与未压缩时一致
+		data, size, etag = cr, cr.Size(), formatETag(cr.MD5())
+	}
+	return data, size, etag, nil
+}
+
+// describeObject 返回对象的原始大小和 ETag
+// 压缩对象需要读取末尾的索引，去重对象从指针中读取，其他对象根据属性计算
+func (local *LFSStore) describeObject(b *blob.Bucket, objectKey string, attrs *blob.Attributes, dataKey []byte) (int64, string, error) {
+	if attrs.Metadata[metaCAS] != "" {
+		return casDescribe(attrs)
+	}
+	if attrs.Metadata[metaCompression] == "" {
+		size, err := objectSize(attrs)
+		return size, formatETag(attrs.MD5), err
+	}
+	reader, err := b.NewReader(local.ctx, objectKey, nil)
+	if err != nil {
+		return 0, "", objectError(objectKey, err)
+	}
+	defer reader.Close()
+	_, size, etag, err := decodeObject(reader, attrs, dataKey)
+	return size, etag, err
+}
+
+func normalizeContentTypes(types []string) []string {
+	ret := make([]string, 0, len(types))
+	for _, t := range types {
+		ret = append(ret, strings.ToLower(strings.TrimSpace(t)))
+	}
+	return ret
+}
@@ -0,0 +1,123 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestLFSStoreCompression(t *testing.T) {
+	store, err := NewLFSStore(t.TempDir(), WithCompression(CompressionZstd, []string{"logs"}, []string{"text/*"}))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	store.CreateBucket("logs")
+	store.CreateBucket("other")
+
+	content := bytes.Repeat([]byte("GET /index.html 200\n"), 200000)
+	sum := md5.Sum(content)
+	etag := `"` + hex.EncodeToString(sum[:]) + `"`
+
+	put := func(bucket, key, contentType string) {
+		err := store.PutObject(bucket, key, &Object{
+			ContentType: contentType,
+			Data:        io.NopCloser(bytes.NewReader(content)),
+		})
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	}
+	diskSize := func(bucket, key string) int64 {
+		info, err := os.Stat(filepath.Join(store.basePath, bucket, key))
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		return info.Size()
+	}
+
+	put("logs", "access.log", "application/octet-stream")
+	put("other", "page.txt", "text/plain; charset=utf-8")
+	put("other", "blob.bin", "application/octet-stream")
+
+	if diskSize("logs", "access.log") >= int64(len(content))/10 {
+		t.Error("Expected object in compressed bucket to be compressed")
+	}
+	if diskSize("other", "page.txt") >= int64(len(content))/10 {
+		t.Error("Expected text/plain object to be compressed")
+	}
+	if diskSize("other", "blob.bin") != int64(len(content)) {
+		t.Error("Expected application/octet-stream object not to be compressed")
+	}
+
+	obj, err := store.GetObject("logs", "access.log")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if obj.Size != int64(len(content)) || obj.ETag != etag {
+		t.Errorf("Unexpected size %d or ETag %s", obj.Size, obj.ETag)
+	}
+	obj.Data.(io.Seeker).Seek(2000005, io.SeekStart)
+	part := make([]byte, 20)
+	io.ReadFull(obj.Data, part)
+	obj.Data.Close()
+	if !bytes.Equal(part, content[2000005:2000025]) {
+		t.Errorf("Unexpected range content %q", part)
+	}
+
+	head, err := store.HeadObject("logs", "access.log")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if head["Size"] != strconv.Itoa(len(content)) || head["ETag"] != etag {
+		t.Errorf("Unexpected head result %v", head)
+	}
+
+	result, err := store.ListBucket("other")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	for _, c := range result.Contents {
+		if c.Size != int64(len(content)) || c.ETag != etag {
+			t.Errorf("Unexpected listing entry %+v", c)
+		}
+	}
+}
+
+func TestLFSStoreCompressionWithEncryption(t *testing.T) {
+	store := newEncryptedStore(t)
+	WithCompression(CompressionGzip, []string{"bucket"}, nil)(store)
+	store.CreateBucket("bucket")
+
+	content := bytes.Repeat([]byte("compress then encrypt "), 100000)
+	err := store.PutObject("bucket", "key", &Object{
+		Data:                 io.NopCloser(bytes.NewReader(content)),
+		ServerSideEncryption: SSEAlgorithmAES256,
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	raw, _ := os.ReadFile(filepath.Join(store.basePath, "bucket", "key"))
+	if len(raw) >= len(content)/10 || bytes.Contains(raw, []byte("compress then encrypt")) {
+		t.Error("Expected object to be compressed and encrypted")
+	}
+
+	obj, err := store.GetObject("bucket", "key")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	data, _ := io.ReadAll(obj.Data)
+	obj.Data.Close()
+	if !bytes.Equal(data, content) || obj.ServerSideEncryption != SSEAlgorithmAES256 {
+		t.Error("Unexpected object content")
+	}
+
+	result, _ := store.ListBucket("bucket")
+	if len(result.Contents) != 1 || result.Contents[0].Size != int64(len(content)) {
+		t.Errorf("Unexpected listing %+v", result.Contents)
+	}
+}
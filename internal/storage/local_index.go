@@ -0,0 +1,328 @@
+package storage
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Grey0520/s3proxy/internal/s3err"
+	bolt "go.etcd.io/bbolt"
+	"gocloud.dev/blob"
+	"gocloud.dev/gcerrors"
+)
+
+// 索引中保存对象记录的 bbolt bucket，键为对象的键，值为 JSON 编码的 indexEntry
+var indexObjects = []byte("objects")
+
+// indexEntry 是索引中记录的一个对象
+type indexEntry struct {
+	Size         int64     `json:"size"`
+	ETag         string    `json:"etag"`
+	ContentType  string    `json:"contentType,omitempty"`
+	LastModified time.Time `json:"lastModified"`
+	// 用户元数据，不包括 s3proxy 自己的元数据
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// 对象每次被修改时递增
+	Version uint64 `json:"version"`
+}
+
+// WithIndex 为每个存储桶维护一个 bbolt 元数据索引，列出对象时直接读取索引，不再遍历目录
+// 索引保存在 basePath/.s3proxy/index/<bucket>.db，不存在时根据磁盘上的对象生成
+func WithIndex() LFSOption {
+	return func(local *LFSStore) error {
+		local.index = true
+		return nil
+	}
+}
+
+// Indexed 返回是否开启了元数据索引
+func (local *LFSStore) Indexed() bool {
+	return local.index
+}
+
+func (local *LFSStore) indexPath(bucketName string) string {
+	return filepath.Join(local.basePath, metaDirName, "index", bucketName+".db")
+}
+
+// indexDB 返回存储桶的索引，打开后缓存在 indexes 中
+func (local *LFSStore) indexDB(bucketName string, b *blob.Bucket) (*bolt.DB, error) {
+	local.mu.RLock()
+	db, ok := local.indexes[bucketName]
+	local.mu.RUnlock()
+	if ok {
+		return db, nil
+	}
+	db, _, err := local.openIndex(bucketName, b, false)
+	return db, err
+}
+
+// openIndex 打开存储桶的索引，索引文件不存在时根据磁盘上的对象生成，built 表示是否刚刚生成
+// recreate 为 true 时无法打开（例如已经损坏）的索引文件会被删除后重新生成
+func (local *LFSStore) openIndex(bucketName string, b *blob.Bucket, recreate bool) (db *bolt.DB, built bool, err error) {
+	local.mu.Lock()
+	defer local.mu.Unlock()
+	if db, ok := local.indexes[bucketName]; ok {
+		return db, false, nil
+	}
+	if _, ok := local.registry[bucketName]; !ok {
+		return nil, false, fmt.Errorf("bucket %s does not exist: %w", bucketName, s3err.ErrNoSuchBucket)
+	}
+	path := local.indexPath(bucketName)
+	if err := createDirIfNotExist(filepath.Dir(path)); err != nil {
+		return nil, false, err
+	}
+	_, statErr := os.Stat(path)
+	// 索引同时只能被一个进程打开
+	opts := &bolt.Options{Timeout: time.Second}
+	db, err = bolt.Open(path, 0o600, opts)
+	if errors.Is(err, bolt.ErrTimeout) {
+		return nil, false, fmt.Errorf("index of bucket %s is in use by another process", bucketName)
+	}
+	if err != nil && recreate {
+		if err := os.Remove(path); err != nil {
+			return nil, false, fmt.Errorf("failed to remove index of bucket %s: %v", bucketName, err)
+		}
+		statErr = os.ErrNotExist
+		db, err = bolt.Open(path, 0o600, opts)
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to open index of bucket %s: %v", bucketName, err)
+	}
+	if os.IsNotExist(statErr) {
+		if _, err := local.rebuildIndex(db, b); err != nil {
+			db.Close()
+			os.Remove(path)
+			return nil, false, err
+		}
+	}
+	local.indexes[bucketName] = db
+	return db, os.IsNotExist(statErr), nil
+}
+
+// closeIndex 关闭存储桶的索引，调用时需要持有 mu
+func (local *LFSStore) closeIndex(bucketName string) {
+	if db, ok := local.indexes[bucketName]; ok {
+		db.Close()
+		delete(local.indexes, bucketName)
+	}
+}
+
+// indexed 持有对象的锁执行修改对象的 fn，并在同一个索引事务中更新对象的记录
+// 执行期间持有存储桶的读锁，不会和删除存储桶交错；同一个存储桶的修改按顺序提交，fn 成功而事务提交失败时需要用 RebuildIndex 重建索引
+func (local *LFSStore) indexed(bucketName string, b *blob.Bucket, objectKey string, fn func() error) error {
+	bucketLock := local.bucketLock(bucketName)
+	bucketLock.RLock()
+	defer bucketLock.RUnlock()
+	// 等待锁时存储桶可能被删除了，b 已经关闭，不能再创建存储桶的目录
+	local.mu.RLock()
+	current, ok := local.buckets[bucketName]
+	local.mu.RUnlock()
+	if !ok || current != b {
+		return fmt.Errorf("bucket %s does not exist: %w", bucketName, s3err.ErrNoSuchBucket)
+	}
+
+	lock := local.lock(bucketName, objectKey)
+	lock.Lock()
+	defer lock.Unlock()
+	if !local.index {
+		return fn()
+	}
+	db, err := local.indexDB(bucketName, b)
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		if err := fn(); err != nil {
+			return err
+		}
+		return local.indexObject(tx.Bucket(indexObjects), b, objectKey)
+	})
+}
+
+// indexObject 根据磁盘上的对象更新索引中的记录，对象不存在时删除记录
+func (local *LFSStore) indexObject(bk *bolt.Bucket, b *blob.Bucket, objectKey string) error {
+	entry, err := local.objectEntry(b, objectKey)
+	if gcerrors.Code(err) == gcerrors.NotFound {
+		return bk.Delete([]byte(objectKey))
+	}
+	if err != nil {
+		return fmt.Errorf("failed to index object %s: %v", objectKey, err)
+	}
+	if data := bk.Get([]byte(objectKey)); data != nil {
+		var prev indexEntry
+		// 对象没有变化时（例如复制时没有写入）不增加版本
+		if json.Unmarshal(data, &prev) == nil && prev.ETag == entry.ETag && prev.LastModified.Equal(entry.LastModified) {
+			return nil
+		}
+	}
+	return putIndexEntry(bk, objectKey, entry)
+}
+
+func putIndexEntry(bk *bolt.Bucket, objectKey string, entry *indexEntry) error {
+	version, err := bk.NextSequence()
+	if err != nil {
+		return err
+	}
+	entry.Version = version
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return bk.Put([]byte(objectKey), data)
+}
+
+// objectEntry 读取对象的原始大小、ETag 和元数据，对象不存在时返回 fileblob 的 NotFound 错误
+func (local *LFSStore) objectEntry(b *blob.Bucket, objectKey string) (*indexEntry, error) {
+	attrs, err := b.Attributes(local.ctx, objectKey)
+	if err != nil {
+		return nil, err
+	}
+	var dataKey []byte
+	if attrs.Metadata[metaCompression] != "" {
+		// 压缩的对象不会使用 SSE-C，不需要客户密钥
+		if dataKey, err = local.decryptionFor(attrs, nil); err != nil {
+			return nil, err
+		}
+	}
+	size, etag, err := local.describeObject(b, objectKey, attrs, dataKey)
+	if err != nil {
+		return nil, err
+	}
+	entry := &indexEntry{
+		Size:         size,
+		ETag:         etag,
+		ContentType:  attrs.ContentType,
+		LastModified: attrs.ModTime,
+	}
+	for k, v := range attrs.Metadata {
+		if !strings.HasPrefix(k, metaPrefix) {
+			if entry.Metadata == nil {
+				entry.Metadata = map[string]string{}
+			}
+			entry.Metadata[k] = v
+		}
+	}
+	return entry, nil
+}
+
+// listIndex 从索引中按键的顺序列出对象
+func (local *LFSStore) listIndex(bucketName string, db *bolt.DB, o *ListOptions) (*ListBucketResult, error) {
+	result := &ListBucketResult{
+		XMLName: xml.Name{Local: "ListBucketResult"},
+		Name:    bucketName,
+		Prefix:  o.Prefix,
+		Marker:  o.Marker,
+		MaxKeys: o.MaxKeys,
+	}
+	err := db.View(func(tx *bolt.Tx) error {
+		start := max(o.Prefix, o.Marker)
+		c := tx.Bucket(indexObjects).Cursor()
+		for k, v := c.Seek([]byte(start)); k != nil && strings.HasPrefix(string(k), o.Prefix); k, v = c.Next() {
+			if !o.match(string(k)) {
+				continue
+			}
+			if o.MaxKeys > 0 && len(result.Contents) == o.MaxKeys {
+				result.IsTruncated = true
+				break
+			}
+			var entry indexEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return fmt.Errorf("invalid index entry %s: %v", k, err)
+			}
+			result.Contents = append(result.Contents, Content{
+				Key:          string(k),
+				LastModified: entry.LastModified,
+				ETag:         entry.ETag,
+				Size:         entry.Size,
+				StorageClass: "STANDARD",
+				Owner:        newFakeOwner(),
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list objects: %v", err)
+	}
+	return result, nil
+}
+
+// RebuildIndex 根据磁盘上的对象重新生成存储桶的索引，返回索引中的对象数量
+// 用于索引文件丢失、损坏或者与磁盘不一致的时候
+func (local *LFSStore) RebuildIndex(bucketName string) (int, error) {
+	if !local.index {
+		return 0, fmt.Errorf("index is not enabled")
+	}
+	b, err := local.bucket(bucketName)
+	if err != nil {
+		return 0, err
+	}
+
+	db, built, err := local.openIndex(bucketName, b, true)
+	if err != nil {
+		return 0, err
+	}
+	if !built {
+		return local.rebuildIndex(db, b)
+	}
+	n := 0
+	err = db.View(func(tx *bolt.Tx) error {
+		n = tx.Bucket(indexObjects).Stats().KeyN
+		return nil
+	})
+	return n, err
+}
+
+// rebuildIndex 在一个事务中清空索引并重新记录所有对象，期间存储桶的修改会等待事务完成
+func (local *LFSStore) rebuildIndex(db *bolt.DB, b *blob.Bucket) (int, error) {
+	n := 0
+	err := db.Update(func(tx *bolt.Tx) error {
+		// 保留版本序号，重建前后同一个对象的版本不会重复
+		var sequence uint64
+		if bk := tx.Bucket(indexObjects); bk != nil {
+			sequence = bk.Sequence()
+		}
+		if err := tx.DeleteBucket(indexObjects); err != nil && !errors.Is(err, bolt.ErrBucketNotFound) {
+			return err
+		}
+		bk, err := tx.CreateBucket(indexObjects)
+		if err != nil {
+			return err
+		}
+		if err := bk.SetSequence(sequence); err != nil {
+			return err
+		}
+
+		iter := b.List(nil)
+		for {
+			obj, err := iter.Next(local.ctx)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("failed to list objects: %v", err)
+			}
+			entry, err := local.objectEntry(b, obj.Key)
+			if gcerrors.Code(err) == gcerrors.NotFound {
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("failed to index object %s: %v", obj.Key, err)
+			}
+			if err := putIndexEntry(bk, obj.Key, entry); err != nil {
+				return err
+			}
+			n++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to rebuild index: %v", err)
+	}
+	return n, nil
+}
@@ -0,0 +1,155 @@
+package storage
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func newIndexedStore(t *testing.T, dir string, opts ...LFSOption) *LFSStore {
+	store, err := NewLFSStore(dir, append(opts, WithIndex())...)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// listKeys 返回 ListBucket 结果中的键
+func listKeys(t *testing.T, store StorageProvider, bucketName string, opts ...ListOption) ([]string, bool) {
+	t.Helper()
+	result, err := store.ListBucket(bucketName, opts...)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	keys := []string{}
+	for _, c := range result.Contents {
+		keys = append(keys, c.Key)
+	}
+	return keys, result.IsTruncated
+}
+
+func readIndexEntry(t *testing.T, store *LFSStore, bucketName, objectKey string) *indexEntry {
+	t.Helper()
+	b, _ := store.bucket(bucketName)
+	db, err := store.indexDB(bucketName, b)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	var entry *indexEntry
+	db.View(func(tx *bolt.Tx) error {
+		if data := tx.Bucket(indexObjects).Get([]byte(objectKey)); data != nil {
+			entry = &indexEntry{}
+			json.Unmarshal(data, entry)
+		}
+		return nil
+	})
+	return entry
+}
+
+func TestLFSStoreIndex(t *testing.T) {
+	store := newIndexedStore(t, t.TempDir())
+	store.CreateBucket("bucket")
+	for _, key := range []string{"c", "a/2", "b", "a/1"} {
+		putString(t, store, "bucket", key, "content of "+key)
+	}
+
+	if keys, _ := listKeys(t, store, "bucket"); len(keys) != 4 || keys[0] != "a/1" || keys[3] != "c" {
+		t.Errorf("Expected sorted listing, got %v", keys)
+	}
+	if keys, _ := listKeys(t, store, "bucket", WithPrefix("a/")); len(keys) != 2 {
+		t.Errorf("Expected 2 keys with prefix, got %v", keys)
+	}
+	keys, truncated := listKeys(t, store, "bucket", WithMarker("a/2"), WithMaxKeys(1))
+	if len(keys) != 1 || keys[0] != "b" || !truncated {
+		t.Errorf("Expected second page, got %v, %v", keys, truncated)
+	}
+	if keys, truncated := listKeys(t, store, "bucket", WithMarker("b"), WithMaxKeys(1)); len(keys) != 1 || keys[0] != "c" || truncated {
+		t.Errorf("Expected last page, got %v, %v", keys, truncated)
+	}
+
+	entry := readIndexEntry(t, store, "bucket", "b")
+	if entry == nil || entry.Size != 12 || entry.ContentType != "text/plain" || entry.ETag == "" {
+		t.Fatalf("Unexpected index entry %+v", entry)
+	}
+	putString(t, store, "bucket", "b", "new content")
+	if updated := readIndexEntry(t, store, "bucket", "b"); updated.Version <= entry.Version || updated.Size != 11 {
+		t.Errorf("Expected new version, got %+v", updated)
+	}
+
+	store.CopyObject("bucket", "a/1", "bucket", "a/copy")
+	store.MoveObject("bucket", "c", "bucket", "d")
+	store.DeleteObject("bucket", "b")
+	if keys, _ := listKeys(t, store, "bucket"); len(keys) != 4 || keys[2] != "a/copy" || keys[3] != "d" {
+		t.Errorf("Unexpected listing %v", keys)
+	}
+	if readIndexEntry(t, store, "bucket", "b") != nil {
+		t.Errorf("Expected deleted object to be removed from index")
+	}
+
+	if err := store.DeleteBucket("bucket"); err == nil {
+		t.Errorf("Expected error deleting non-empty bucket")
+	}
+	for _, key := range []string{"a/1", "a/2", "a/copy", "d"} {
+		store.DeleteObject("bucket", key)
+	}
+	if err := store.DeleteBucket("bucket"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, err := os.Stat(store.indexPath("bucket")); !os.IsNotExist(err) {
+		t.Errorf("Expected index to be removed, got %v", err)
+	}
+}
+
+func TestLFSStoreIndexRebuild(t *testing.T) {
+	dir := t.TempDir()
+	plain, _ := NewLFSStore(dir)
+	plain.CreateBucket("bucket")
+	putString(t, plain, "bucket", "a", "a")
+	putString(t, plain, "bucket", "b", "b")
+	plain.Close()
+
+	// 开启索引时根据已有的对象生成
+	store := newIndexedStore(t, dir)
+	if keys, _ := listKeys(t, store, "bucket"); len(keys) != 2 {
+		t.Fatalf("Expected existing objects to be indexed, got %v", keys)
+	}
+
+	// 绕过 s3proxy 写入的文件只有重建后才能看到
+	os.WriteFile(filepath.Join(dir, "bucket", "c"), []byte("c"), 0o644)
+	if keys, _ := listKeys(t, store, "bucket"); len(keys) != 2 {
+		t.Errorf("Expected stale index, got %v", keys)
+	}
+	version := readIndexEntry(t, store, "bucket", "b").Version
+	if n, err := store.RebuildIndex("bucket"); err != nil || n != 3 {
+		t.Fatalf("Expected 3 objects indexed, got %d, %v", n, err)
+	}
+	if keys, _ := listKeys(t, store, "bucket"); len(keys) != 3 {
+		t.Errorf("Expected rebuilt index, got %v", keys)
+	}
+	if v := readIndexEntry(t, store, "bucket", "b").Version; v <= version {
+		t.Errorf("Expected versions to keep increasing, got %d after %d", v, version)
+	}
+
+	// basePath 被其他 LFSStore 使用时不能打开
+	if _, err := NewLFSStore(dir, WithIndex()); err == nil {
+		t.Errorf("Expected error while basePath is in use")
+	}
+
+	// 损坏的索引无法打开，重建时重新生成
+	store.Close()
+	os.WriteFile(store.indexPath("bucket"), []byte("corrupted"), 0o600)
+	other := newIndexedStore(t, dir)
+	if _, err := other.ListBucket("bucket"); err == nil {
+		t.Errorf("Expected error with corrupted index")
+	}
+	if n, err := other.RebuildIndex("bucket"); err != nil || n != 3 {
+		t.Fatalf("Expected 3 objects indexed, got %d, %v", n, err)
+	}
+	if keys, _ := listKeys(t, other, "bucket", WithPrefix("b")); len(keys) != 1 {
+		t.Errorf("Unexpected listing %v", keys)
+	}
+}
@@ -0,0 +1,27 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+)
+
+var errLocked = errors.New("locked by another process")
+
+// lockBasePath 锁定 basePath/.s3proxy/lock，保证同时只有一个 LFSStore 使用 basePath
+// 启动时的 recoverWrites 会删除临时文件，服务运行时 fsck 这样的离线命令如果也打开 basePath 会破坏正在进行的上传
+func (local *LFSStore) lockBasePath() error {
+	dir := filepath.Join(local.basePath, metaDirName)
+	if err := createDir(dir); err != nil {
+		return err
+	}
+	f, err := lockFile(filepath.Join(dir, "lock"))
+	if errors.Is(err, errLocked) {
+		return fmt.Errorf("%s is in use by another s3proxy process, stop the server before running offline commands", local.basePath)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to lock %s: %v", local.basePath, err)
+	}
+	local.lockFile = f
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build !(linux || darwin || freebsd)
+
+package storage
+
+import "os"
+
+// lockFile 在不支持 flock 的平台上只创建文件，不阻止其他进程同时使用 basePath
+func lockFile(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+}
@@ -0,0 +1,91 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// bucketRegistryEntry 是 basePath/.s3proxy/buckets.json 中记录的一个存储桶
+type bucketRegistryEntry struct {
+	Name         string    `json:"name"`
+	CreationDate time.Time `json:"creationDate"`
+}
+
+func (local *LFSStore) registryPath() string {
+	return filepath.Join(local.basePath, metaDirName, "buckets.json")
+}
+
+// loadRegistry 读取存储桶列表，文件不存在时（之前的版本创建的目录）根据 basePath 下的一级目录生成
+// 之后只有列表中的目录才是存储桶，查找存储桶不需要访问磁盘
+func (local *LFSStore) loadRegistry() error {
+	local.registry = make(map[string]time.Time)
+	data, err := os.ReadFile(local.registryPath())
+	if err == nil {
+		var entries []bucketRegistryEntry
+		if err := json.Unmarshal(data, &entries); err != nil {
+			return fmt.Errorf("failed to parse bucket registry: %v", err)
+		}
+		for _, e := range entries {
+			// 手动修改过的列表中不能作为目录名的名称会指向 basePath 之外
+			if !validLocalBucketName(e.Name) {
+				return fmt.Errorf("invalid bucket name %q in bucket registry", e.Name)
+			}
+			local.registry[e.Name] = e.CreationDate
+		}
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read bucket registry: %v", err)
+	}
+
+	entries, err := os.ReadDir(local.basePath)
+	if err != nil {
+		return fmt.Errorf("failed to read bucket registry: %v", err)
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() || !validLocalBucketName(entry.Name()) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return fmt.Errorf("failed to read bucket registry: %v", err)
+		}
+		local.registry[entry.Name()] = info.ModTime()
+	}
+	return local.saveRegistry()
+}
+
+// saveRegistry 把存储桶列表写回磁盘，调用时需要持有 mu
+func (local *LFSStore) saveRegistry() error {
+	data, err := json.MarshalIndent(local.registryEntries(), "", "  ")
+	if err != nil {
+		return err
+	}
+	path := local.registryPath()
+	if err := createDirIfNotExist(filepath.Dir(path)); err != nil {
+		return err
+	}
+	// 先写临时文件再重命名，进程崩溃时不会留下写了一半的列表
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("failed to write bucket registry: %v", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to write bucket registry: %v", err)
+	}
+	return nil
+}
+
+// registryEntries 返回按名称排序的存储桶，调用时需要持有 mu
+func (local *LFSStore) registryEntries() []bucketRegistryEntry {
+	entries := make([]bucketRegistryEntry, 0, len(local.registry))
+	for name, created := range local.registry {
+		entries = append(entries, bucketRegistryEntry{Name: name, CreationDate: created})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries
+}
@@ -0,0 +1,129 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Grey0520/s3proxy/internal/s3err"
+)
+
+func TestLFSStoreBucketRegistry(t *testing.T) {
+	dir := t.TempDir()
+	// 之前的版本创建的存储桶在第一次启动时加入列表
+	os.MkdirAll(filepath.Join(dir, "existing", "logs"), 0o755)
+	os.MkdirAll(filepath.Join(dir, ".hidden"), 0o755)
+	store, err := NewLFSStore(dir)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	store.CreateBucket("bucket")
+	putString(t, store, "bucket", "logs/app.log", "x")
+
+	result, _ := store.ListAllMyBuckets()
+	if len(result.Buckets.Bucket) != 2 || result.Buckets.Bucket[0].Name != "bucket" || result.Buckets.Bucket[1].Name != "existing" {
+		t.Errorf("Unexpected buckets %+v", result.Buckets.Bucket)
+	}
+	created := result.Buckets.Bucket[0].CreationDate
+
+	// 与存储桶同名的子目录以及之后手动创建的目录都不是存储桶
+	os.MkdirAll(filepath.Join(dir, "manual"), 0o755)
+	for _, name := range []string{"logs", "manual"} {
+		if _, err := store.ListBucket(name); !errors.Is(err, s3err.ErrNoSuchBucket) {
+			t.Errorf("Expected NoSuchBucket for %s, got %v", name, err)
+		}
+	}
+	if err := store.CreateBucket("manual"); !errors.Is(err, s3err.ErrBucketAlreadyExists) {
+		t.Errorf("Expected BucketAlreadyExists, got %v", err)
+	}
+
+	store.DeleteBucket("existing")
+	store.Close()
+	store = newTestLFSStore(t, dir)
+	result, _ = store.ListAllMyBuckets()
+	if len(result.Buckets.Bucket) != 1 || !result.Buckets.Bucket[0].CreationDate.Equal(created) {
+		t.Errorf("Expected registry to be persisted, got %+v", result.Buckets.Bucket)
+	}
+	if err := store.DeleteBucket("existing"); !errors.Is(err, s3err.ErrNoSuchBucket) {
+		t.Errorf("Expected NoSuchBucket, got %v", err)
+	}
+}
+
+// 存储桶中的子目录不会被列为存储桶
+func TestLFSStoreListAllMyBucketsTopLevel(t *testing.T) {
+	store := newTestLFSStore(t, t.TempDir())
+	store.CreateBucket("bucket")
+	putString(t, store, "bucket", "dir/key", "x")
+
+	result, err := store.ListAllMyBuckets()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(result.Buckets.Bucket) != 1 || result.Buckets.Bucket[0].Name != "bucket" {
+		t.Errorf("Expected only bucket, got %+v", result.Buckets.Bucket)
+	}
+}
+
+func newTestLFSStore(t testing.TB, dir string) *LFSStore {
+	store, err := NewLFSStore(dir)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// newLargeTree 创建 buckets 个存储桶，最后一个存储桶中有 files 个分布在多级目录中的对象
+func newLargeTree(b *testing.B, buckets, files int) *LFSStore {
+	dir := b.TempDir()
+	store := newTestLFSStore(b, dir)
+	for i := 0; i < buckets; i++ {
+		if err := store.CreateBucket(fmt.Sprintf("bucket-%d", i)); err != nil {
+			b.Fatalf("Expected no error, got %v", err)
+		}
+	}
+	last := filepath.Join(dir, fmt.Sprintf("bucket-%d", buckets-1))
+	for i := 0; i < files; i++ {
+		path := filepath.Join(last, fmt.Sprintf("%02d/%02d/bucket-%d/object-%d", i%100, i/100%100, i%buckets, i))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			b.Fatalf("Expected no error, got %v", err)
+		}
+		if err := os.WriteFile(path, []byte("x"), 0o644); err != nil {
+			b.Fatalf("Expected no error, got %v", err)
+		}
+	}
+	return store
+}
+
+func BenchmarkLFSStoreHeadObject(b *testing.B) {
+	store := newLargeTree(b, 100, 20000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := store.HeadObject("bucket-99", "00/00/bucket-0/object-0"); err != nil {
+			b.Fatalf("Expected no error, got %v", err)
+		}
+	}
+}
+
+func BenchmarkLFSStoreGetObjectNoSuchBucket(b *testing.B) {
+	store := newLargeTree(b, 100, 20000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := store.GetObject("missing", "key"); !errors.Is(err, s3err.ErrNoSuchBucket) {
+			b.Fatalf("Expected NoSuchBucket, got %v", err)
+		}
+	}
+}
+
+func BenchmarkLFSStoreListAllMyBuckets(b *testing.B) {
+	store := newLargeTree(b, 1000, 20000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		result, err := store.ListAllMyBuckets()
+		if err != nil || len(result.Buckets.Bucket) != 1000 {
+			b.Fatalf("Expected 1000 buckets, got %v", err)
+		}
+	}
+}
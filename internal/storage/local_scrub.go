@@ -0,0 +1,403 @@
+package storage
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 修改时间早于这个时间的临时文件不属于正在进行的写入
+// 写入中的文件每次写入数据都会更新修改时间，因此只有停顿了这么久的上传才会被误判
+// 打开存储之前就存在的临时文件一定是残留的，见 WithoutRecovery
+const scrubTempAge = 24 * time.Hour
+
+// ScrubReport 是一次完整性检查的结果
+type ScrubReport struct {
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	// 检查过的对象数量以及读取的字节数，包括去重的内容
+	Objects int   `json:"objects"`
+	Bytes   int64 `json:"bytes"`
+	// 没有属性文件或者属性中没有 MD5，无法检查的对象数量
+	Unverified int `json:"unverified"`
+	// 数据与保存的 MD5 不一致的对象，以及内容与 SHA-256 不一致的去重内容
+	Corrupt []ScrubIssue `json:"corrupt"`
+	// 对象已经不存在的属性文件
+	OrphanedAttrs []string `json:"orphanedAttrs"`
+	// 中断的写入留下的临时文件
+	StrayTempFiles []string `json:"strayTempFiles"`
+	// 隔离的文件移动到的目录，没有隔离任何文件时为空
+	Quarantine string `json:"quarantine,omitempty"`
+}
+
+// ScrubIssue 是一个损坏的对象或者去重内容，去重内容没有 Bucket 和 Key
+type ScrubIssue struct {
+	Bucket   string `json:"bucket,omitempty"`
+	Key      string `json:"key,omitempty"`
+	Path     string `json:"path"`
+	Expected string `json:"expected,omitempty"`
+	Actual   string `json:"actual,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Problems 返回发现的问题数量
+func (r *ScrubReport) Problems() int {
+	return len(r.Corrupt) + len(r.OrphanedAttrs) + len(r.StrayTempFiles)
+}
+
+// WithScrub 每隔 interval 在后台执行一次 Scrub，结果写入 basePath/.s3proxy/scrub.json
+func WithScrub(interval time.Duration, quarantine bool) LFSOption {
+	return func(local *LFSStore) error {
+		local.scrubInterval = interval
+		local.scrubQuarantine = quarantine
+		return nil
+	}
+}
+
+func (local *LFSStore) scrubReportPath() string {
+	return filepath.Join(local.basePath, metaDirName, "scrub.json")
+}
+
+// scrubOnce 执行一次后台检查，记录结果
+func (local *LFSStore) scrubOnce() {
+	report, err := local.Scrub(local.scrubQuarantine)
+	if err != nil {
+		log.Printf("local: scrub failed: %v", err)
+		return
+	}
+	log.Printf("local: scrubbed %d objects, %d corrupt, %d orphaned attributes, %d stray temp files",
+		report.Objects, len(report.Corrupt), len(report.OrphanedAttrs), len(report.StrayTempFiles))
+	path := local.scrubReportPath()
+	if err := writeJSONFile(path+".tmp", report, false); err != nil {
+		log.Printf("local: failed to write scrub report: %v", err)
+		return
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		log.Printf("local: failed to write scrub report: %v", err)
+	}
+}
+
+// Scrub 重新计算对象的 MD5 并与属性中保存的 MD5 比较，找出损坏的对象、孤立的属性文件和残留的临时文件
+// 不指定存储桶时检查所有存储桶；quarantine 为 true 时把发现的文件移动到 basePath/.s3proxy/quarantine 下，
+// 损坏的对象因此不再能被读取，Scrub 本身不会删除任何文件
+func (local *LFSStore) Scrub(quarantine bool, buckets ...string) (*ScrubReport, error) {
+	s := &scrubber{
+		local:      local,
+		quarantine: quarantine,
+		blobs:      make(map[string]string),
+		report: &ScrubReport{
+			Started:        time.Now().UTC(),
+			Corrupt:        []ScrubIssue{},
+			OrphanedAttrs:  []string{},
+			StrayTempFiles: []string{},
+		},
+	}
+	if len(buckets) == 0 {
+		local.mu.RLock()
+		for _, e := range local.registryEntries() {
+			buckets = append(buckets, e.Name)
+		}
+		local.mu.RUnlock()
+	}
+
+	// 先检查去重的内容，检查对象时直接使用结果
+	if local.cas {
+		if err := s.scrubCAS(); err != nil {
+			return nil, err
+		}
+	}
+	for _, bucketName := range buckets {
+		if err := s.scrubBucket(bucketName); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.scrubTemp(local.tmpDir(), nil); err != nil {
+		return nil, err
+	}
+	if local.cas {
+		err := s.scrubTemp(filepath.Join(local.casDir(), "tmp"), func(path string) bool {
+			return local.casUploads[path]
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	s.report.Finished = time.Now().UTC()
+	return s.report, nil
+}
+
+type scrubber struct {
+	local      *LFSStore
+	quarantine bool
+	report     *ScrubReport
+	// 损坏或者已经隔离的去重内容，值为原因
+	blobs map[string]string
+}
+
+// 对象的检查结果
+const (
+	scrubOK = iota
+	scrubUnverified
+	scrubCorrupt
+	// 检查时对象被删除了
+	scrubGone
+)
+
+func (s *scrubber) scrubBucket(bucketName string) error {
+	b, err := s.local.bucket(bucketName)
+	if err != nil {
+		return err
+	}
+	dir := s.local.bucketPath(bucketName)
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// 检查期间被删除的目录
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return fmt.Errorf("failed to scrub bucket %s: %v", bucketName, err)
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if strings.HasSuffix(path, attrsExt) {
+			return s.checkAttrs(bucketName, rel, path)
+		}
+
+		objectKey := unescapeKey(filepath.ToSlash(rel))
+		issue := &ScrubIssue{Bucket: bucketName, Key: objectKey, Path: path}
+		result, info := s.verify(path, issue)
+		if result == scrubCorrupt {
+			// 对象可能在检查期间被替换，重新检查同一个文件仍然不一致时才是损坏
+			issue = &ScrubIssue{Bucket: bucketName, Key: objectKey, Path: path}
+			again, info2 := s.verify(path, issue)
+			if again == scrubCorrupt && info != nil && info2 != nil && !os.SameFile(info, info2) {
+				again = scrubOK
+			}
+			result = again
+		}
+		switch result {
+		case scrubGone:
+			return nil
+		case scrubUnverified:
+			s.report.Unverified++
+		case scrubCorrupt:
+			if s.quarantine {
+				err := s.local.indexed(bucketName, b, objectKey, func() error {
+					return s.local.replaceObject(b, objectKey, func() error {
+						if err := s.move(path, filepath.Join(bucketName, rel)); err != nil {
+							return err
+						}
+						return s.move(path+attrsExt, filepath.Join(bucketName, rel+attrsExt))
+					})
+				})
+				if err != nil {
+					return fmt.Errorf("failed to quarantine object %s: %v", objectKey, err)
+				}
+			}
+			s.report.Corrupt = append(s.report.Corrupt, *issue)
+		}
+		s.report.Objects++
+		return nil
+	})
+}
+
+// verify 计算对象数据的 MD5 并与属性文件中的 MD5 比较，不一致时把原因填入 issue
+// 同时返回数据文件的信息，用于确认两次检查的是同一个文件
+func (s *scrubber) verify(path string, issue *ScrubIssue) (int, os.FileInfo) {
+	var attrs fileAttrs
+	data, err := os.ReadFile(path + attrsExt)
+	if os.IsNotExist(err) {
+		return scrubUnverified, nil
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &attrs)
+	}
+	if err != nil {
+		issue.Error = fmt.Sprintf("invalid attributes: %v", err)
+		return scrubCorrupt, nil
+	}
+
+	sum, info, err := s.hashFile(path, md5.New())
+	if os.IsNotExist(err) {
+		return scrubGone, nil
+	}
+	if err != nil {
+		issue.Error = err.Error()
+		return scrubCorrupt, info
+	}
+	if len(attrs.MD5) == 0 {
+		return scrubUnverified, info
+	}
+	if expected := hex.EncodeToString(attrs.MD5); sum != expected {
+		issue.Expected, issue.Actual = expected, sum
+		return scrubCorrupt, info
+	}
+	if hash := attrs.Metadata[metaCAS]; hash != "" {
+		if reason, ok := s.blobs[hash]; ok {
+			issue.Error = fmt.Sprintf("content %s %s", hash, reason)
+			return scrubCorrupt, info
+		}
+		if _, err := os.Stat(s.local.casBlobPath(hash)); err != nil {
+			issue.Error = fmt.Sprintf("content %s is missing", hash)
+			return scrubCorrupt, info
+		}
+	}
+	return scrubOK, info
+}
+
+// checkAttrs 检查属性文件对应的对象是否存在
+// fileblob 删除对象时先删除数据文件再删除属性文件，因此看到数据文件不存在时需要确认属性文件还在
+func (s *scrubber) checkAttrs(bucketName, rel, path string) error {
+	if _, err := os.Lstat(strings.TrimSuffix(path, attrsExt)); !os.IsNotExist(err) {
+		return nil
+	}
+	if _, err := os.Lstat(path); os.IsNotExist(err) {
+		return nil
+	}
+	if s.quarantine {
+		if err := s.move(path, filepath.Join(bucketName, rel)); err != nil {
+			return fmt.Errorf("failed to quarantine %s: %v", path, err)
+		}
+	}
+	s.report.OrphanedAttrs = append(s.report.OrphanedAttrs, path)
+	return nil
+}
+
+// scrubCAS 检查去重内容的 SHA-256 与文件名是否一致，内容不会被修改，不需要重新检查
+func (s *scrubber) scrubCAS() error {
+	dir := s.local.casDir()
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return fmt.Errorf("failed to scrub %s: %v", dir, err)
+		}
+		if d.IsDir() {
+			if path == filepath.Join(dir, "tmp") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		sum, _, err := s.hashFile(path, sha256.New())
+		if os.IsNotExist(err) {
+			// 被 CollectGarbage 删除
+			return nil
+		}
+		issue := ScrubIssue{Path: path, Expected: d.Name()}
+		if err != nil {
+			issue.Error = err.Error()
+		} else if sum != d.Name() {
+			issue.Actual = sum
+		} else {
+			return nil
+		}
+		s.blobs[d.Name()] = "is corrupt"
+		if s.quarantine {
+			rel, _ := filepath.Rel(s.local.basePath, path)
+			s.local.casMu.Lock()
+			err := s.move(path, rel)
+			s.local.casMu.Unlock()
+			if err != nil {
+				return fmt.Errorf("failed to quarantine %s: %v", path, err)
+			}
+			// 引用这份内容的对象也会被隔离，之后上传相同的内容会重新写入
+			s.blobs[d.Name()] = "is corrupt and quarantined"
+		}
+		s.report.Corrupt = append(s.report.Corrupt, issue)
+		return nil
+	})
+}
+
+// scrubTemp 找出 dir 中残留的临时文件，active 返回 true 的文件正在使用
+func (s *scrubber) scrubTemp(dir string, active func(path string) bool) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to scrub %s: %v", dir, err)
+	}
+	if active != nil {
+		s.local.casMu.Lock()
+		defer s.local.casMu.Unlock()
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		info, err := entry.Info()
+		if err != nil || (info.ModTime().After(s.local.opened) && time.Since(info.ModTime()) < scrubTempAge) || (active != nil && active(path)) {
+			continue
+		}
+		if s.quarantine {
+			rel, _ := filepath.Rel(s.local.basePath, path)
+			if err := s.move(path, rel); err != nil {
+				return fmt.Errorf("failed to quarantine %s: %v", path, err)
+			}
+		}
+		s.report.StrayTempFiles = append(s.report.StrayTempFiles, path)
+	}
+	return nil
+}
+
+func (s *scrubber) hashFile(path string, h hash.Hash) (string, os.FileInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", nil, err
+	}
+	n, err := io.Copy(h, f)
+	s.report.Bytes += n
+	if err != nil {
+		return "", info, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), info, nil
+}
+
+// move 把文件移动到这次检查的隔离目录中 rel 的位置，文件不存在时忽略
+func (s *scrubber) move(path, rel string) error {
+	s.report.Quarantine = filepath.Join(s.local.basePath, metaDirName, "quarantine", s.report.Started.Format("20060102T150405Z"))
+	dst := filepath.Join(s.report.Quarantine, rel)
+	if err := createDir(filepath.Dir(dst)); err != nil {
+		return err
+	}
+	if err := os.Rename(path, dst); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+var escapedRune = regexp.MustCompile(`__0x([^_]*)__`)
+
+// unescapeKey 把 fileblob 转义过的路径还原为对象的键
+func unescapeKey(s string) string {
+	return escapedRune.ReplaceAllStringFunc(s, func(m string) string {
+		r, err := strconv.ParseInt(escapedRune.FindStringSubmatch(m)[1], 16, 32)
+		if err != nil {
+			return m
+		}
+		return string(rune(r))
+	})
+}
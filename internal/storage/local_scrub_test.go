@@ -0,0 +1,139 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Grey0520/s3proxy/internal/s3err"
+)
+
+// flipByte 修改文件中的一个字节，模拟磁盘上的静默损坏
+func flipByte(t *testing.T, path string) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	data[len(data)/2] ^= 0xff
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+}
+
+func TestLFSStoreScrub(t *testing.T) {
+	dir := t.TempDir()
+	store := newIndexedStore(t, dir, WithCompression(CompressionGzip, []string{"bucket"}, []string{"text/csv"}))
+	store.CreateBucket("bucket")
+	putString(t, store, "bucket", "good", "good content")
+	putString(t, store, "bucket", "a//b", "corrupt content")
+	store.PutObject("bucket", "data.csv", &Object{ContentType: "text/csv", Data: io.NopCloser(strings.NewReader("a,b,c\n1,2,3\n"))})
+
+	flipByte(t, filepath.Join(dir, "bucket", "a", "__0x2f__b"))
+	os.WriteFile(filepath.Join(dir, "bucket", "deleted.attrs"), []byte("{}"), 0o644)
+	stray := filepath.Join(store.tmpDir(), "upload.data")
+	os.WriteFile(stray, []byte("x"), 0o644)
+	old := time.Now().Add(-2 * scrubTempAge)
+	os.Chtimes(stray, old, old)
+	// 正在进行的写入
+	os.WriteFile(filepath.Join(store.tmpDir(), "active.data"), []byte("x"), 0o644)
+
+	report, err := store.Scrub(false)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if report.Objects != 3 || len(report.Corrupt) != 1 || report.Quarantine != "" {
+		t.Fatalf("Unexpected report %+v", report)
+	}
+	if c := report.Corrupt[0]; c.Bucket != "bucket" || c.Key != "a//b" || c.Expected == c.Actual {
+		t.Errorf("Unexpected corrupt object %+v", c)
+	}
+	if !reflect.DeepEqual(report.OrphanedAttrs, []string{filepath.Join(dir, "bucket", "deleted.attrs")}) {
+		t.Errorf("Unexpected orphaned attributes %v", report.OrphanedAttrs)
+	}
+	if !reflect.DeepEqual(report.StrayTempFiles, []string{stray}) {
+		t.Errorf("Unexpected stray temp files %v", report.StrayTempFiles)
+	}
+	if keys, _ := listKeys(t, store, "bucket"); len(keys) != 3 {
+		t.Errorf("Expected report only, got keys %v", keys)
+	}
+
+	report, err = store.Scrub(true)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if report.Problems() != 3 || !strings.HasPrefix(report.Quarantine, filepath.Join(dir, metaDirName, "quarantine")) {
+		t.Fatalf("Unexpected report %+v", report)
+	}
+	for _, path := range []string{"bucket/a/__0x2f__b", "bucket/a/__0x2f__b.attrs", "bucket/deleted.attrs", metaDirName + "/tmp/upload.data"} {
+		if _, err := os.Stat(filepath.Join(report.Quarantine, path)); err != nil {
+			t.Errorf("Expected %s to be quarantined, got %v", path, err)
+		}
+	}
+	if _, err := store.GetObject("bucket", "a//b"); !errors.Is(err, s3err.ErrNoSuchKey) {
+		t.Errorf("Expected NoSuchKey for quarantined object, got %v", err)
+	}
+	if keys, _ := listKeys(t, store, "bucket"); !reflect.DeepEqual(keys, []string{"data.csv", "good"}) {
+		t.Errorf("Expected quarantined object to be removed from index, got %v", keys)
+	}
+
+	report, err = store.Scrub(false)
+	if err != nil || report.Problems() != 0 || report.Objects != 2 {
+		t.Errorf("Expected clean report, got %+v (%v)", report, err)
+	}
+}
+
+func TestLFSStoreScrubDedup(t *testing.T) {
+	dir := t.TempDir()
+	store := newDedupStore(t, dir)
+	store.CreateBucket("bucket")
+	putString(t, store, "bucket", "a", "shared content")
+	putString(t, store, "bucket", "b", "shared content")
+	putString(t, store, "bucket", "c", "other content")
+
+	sum := sha256.Sum256([]byte("shared content"))
+	flipByte(t, store.casBlobPath(hex.EncodeToString(sum[:])))
+
+	report, err := store.Scrub(true)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	var corrupt []string
+	for _, c := range report.Corrupt {
+		corrupt = append(corrupt, c.Key)
+	}
+	if !reflect.DeepEqual(corrupt, []string{"", "a", "b"}) {
+		t.Fatalf("Expected content and both objects to be corrupt, got %+v", report.Corrupt)
+	}
+	if got := readString(t, store, "bucket", "c"); got != "other content" {
+		t.Errorf("Expected other content, got %q", got)
+	}
+
+	// 重新上传相同的内容时写入新的副本
+	putString(t, store, "bucket", "a", "shared content")
+	if got := readString(t, store, "bucket", "a"); got != "shared content" {
+		t.Errorf("Expected shared content, got %q", got)
+	}
+	if report, err := store.Scrub(false); err != nil || report.Problems() != 0 {
+		t.Errorf("Expected clean report, got %+v (%v)", report, err)
+	}
+}
+
+func TestUnescapeKey(t *testing.T) {
+	for _, key := range []string{"plain", "a//b", "../up", "trailing/", "ctl\x01key", "__0xzz__"} {
+		escaped, err := escapeKey(key)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if got := unescapeKey(escaped); got != key {
+			t.Errorf("Expected %q, got %q", key, got)
+		}
+	}
+}
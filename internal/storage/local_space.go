@@ -0,0 +1,194 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Grey0520/s3proxy/internal/s3err"
+)
+
+// SpaceStatus 是 LFSStore 或 ErasureStore 的一个目录所在文件系统的剩余空间，低于下限时这个目录只接受读取和删除
+type SpaceStatus struct {
+	Path        string `json:"path"`
+	FreeBytes   int64  `json:"freeBytes"`
+	TotalBytes  int64  `json:"totalBytes"`
+	FreeInodes  int64  `json:"freeInodes"`
+	TotalInodes int64  `json:"totalInodes"`
+	ReadOnly    bool   `json:"readOnly"`
+	// 切换到只读的原因
+	Reason  string    `json:"reason,omitempty"`
+	Checked time.Time `json:"checked"`
+	// 读取文件系统信息失败时的错误，此时不切换到只读
+	Error string `json:"error,omitempty"`
+}
+
+// fsStats 是 statFS 返回的文件系统信息，不支持 inode 的文件系统 totalInodes 为 0
+type fsStats struct {
+	freeBytes, totalBytes   int64
+	freeInodes, totalInodes int64
+}
+
+// 没有指定间隔时，剩余空间的检查结果缓存的时间
+const defaultSpaceInterval = 30 * time.Second
+
+// WithSpaceGuard 在剩余空间少于 minFreeBytes 或剩余 inode 少于 minFreeInodes 时拒绝写入，为 0 的下限不检查
+// 检查结果缓存 interval（为 0 时 30 秒），期间的写入使用缓存的结果并从中扣除写入的大小
+func WithSpaceGuard(minFreeBytes, minFreeInodes int64, interval time.Duration) LFSOption {
+	return func(local *LFSStore) error {
+		g, err := newSpaceGuard("local", local.basePath, minFreeBytes, minFreeInodes, interval)
+		if err != nil {
+			return err
+		}
+		local.space = g
+		return nil
+	}
+}
+
+// initSpace 在启动时检查一次剩余空间，当前平台不支持时返回错误
+func (local *LFSStore) initSpace() error {
+	return local.space.init()
+}
+
+// SpaceStatus 返回最近一次检查的结果，没有开启剩余空间检查时返回 false
+func (local *LFSStore) SpaceStatus() (SpaceStatus, bool) {
+	if local.space == nil {
+		return SpaceStatus{}, false
+	}
+	return local.space.current(), true
+}
+
+// checkSpace 在写入前检查剩余空间，只读或写入 size 字节后会低于下限时返回 InsufficientStorage
+// size 为 0 表示大小未知，只检查是否只读
+func (local *LFSStore) checkSpace(size int64) error {
+	if local.space == nil {
+		return nil
+	}
+	return local.space.check(size)
+}
+
+// spaceGuard 检查一个目录所在文件系统的剩余空间，LFSStore 和 ErasureStore 的每个目录各使用一个
+type spaceGuard struct {
+	// 日志的前缀
+	name          string
+	path          string
+	minFreeBytes  int64
+	minFreeInodes int64
+	interval      time.Duration
+
+	mu     sync.Mutex
+	status SpaceStatus
+}
+
+func newSpaceGuard(name, path string, minFreeBytes, minFreeInodes int64, interval time.Duration) (*spaceGuard, error) {
+	if minFreeBytes < 0 || minFreeInodes < 0 {
+		return nil, fmt.Errorf("free space watermark cannot be negative")
+	}
+	if interval < 0 {
+		return nil, fmt.Errorf("free space check interval cannot be negative")
+	}
+	if interval == 0 {
+		interval = defaultSpaceInterval
+	}
+	return &spaceGuard{name: name, path: path, minFreeBytes: minFreeBytes, minFreeInodes: minFreeInodes, interval: interval}, nil
+}
+
+// init 读取一次文件系统信息，当前平台不支持时返回错误
+func (g *spaceGuard) init() error {
+	if _, err := statFS(g.path); errors.Is(err, errors.ErrUnsupported) {
+		return fmt.Errorf("free space guard: %v", err)
+	}
+	g.refresh()
+	return nil
+}
+
+// refresh 重新读取文件系统信息，按下限切换只读状态
+func (g *spaceGuard) refresh() SpaceStatus {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.refreshLocked()
+}
+
+func (g *spaceGuard) refreshLocked() SpaceStatus {
+	status := SpaceStatus{Path: g.path, Checked: time.Now().UTC()}
+	st, err := statFS(g.path)
+	if err != nil {
+		status.Error = err.Error()
+	} else {
+		status.FreeBytes, status.TotalBytes = st.freeBytes, st.totalBytes
+		status.FreeInodes, status.TotalInodes = st.freeInodes, st.totalInodes
+		switch {
+		case g.minFreeBytes > 0 && st.freeBytes < g.minFreeBytes:
+			status.Reason = fmt.Sprintf("%d bytes free, below the watermark of %d", st.freeBytes, g.minFreeBytes)
+		case g.minFreeInodes > 0 && st.totalInodes > 0 && st.freeInodes < g.minFreeInodes:
+			status.Reason = fmt.Sprintf("%d inodes free, below the watermark of %d", st.freeInodes, g.minFreeInodes)
+		}
+		status.ReadOnly = status.Reason != ""
+	}
+
+	if status.ReadOnly && !g.status.ReadOnly {
+		log.Printf("%s: %s is read-only: %s", g.name, g.path, status.Reason)
+	} else if !status.ReadOnly && g.status.ReadOnly && status.Error == "" {
+		log.Printf("%s: %s is writable again", g.name, g.path)
+	}
+	// 读取失败时保持原来的状态
+	if status.Error != "" {
+		status.ReadOnly, status.Reason = g.status.ReadOnly, g.status.Reason
+	}
+	g.status = status
+	return status
+}
+
+// current 返回缓存的状态，超过 interval 时重新检查
+func (g *spaceGuard) current() SpaceStatus {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if time.Since(g.status.Checked) >= g.interval {
+		return g.refreshLocked()
+	}
+	return g.status
+}
+
+// check 使用缓存的状态判断能否写入 size 字节，允许时从缓存的剩余空间中扣除 size，
+// 使下一次检查之前的写入也计入下限
+func (g *spaceGuard) check(size int64) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	status := g.status
+	if time.Since(status.Checked) >= g.interval {
+		status = g.refreshLocked()
+	}
+	if status.ReadOnly {
+		return s3err.ErrInsufficientStorage.WithMessage("The local store is read-only: " + status.Reason)
+	}
+	if size > 0 && g.minFreeBytes > 0 && status.Error == "" {
+		if status.FreeBytes-size < g.minFreeBytes {
+			return s3err.ErrInsufficientStorage.WithMessage(fmt.Sprintf("Not enough free space to store %d bytes: %d bytes free, watermark %d", size, status.FreeBytes, g.minFreeBytes))
+		}
+		g.status.FreeBytes -= size
+	}
+	return nil
+}
+
+// SpaceStatistics 返回所有开启了剩余空间检查的本地存储的状态，键为后端名称，
+// ErasureStore 的每个目录单独报告，键为后端名称加上目录的序号，如 default.0
+func SpaceStatistics(p StorageProvider) map[string]SpaceStatus {
+	stats := make(map[string]SpaceStatus)
+	WalkProviders(p, func(name string, p StorageProvider) {
+		switch s := p.(type) {
+		case *LFSStore:
+			if status, ok := s.SpaceStatus(); ok {
+				stats[name] = status
+			}
+		case *ErasureStore:
+			if dirs, ok := s.SpaceStatus(); ok {
+				for d, status := range dirs {
+					stats[fmt.Sprintf("%s.%d", name, d)] = status
+				}
+			}
+		}
+	})
+	return stats
+}
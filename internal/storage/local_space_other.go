@@ -0,0 +1,9 @@
+//go:build !(linux || darwin || freebsd)
+
+package storage
+
+import "errors"
+
+func statFS(path string) (fsStats, error) {
+	return fsStats{}, errors.ErrUnsupported
+}
@@ -0,0 +1,94 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/Grey0520/s3proxy/internal/s3err"
+)
+
+func TestLFSStoreSpaceGuard(t *testing.T) {
+	store, err := NewLFSStore(t.TempDir(), WithSpaceGuard(1, 0, 0))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	defer store.Close()
+	status, ok := store.SpaceStatus()
+	if !ok || status.ReadOnly || status.Error != "" || status.FreeBytes <= 0 || status.TotalBytes < status.FreeBytes {
+		t.Fatalf("Unexpected status %+v", status)
+	}
+	store.CreateBucket("bucket")
+	putString(t, store, "bucket", "existing", "existing content")
+
+	// 声明的大小会使剩余空间低于下限时直接拒绝
+	if status.FreeBytes > 8<<20 {
+		store.space.minFreeBytes = status.FreeBytes - 4<<20
+		err := store.PutObject("bucket", "large", &Object{Size: 64 << 20, Data: io.NopCloser(strings.NewReader("x"))})
+		if !errors.Is(err, s3err.ErrInsufficientStorage) {
+			t.Errorf("Expected InsufficientStorage, got %v", err)
+		}
+		if _, err := store.GetObject("bucket", "large"); !errors.Is(err, s3err.ErrNoSuchKey) {
+			t.Errorf("Expected rejected object not to exist, got %v", err)
+		}
+		if err := store.PutObject("bucket", "small", &Object{Size: 5, Data: io.NopCloser(strings.NewReader("small"))}); err != nil {
+			t.Errorf("Expected no error, got %v", err)
+		}
+	}
+
+	// 写入使用缓存的检查结果，到下一次检查时才切换到只读
+	store.space.minFreeBytes = 1 << 62
+	if err := putString(t, store, "bucket", "cached", "x"); err != nil {
+		t.Errorf("Expected cached status to allow writes, got %v", err)
+	}
+
+	// 低于下限时只读，仍然可以读取和删除
+	store.space.refresh()
+	if err := putString(t, store, "bucket", "key", "x"); !errors.Is(err, s3err.ErrInsufficientStorage) {
+		t.Errorf("Expected InsufficientStorage, got %v", err)
+	}
+	if err := store.CopyObject("bucket", "existing", "bucket", "copy"); !errors.Is(err, s3err.ErrInsufficientStorage) {
+		t.Errorf("Expected InsufficientStorage copying, got %v", err)
+	}
+	if err := store.CreateBucket("other"); !errors.Is(err, s3err.ErrInsufficientStorage) {
+		t.Errorf("Expected InsufficientStorage creating bucket, got %v", err)
+	}
+	if got := readString(t, store, "bucket", "existing"); got != "existing content" {
+		t.Errorf("Expected existing content, got %q", got)
+	}
+	if err := store.DeleteObject("bucket", "existing"); err != nil {
+		t.Errorf("Expected no error deleting, got %v", err)
+	}
+	status = SpaceStatistics(store)[DefaultBackend]
+	if !status.ReadOnly || !strings.Contains(status.Reason, "bytes free") {
+		t.Errorf("Expected read-only status, got %+v", status)
+	}
+
+	store.space.minFreeBytes = 1
+	store.space.refresh()
+	if err := putString(t, store, "bucket", "key", "x"); err != nil {
+		t.Errorf("Expected writes to resume, got %v", err)
+	}
+	if status, _ := store.SpaceStatus(); status.ReadOnly {
+		t.Errorf("Expected writable status, got %+v", status)
+	}
+
+	if status.TotalInodes > 0 {
+		store.space.minFreeInodes = 1 << 62
+		store.space.refresh()
+		if err := putString(t, store, "bucket", "key", "x"); !errors.Is(err, s3err.ErrInsufficientStorage) {
+			t.Errorf("Expected InsufficientStorage for inodes, got %v", err)
+		}
+	}
+}
+
+func TestLFSStoreSpaceGuardDisabled(t *testing.T) {
+	store := newTestLFSStore(t, t.TempDir())
+	if _, ok := store.SpaceStatus(); ok {
+		t.Error("Expected no status without a watermark")
+	}
+	if stats := SpaceStatistics(store); len(stats) != 0 {
+		t.Errorf("Expected no statistics, got %v", stats)
+	}
+}
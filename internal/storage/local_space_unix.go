@@ -0,0 +1,19 @@
+//go:build linux || darwin || freebsd
+
+package storage
+
+import "syscall"
+
+func statFS(path string) (fsStats, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return fsStats{}, err
+	}
+	return fsStats{
+		// Bavail 不包括只有 root 可以使用的保留空间
+		freeBytes:   int64(st.Bavail) * int64(st.Bsize),
+		totalBytes:  int64(st.Blocks) * int64(st.Bsize),
+		freeInodes:  int64(st.Ffree),
+		totalInodes: int64(st.Files),
+	}, nil
+}
@@ -0,0 +1,247 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/Grey0520/s3proxy/internal/s3err"
+	"gocloud.dev/blob"
+)
+
+const (
+	// 保存 s3proxy 自身数据的目录，位于 basePath 下，不会被当作存储桶
+	metaDirName = ".s3proxy"
+
+	// s3proxy 写入对象元数据的键都以 metaPrefix 开头，不会返回给客户端
+	metaPrefix = "s3proxy-"
+	metaSSE    = metaPrefix + "sse"
+	metaSSEKey = metaPrefix + "sse-key"
+
+	metaSSEC        = metaPrefix + "ssec"
+	metaSSECSalt    = metaPrefix + "ssec-salt"
+	metaSSECKeyHMAC = metaPrefix + "ssec-key-hmac"
+)
+
+// bucketConfig 是存储桶级别的设置，保存在 basePath/.s3proxy/buckets/<bucket>.json
+type bucketConfig struct {
+	// 默认的服务端加密算法，为空表示不加密
+	Encryption string `json:"encryption,omitempty"`
+}
+
+func (local *LFSStore) bucketConfigPath(bucketName string) string {
+	return filepath.Join(local.basePath, metaDirName, "buckets", bucketName+".json")
+}
+
+func (local *LFSStore) readBucketConfig(bucketName string) (*bucketConfig, error) {
+	cfg := &bucketConfig{}
+	data, err := os.ReadFile(local.bucketConfigPath(bucketName))
+	if os.IsNotExist(err) {
+		return cfg, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read bucket %s config: %v", bucketName, err)
+	}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse bucket %s config: %v", bucketName, err)
+	}
+	return cfg, nil
+}
+
+func (local *LFSStore) writeBucketConfig(bucketName string, cfg *bucketConfig) error {
+	if err := local.checkSpace(0); err != nil {
+		return err
+	}
+	path := local.bucketConfigPath(bucketName)
+	if err := createDirIfNotExist(filepath.Dir(path)); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+	// 先写临时文件再重命名，避免写到一半的配置被读到
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("failed to write bucket %s config: %v", bucketName, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to write bucket %s config: %v", bucketName, err)
+	}
+	return nil
+}
+
+func (local *LFSStore) PutBucketEncryption(bucketName string, cfg *ServerSideEncryptionConfiguration) error {
+	if _, err := local.bucket(bucketName); err != nil {
+		return err
+	}
+	if len(cfg.Rules) != 1 {
+		return s3err.ErrInvalidArgument.WithMessage("exactly one encryption rule is required")
+	}
+	algorithm := cfg.Rules[0].ApplyServerSideEncryptionByDefault.SSEAlgorithm
+	if err := local.checkEncryption(algorithm); err != nil {
+		return err
+	}
+
+	bc, err := local.readBucketConfig(bucketName)
+	if err != nil {
+		return err
+	}
+	bc.Encryption = algorithm
+	return local.writeBucketConfig(bucketName, bc)
+}
+
+func (local *LFSStore) GetBucketEncryption(bucketName string) (*ServerSideEncryptionConfiguration, error) {
+	if _, err := local.bucket(bucketName); err != nil {
+		return nil, err
+	}
+	bc, err := local.readBucketConfig(bucketName)
+	if err != nil {
+		return nil, err
+	}
+	if bc.Encryption == "" {
+		return nil, s3err.ErrNoSuchEncryptionConfiguration
+	}
+	return &ServerSideEncryptionConfiguration{
+		Rules: []ServerSideEncryptionRule{
+			{ApplyServerSideEncryptionByDefault: ServerSideEncryptionByDefault{SSEAlgorithm: bc.Encryption}},
+		},
+	}, nil
+}
+
+func (local *LFSStore) DeleteBucketEncryption(bucketName string) error {
+	if _, err := local.bucket(bucketName); err != nil {
+		return err
+	}
+	bc, err := local.readBucketConfig(bucketName)
+	if err != nil {
+		return err
+	}
+	if bc.Encryption == "" {
+		return nil
+	}
+	bc.Encryption = ""
+	return local.writeBucketConfig(bucketName, bc)
+}
+
+// checkEncryption 检查是否支持指定的加密算法
+func (local *LFSStore) checkEncryption(algorithm string) error {
+	switch algorithm {
+	case SSEAlgorithmAES256:
+		if local.masterKey == nil {
+			return s3err.ErrInvalidRequest.WithMessage("server-side encryption is not configured on this server")
+		}
+		return nil
+	case "aws:kms", "aws:kms:dsse":
+		return s3err.ErrNotImplemented.WithMessage("KMS encryption is not supported")
+	default:
+		return s3err.ErrInvalidArgument.WithMessage(fmt.Sprintf("unsupported server-side encryption algorithm %q", algorithm))
+	}
+}
+
+// resolveEncryption 决定新对象使用的加密算法，请求中没有指定时使用存储桶的默认设置
+func (local *LFSStore) resolveEncryption(bucketName, requested string) (string, error) {
+	if requested != "" {
+		if err := local.checkEncryption(requested); err != nil {
+			return "", err
+		}
+		return requested, nil
+	}
+	bc, err := local.readBucketConfig(bucketName)
+	if err != nil {
+		return "", err
+	}
+	if bc.Encryption != "" {
+		// 主密钥可能在设置默认加密之后被移除了
+		if err := local.checkEncryption(bc.Encryption); err != nil {
+			return "", err
+		}
+	}
+	return bc.Encryption, nil
+}
+
+// newEncryptionMetadata 生成新的数据密钥，返回密钥以及需要写入对象的元数据
+func (local *LFSStore) newEncryptionMetadata() ([]byte, map[string]string, error) {
+	dataKey, err := newDataKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	wrapped, err := wrapKey(local.masterKey, dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return dataKey, map[string]string{
+		metaSSE:    SSEAlgorithmAES256,
+		metaSSEKey: wrapped,
+	}, nil
+}
+
+// encryptionFor 返回写入新对象使用的数据密钥和需要保存的元数据，不加密时都为 nil
+func (local *LFSStore) encryptionFor(bucketName string, data *Object, o *ObjectOptions) ([]byte, map[string]string, error) {
+	if key := o.SSECustomerKey; key != nil {
+		if data.ServerSideEncryption != "" {
+			return nil, nil, s3err.ErrInvalidArgument.WithMessage("Server Side Encryption with Customer provided key is incompatible with the encryption method specified.")
+		}
+		salt, err := newSSECSalt()
+		if err != nil {
+			return nil, nil, err
+		}
+		dataKey, keyHMAC := ssecDerive(key.Key, salt)
+		return dataKey, map[string]string{
+			metaSSEC:        key.Algorithm,
+			metaSSECSalt:    base64.StdEncoding.EncodeToString(salt),
+			metaSSECKeyHMAC: base64.StdEncoding.EncodeToString(keyHMAC),
+		}, nil
+	}
+
+	algorithm, err := local.resolveEncryption(bucketName, data.ServerSideEncryption)
+	if err != nil || algorithm != SSEAlgorithmAES256 {
+		return nil, nil, err
+	}
+	return local.newEncryptionMetadata()
+}
+
+// decryptionFor 返回读取对象使用的数据密钥，对象未加密时返回 nil
+// key 为请求中提供的 SSE-C 密钥，与对象的加密方式不符时返回 S3 对应的错误
+func (local *LFSStore) decryptionFor(attrs *blob.Attributes, key *SSECustomerKey) ([]byte, error) {
+	if attrs.Metadata[metaSSEC] != "" {
+		if key == nil {
+			return nil, s3err.ErrInvalidRequest.WithMessage("The object was stored using a form of Server Side Encryption. The correct parameters must be provided to retrieve the object.")
+		}
+		salt, err := base64.StdEncoding.DecodeString(attrs.Metadata[metaSSECSalt])
+		if err != nil {
+			return nil, fmt.Errorf("invalid SSE-C salt: %v", err)
+		}
+		stored, err := base64.StdEncoding.DecodeString(attrs.Metadata[metaSSECKeyHMAC])
+		if err != nil {
+			return nil, fmt.Errorf("invalid SSE-C key HMAC: %v", err)
+		}
+		dataKey, keyHMAC := ssecDerive(key.Key, salt)
+		if !hmac.Equal(keyHMAC, stored) {
+			return nil, s3err.ErrAccessDenied.WithMessage("The provided encryption key does not match the key used to encrypt the object.")
+		}
+		return dataKey, nil
+	}
+
+	if key != nil {
+		return nil, s3err.ErrInvalidRequest.WithMessage("The encryption parameters are not applicable to this object.")
+	}
+	if attrs.Metadata[metaSSE] != "" {
+		if local.masterKey == nil {
+			return nil, fmt.Errorf("object is encrypted but no master key is configured")
+		}
+		return unwrapKey(local.masterKey, attrs.Metadata[metaSSEKey])
+	}
+	return nil, nil
+}
+
+// objectSize 返回对象的明文大小
+func objectSize(attrs *blob.Attributes) (int64, error) {
+	if attrs.Metadata[metaSSE] != "" || attrs.Metadata[metaSSEC] != "" {
+		return ssePlaintextSize(attrs.Size)
+	}
+	return attrs.Size, nil
+}
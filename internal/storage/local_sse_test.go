@@ -0,0 +1,151 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/Grey0520/s3proxy/internal/s3err"
+)
+
+func newEncryptedStore(t *testing.T) *LFSStore {
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, sseKeySize))
+	store, err := NewLFSStore(t.TempDir(), WithMasterKey(key))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	return store
+}
+
+func TestLFSStoreMasterKey(t *testing.T) {
+	if _, err := NewLFSStore(t.TempDir(), WithMasterKey("c2hvcnQ=")); err == nil {
+		t.Error("Expected error for short master key")
+	}
+
+	store, _ := NewLFSStore(t.TempDir())
+	store.CreateBucket("bucket")
+	err := store.PutObject("bucket", "key", &Object{
+		Data:                 io.NopCloser(bytes.NewReader([]byte("test content"))),
+		ServerSideEncryption: SSEAlgorithmAES256,
+	})
+	if !errors.Is(err, s3err.ErrInvalidRequest) {
+		t.Errorf("Expected InvalidRequest without master key, got %v", err)
+	}
+}
+
+func TestLFSStoreEncryptedObject(t *testing.T) {
+	store := newEncryptedStore(t)
+	if err := store.CreateBucket("bucket"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	content := bytes.Repeat([]byte("secret content "), 10000)
+	err := store.PutObject("bucket", "key", &Object{
+		ContentType:          "text/plain",
+		Data:                 io.NopCloser(bytes.NewReader(content)),
+		ServerSideEncryption: SSEAlgorithmAES256,
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// 磁盘上不能出现明文
+	raw, err := os.ReadFile(filepath.Join(store.basePath, "bucket", "key"))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if bytes.Contains(raw, []byte("secret content")) {
+		t.Error("Expected object to be encrypted on disk")
+	}
+
+	obj, err := store.GetObject("bucket", "key")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	defer obj.Data.Close()
+	if obj.Size != int64(len(content)) || obj.ServerSideEncryption != SSEAlgorithmAES256 {
+		t.Errorf("Unexpected object attributes: size %d, sse %q", obj.Size, obj.ServerSideEncryption)
+	}
+	seeker, ok := obj.Data.(io.Seeker)
+	if !ok {
+		t.Fatal("Expected encrypted object to be seekable")
+	}
+	seeker.Seek(100000, io.SeekStart)
+	part := make([]byte, 15)
+	if _, err := io.ReadFull(obj.Data, part); err != nil || !bytes.Equal(part, content[100000:100015]) {
+		t.Errorf("Unexpected range content %q (%v)", part, err)
+	}
+
+	head, err := store.HeadObject("bucket", "key")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if head["Size"] != strconv.Itoa(len(content)) || head["ServerSideEncryption"] != SSEAlgorithmAES256 {
+		t.Errorf("Unexpected head result %v", head)
+	}
+	if _, ok := head[metaSSEKey]; ok {
+		t.Error("Expected internal metadata to be hidden")
+	}
+
+	result, err := store.ListBucket("bucket")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(result.Contents) != 1 || result.Contents[0].Size != int64(len(content)) {
+		t.Errorf("Unexpected listing %+v", result.Contents)
+	}
+}
+
+func TestLFSStoreBucketEncryption(t *testing.T) {
+	store := newEncryptedStore(t)
+	store.CreateBucket("bucket")
+
+	if _, err := store.GetBucketEncryption("bucket"); !errors.Is(err, s3err.ErrNoSuchEncryptionConfiguration) {
+		t.Fatalf("Expected no encryption configuration, got %v", err)
+	}
+
+	kms := &ServerSideEncryptionConfiguration{Rules: []ServerSideEncryptionRule{
+		{ApplyServerSideEncryptionByDefault: ServerSideEncryptionByDefault{SSEAlgorithm: "aws:kms"}},
+	}}
+	if err := store.PutBucketEncryption("bucket", kms); !errors.Is(err, s3err.ErrNotImplemented) {
+		t.Errorf("Expected NotImplemented for aws:kms, got %v", err)
+	}
+
+	cfg := &ServerSideEncryptionConfiguration{Rules: []ServerSideEncryptionRule{
+		{ApplyServerSideEncryptionByDefault: ServerSideEncryptionByDefault{SSEAlgorithm: SSEAlgorithmAES256}},
+	}}
+	if err := store.PutBucketEncryption("bucket", cfg); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	store.PutObject("bucket", "key", &Object{Data: io.NopCloser(bytes.NewReader([]byte("test content")))})
+	obj, err := store.GetObject("bucket", "key")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	data, _ := io.ReadAll(obj.Data)
+	obj.Data.Close()
+	if obj.ServerSideEncryption != SSEAlgorithmAES256 || string(data) != "test content" {
+		t.Errorf("Expected object encrypted by bucket default, got %q %q", obj.ServerSideEncryption, data)
+	}
+
+	// 配置目录不能被当作存储桶
+	buckets, _ := store.ListAllMyBuckets()
+	for _, b := range buckets.Buckets.Bucket {
+		if b.Name == metaDirName || b.Name == "buckets" {
+			t.Errorf("Unexpected bucket %s", b.Name)
+		}
+	}
+
+	if err := store.DeleteBucketEncryption("bucket"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, err := store.GetBucketEncryption("bucket"); !errors.Is(err, s3err.ErrNoSuchEncryptionConfiguration) {
+		t.Errorf("Expected encryption configuration to be deleted, got %v", err)
+	}
+}
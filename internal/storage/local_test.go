@@ -2,34 +2,59 @@ package storage
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/Grey0520/s3proxy/internal/s3err"
 )
 
 var baseDir = "/tmp/buckets"
 
 func TestNewLFSStore(t *testing.T) {
 	dir := baseDir
-	_, err := NewLFSStore(dir)
+	store, err := NewLFSStore(dir)
 	if err != nil {
-		t.Errorf("failed to create new local storage provider: %v", err)
+		t.Fatalf("failed to create new local storage provider: %v", err)
+	}
+	store.Close()
+}
+
+func TestNewLFSStoreInvalidOptions(t *testing.T) {
+	for name, opt := range map[string]LFSOption{
+		"negative scrub interval":     WithScrub(-time.Second, false),
+		"quarantine without interval": WithScrub(0, true),
+		"negative dedup gc interval":  WithDedup(-time.Second),
+		"negative rescan interval":    WithWatch(-time.Second, nil),
+	} {
+		if store, err := NewLFSStore(t.TempDir(), opt); err == nil {
+			store.Close()
+			t.Errorf("Expected error for %s", name)
+		}
 	}
 }
 
 func TestLFSStoreCreateBucket(t *testing.T) {
 	dir := baseDir
 	store, _ := NewLFSStore(dir)
+	defer store.Close()
 
-	bucketName := "test_bucket_create"
+	bucketName := "test-bucket-create"
 	_ = store.CreateBucket(bucketName)
 }
 
 func TestLFSStoreDeleteBucket(t *testing.T) {
 	dir := baseDir
 	store, _ := NewLFSStore(dir)
+	defer store.Close()
 
-	bucketName := "test_bucket_delete"
+	bucketName := "test-bucket-delete"
 	err := store.CreateBucket(bucketName)
 	if err != nil {
 		t.Fatalf("Failed to create bucket: %v", err)
@@ -44,6 +69,7 @@ func TestLFSStoreDeleteBucket(t *testing.T) {
 func TestLFSStoreListBucket(t *testing.T) {
 	dir := baseDir
 	store, _ := NewLFSStore(dir)
+	defer store.Close()
 
 	bucketName := "test-bucket-listbucket"
 	err := store.CreateBucket(bucketName)
@@ -61,6 +87,7 @@ func TestLFSStoreListBucket(t *testing.T) {
 func TestLFSStoreListAllMyBuckets(t *testing.T) {
 	dir := baseDir
 	store, _ := NewLFSStore(dir)
+	defer store.Close()
 
 	bucketName := "test-bucket-listallmybuckets"
 	err := store.CreateBucket(bucketName)
@@ -86,6 +113,7 @@ func TestLFSStoreListAllMyBuckets(t *testing.T) {
 func TestLFSStoreGetBucketAcl(t *testing.T) {
 	dir := baseDir
 	store, _ := NewLFSStore(dir)
+	defer store.Close()
 
 	bucketName := "test-bucket-getbucketacl"
 	err := store.CreateBucket(bucketName)
@@ -103,6 +131,7 @@ func TestLFSStoreGetBucketAcl(t *testing.T) {
 func TestLFSStorePutObject(t *testing.T) {
 	dir := baseDir
 	store, _ := NewLFSStore(dir)
+	defer store.Close()
 
 	bucketName := "test-bucket-putobject"
 	store.CreateBucket(bucketName)
@@ -110,7 +139,7 @@ func TestLFSStorePutObject(t *testing.T) {
 	objectKey := "test-object-key"
 	objectData := &Object{
 		Key:         objectKey,
-		Data:        bytes.NewReader([]byte("test content")),
+		Data:        io.NopCloser(bytes.NewReader([]byte("test content"))),
 		ContentType: "text/plain",
 	}
 	err := store.PutObject(bucketName, objectKey, objectData)
@@ -122,6 +151,7 @@ func TestLFSStorePutObject(t *testing.T) {
 func TestLFSStoreGetObject(t *testing.T) {
 	dir := baseDir
 	store, _ := NewLFSStore(dir)
+	defer store.Close()
 
 	bucketName := "test-bucket-getobject"
 	store.CreateBucket(bucketName)
@@ -129,7 +159,7 @@ func TestLFSStoreGetObject(t *testing.T) {
 	objectKey := "test-object-key"
 	objectData := &Object{
 		Key:         objectKey,
-		Data:        bytes.NewReader([]byte("test content")),
+		Data:        io.NopCloser(bytes.NewReader([]byte("test content"))),
 		ContentType: "text/plain",
 	}
 	store.PutObject(bucketName, objectKey, objectData)
@@ -150,6 +180,7 @@ func TestLFSStoreGetObject(t *testing.T) {
 func TestLFSStoreDeleteObject(t *testing.T) {
 	dir := baseDir
 	store, _ := NewLFSStore(dir)
+	defer store.Close()
 
 	bucketName := "test-bucket-deleteobject"
 	store.CreateBucket(bucketName)
@@ -157,7 +188,7 @@ func TestLFSStoreDeleteObject(t *testing.T) {
 	objectKey := "test-object-key"
 	objectData := &Object{
 		Key:         objectKey,
-		Data:        bytes.NewReader([]byte("test content")),
+		Data:        io.NopCloser(bytes.NewReader([]byte("test content"))),
 		ContentType: "text/plain",
 	}
 	store.PutObject(bucketName, objectKey, objectData)
@@ -171,6 +202,7 @@ func TestLFSStoreDeleteObject(t *testing.T) {
 func TestLFSStoreCopyObject(t *testing.T) {
 	dir := baseDir
 	store, _ := NewLFSStore(dir)
+	defer store.Close()
 
 	bucketName := "test-bucket-copyobject"
 	store.CreateBucket(bucketName)
@@ -178,7 +210,7 @@ func TestLFSStoreCopyObject(t *testing.T) {
 	objectKey := "test-object-key"
 	objectData := &Object{
 		Key:         objectKey,
-		Data:        bytes.NewReader([]byte("test content")),
+		Data:        io.NopCloser(bytes.NewReader([]byte("test content"))),
 		ContentType: "text/plain",
 	}
 	store.PutObject(bucketName, objectKey, objectData)
@@ -193,6 +225,7 @@ func TestLFSStoreCopyObject(t *testing.T) {
 func TestLFSStoreMoveObject(t *testing.T) {
 	dir := baseDir
 	store, _ := NewLFSStore(dir)
+	defer store.Close()
 
 	bucketName := "test-bucket-moveobject"
 	store.CreateBucket(bucketName)
@@ -200,7 +233,7 @@ func TestLFSStoreMoveObject(t *testing.T) {
 	objectKey := "test-object-key"
 	objectData := &Object{
 		Key:         objectKey,
-		Data:        bytes.NewReader([]byte("test content")),
+		Data:        io.NopCloser(bytes.NewReader([]byte("test content"))),
 		ContentType: "text/plain",
 	}
 	store.PutObject(bucketName, objectKey, objectData)
@@ -211,3 +244,217 @@ func TestLFSStoreMoveObject(t *testing.T) {
 		t.Fatalf("Failed to move object: %v", err)
 	}
 }
+
+// hammerBuckets 在多个存储桶上并发读写，每个对象的内容包含自己的存储桶和键，用于发现写到其他存储桶的对象
+func hammerBuckets(t *testing.T, store *LFSStore) {
+	const buckets, workers, rounds = 8, 16, 20
+	for b := 0; b < buckets; b++ {
+		if err := store.CreateBucket(fmt.Sprintf("bucket-%d", b)); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers*rounds)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				bucketName := fmt.Sprintf("bucket-%d", (w+i)%buckets)
+				key := fmt.Sprintf("worker-%d/key-%d", w, i)
+				content := bucketName + "/" + key
+				err := store.PutObject(bucketName, key, &Object{
+					ContentType: "text/plain",
+					Data:        io.NopCloser(bytes.NewReader([]byte(content))),
+				})
+				if err != nil {
+					errs <- err
+					continue
+				}
+				obj, err := store.GetObject(bucketName, key)
+				if err != nil {
+					errs <- err
+					continue
+				}
+				data, err := io.ReadAll(obj.Data)
+				obj.Data.Close()
+				if err != nil || string(data) != content {
+					errs <- fmt.Errorf("unexpected content %q for %s, %v", data, content, err)
+				}
+				if _, err := store.HeadObject(bucketName, key); err != nil {
+					errs <- err
+				}
+				if _, err := store.ListBucket(bucketName); err != nil {
+					errs <- err
+				}
+				// 复制到下一个存储桶，然后删除一半的对象
+				dst := fmt.Sprintf("bucket-%d", (w+i+1)%buckets)
+				if err := store.CopyObject(bucketName, key, dst, key+".copy"); err != nil {
+					errs <- err
+				}
+				if i%2 == 1 {
+					if err := store.DeleteObject(bucketName, key); err != nil {
+						errs <- err
+					}
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("Expected no error, got %v", err)
+	}
+
+	total := 0
+	for b := 0; b < buckets; b++ {
+		bucketName := fmt.Sprintf("bucket-%d", b)
+		result, err := store.ListBucket(bucketName)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		for _, c := range result.Contents {
+			got := readString(t, store, bucketName, c.Key)
+			want := bucketName + "/" + c.Key
+			if copied, ok := strings.CutSuffix(c.Key, ".copy"); ok {
+				// 副本的内容来自上一个存储桶
+				want = fmt.Sprintf("bucket-%d/%s", (b+buckets-1)%buckets, copied)
+			}
+			if got != want {
+				t.Errorf("Expected %q in %s, got %q", want, bucketName, got)
+			}
+			total++
+		}
+	}
+	if want := workers * rounds * 3 / 2; total != want {
+		t.Errorf("Expected %d objects, got %d", want, total)
+	}
+}
+
+func TestLFSStoreConcurrentBuckets(t *testing.T) {
+	store, _ := NewLFSStore(t.TempDir())
+	hammerBuckets(t, store)
+}
+
+func TestLFSStoreConcurrentBucketsDedup(t *testing.T) {
+	hammerBuckets(t, newDedupStore(t, t.TempDir()))
+}
+
+func TestLFSStoreConcurrentCreateBucket(t *testing.T) {
+	store, _ := NewLFSStore(t.TempDir())
+
+	var wg sync.WaitGroup
+	results := make(chan error, 16)
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results <- store.CreateBucket("bucket")
+		}()
+	}
+	wg.Wait()
+	close(results)
+	created := 0
+	for err := range results {
+		if err == nil {
+			created++
+		} else if !errors.Is(err, s3err.ErrBucketAlreadyExists) {
+			t.Errorf("Expected BucketAlreadyExists, got %v", err)
+		}
+	}
+	if created != 1 {
+		t.Errorf("Expected exactly one bucket to be created, got %d", created)
+	}
+
+	// 删除和重新创建存储桶的同时读写其他存储桶
+	store.CreateBucket("other")
+	putString(t, store, "other", "key", "content")
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			store.DeleteBucket("bucket")
+			store.CreateBucket("bucket")
+		}()
+		go func() {
+			defer wg.Done()
+			obj, err := store.GetObject("other", "key")
+			if err != nil {
+				t.Errorf("Expected no error, got %v", err)
+				return
+			}
+			data, _ := io.ReadAll(obj.Data)
+			obj.Data.Close()
+			if string(data) != "content" {
+				t.Errorf("Unexpected content %q", data)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, name := range []string{"", ".s3proxy", "a/b"} {
+		if err := store.CreateBucket(name); !errors.Is(err, s3err.ErrInvalidBucketName) {
+			t.Errorf("Expected InvalidBucketName for %q, got %v", name, err)
+		}
+	}
+}
+
+// 删除存储桶的同时写入对象，写入成功的对象不会随存储桶一起删除
+func TestLFSStoreDeleteBucketConcurrentPut(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewLFSStore(dir)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	for i := 0; i < 50; i++ {
+		if err := store.CreateBucket("bucket"); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		var putErr, deleteErr error
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			putErr = putString(t, store, "bucket", "key", "content")
+		}()
+		go func() {
+			defer wg.Done()
+			deleteErr = store.DeleteBucket("bucket")
+		}()
+		wg.Wait()
+
+		switch {
+		case putErr == nil && deleteErr == nil:
+			t.Fatalf("Expected the object or the bucket to survive")
+		case putErr == nil:
+			if !errors.Is(deleteErr, s3err.ErrBucketNotEmpty) {
+				t.Fatalf("Expected BucketNotEmpty, got %v", deleteErr)
+			}
+			if got := readString(t, store, "bucket", "key"); got != "content" {
+				t.Fatalf("Unexpected content %q", got)
+			}
+			if err := store.DeleteObject("bucket", "key"); err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if err := store.DeleteBucket("bucket"); err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+		default:
+			if !errors.Is(putErr, s3err.ErrNoSuchBucket) {
+				t.Fatalf("Expected NoSuchBucket, got %v", putErr)
+			}
+		}
+	}
+	// 被拒绝的写入不会留下存储桶目录或者临时文件
+	if _, err := os.Stat(filepath.Join(dir, "bucket")); !os.IsNotExist(err) {
+		t.Errorf("Expected bucket directory to be removed, got %v", err)
+	}
+	if entries, _ := os.ReadDir(store.tmpDir()); len(entries) != 0 {
+		t.Errorf("Expected no temporary files, got %d", len(entries))
+	}
+}
+
+func TestLFSStoreConcurrentBucketsIndex(t *testing.T) {
+	hammerBuckets(t, newDedupStore(t, t.TempDir(), WithIndex()))
+}
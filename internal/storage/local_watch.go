@@ -0,0 +1,427 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	bolt "go.etcd.io/bbolt"
+)
+
+// 外部修改的类型
+const (
+	ChangeCreated = "created"
+	ChangeUpdated = "updated"
+	ChangeRemoved = "removed"
+)
+
+// 文件在这段时间内没有新的事件才处理，避免读取正在写入的文件
+const watchSettle = time.Second
+
+// ChangeEvent 是一次不经过 s3proxy 的对象修改
+type ChangeEvent struct {
+	Type        string `json:"type"`
+	Bucket      string `json:"bucket"`
+	Key         string `json:"key"`
+	Size        int64  `json:"size,omitempty"`
+	ETag        string `json:"etag,omitempty"`
+	ContentType string `json:"contentType,omitempty"`
+}
+
+// WithWatch 发现直接在存储桶目录中添加、修改或删除的文件，为它们计算 ETag 和 Content-Type，写入属性文件并更新索引
+// 用 inotify 监听存储桶目录，同时每隔 interval 完整地扫描一次（NFS 上其他机器的修改不会产生 inotify 事件）
+// interval 为 0 时只在启动时扫描；每个修改都会调用一次 onChange，为空时写入日志
+// 是否修改只通过数据文件和属性文件的修改时间判断，覆盖时保留了较早修改时间的文件（如 cp -p、rsync -t）不会被发现
+func WithWatch(interval time.Duration, onChange func(ChangeEvent)) LFSOption {
+	return func(local *LFSStore) error {
+		local.watch = true
+		local.rescanInterval = interval
+		local.onChange = onChange
+		return nil
+	}
+}
+
+func (local *LFSStore) emit(events []ChangeEvent) {
+	for _, e := range events {
+		if local.onChange != nil {
+			local.onChange(e)
+		} else {
+			log.Printf("local: %s/%s %s externally", e.Bucket, e.Key, e.Type)
+		}
+	}
+}
+
+// watchLoop 处理 inotify 事件并定期扫描所有存储桶，直到 Close
+func (local *LFSStore) watchLoop() {
+	defer local.background.Done()
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Printf("local: failed to watch %s, only rescanning: %v", local.basePath, err)
+	} else {
+		defer w.Close()
+		if err := w.Add(local.basePath); err != nil {
+			log.Printf("local: failed to watch %s: %v", local.basePath, err)
+		}
+		local.mu.RLock()
+		entries := local.registryEntries()
+		local.mu.RUnlock()
+		for _, e := range entries {
+			local.watchDir(w, local.bucketPath(e.Name), nil)
+		}
+	}
+	// 开始监听之后再扫描，期间的修改不会遗漏
+	local.rescanAll()
+
+	var events chan fsnotify.Event
+	var errs chan error
+	if w != nil {
+		events, errs = w.Events, w.Errors
+	}
+	var rescan <-chan time.Time
+	if local.rescanInterval > 0 {
+		ticker := time.NewTicker(local.rescanInterval)
+		defer ticker.Stop()
+		rescan = ticker.C
+	}
+	settle := time.NewTicker(watchSettle / 2)
+	defer settle.Stop()
+	pending := make(map[string]time.Time)
+	for {
+		select {
+		case <-local.done:
+			return
+		case e := <-events:
+			local.watchEvent(w, e, pending)
+		case err := <-errs:
+			log.Printf("local: watch error: %v", err)
+		case <-settle.C:
+			for path, t := range pending {
+				if time.Since(t) >= watchSettle {
+					delete(pending, path)
+					local.emit(local.syncPath(path))
+				}
+			}
+		case <-rescan:
+			local.rescanAll()
+		}
+	}
+}
+
+// watchEvent 记录发生变化的文件，新建的目录也加入监听
+func (local *LFSStore) watchEvent(w *fsnotify.Watcher, e fsnotify.Event, pending map[string]time.Time) {
+	bucketName, rel := local.splitPath(e.Name)
+	if bucketName == "" {
+		return
+	}
+	if e.Has(fsnotify.Create) {
+		if info, err := os.Lstat(e.Name); err == nil && info.IsDir() {
+			// 监听之前目录中可能已经有文件了
+			local.watchDir(w, e.Name, pending)
+			return
+		}
+	}
+	if rel == "" {
+		return
+	}
+	pending[strings.TrimSuffix(e.Name, attrsExt)] = time.Now()
+}
+
+// watchDir 监听 dir 以及其中的所有子目录，pending 不为空时把其中的文件加入 pending
+func (local *LFSStore) watchDir(w *fsnotify.Watcher, dir string, pending map[string]time.Time) {
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() {
+			if err := w.Add(path); err != nil {
+				log.Printf("local: failed to watch %s: %v", path, err)
+			}
+		} else if pending != nil {
+			pending[strings.TrimSuffix(path, attrsExt)] = time.Now()
+		}
+		return nil
+	})
+}
+
+// splitPath 把 basePath 下的路径分为存储桶名称和存储桶中的相对路径，不在存储桶中时返回空的存储桶名称
+func (local *LFSStore) splitPath(path string) (string, string) {
+	rel, err := filepath.Rel(local.basePath, path)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return "", ""
+	}
+	bucketName, rel, _ := strings.Cut(filepath.ToSlash(rel), "/")
+	local.mu.RLock()
+	_, ok := local.registry[bucketName]
+	local.mu.RUnlock()
+	if !ok {
+		return "", ""
+	}
+	return bucketName, rel
+}
+
+// syncPath 根据磁盘上的文件更新对象，path 是对象数据文件的路径
+func (local *LFSStore) syncPath(path string) []ChangeEvent {
+	bucketName, rel := local.splitPath(path)
+	if bucketName == "" || rel == "" {
+		return nil
+	}
+	objectKey := unescapeKey(rel)
+	// 不是 fileblob 会生成的路径，无法作为对象访问
+	if escaped, err := escapeKey(objectKey); err != nil || escaped != rel {
+		return nil
+	}
+	event, err := local.syncObject(bucketName, objectKey)
+	if err != nil {
+		log.Printf("local: failed to sync %s: %v", path, err)
+		return nil
+	}
+	if event == nil {
+		return nil
+	}
+	return []ChangeEvent{*event}
+}
+
+func (local *LFSStore) rescanAll() {
+	local.mu.RLock()
+	entries := local.registryEntries()
+	local.mu.RUnlock()
+	for _, e := range entries {
+		events, err := local.Rescan(e.Name)
+		if err != nil {
+			log.Printf("local: failed to rescan bucket %s: %v", e.Name, err)
+		}
+		local.emit(events)
+	}
+}
+
+// Rescan 扫描存储桶目录，为外部添加或修改的文件生成属性文件，清理外部删除的对象，返回发现的修改
+// 没有变化的文件只需要读取文件信息
+func (local *LFSStore) Rescan(bucketName string) ([]ChangeEvent, error) {
+	if _, err := local.bucket(bucketName); err != nil {
+		return nil, err
+	}
+	var events []ChangeEvent
+	dir := local.bucketPath(bucketName)
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		path = strings.TrimSuffix(path, attrsExt)
+		if changed, err := externallyChanged(path); err != nil || !changed {
+			return err
+		}
+		events = append(events, local.syncPath(path)...)
+		return nil
+	})
+	if err != nil {
+		return events, fmt.Errorf("failed to rescan bucket %s: %v", bucketName, err)
+	}
+
+	// 整个目录被删除时没有属性文件可以发现，需要对照索引
+	if local.index {
+		removed, err := local.removedFromDisk(bucketName)
+		if err != nil {
+			return events, err
+		}
+		events = append(events, removed...)
+	}
+	return events, nil
+}
+
+// removedFromDisk 删除索引中数据文件已经不存在的对象
+func (local *LFSStore) removedFromDisk(bucketName string) ([]ChangeEvent, error) {
+	b, err := local.bucket(bucketName)
+	if err != nil {
+		return nil, err
+	}
+	db, err := local.indexDB(bucketName, b)
+	if err != nil {
+		return nil, err
+	}
+	var missing []string
+	err = db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(indexObjects).ForEach(func(k, _ []byte) error {
+			if path, err := local.objectPath(bucketName, string(k)); err == nil {
+				if _, err := os.Lstat(path); os.IsNotExist(err) {
+					missing = append(missing, string(k))
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to rescan bucket %s: %v", bucketName, err)
+	}
+	var events []ChangeEvent
+	for _, objectKey := range missing {
+		if _, err := local.syncObject(bucketName, objectKey); err != nil {
+			return events, err
+		}
+		events = append(events, ChangeEvent{Type: ChangeRemoved, Bucket: bucketName, Key: objectKey})
+	}
+	return events, nil
+}
+
+// externallyChanged 判断数据文件是否在 s3proxy 之外被修改：数据文件没有属性文件、数据文件被删除但属性文件还在，
+// 或者数据文件比属性文件新。s3proxy 写入对象时先写数据再写属性文件，属性文件不会比数据文件旧
+func externallyChanged(path string) (bool, error) {
+	info, err := os.Lstat(path)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	attrs, err := os.Lstat(path + attrsExt)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	switch {
+	case info == nil:
+		return attrs != nil, nil
+	case !info.Mode().IsRegular():
+		return false, nil
+	case attrs == nil:
+		return true, nil
+	default:
+		return info.ModTime().After(attrs.ModTime()), nil
+	}
+}
+
+// syncObject 持有对象的锁检查数据文件，有外部修改时更新属性文件和索引，返回发生的修改
+func (local *LFSStore) syncObject(bucketName, objectKey string) (*ChangeEvent, error) {
+	b, err := local.bucket(bucketName)
+	if err != nil {
+		return nil, err
+	}
+	path, err := local.objectPath(bucketName, objectKey)
+	if err != nil {
+		return nil, err
+	}
+	var event *ChangeEvent
+	err = local.indexed(bucketName, b, objectKey, func() (err error) {
+		changed, err := externallyChanged(path)
+		if err != nil || !changed {
+			return err
+		}
+		event, err = local.adoptFile(path)
+		if event != nil {
+			event.Bucket, event.Key = bucketName, objectKey
+		}
+		return err
+	})
+	return event, err
+}
+
+// adoptFile 为外部修改的数据文件重新生成属性文件，数据文件不存在时删除属性文件，调用时需要持有对象的锁
+func (local *LFSStore) adoptFile(path string) (*ChangeEvent, error) {
+	var prev fileAttrs
+	data, err := os.ReadFile(path + attrsExt)
+	exists := err == nil
+	if exists {
+		json.Unmarshal(data, &prev)
+	}
+
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		if err := os.Remove(path + attrsExt); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		local.releaseAttrs(&prev)
+		return &ChangeEvent{Type: ChangeRemoved}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := md5.New()
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(f, head)
+	h.Write(head[:n])
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	// 计算期间文件又被修改了，等下一次事件或者扫描再处理
+	if after, err := f.Stat(); err != nil || !after.ModTime().Equal(info.ModTime()) || after.Size() != info.Size() {
+		return nil, err
+	}
+
+	attrs := fileAttrs{MD5: h.Sum(nil)}
+	event := &ChangeEvent{Type: ChangeCreated, Size: info.Size(), ETag: formatETag(attrs.MD5)}
+	switch {
+	case exists && bytes.Equal(prev.MD5, attrs.MD5):
+		// 内容没有变化（例如只是 touch 了文件），保留原来的属性，只更新时间
+		attrs, event = prev, nil
+	case exists:
+		event.Type = ChangeUpdated
+		attrs.ContentType = prev.ContentType
+		// 数据已经被替换，加密、压缩和去重的元数据不再适用
+		for k, v := range prev.Metadata {
+			if !strings.HasPrefix(k, metaPrefix) {
+				if attrs.Metadata == nil {
+					attrs.Metadata = make(map[string]string)
+				}
+				attrs.Metadata[k] = v
+			}
+		}
+	}
+	if attrs.ContentType == "" {
+		attrs.ContentType = mime.TypeByExtension(filepath.Ext(path))
+		if attrs.ContentType == "" {
+			attrs.ContentType = http.DetectContentType(head[:n])
+		}
+	}
+
+	tmp, err := os.CreateTemp(local.tmpDir(), "*.attrs")
+	if err != nil {
+		return nil, err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+	if err := writeJSONFile(tmp.Name(), attrs, local.durability != DurabilityNone); err != nil {
+		return nil, err
+	}
+	// 属性文件的时间与计算时的数据文件相同，之后数据文件再被修改就会比属性文件新
+	if err := os.Chtimes(tmp.Name(), info.ModTime(), info.ModTime()); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp.Name(), path+attrsExt); err != nil {
+		return nil, err
+	}
+	if event == nil {
+		return nil, nil
+	}
+	if exists {
+		local.releaseAttrs(&prev)
+	}
+	event.ContentType = attrs.ContentType
+	return event, nil
+}
+
+// releaseAttrs 释放被替换的去重指针引用的内容
+func (local *LFSStore) releaseAttrs(attrs *fileAttrs) {
+	if hash := attrs.Metadata[metaCAS]; hash != "" && local.cas {
+		local.casMu.Lock()
+		local.release(hash)
+		local.casMu.Unlock()
+	}
+}
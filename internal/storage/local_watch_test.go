@@ -0,0 +1,162 @@
+package storage
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// writeExternal 模拟其他程序直接在存储桶目录中写入文件，修改时间晚于之前的文件
+func writeExternal(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	later := time.Now().Add(time.Second)
+	os.Chtimes(path, later, later)
+}
+
+func rescan(t *testing.T, store *LFSStore, bucketName string) []ChangeEvent {
+	t.Helper()
+	events, err := store.Rescan(bucketName)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	return events
+}
+
+func md5ETag(content string) string {
+	sum := md5.Sum([]byte(content))
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func TestLFSStoreRescan(t *testing.T) {
+	dir := t.TempDir()
+	store := newIndexedStore(t, dir)
+	store.CreateBucket("bucket")
+	putString(t, store, "bucket", "uploaded", "uploaded through s3proxy")
+
+	writeExternal(t, filepath.Join(dir, "bucket", "ingest", "data.json"), `{"a": 1}`)
+	writeExternal(t, filepath.Join(dir, "bucket", "page"), "<html><body>hi</body></html>")
+	events := rescan(t, store, "bucket")
+	want := []ChangeEvent{
+		{Type: ChangeCreated, Bucket: "bucket", Key: "ingest/data.json", Size: 8, ETag: md5ETag(`{"a": 1}`), ContentType: "application/json"},
+		{Type: ChangeCreated, Bucket: "bucket", Key: "page", Size: 28, ETag: md5ETag("<html><body>hi</body></html>"), ContentType: "text/html; charset=utf-8"},
+	}
+	if !reflect.DeepEqual(events, want) {
+		t.Fatalf("Expected %+v, got %+v", want, events)
+	}
+	attrs, err := store.HeadObject("bucket", "ingest/data.json")
+	if err != nil || attrs["ETag"] != md5ETag(`{"a": 1}`) || attrs["ContentType"] != "application/json" {
+		t.Errorf("Unexpected attributes %v (%v)", attrs, err)
+	}
+	if keys, _ := listKeys(t, store, "bucket"); !reflect.DeepEqual(keys, []string{"ingest/data.json", "page", "uploaded"}) {
+		t.Errorf("Expected external files to be indexed, got %v", keys)
+	}
+	if events := rescan(t, store, "bucket"); len(events) != 0 {
+		t.Errorf("Expected no changes, got %+v", events)
+	}
+
+	// 修改内容时保留 Content-Type，只修改时间时不产生事件
+	writeExternal(t, filepath.Join(dir, "bucket", "ingest", "data.json"), `{"a": 2}`)
+	later := time.Now().Add(2 * time.Second)
+	os.Chtimes(filepath.Join(dir, "bucket", "page"), later, later)
+	events = rescan(t, store, "bucket")
+	if len(events) != 1 || events[0].Type != ChangeUpdated || events[0].ETag != md5ETag(`{"a": 2}`) || events[0].ContentType != "application/json" {
+		t.Fatalf("Unexpected events %+v", events)
+	}
+	if got := readString(t, store, "bucket", "ingest/data.json"); got != `{"a": 2}` {
+		t.Errorf("Expected updated content, got %q", got)
+	}
+
+	os.Remove(filepath.Join(dir, "bucket", "page"))
+	events = rescan(t, store, "bucket")
+	if !reflect.DeepEqual(events, []ChangeEvent{{Type: ChangeRemoved, Bucket: "bucket", Key: "page"}}) {
+		t.Fatalf("Unexpected events %+v", events)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "bucket", "page.attrs")); !os.IsNotExist(err) {
+		t.Errorf("Expected attributes to be removed, got %v", err)
+	}
+
+	// 整个目录被删除时根据索引发现
+	os.RemoveAll(filepath.Join(dir, "bucket", "ingest"))
+	events = rescan(t, store, "bucket")
+	if !reflect.DeepEqual(events, []ChangeEvent{{Type: ChangeRemoved, Bucket: "bucket", Key: "ingest/data.json"}}) {
+		t.Fatalf("Unexpected events %+v", events)
+	}
+	if keys, _ := listKeys(t, store, "bucket"); !reflect.DeepEqual(keys, []string{"uploaded"}) {
+		t.Errorf("Expected removed files to leave the index, got %v", keys)
+	}
+	if report, err := store.Scrub(false); err != nil || report.Problems() != 0 || report.Unverified != 0 {
+		t.Errorf("Expected clean scrub, got %+v (%v)", report, err)
+	}
+}
+
+func TestLFSStoreRescanDedup(t *testing.T) {
+	dir := t.TempDir()
+	store := newDedupStore(t, dir)
+	store.CreateBucket("bucket")
+	putString(t, store, "bucket", "key", "deduplicated content")
+
+	writeExternal(t, filepath.Join(dir, "bucket", "key"), "replaced")
+	events := rescan(t, store, "bucket")
+	if len(events) != 1 || events[0].Type != ChangeUpdated {
+		t.Fatalf("Unexpected events %+v", events)
+	}
+	if got := readString(t, store, "bucket", "key"); got != "replaced" {
+		t.Errorf("Expected replaced content, got %q", got)
+	}
+	// 被替换的指针不再引用原来的内容
+	if n, _, err := store.CollectGarbage(); err != nil || n != 1 {
+		t.Errorf("Expected 1 content to be collected, got %d (%v)", n, err)
+	}
+}
+
+func TestLFSStoreWatch(t *testing.T) {
+	dir := t.TempDir()
+	events := make(chan ChangeEvent, 16)
+	store, err := NewLFSStore(dir, WithWatch(0, func(e ChangeEvent) { events <- e }))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	defer store.Close()
+	store.CreateBucket("bucket")
+	// 等待新的存储桶被监听
+	time.Sleep(100 * time.Millisecond)
+
+	putString(t, store, "bucket", "uploaded", "x")
+	writeExternal(t, filepath.Join(dir, "bucket", "new", "dir", "file.json"), "{}")
+	select {
+	case e := <-events:
+		if e.Type != ChangeCreated || e.Key != "new/dir/file.json" {
+			t.Errorf("Unexpected event %+v", e)
+		}
+	case <-time.After(5 * watchSettle):
+		t.Fatalf("Expected an event for the external file")
+	}
+	if got := readString(t, store, "bucket", "new/dir/file.json"); got != "{}" {
+		t.Errorf("Expected external content, got %q", got)
+	}
+
+	os.Remove(filepath.Join(dir, "bucket", "new", "dir", "file.json"))
+	select {
+	case e := <-events:
+		if e.Type != ChangeRemoved || e.Key != "new/dir/file.json" {
+			t.Errorf("Unexpected event %+v", e)
+		}
+	case <-time.After(5 * watchSettle):
+		t.Fatalf("Expected an event for the removed file")
+	}
+	select {
+	case e := <-events:
+		t.Errorf("Unexpected event %+v", e)
+	case <-time.After(2 * watchSettle):
+	}
+}
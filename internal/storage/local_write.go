@@ -0,0 +1,327 @@
+package storage
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Grey0520/s3proxy/internal/s3err"
+)
+
+// 写入对象的持久化级别
+const (
+	// 不调用 fsync，进程崩溃时不会留下写了一半的对象，但断电时可能丢失最近写入的对象
+	DurabilityNone = "none"
+	// 提交前 fsync 数据和属性文件，断电后对象要么是旧版本，要么是完整的新版本
+	DurabilityFile = "file"
+	// 在 file 的基础上 fsync 对象所在的目录，返回成功之后断电也不会丢失
+	DurabilityFull = "full"
+)
+
+// fileblob 保存对象属性的文件扩展名，不能用作对象的键
+const attrsExt = ".attrs"
+
+// fileAttrs 与 fileblob 保存在 <object>.attrs 中的属性格式相同，写入后仍然通过 fileblob 读取
+type fileAttrs struct {
+	CacheControl       string            `json:"user.cache_control"`
+	ContentDisposition string            `json:"user.content_disposition"`
+	ContentEncoding    string            `json:"user.content_encoding"`
+	ContentLanguage    string            `json:"user.content_language"`
+	ContentType        string            `json:"user.content_type"`
+	Metadata           map[string]string `json:"user.metadata"`
+	MD5                []byte            `json:"md5"`
+}
+
+// commitRecord 记录一次提交需要移动的文件，进程在移动过程中退出时，启动时根据它完成提交
+type commitRecord struct {
+	Path string `json:"path"`
+}
+
+// WithoutRecovery 打开时不完成中断的写入，也不删除残留的临时文件，fsck 用它报告这些文件
+// 中断的写入保留在临时目录中，下次正常打开时再完成；也不启动 scrub、watch 和去重回收等后台任务
+func WithoutRecovery() LFSOption {
+	return func(local *LFSStore) error {
+		local.noRecovery = true
+		return nil
+	}
+}
+
+// WithDurability 设置写入对象时的持久化级别，默认为 DurabilityFile
+func WithDurability(level string) LFSOption {
+	return func(local *LFSStore) error {
+		switch level {
+		case DurabilityNone, DurabilityFile, DurabilityFull:
+			local.durability = level
+			return nil
+		default:
+			return fmt.Errorf("unsupported durability %q", level)
+		}
+	}
+}
+
+// tmpDir 保存写入中的对象，与存储桶在同一个文件系统上，提交时只需要重命名
+func (local *LFSStore) tmpDir() string {
+	return filepath.Join(local.basePath, metaDirName, "tmp")
+}
+
+// escapeKey 按 fileblob 的方式转义对象的键，返回相对于存储桶目录的路径
+// fileblob 会转义 "../" 中的 "/"，但不处理 "." 和结尾的 ".."，这样的键会指向存储桶目录或者它的上级目录，因此拒绝
+func escapeKey(objectKey string) (string, error) {
+	if err := checkObjectKey(objectKey); err != nil {
+		return "", err
+	}
+	escaped := []rune{}
+	runes := []rune(objectKey)
+	for i, c := range runes {
+		if c < 32 || (i > 1 && c == '/' && runes[i-1] == '.' && runes[i-2] == '.') ||
+			(i > 0 && c == '/' && runes[i-1] == '/') || (c == '/' && i == len(runes)-1) {
+			escaped = append(escaped, []rune(fmt.Sprintf("__%#x__", c))...)
+			continue
+		}
+		escaped = append(escaped, c)
+	}
+	for _, elem := range strings.Split(string(escaped), "/") {
+		if elem == "." || elem == ".." {
+			return "", s3err.ErrInvalidArgument.WithMessage(fmt.Sprintf("object key %q is not supported by the local backend", objectKey))
+		}
+	}
+	if strings.HasSuffix(string(escaped), attrsExt) {
+		return "", s3err.ErrInvalidArgument.WithMessage(fmt.Sprintf("object key %q is not supported by the local backend: file extension %q is reserved", objectKey, attrsExt))
+	}
+	return string(escaped), nil
+}
+
+// objectPath 返回对象在磁盘上的路径，与 fileblob 读取的路径相同
+func (local *LFSStore) objectPath(bucketName, objectKey string) (string, error) {
+	escaped, err := escapeKey(objectKey)
+	if err != nil {
+		return "", err
+	}
+	dir := local.bucketPath(bucketName)
+	path := filepath.Join(dir, filepath.FromSlash(escaped))
+	if !strings.HasPrefix(path, dir+string(filepath.Separator)) {
+		return "", s3err.ErrInvalidArgument.WithMessage(fmt.Sprintf("object key %q is not supported by the local backend", objectKey))
+	}
+	return path, nil
+}
+
+// objectWriter 把对象的数据写入 tmpDir 中的临时文件，commit 之前存储桶中看不到新的数据
+type objectWriter struct {
+	local *LFSStore
+	path  string
+	f     *os.File
+	md5   hash.Hash
+	attrs fileAttrs
+}
+
+// newObjectWriter 创建对象的临时文件，与 blob.Writer 一样规范化 Content-Type 和元数据的键
+func (local *LFSStore) newObjectWriter(bucketName, objectKey, contentType string, metadata map[string]string) (*objectWriter, error) {
+	path, err := local.objectPath(bucketName, objectKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create object %s: %v", objectKey, err)
+	}
+	if contentType != "" {
+		t, params, err := mime.ParseMediaType(contentType)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create object %s: %v", objectKey, err)
+		}
+		contentType = mime.FormatMediaType(t, params)
+	}
+	var md map[string]string
+	for k, v := range metadata {
+		if md == nil {
+			md = make(map[string]string, len(metadata))
+		}
+		md[strings.ToLower(k)] = v
+	}
+	f, err := os.CreateTemp(local.tmpDir(), "*.data")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create object %s: %v", objectKey, err)
+	}
+	return &objectWriter{
+		local: local,
+		path:  path,
+		f:     f,
+		md5:   md5.New(),
+		attrs: fileAttrs{ContentType: contentType, Metadata: md},
+	}, nil
+}
+
+func (w *objectWriter) Write(p []byte) (int, error) {
+	n, err := w.f.Write(p)
+	w.md5.Write(p[:n])
+	return n, err
+}
+
+// abort 丢弃写入的数据
+func (w *objectWriter) abort() {
+	w.f.Close()
+	os.Remove(w.f.Name())
+}
+
+// commit 把对象移动到存储桶中
+// 先把数据、属性和提交记录都写入 tmpDir，再依次重命名数据和属性文件，最后删除提交记录
+// 有提交记录时中途退出也可以在启动时完成提交，因此崩溃之后对象不会停留在属性与数据不一致的状态
+func (w *objectWriter) commit() error {
+	id := strings.TrimSuffix(w.f.Name(), ".data")
+	err := w.prepare(id)
+	if err == nil {
+		err = w.local.applyCommit(id, w.path, false)
+	}
+	if err != nil {
+		w.f.Close()
+		removeCommit(id)
+		return fmt.Errorf("failed to commit object %s: %v", w.path, err)
+	}
+	return nil
+}
+
+// prepare 写入属性文件和提交记录，返回之后这次提交一定会完成
+func (w *objectWriter) prepare(id string) error {
+	if w.attrs.ContentType == "" {
+		// 没有指定 Content-Type 时与 blob.Writer 一样根据开头的数据判断
+		head := make([]byte, 512)
+		n, _ := w.f.ReadAt(head, 0)
+		w.attrs.ContentType = http.DetectContentType(head[:n])
+	}
+	durable := w.local.durability != DurabilityNone
+	if durable {
+		if err := w.f.Sync(); err != nil {
+			return err
+		}
+	}
+	if err := w.f.Close(); err != nil {
+		return err
+	}
+	w.attrs.MD5 = w.md5.Sum(nil)
+	if err := writeJSONFile(id+attrsExt, w.attrs, durable); err != nil {
+		return err
+	}
+	if err := writeJSONFile(id+".commit", commitRecord{Path: w.path}, durable); err != nil {
+		return err
+	}
+	if w.local.durability == DurabilityFull {
+		return syncDir(w.local.tmpDir())
+	}
+	return nil
+}
+
+// applyCommit 把 id 对应的临时文件移动到 path，先移动数据文件，路径被目录占用这类错误发生时对象还没有被修改
+// recovering 为 true 时跳过已经移动过的文件，因此启动时可以重复执行中断的提交；正常写入时缺少文件是错误
+func (local *LFSStore) applyCommit(id, path string, recovering bool) error {
+	if err := createDir(filepath.Dir(path)); err != nil {
+		return err
+	}
+	if err := os.Rename(id+".data", path); err != nil && !(recovering && os.IsNotExist(err)) {
+		return err
+	}
+	if err := os.Rename(id+attrsExt, path+attrsExt); err != nil && !(recovering && os.IsNotExist(err)) {
+		return err
+	}
+	if local.durability == DurabilityFull {
+		if err := syncDir(filepath.Dir(path)); err != nil {
+			return err
+		}
+	}
+	return os.Remove(id + ".commit")
+}
+
+// syncObjectDir 在 DurabilityFull 级别下 fsync 对象所在的目录，用于删除对象之后
+func (local *LFSStore) syncObjectDir(bucketName, objectKey string) error {
+	if local.durability != DurabilityFull {
+		return nil
+	}
+	path, err := local.objectPath(bucketName, objectKey)
+	if err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// recoverWrites 在启动时完成有提交记录的写入，删除其他中断的写入留下的临时文件
+func (local *LFSStore) recoverWrites() error {
+	dir := local.tmpDir()
+	if err := createDir(dir); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to recover writes: %v", err)
+	}
+	recovered := 0
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(filepath.Join(dir, entry.Name()), ".commit")
+		if !ok {
+			continue
+		}
+		var record commitRecord
+		data, err := os.ReadFile(id + ".commit")
+		if err != nil {
+			return fmt.Errorf("failed to recover writes: %v", err)
+		}
+		// 没有写完的提交记录说明 prepare 没有完成，按中断的写入处理
+		if json.Unmarshal(data, &record) != nil || record.Path == "" {
+			continue
+		}
+		if err := local.applyCommit(id, record.Path, true); err != nil {
+			// 无法完成的提交不能阻止启动，临时文件在下面删除
+			log.Printf("local: failed to complete interrupted write of %s: %v", record.Path, err)
+			continue
+		}
+		recovered++
+	}
+
+	if entries, err = os.ReadDir(dir); err != nil {
+		return fmt.Errorf("failed to recover writes: %v", err)
+	}
+	for _, entry := range entries {
+		if err := os.Remove(filepath.Join(dir, entry.Name())); err != nil {
+			return fmt.Errorf("failed to remove temp file: %v", err)
+		}
+	}
+	if recovered > 0 || len(entries) > 0 {
+		log.Printf("local: completed %d interrupted writes, removed %d temp files", recovered, len(entries))
+	}
+	return nil
+}
+
+// removeCommit 删除一次提交的所有临时文件
+func removeCommit(id string) {
+	os.Remove(id + ".data")
+	os.Remove(id + attrsExt)
+	os.Remove(id + ".commit")
+}
+
+func writeJSONFile(path string, v any, durable bool) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(f).Encode(v); err != nil {
+		f.Close()
+		return err
+	}
+	if durable {
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
+
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
@@ -0,0 +1,267 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gocloud.dev/blob/fileblob"
+)
+
+func TestLFSStoreDurability(t *testing.T) {
+	if _, err := NewLFSStore(t.TempDir(), WithDurability("always")); err == nil {
+		t.Errorf("Expected error for unsupported durability")
+	}
+	for _, level := range []string{DurabilityNone, DurabilityFile, DurabilityFull} {
+		store, err := NewLFSStore(t.TempDir(), WithDurability(level))
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		store.CreateBucket("bucket")
+		if err := putString(t, store, "bucket", "dir/key", level); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if got := readString(t, store, "bucket", "dir/key"); got != level {
+			t.Errorf("Expected %q, got %q", level, got)
+		}
+		if err := store.DeleteObject("bucket", "dir/key"); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	}
+}
+
+// 写入的文件与 fileblob 自己写入的相同，仍然可以通过 fileblob 读取
+func TestLFSStoreWriteCompat(t *testing.T) {
+	dir := t.TempDir()
+	store := newTestLFSStore(t, dir)
+	store.CreateBucket("bucket")
+	keys := []string{"plain", "dir/sub/key", "a//b", "../up", "x/../y", "trailing/", "ctl\x01key", "空格 key"}
+	for _, key := range keys {
+		if err := putString(t, store, "bucket", key, key); err != nil {
+			t.Fatalf("Expected no error for %q, got %v", key, err)
+		}
+	}
+	if err := putString(t, store, "bucket", "meta.attrs", "x"); err == nil {
+		t.Errorf("Expected error for reserved extension")
+	}
+
+	b, err := fileblob.OpenBucket(filepath.Join(dir, "bucket"), nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	defer b.Close()
+	ctx := context.Background()
+	for _, key := range keys {
+		data, err := b.ReadAll(ctx, key)
+		if err != nil || string(data) != key {
+			t.Errorf("Expected %q, got %q (%v)", key, data, err)
+		}
+		attrs, err := b.Attributes(ctx, key)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if attrs.ContentType != "text/plain" || attrs.MD5 == nil {
+			t.Errorf("Unexpected attributes of %q: %+v", key, attrs)
+		}
+	}
+	result, err := store.ListBucket("bucket")
+	if err != nil || len(result.Contents) != len(keys) {
+		t.Errorf("Expected %d objects, got %+v (%v)", len(keys), result, err)
+	}
+
+	// 没有指定 Content-Type 时根据内容判断
+	store.PutObject("bucket", "page", &Object{Data: io.NopCloser(strings.NewReader("<html><body></body></html>"))})
+	if attrs, _ := b.Attributes(ctx, "page"); attrs == nil || !strings.HasPrefix(attrs.ContentType, "text/html") {
+		t.Errorf("Expected sniffed content type, got %+v", attrs)
+	}
+}
+
+func TestLFSStorePutObjectInterrupted(t *testing.T) {
+	dir := t.TempDir()
+	store := newTestLFSStore(t, dir)
+	store.CreateBucket("bucket")
+	putString(t, store, "bucket", "key", "old")
+
+	err := store.PutObject("bucket", "key", &Object{
+		ContentType: "text/plain",
+		Data:        io.NopCloser(&failingReader{n: 100}),
+	})
+	if err == nil {
+		t.Fatalf("Expected error for interrupted upload")
+	}
+	if got := readString(t, store, "bucket", "key"); got != "old" {
+		t.Errorf("Expected old content, got %q", got)
+	}
+	if entries, _ := os.ReadDir(store.tmpDir()); len(entries) != 0 {
+		t.Errorf("Expected no temp files, got %d", len(entries))
+	}
+}
+
+// 正常写入时数据文件丢失不能报告成功
+func TestLFSStoreCommitMissingData(t *testing.T) {
+	store := newTestLFSStore(t, t.TempDir())
+	store.CreateBucket("bucket")
+	putString(t, store, "bucket", "key", "old")
+
+	w, err := store.newObjectWriter("bucket", "key", "text/plain", nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	io.WriteString(w, "new")
+	os.Remove(w.f.Name())
+	if err := w.commit(); err == nil {
+		t.Fatalf("Expected error for missing data file")
+	}
+	if got := readString(t, store, "bucket", "key"); got != "old" {
+		t.Errorf("Expected old content, got %q", got)
+	}
+	if entries, _ := os.ReadDir(store.tmpDir()); len(entries) != 0 {
+		t.Errorf("Expected no temp files, got %d", len(entries))
+	}
+}
+
+// 提交记录已经写入时，重新启动后完成提交
+func TestLFSStoreRecoverCommit(t *testing.T) {
+	dir := t.TempDir()
+	store := newTestLFSStore(t, dir)
+	store.CreateBucket("bucket")
+	putString(t, store, "bucket", "key", "old")
+
+	w, err := store.newObjectWriter("bucket", "key", "text/csv", nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	io.WriteString(w, "new")
+	if err := w.prepare(strings.TrimSuffix(w.f.Name(), ".data")); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	// 没有提交记录的临时文件属于中断的写入
+	os.WriteFile(filepath.Join(store.tmpDir(), "orphan.data"), []byte("x"), 0o644)
+
+	store.Close()
+	store = newTestLFSStore(t, dir)
+	obj, err := store.GetObject("bucket", "key")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	data, _ := io.ReadAll(obj.Data)
+	obj.Data.Close()
+	if string(data) != "new" || obj.ContentType != "text/csv" {
+		t.Errorf("Expected recovered object, got %q %s", data, obj.ContentType)
+	}
+	if entries, _ := os.ReadDir(store.tmpDir()); len(entries) != 0 {
+		t.Errorf("Expected no temp files, got %d", len(entries))
+	}
+}
+
+// basePath 同时只能被一个 LFSStore 打开，离线命令不会删除服务正在写入的临时文件
+func TestLFSStoreLock(t *testing.T) {
+	dir := t.TempDir()
+	store := newTestLFSStore(t, dir)
+	store.CreateBucket("bucket")
+	w, err := store.newObjectWriter("bucket", "key", "text/plain", nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	io.WriteString(w, "new")
+
+	if _, err := NewLFSStore(dir); err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Fatalf("Expected error while basePath is in use, got %v", err)
+	}
+	if err := w.commit(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if got := readString(t, store, "bucket", "key"); got != "new" {
+		t.Errorf("Expected %q, got %q", "new", got)
+	}
+
+	store.Close()
+	store = newTestLFSStore(t, dir)
+	if got := readString(t, store, "bucket", "key"); got != "new" {
+		t.Errorf("Expected %q after reopening, got %q", "new", got)
+	}
+}
+
+func TestLFSStoreWithoutRecovery(t *testing.T) {
+	dir := t.TempDir()
+	store := newTestLFSStore(t, dir)
+	store.CreateBucket("bucket")
+	store.Close()
+	// 不经过 s3proxy 添加的文件，正常打开时 watch 会为它生成属性文件
+	external := filepath.Join(dir, "bucket", "external")
+	os.WriteFile(external, []byte("external"), 0o644)
+
+	store, err := NewLFSStore(dir, WithWatch(0, nil), WithoutRecovery())
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	store.Close()
+	if _, err := os.Stat(external + attrsExt); !os.IsNotExist(err) {
+		t.Errorf("Expected no background task to modify the store, got %v", err)
+	}
+}
+
+// 被 TestLFSStoreKilledDuringWrite 作为子进程运行，写入一半时输出 ready 并等待被结束
+func TestLFSStoreKilledDuringWriteHelper(t *testing.T) {
+	dir := os.Getenv("S3PROXY_TEST_CRASH_DIR")
+	if dir == "" {
+		t.Skip("only run by TestLFSStoreKilledDuringWrite")
+	}
+	store := newTestLFSStore(t, dir)
+	pr, pw := io.Pipe()
+	go func() {
+		pw.Write([]byte(strings.Repeat("new", 1<<16)))
+		fmt.Println("ready")
+	}()
+	store.PutObject("bucket", "key", &Object{ContentType: "text/plain", Data: pr})
+}
+
+func TestLFSStoreKilledDuringWrite(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping subprocess test in short mode")
+	}
+	for _, level := range []string{DurabilityNone, DurabilityFile, DurabilityFull} {
+		dir := t.TempDir()
+		store, err := NewLFSStore(dir, WithDurability(level))
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		store.CreateBucket("bucket")
+		putString(t, store, "bucket", "key", "old")
+		store.Close()
+
+		cmd := exec.Command(os.Args[0], "-test.run=^TestLFSStoreKilledDuringWriteHelper$")
+		cmd.Env = append(os.Environ(), "S3PROXY_TEST_CRASH_DIR="+dir)
+		stdout, _ := cmd.StdoutPipe()
+		if err := cmd.Start(); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		line, _ := bufio.NewReader(stdout).ReadString('\n')
+		cmd.Process.Kill()
+		cmd.Wait()
+		if line != "ready\n" {
+			t.Fatalf("Expected helper to be ready, got %q", line)
+		}
+		if entries, _ := os.ReadDir(store.tmpDir()); len(entries) == 0 {
+			t.Errorf("Expected temp file of the killed write")
+		}
+
+		store = newTestLFSStore(t, dir)
+		if got := readString(t, store, "bucket", "key"); got != "old" {
+			t.Errorf("Expected old content after crash, got %q", got)
+		}
+		if entries, _ := os.ReadDir(store.tmpDir()); len(entries) != 0 {
+			t.Errorf("Expected temp files to be removed, got %d", len(entries))
+		}
+		result, _ := store.ListBucket("bucket")
+		if len(result.Contents) != 1 {
+			t.Errorf("Expected 1 object, got %+v", result.Contents)
+		}
+	}
+}
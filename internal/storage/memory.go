@@ -0,0 +1,351 @@
+package storage
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Grey0520/s3proxy/internal/s3err"
+	"gocloud.dev/blob"
+	"gocloud.dev/blob/memblob"
+)
+
+// MemoryStore 把存储桶和对象保存在内存中，进程退出后数据即丢失，用于测试和临时环境
+// 每个存储桶对应一个 memblob，所有操作串行执行
+type MemoryStore struct {
+	mu      sync.Mutex
+	buckets map[string]*memoryBucket
+	ctx     context.Context
+
+	// 所有对象的总大小上限，为 0 时不限制
+	maxSize int64
+	size    int64
+}
+
+type memoryBucket struct {
+	bucket  *blob.Bucket
+	created time.Time
+	// 每个对象的大小，用于统计总大小
+	sizes map[string]int64
+}
+
+// NewMemoryStore 创建 MemoryStore，maxSize 为所有对象的总大小上限（字节），为 0 时不限制
+func NewMemoryStore(maxSize int64) (*MemoryStore, error) {
+	if maxSize < 0 {
+		return nil, fmt.Errorf("invalid memory store size limit %d", maxSize)
+	}
+	return &MemoryStore{
+		buckets: make(map[string]*memoryBucket),
+		ctx:     context.Background(),
+		maxSize: maxSize,
+	}, nil
+}
+
+func (store *MemoryStore) bucket(bucketName string) (*memoryBucket, error) {
+	b, ok := store.buckets[bucketName]
+	if !ok {
+		return nil, fmt.Errorf("bucket %s does not exist: %w", bucketName, s3err.ErrNoSuchBucket)
+	}
+	return b, nil
+}
+
+func (store *MemoryStore) CreateBucket(bucketName string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if _, ok := store.buckets[bucketName]; ok {
+		return fmt.Errorf("bucket %s already exists: %w", bucketName, s3err.ErrBucketAlreadyOwnedByYou)
+	}
+	store.buckets[bucketName] = &memoryBucket{
+		bucket:  memblob.OpenBucket(nil),
+		created: time.Now().UTC(),
+		sizes:   make(map[string]int64),
+	}
+	return nil
+}
+
+func (store *MemoryStore) DeleteBucket(bucketName string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	b, err := store.bucket(bucketName)
+	if err != nil {
+		return err
+	}
+	if len(b.sizes) > 0 {
+		return fmt.Errorf("bucket %s is not empty: %w", bucketName, s3err.ErrBucketNotEmpty)
+	}
+	b.bucket.Close()
+	delete(store.buckets, bucketName)
+	return nil
+}
+
+func (store *MemoryStore) ListBucket(bucketName string, opts ...ListOption) (*ListBucketResult, error) {
+	o := newListOptions(opts)
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	b, err := store.bucket(bucketName)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &ListBucketResult{
+		XMLName: xml.Name{Local: "ListBucketResult"},
+		Name:    bucketName,
+	}
+	iter := b.bucket.List(&blob.ListOptions{Prefix: o.Prefix})
+	for {
+		obj, err := iter.Next(store.ctx)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list objects: %v", err)
+		}
+		result.Contents = append(result.Contents, Content{
+			Key:          obj.Key,
+			LastModified: obj.ModTime,
+			ETag:         formatETag(obj.MD5),
+			Size:         obj.Size,
+			StorageClass: "STANDARD",
+			Owner:        newFakeOwner(),
+		})
+	}
+	return o.paginate(result), nil
+}
+
+func (store *MemoryStore) ListAllMyBuckets() (*ListAllMyBucketsResult, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	var buckets []Bucket
+	for name, b := range store.buckets {
+		buckets = append(buckets, Bucket{
+			Name:         name,
+			CreationDate: b.created,
+		})
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].Name < buckets[j].Name })
+
+	return &ListAllMyBucketsResult{
+		XMLName: xml.Name{Local: "ListAllMyBucketsResult"},
+		Owner:   newFakeOwner(),
+		Buckets: Buckets{
+			Bucket: buckets,
+		},
+	}, nil
+}
+
+func (store *MemoryStore) GetBucketAcl(bucketName string) (*AccessControlPolicy, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if _, err := store.bucket(bucketName); err != nil {
+		return nil, err
+	}
+	owner := newFakeOwner()
+	return &AccessControlPolicy{
+		Owner: owner,
+		AccessControlList: AccessControlList{
+			Grant: []Grant{
+				{
+					Grantee: Grantee{
+						ID:          owner.ID,
+						DisplayName: owner.DisplayName,
+					},
+					Permission: "FULL_CONTROL",
+				},
+			},
+		},
+	}, nil
+}
+
+func (store *MemoryStore) PutObject(bucketName, objectKey string, data *Object, opts ...ObjectOption) error {
+	if err := checkMemoryEncryption(data.ServerSideEncryption, newObjectOptions(opts)); err != nil {
+		return err
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	b, err := store.bucket(bucketName)
+	if err != nil {
+		return err
+	}
+	return store.write(b, objectKey, data.ContentType, data.Data)
+}
+
+// write 写入对象并更新总大小，超过上限时放弃写入，调用者需要持有锁
+func (store *MemoryStore) write(b *memoryBucket, objectKey, contentType string, r io.Reader) error {
+	// 覆盖已有对象时，旧对象占用的空间可以复用
+	limit := int64(-1)
+	if store.maxSize > 0 {
+		limit = store.maxSize - store.size + b.sizes[objectKey]
+		r = io.LimitReader(r, limit+1)
+	}
+
+	ctx, cancel := context.WithCancel(store.ctx)
+	defer cancel()
+	w, err := b.bucket.NewWriter(ctx, objectKey, &blob.WriterOptions{ContentType: contentType})
+	if err != nil {
+		return fmt.Errorf("failed to create object %s: %v", objectKey, err)
+	}
+	n, err := io.Copy(w, r)
+	if err == nil && limit >= 0 && n > limit {
+		err = s3err.ErrEntityTooLarge.WithMessage("The memory storage is full.")
+	}
+	if err != nil {
+		// 取消 context 后关闭 writer 会丢弃已写入的数据
+		cancel()
+		w.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("failed to create object %s: %v", objectKey, err)
+	}
+
+	store.size += n - b.sizes[objectKey]
+	b.sizes[objectKey] = n
+	return nil
+}
+
+func (store *MemoryStore) GetObject(bucketName, objectKey string, opts ...ObjectOption) (*Object, error) {
+	if err := checkMemoryEncryption("", newObjectOptions(opts)); err != nil {
+		return nil, err
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	b, err := store.bucket(bucketName)
+	if err != nil {
+		return nil, err
+	}
+	attrs, err := b.bucket.Attributes(store.ctx, objectKey)
+	if err != nil {
+		return nil, objectError(objectKey, err)
+	}
+	// memblob 的 reader 持有对象内容的快照，之后的写入不会影响它
+	r, err := b.bucket.NewReader(store.ctx, objectKey, nil)
+	if err != nil {
+		return nil, objectError(objectKey, err)
+	}
+
+	// 由调用者关闭 Data
+	return &Object{
+		Key:          objectKey,
+		Size:         attrs.Size,
+		LastModified: attrs.ModTime,
+		ContentType:  attrs.ContentType,
+		ETag:         formatETag(attrs.MD5),
+		Data:         r,
+	}, nil
+}
+
+func (store *MemoryStore) DeleteObject(bucketName, objectKey string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	b, err := store.bucket(bucketName)
+	if err != nil {
+		return err
+	}
+	// 与 S3 一样，删除不存在的对象不是错误
+	if _, ok := b.sizes[objectKey]; !ok {
+		return nil
+	}
+	if err := b.bucket.Delete(store.ctx, objectKey); err != nil {
+		return fmt.Errorf("failed to delete object %s: %v", objectKey, err)
+	}
+	store.size -= b.sizes[objectKey]
+	delete(b.sizes, objectKey)
+	return nil
+}
+
+func (store *MemoryStore) CopyObject(srcBucketName, srcObjectKey, destBucketName, destObjectKey string, opts ...ObjectOption) error {
+	o := newObjectOptions(opts)
+	if err := checkMemoryEncryption("", o); err != nil {
+		return err
+	}
+	if o.CopySourceSSECustomerKey != nil {
+		return s3err.ErrNotImplemented.WithMessage("customer-provided encryption keys are not supported")
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	src, err := store.bucket(srcBucketName)
+	if err != nil {
+		return err
+	}
+	dst, err := store.bucket(destBucketName)
+	if err != nil {
+		return err
+	}
+	attrs, err := src.bucket.Attributes(store.ctx, srcObjectKey)
+	if err != nil {
+		return objectError(srcObjectKey, err)
+	}
+	r, err := src.bucket.NewReader(store.ctx, srcObjectKey, nil)
+	if err != nil {
+		return objectError(srcObjectKey, err)
+	}
+	defer r.Close()
+
+	return store.write(dst, destObjectKey, attrs.ContentType, r)
+}
+
+func (store *MemoryStore) MoveObject(srcBucketName, srcObjectKey, destBucketName, destObjectKey string) error {
+	if err := store.CopyObject(srcBucketName, srcObjectKey, destBucketName, destObjectKey); err != nil {
+		return err
+	}
+	return store.DeleteObject(srcBucketName, srcObjectKey)
+}
+
+func (store *MemoryStore) HeadObject(bucketName, objectKey string, opts ...ObjectOption) (map[string]string, error) {
+	if err := checkMemoryEncryption("", newObjectOptions(opts)); err != nil {
+		return nil, err
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	b, err := store.bucket(bucketName)
+	if err != nil {
+		return nil, err
+	}
+	attrs, err := b.bucket.Attributes(store.ctx, objectKey)
+	if err != nil {
+		return nil, objectError(objectKey, err)
+	}
+	return map[string]string{
+		"Size":         strconv.FormatInt(attrs.Size, 10),
+		"LastModified": attrs.ModTime.UTC().Format(time.RFC3339),
+		"ContentType":  attrs.ContentType,
+		"ETag":         formatETag(attrs.MD5),
+	}, nil
+}
+
+// Size 返回所有对象的总大小
+func (store *MemoryStore) Size() int64 {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return store.size
+}
+
+// checkMemoryEncryption 内存存储不加密数据，拒绝所有加密请求，避免让客户端误以为数据已加密
+func checkMemoryEncryption(algorithm string, o *ObjectOptions) error {
+	if o.SSECustomerKey != nil {
+		return s3err.ErrNotImplemented.WithMessage("customer-provided encryption keys are not supported")
+	}
+	if algorithm != "" {
+		return s3err.ErrNotImplemented.WithMessage("server-side encryption is not supported by the memory backend")
+	}
+	return nil
+}
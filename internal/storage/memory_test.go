@@ -0,0 +1,166 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/Grey0520/s3proxy/internal/s3err"
+)
+
+func newTestMemoryStore(t *testing.T, maxSize int64) *MemoryStore {
+	store, err := NewMemoryStore(maxSize)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := store.CreateBucket("bucket"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	return store
+}
+
+func putString(t *testing.T, store StorageProvider, bucketName, objectKey, content string) error {
+	t.Helper()
+	return store.PutObject(bucketName, objectKey, &Object{
+		ContentType: "text/plain",
+		Data:        io.NopCloser(strings.NewReader(content)),
+	})
+}
+
+func TestMemoryStoreBuckets(t *testing.T) {
+	store := newTestMemoryStore(t, 0)
+
+	if err := store.CreateBucket("bucket"); !errors.Is(err, s3err.ErrBucketAlreadyOwnedByYou) {
+		t.Errorf("Expected BucketAlreadyOwnedByYou, got %v", err)
+	}
+	store.CreateBucket("another")
+
+	result, err := store.ListAllMyBuckets()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(result.Buckets.Bucket) != 2 || result.Buckets.Bucket[0].Name != "another" {
+		t.Errorf("Unexpected buckets %+v", result.Buckets.Bucket)
+	}
+	if _, err := store.GetBucketAcl("missing"); !errors.Is(err, s3err.ErrNoSuchBucket) {
+		t.Errorf("Expected NoSuchBucket, got %v", err)
+	}
+
+	putString(t, store, "bucket", "key", "x")
+	if err := store.DeleteBucket("bucket"); !errors.Is(err, s3err.ErrBucketNotEmpty) {
+		t.Errorf("Expected BucketNotEmpty, got %v", err)
+	}
+	store.DeleteObject("bucket", "key")
+	if err := store.DeleteBucket("bucket"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, err := store.ListBucket("bucket"); !errors.Is(err, s3err.ErrNoSuchBucket) {
+		t.Errorf("Expected NoSuchBucket, got %v", err)
+	}
+}
+
+func TestMemoryStoreObjects(t *testing.T) {
+	store := newTestMemoryStore(t, 0)
+	store.CreateBucket("other")
+
+	if err := putString(t, store, "bucket", "dir/key.txt", "hello memory"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := putString(t, store, "missing", "key", "x"); !errors.Is(err, s3err.ErrNoSuchBucket) {
+		t.Errorf("Expected NoSuchBucket, got %v", err)
+	}
+
+	obj, err := store.GetObject("bucket", "dir/key.txt")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	obj.Data.(io.Seeker).Seek(6, io.SeekStart)
+	data, _ := io.ReadAll(obj.Data)
+	obj.Data.Close()
+	if string(data) != "memory" || obj.ContentType != "text/plain" || obj.ETag == "" {
+		t.Errorf("Unexpected object %q %+v", data, obj)
+	}
+
+	head, err := store.HeadObject("bucket", "dir/key.txt")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if head["Size"] != "12" || head["ETag"] != obj.ETag {
+		t.Errorf("Unexpected head result %v", head)
+	}
+
+	if err := store.MoveObject("bucket", "dir/key.txt", "other", "moved.txt"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, err := store.GetObject("bucket", "dir/key.txt"); !errors.Is(err, s3err.ErrNoSuchKey) {
+		t.Errorf("Expected NoSuchKey, got %v", err)
+	}
+	result, err := store.ListBucket("other")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(result.Contents) != 1 || result.Contents[0].Key != "moved.txt" || result.Contents[0].Size != 12 {
+		t.Errorf("Unexpected listing %+v", result.Contents)
+	}
+
+	if err := store.PutObject("bucket", "key", &Object{ServerSideEncryption: SSEAlgorithmAES256, Data: io.NopCloser(strings.NewReader("x"))}); !errors.Is(err, s3err.ErrNotImplemented) {
+		t.Errorf("Expected NotImplemented, got %v", err)
+	}
+}
+
+func TestMemoryStoreSizeLimit(t *testing.T) {
+	store := newTestMemoryStore(t, 10)
+
+	if err := putString(t, store, "bucket", "a", "123456"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := putString(t, store, "bucket", "b", "12345"); !errors.Is(err, s3err.ErrEntityTooLarge) {
+		t.Errorf("Expected EntityTooLarge, got %v", err)
+	}
+	if _, err := store.HeadObject("bucket", "b"); !errors.Is(err, s3err.ErrNoSuchKey) {
+		t.Errorf("Expected rejected object not to be stored, got %v", err)
+	}
+
+	// 覆盖时旧对象的空间可以复用
+	if err := putString(t, store, "bucket", "a", "1234567890"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if store.Size() != 10 {
+		t.Errorf("Expected size 10, got %d", store.Size())
+	}
+	if err := store.CopyObject("bucket", "a", "bucket", "c"); !errors.Is(err, s3err.ErrEntityTooLarge) {
+		t.Errorf("Expected EntityTooLarge, got %v", err)
+	}
+
+	store.DeleteObject("bucket", "a")
+	if store.Size() != 0 {
+		t.Errorf("Expected size 0, got %d", store.Size())
+	}
+	if err := putString(t, store, "bucket", "b", "12345"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if _, err := NewMemoryStore(-1); err == nil {
+		t.Errorf("Expected error for negative size limit")
+	}
+}
+
+func TestMemoryStoreListBucketOptions(t *testing.T) {
+	store := newTestMemoryStore(t, 0)
+	for _, key := range []string{"logs/b", "logs/a", "data", "logs/c"} {
+		putString(t, store, "bucket", key, key)
+	}
+
+	keys, truncated := listKeys(t, store, "bucket", WithPrefix("logs/"), WithMaxKeys(2))
+	if len(keys) != 2 || keys[0] != "logs/a" || keys[1] != "logs/b" || !truncated {
+		t.Errorf("Expected first page, got %v, %v", keys, truncated)
+	}
+	keys, truncated = listKeys(t, store, "bucket", WithPrefix("logs/"), WithMarker("logs/b"), WithMaxKeys(2))
+	if len(keys) != 1 || keys[0] != "logs/c" || truncated {
+		t.Errorf("Expected last page, got %v, %v", keys, truncated)
+	}
+	if keys, _ := listKeys(t, store, "bucket"); len(keys) != 4 {
+		t.Errorf("Expected all keys without options, got %v", keys)
+	}
+}
@@ -0,0 +1,540 @@
+package storage
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Grey0520/s3proxy/internal/config"
+	"github.com/Grey0520/s3proxy/internal/s3err"
+)
+
+// MirrorStore 把写操作同时应用到主、备两个后端
+//
+// 备份总是从主后端读取对象的当前状态再写入备份，所以重试不依赖请求体，同一个对象的多次写入
+// 在重试队列中只保留一条。读操作在主后端出错（不是 NoSuchKey 这样的 S3 错误）时改读备份
+type MirrorStore struct {
+	Primary   StorageProvider
+	Secondary StorageProvider
+	async     bool
+	interval  time.Duration
+	queue     *mirrorQueue
+	notify    chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewMirrorStore 创建 mirror 后端并启动后台重试
+func NewMirrorStore(primary, secondary StorageProvider, cfg config.MirrorConfig) (*MirrorStore, error) {
+	var async bool
+	switch cfg.Mode {
+	case "", "sync":
+	case "async":
+		async = true
+	default:
+		return nil, fmt.Errorf("unsupported mirror mode %s", cfg.Mode)
+	}
+	if primary == nil || secondary == nil {
+		return nil, fmt.Errorf("mirror requires a primary and a secondary backend")
+	}
+	queue, err := newMirrorQueue(cfg.QueueDir)
+	if err != nil {
+		return nil, err
+	}
+	interval := cfg.RetryInterval
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+
+	m := &MirrorStore{
+		Primary:   primary,
+		Secondary: secondary,
+		async:     async,
+		interval:  interval,
+		queue:     queue,
+		notify:    make(chan struct{}, 1),
+		done:      make(chan struct{}),
+	}
+	go m.run()
+	return m, nil
+}
+
+// Close 停止后台重试，队列中未完成的操作保留在 QueueDir 中
+func (m *MirrorStore) Close() error {
+	m.closeOnce.Do(func() { close(m.done) })
+	return nil
+}
+
+// Pending 返回等待备份的操作数
+func (m *MirrorStore) Pending() int {
+	return m.queue.len()
+}
+
+func (m *MirrorStore) run() {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-ticker.C:
+		case <-m.notify:
+		}
+		m.Flush()
+	}
+}
+
+// Flush 立即重试队列中的所有操作，返回仍未成功的操作数
+// 备份期间同一个对象又被写入时，队列中的是新的操作，不会被这次成功的备份移除
+func (m *MirrorStore) Flush() int {
+	for _, e := range m.queue.list() {
+		if err := m.apply(e); err != nil {
+			log.Printf("mirror: failed to replicate %s: %v", e, err)
+			continue
+		}
+		m.queue.remove(e)
+	}
+	return m.queue.len()
+}
+
+// replicate 在主后端写入成功后调用，同步模式下直接备份，失败或异步模式时放入队列
+func (m *MirrorStore) replicate(entries ...mirrorEntry) {
+	for _, e := range entries {
+		if !m.async {
+			err := m.apply(e)
+			if err == nil {
+				continue
+			}
+			log.Printf("mirror: failed to replicate %s, queued for retry: %v", e, err)
+		}
+		if err := m.queue.add(e); err != nil {
+			log.Printf("mirror: failed to queue %s: %v", e, err)
+		}
+	}
+	if m.async {
+		select {
+		case m.notify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// apply 让备份中的存储桶或对象与主后端一致
+func (m *MirrorStore) apply(e mirrorEntry) error {
+	if e.Key == "" {
+		_, err := m.Primary.GetBucketAcl(e.Bucket)
+		switch {
+		case err == nil:
+			err = m.Secondary.CreateBucket(e.Bucket)
+			if errors.Is(err, s3err.ErrBucketAlreadyExists) || errors.Is(err, s3err.ErrBucketAlreadyOwnedByYou) {
+				return nil
+			}
+			return err
+		case errors.Is(err, s3err.ErrNoSuchBucket):
+			err = m.Secondary.DeleteBucket(e.Bucket)
+			if errors.Is(err, s3err.ErrNoSuchBucket) {
+				return nil
+			}
+			return err
+		default:
+			return err
+		}
+	}
+
+	obj, err := m.Primary.GetObject(e.Bucket, e.Key)
+	switch {
+	case err == nil:
+		defer obj.Data.Close()
+		return m.Secondary.PutObject(e.Bucket, e.Key, &Object{
+			Key:                  e.Key,
+			Size:                 obj.Size,
+			ContentType:          obj.ContentType,
+			ServerSideEncryption: obj.ServerSideEncryption,
+			Data:                 obj.Data,
+		})
+	case errors.Is(err, s3err.ErrNoSuchKey), errors.Is(err, s3err.ErrNoSuchBucket):
+		return m.Secondary.DeleteObject(e.Bucket, e.Key)
+	default:
+		return err
+	}
+}
+
+// fallback 判断读主后端的错误是否应改读备份，S3 错误说明主后端正常工作
+func fallback(err error) bool {
+	var s3Err *s3err.Error
+	return err != nil && !errors.As(err, &s3Err)
+}
+
+// checkMirrorEncryption 无法在重试时重新提供 SSE-C 密钥，拒绝这样的请求
+func checkMirrorEncryption(o *ObjectOptions) error {
+	if o.SSECustomerKey != nil || o.CopySourceSSECustomerKey != nil {
+		return s3err.ErrNotImplemented.WithMessage("customer-provided encryption keys are not supported by the mirror backend")
+	}
+	return nil
+}
+
+func (m *MirrorStore) CreateBucket(bucketName string) error {
+	if err := m.Primary.CreateBucket(bucketName); err != nil {
+		return err
+	}
+	m.replicate(mirrorEntry{Bucket: bucketName})
+	return nil
+}
+
+func (m *MirrorStore) DeleteBucket(bucketName string) error {
+	if err := m.Primary.DeleteBucket(bucketName); err != nil {
+		return err
+	}
+	m.replicate(mirrorEntry{Bucket: bucketName})
+	return nil
+}
+
+func (m *MirrorStore) ListBucket(bucketName string, opts ...ListOption) (*ListBucketResult, error) {
+	result, err := m.Primary.ListBucket(bucketName, opts...)
+	if fallback(err) {
+		return m.Secondary.ListBucket(bucketName, opts...)
+	}
+	return result, err
+}
+
+func (m *MirrorStore) ListAllMyBuckets() (*ListAllMyBucketsResult, error) {
+	result, err := m.Primary.ListAllMyBuckets()
+	if fallback(err) {
+		return m.Secondary.ListAllMyBuckets()
+	}
+	return result, err
+}
+
+func (m *MirrorStore) GetBucketAcl(bucketName string) (*AccessControlPolicy, error) {
+	acp, err := m.Primary.GetBucketAcl(bucketName)
+	if fallback(err) {
+		return m.Secondary.GetBucketAcl(bucketName)
+	}
+	return acp, err
+}
+
+func (m *MirrorStore) PutObject(bucketName, objectKey string, data *Object, opts ...ObjectOption) error {
+	if err := checkMirrorEncryption(newObjectOptions(opts)); err != nil {
+		return err
+	}
+	if err := m.Primary.PutObject(bucketName, objectKey, data); err != nil {
+		return err
+	}
+	m.replicate(mirrorEntry{Bucket: bucketName, Key: objectKey})
+	return nil
+}
+
+func (m *MirrorStore) GetObject(bucketName, objectKey string, opts ...ObjectOption) (*Object, error) {
+	if err := checkMirrorEncryption(newObjectOptions(opts)); err != nil {
+		return nil, err
+	}
+	obj, err := m.Primary.GetObject(bucketName, objectKey)
+	if fallback(err) {
+		return m.Secondary.GetObject(bucketName, objectKey)
+	}
+	return obj, err
+}
+
+func (m *MirrorStore) DeleteObject(bucketName, objectKey string) error {
+	if err := m.Primary.DeleteObject(bucketName, objectKey); err != nil {
+		return err
+	}
+	m.replicate(mirrorEntry{Bucket: bucketName, Key: objectKey})
+	return nil
+}
+
+func (m *MirrorStore) CopyObject(srcBucketName, srcObjectKey, destBucketName, destObjectKey string, opts ...ObjectOption) error {
+	if err := checkMirrorEncryption(newObjectOptions(opts)); err != nil {
+		return err
+	}
+	if err := m.Primary.CopyObject(srcBucketName, srcObjectKey, destBucketName, destObjectKey); err != nil {
+		return err
+	}
+	m.replicate(mirrorEntry{Bucket: destBucketName, Key: destObjectKey})
+	return nil
+}
+
+func (m *MirrorStore) MoveObject(srcBucketName, srcObjectKey, destBucketName, destObjectKey string) error {
+	if err := m.Primary.MoveObject(srcBucketName, srcObjectKey, destBucketName, destObjectKey); err != nil {
+		return err
+	}
+	m.replicate(mirrorEntry{Bucket: destBucketName, Key: destObjectKey}, mirrorEntry{Bucket: srcBucketName, Key: srcObjectKey})
+	return nil
+}
+
+func (m *MirrorStore) HeadObject(bucketName, objectKey string, opts ...ObjectOption) (map[string]string, error) {
+	if err := checkMirrorEncryption(newObjectOptions(opts)); err != nil {
+		return nil, err
+	}
+	head, err := m.Primary.HeadObject(bucketName, objectKey)
+	if fallback(err) {
+		return m.Secondary.HeadObject(bucketName, objectKey)
+	}
+	return head, err
+}
+
+// MirrorDiff 是 Reconcile 发现的一处不一致，Key 为空表示存储桶本身
+type MirrorDiff struct {
+	Bucket string
+	Key    string
+	// missing：备份中缺少；extra：主后端中已不存在；changed：大小或 ETag 不同
+	Kind string
+}
+
+func (d MirrorDiff) String() string {
+	return fmt.Sprintf("%s %s", d.Kind, mirrorEntry{Bucket: d.Bucket, Key: d.Key})
+}
+
+// Reconcile 比较主、备两个后端的所有存储桶和对象，fix 为 true 时以主后端为准修复备份
+func (m *MirrorStore) Reconcile(fix bool) ([]MirrorDiff, error) {
+	primary, err := m.Primary.ListAllMyBuckets()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list primary buckets: %v", err)
+	}
+	secondary, err := m.Secondary.ListAllMyBuckets()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list secondary buckets: %v", err)
+	}
+
+	buckets := make(map[string]string)
+	for _, b := range primary.Buckets.Bucket {
+		buckets[b.Name] = "missing"
+	}
+	for _, b := range secondary.Buckets.Bucket {
+		if _, ok := buckets[b.Name]; ok {
+			buckets[b.Name] = ""
+		} else {
+			buckets[b.Name] = "extra"
+		}
+	}
+
+	var diffs []MirrorDiff
+	for _, name := range sortedKeys(buckets) {
+		objects, err := m.diffObjects(name, buckets[name])
+		if err != nil {
+			return nil, err
+		}
+		switch bucket := (MirrorDiff{Bucket: name, Kind: buckets[name]}); bucket.Kind {
+		case "missing":
+			diffs = append(append(diffs, bucket), objects...)
+		case "extra":
+			// 修复时要先删除其中的对象
+			diffs = append(append(diffs, objects...), bucket)
+		default:
+			diffs = append(diffs, objects...)
+		}
+	}
+
+	if fix {
+		for _, d := range diffs {
+			if err := m.apply(mirrorEntry{Bucket: d.Bucket, Key: d.Key}); err != nil {
+				return diffs, fmt.Errorf("failed to fix %s: %v", d, err)
+			}
+		}
+	}
+	return diffs, nil
+}
+
+// diffObjects 比较一个存储桶中的对象，kind 为 missing 或 extra 时只有一侧有这个存储桶
+func (m *MirrorStore) diffObjects(bucketName, kind string) ([]MirrorDiff, error) {
+	// 后端每次最多返回 1000 个对象（如 AWSStore），需要逐页列出
+	list := func(p StorageProvider) (map[string]Content, error) {
+		contents := make(map[string]Content)
+		marker := ""
+		for {
+			result, err := p.ListBucket(bucketName, WithMarker(marker), WithMaxKeys(1000))
+			if err != nil {
+				return nil, fmt.Errorf("failed to list bucket %s: %v", bucketName, err)
+			}
+			for _, c := range result.Contents {
+				contents[c.Key] = c
+			}
+			if !result.IsTruncated || len(result.Contents) == 0 {
+				return contents, nil
+			}
+			marker = result.Contents[len(result.Contents)-1].Key
+		}
+	}
+
+	primary, secondary := map[string]Content{}, map[string]Content{}
+	var err error
+	if kind != "extra" {
+		if primary, err = list(m.Primary); err != nil {
+			return nil, err
+		}
+	}
+	if kind != "missing" {
+		if secondary, err = list(m.Secondary); err != nil {
+			return nil, err
+		}
+	}
+
+	var diffs []MirrorDiff
+	for _, key := range sortedKeys(primary) {
+		s, ok := secondary[key]
+		switch {
+		case !ok:
+			diffs = append(diffs, MirrorDiff{Bucket: bucketName, Key: key, Kind: "missing"})
+		case !sameContent(primary[key], s):
+			diffs = append(diffs, MirrorDiff{Bucket: bucketName, Key: key, Kind: "changed"})
+		}
+	}
+	for _, key := range sortedKeys(secondary) {
+		if _, ok := primary[key]; !ok {
+			diffs = append(diffs, MirrorDiff{Bucket: bucketName, Key: key, Kind: "extra"})
+		}
+	}
+	return diffs, nil
+}
+
+// sameContent 比较大小，两边的 ETag 都是 MD5 时也比较 ETag；不同后端生成 ETag 的方式可能不同
+func sameContent(a, b Content) bool {
+	if a.Size != b.Size {
+		return false
+	}
+	if isMD5ETag(a.ETag) && isMD5ETag(b.ETag) {
+		return a.ETag == b.ETag
+	}
+	return true
+}
+
+func isMD5ETag(etag string) bool {
+	etag = strings.Trim(etag, `"`)
+	if len(etag) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(etag)
+	return err == nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// mirrorEntry 是一个等待备份的存储桶或对象，Key 为空表示存储桶本身
+type mirrorEntry struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key,omitempty"`
+	// 加入队列的序号，每次加入都会增加，只在内存中使用
+	seq uint64
+}
+
+func (e mirrorEntry) String() string {
+	if e.Key == "" {
+		return e.Bucket
+	}
+	return e.Bucket + "/" + e.Key
+}
+
+func (e mirrorEntry) id() string {
+	sum := sha1.Sum([]byte(e.Bucket + "\x00" + e.Key))
+	return hex.EncodeToString(sum[:])
+}
+
+// mirrorQueue 保存备份失败的操作，dir 不为空时每个操作保存为 dir 下的一个文件
+type mirrorQueue struct {
+	mu      sync.Mutex
+	dir     string
+	pending map[string]mirrorEntry
+	seq     uint64
+}
+
+func newMirrorQueue(dir string) (*mirrorQueue, error) {
+	q := &mirrorQueue{
+		dir:     dir,
+		pending: make(map[string]mirrorEntry),
+	}
+	if dir == "" {
+		return q, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create mirror queue directory: %v", err)
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read mirror queue: %v", err)
+		}
+		var e mirrorEntry
+		if err := json.Unmarshal(data, &e); err != nil {
+			return nil, fmt.Errorf("invalid mirror queue entry %s: %v", file, err)
+		}
+		q.seq++
+		e.seq = q.seq
+		q.pending[e.id()] = e
+	}
+	return q, nil
+}
+
+func (q *mirrorQueue) add(e mirrorEntry) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.dir != "" {
+		data, _ := json.Marshal(e)
+		file := filepath.Join(q.dir, e.id()+".json")
+		if err := os.WriteFile(file+".tmp", data, 0644); err != nil {
+			return err
+		}
+		if err := os.Rename(file+".tmp", file); err != nil {
+			return err
+		}
+	}
+	q.seq++
+	e.seq = q.seq
+	q.pending[e.id()] = e
+	return nil
+}
+
+// remove 移除 list 返回的操作，之后又被重新加入的操作保留
+func (q *mirrorQueue) remove(e mirrorEntry) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.pending[e.id()].seq != e.seq {
+		return
+	}
+	if q.dir != "" {
+		os.Remove(filepath.Join(q.dir, e.id()+".json"))
+	}
+	delete(q.pending, e.id())
+}
+
+// list 返回所有等待的操作，存储桶排在其中的对象之前
+func (q *mirrorQueue) list() []mirrorEntry {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	entries := make([]mirrorEntry, 0, len(q.pending))
+	for _, e := range q.pending {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Bucket != entries[j].Bucket {
+			return entries[i].Bucket < entries[j].Bucket
+		}
+		return entries[i].Key < entries[j].Key
+	})
+	return entries
+}
+
+func (q *mirrorQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending)
+}
@@ -0,0 +1,352 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Grey0520/s3proxy/internal/config"
+	"github.com/Grey0520/s3proxy/internal/s3err"
+)
+
+var errBackendDown = errors.New("connection refused")
+
+// flakyStore 在 down 时让所有操作失败，模拟不可用的后端
+type flakyStore struct {
+	*MemoryStore
+	down atomic.Bool
+}
+
+func (s *flakyStore) err() error {
+	if s.down.Load() {
+		return errBackendDown
+	}
+	return nil
+}
+
+func (s *flakyStore) CreateBucket(bucketName string) error {
+	if err := s.err(); err != nil {
+		return err
+	}
+	return s.MemoryStore.CreateBucket(bucketName)
+}
+
+func (s *flakyStore) GetBucketAcl(bucketName string) (*AccessControlPolicy, error) {
+	if err := s.err(); err != nil {
+		return nil, err
+	}
+	return s.MemoryStore.GetBucketAcl(bucketName)
+}
+
+func (s *flakyStore) PutObject(bucketName, objectKey string, data *Object, opts ...ObjectOption) error {
+	if err := s.err(); err != nil {
+		return err
+	}
+	return s.MemoryStore.PutObject(bucketName, objectKey, data, opts...)
+}
+
+func (s *flakyStore) GetObject(bucketName, objectKey string, opts ...ObjectOption) (*Object, error) {
+	if err := s.err(); err != nil {
+		return nil, err
+	}
+	return s.MemoryStore.GetObject(bucketName, objectKey, opts...)
+}
+
+func (s *flakyStore) DeleteObject(bucketName, objectKey string) error {
+	if err := s.err(); err != nil {
+		return err
+	}
+	return s.MemoryStore.DeleteObject(bucketName, objectKey)
+}
+
+func newFlakyStore() *flakyStore {
+	store, _ := NewMemoryStore(0)
+	return &flakyStore{MemoryStore: store}
+}
+
+func newTestMirrorStore(t *testing.T, cfg config.MirrorConfig) (*MirrorStore, *flakyStore, *flakyStore) {
+	primary, secondary := newFlakyStore(), newFlakyStore()
+	m, err := NewMirrorStore(primary, secondary, cfg)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	t.Cleanup(func() { m.Close() })
+	if err := m.CreateBucket("bucket"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	return m, primary, secondary
+}
+
+func readString(t *testing.T, store StorageProvider, bucketName, objectKey string) string {
+	t.Helper()
+	obj, err := store.GetObject(bucketName, objectKey)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	defer obj.Data.Close()
+	data, _ := io.ReadAll(obj.Data)
+	return string(data)
+}
+
+func TestMirrorStoreSync(t *testing.T) {
+	m, primary, secondary := newTestMirrorStore(t, config.MirrorConfig{})
+
+	if _, err := secondary.ListBucket("bucket"); err != nil {
+		t.Fatalf("Expected bucket on secondary, got %v", err)
+	}
+	if err := putString(t, m, "bucket", "key.txt", "mirrored"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if got := readString(t, secondary, "bucket", "key.txt"); got != "mirrored" {
+		t.Errorf("Expected object on secondary, got %q", got)
+	}
+
+	if err := m.MoveObject("bucket", "key.txt", "bucket", "moved.txt"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, err := secondary.HeadObject("bucket", "key.txt"); !errors.Is(err, s3err.ErrNoSuchKey) {
+		t.Errorf("Expected source to be removed from secondary, got %v", err)
+	}
+	if got := readString(t, secondary, "bucket", "moved.txt"); got != "mirrored" {
+		t.Errorf("Expected moved object on secondary, got %q", got)
+	}
+
+	m.DeleteObject("bucket", "moved.txt")
+	if _, err := secondary.HeadObject("bucket", "moved.txt"); !errors.Is(err, s3err.ErrNoSuchKey) {
+		t.Errorf("Expected NoSuchKey, got %v", err)
+	}
+	if err := m.DeleteBucket("bucket"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, err := secondary.ListBucket("bucket"); !errors.Is(err, s3err.ErrNoSuchBucket) {
+		t.Errorf("Expected bucket to be removed from secondary, got %v", err)
+	}
+	if _, err := primary.ListBucket("bucket"); !errors.Is(err, s3err.ErrNoSuchBucket) {
+		t.Errorf("Expected NoSuchBucket, got %v", err)
+	}
+
+	key := newTestCustomerKey(t, 1)
+	if err := m.PutObject("bucket", "k", &Object{Data: io.NopCloser(strings.NewReader("x"))}, WithSSECustomerKey(key)); !errors.Is(err, s3err.ErrNotImplemented) {
+		t.Errorf("Expected NotImplemented, got %v", err)
+	}
+}
+
+func TestMirrorStoreRetryQueue(t *testing.T) {
+	dir := t.TempDir()
+	m, _, secondary := newTestMirrorStore(t, config.MirrorConfig{QueueDir: dir, RetryInterval: time.Hour})
+
+	secondary.down.Store(true)
+	putString(t, m, "bucket", "a", "first")
+	putString(t, m, "bucket", "a", "second")
+	if err := putString(t, m, "bucket", "b", "x"); err != nil {
+		t.Fatalf("Expected secondary failures not to fail writes, got %v", err)
+	}
+	if m.Pending() != 2 {
+		t.Errorf("Expected 2 pending entries, got %d", m.Pending())
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	if len(files) != 2 {
+		t.Errorf("Expected 2 queue files, got %v", files)
+	}
+	if m.Flush() != 2 {
+		t.Errorf("Expected entries to stay queued while secondary is down")
+	}
+
+	// 重新创建后从目录中恢复队列
+	m.Close()
+	m, err := NewMirrorStore(m.Primary, secondary, config.MirrorConfig{QueueDir: dir, RetryInterval: time.Hour})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	defer m.Close()
+	if m.Pending() != 2 {
+		t.Fatalf("Expected 2 pending entries after restart, got %d", m.Pending())
+	}
+
+	secondary.down.Store(false)
+	if n := m.Flush(); n != 0 {
+		t.Errorf("Expected empty queue, got %d", n)
+	}
+	if got := readString(t, secondary, "bucket", "a"); got != "second" {
+		t.Errorf("Expected latest content on secondary, got %q", got)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("Expected queue directory to be empty, got %v", entries)
+	}
+}
+
+func TestMirrorQueueRequeued(t *testing.T) {
+	dir := t.TempDir()
+	q, err := newMirrorQueue(dir)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	e := mirrorEntry{Bucket: "bucket", Key: "key"}
+	q.add(e)
+	listed := q.list()[0]
+	// 备份期间对象又被写入，成功的旧备份不能移除新的操作
+	q.add(e)
+	q.remove(listed)
+	if q.len() != 1 {
+		t.Fatalf("Expected the re-queued entry to be kept, got %d pending", q.len())
+	}
+	if _, err := os.Stat(filepath.Join(dir, e.id()+".json")); err != nil {
+		t.Errorf("Expected queue file to be kept, got %v", err)
+	}
+	q.remove(q.list()[0])
+	if q.len() != 0 {
+		t.Errorf("Expected empty queue, got %d pending", q.len())
+	}
+}
+
+func TestMirrorStoreReadFallback(t *testing.T) {
+	m, primary, _ := newTestMirrorStore(t, config.MirrorConfig{})
+	putString(t, m, "bucket", "key", "from secondary")
+
+	primary.down.Store(true)
+	if got := readString(t, m, "bucket", "key"); got != "from secondary" {
+		t.Errorf("Expected read from secondary, got %q", got)
+	}
+	if err := putString(t, m, "bucket", "other", "x"); !errors.Is(err, errBackendDown) {
+		t.Errorf("Expected primary error, got %v", err)
+	}
+
+	// 主后端正常时 NoSuchKey 不会改读备份
+	primary.down.Store(false)
+	primary.DeleteObject("bucket", "key")
+	if _, err := m.GetObject("bucket", "key"); !errors.Is(err, s3err.ErrNoSuchKey) {
+		t.Errorf("Expected NoSuchKey, got %v", err)
+	}
+}
+
+func TestMirrorStoreAsync(t *testing.T) {
+	m, _, secondary := newTestMirrorStore(t, config.MirrorConfig{Mode: "async", RetryInterval: time.Hour})
+	putString(t, m, "bucket", "key", "async")
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := secondary.HeadObject("bucket", "key"); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for async replication")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, err := NewMirrorStore(m.Primary, m.Secondary, config.MirrorConfig{Mode: "eventual"}); err == nil {
+		t.Errorf("Expected error for unsupported mode")
+	}
+}
+
+func TestMirrorStoreReconcile(t *testing.T) {
+	m, primary, secondary := newTestMirrorStore(t, config.MirrorConfig{})
+	putString(t, m, "bucket", "same", "x")
+
+	putString(t, primary, "bucket", "missing", "x")
+	putString(t, secondary, "bucket", "extra", "x")
+	putString(t, primary, "bucket", "changed", "new content")
+	putString(t, secondary, "bucket", "changed", "old")
+	primary.CreateBucket("only-primary")
+	putString(t, primary, "only-primary", "key", "x")
+	secondary.CreateBucket("only-secondary")
+	putString(t, secondary, "only-secondary", "key", "x")
+
+	diffs, err := m.Reconcile(false)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	var got []string
+	for _, d := range diffs {
+		got = append(got, d.String())
+	}
+	want := []string{
+		"changed bucket/changed",
+		"missing bucket/missing",
+		"extra bucket/extra",
+		"missing only-primary",
+		"missing only-primary/key",
+		"extra only-secondary/key",
+		"extra only-secondary",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Expected diffs\n%s\ngot\n%s", strings.Join(want, "\n"), strings.Join(got, "\n"))
+	}
+
+	if _, err := m.Reconcile(true); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if diffs, _ := m.Reconcile(false); len(diffs) != 0 {
+		t.Errorf("Expected no diffs after fix, got %v", diffs)
+	}
+	if got := readString(t, secondary, "bucket", "changed"); got != "new content" {
+		t.Errorf("Expected fixed content, got %q", got)
+	}
+}
+
+// pagedStore 每次最多列出 2 个对象，模拟 AWSStore 每页 1000 个的上限
+type pagedStore struct {
+	*flakyStore
+}
+
+func (s *pagedStore) ListBucket(bucketName string, opts ...ListOption) (*ListBucketResult, error) {
+	if o := newListOptions(opts); o.MaxKeys == 0 || o.MaxKeys > 2 {
+		opts = append(opts, WithMaxKeys(2))
+	}
+	return s.flakyStore.ListBucket(bucketName, opts...)
+}
+
+func TestMirrorStoreReconcilePaged(t *testing.T) {
+	primary, secondary := &pagedStore{newFlakyStore()}, newFlakyStore()
+	m, err := NewMirrorStore(primary, secondary, config.MirrorConfig{})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	defer m.Close()
+	m.CreateBucket("bucket")
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		putString(t, m, "bucket", key, "x")
+	}
+	if diffs, err := m.Reconcile(false); err != nil || len(diffs) != 0 {
+		t.Errorf("Expected no differences, got %v, %v", diffs, err)
+	}
+}
+
+func TestNewStorageProviderMirror(t *testing.T) {
+	cfg := config.Config{
+		Cloud: config.CloudsConfig{Provider: "mirror", Mirror: config.MirrorConfig{Primary: "a", Secondary: "b"}},
+		Backends: []config.BackendConfig{
+			{Name: "a", CloudsConfig: config.CloudsConfig{Provider: "memory"}},
+			{Name: "b", CloudsConfig: config.CloudsConfig{Provider: "local", Filesystem: config.FilesystemConfig{Basedir: t.TempDir()}}},
+		},
+	}
+	stg, err := NewStorageProvider(cfg)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	m, ok := stg.(*MirrorStore)
+	if !ok {
+		t.Fatalf("Expected *MirrorStore, got %T", stg)
+	}
+	defer m.Close()
+	local, ok := m.Secondary.(*LFSStore)
+	if !ok {
+		t.Fatalf("Expected local secondary, got %T", m.Secondary)
+	}
+	// 释放 basedir，下面的错误只能来自配置
+	local.Close()
+
+	cfg.Cloud.Mirror.Secondary = "default"
+	if _, err := NewStorageProvider(cfg); err == nil {
+		t.Errorf("Expected error for mirror referring to itself")
+	}
+	cfg.Cloud.Mirror.Secondary = "missing"
+	if _, err := NewStorageProvider(cfg); err == nil {
+		t.Errorf("Expected error for unknown backend")
+	}
+}
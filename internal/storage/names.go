@@ -0,0 +1,66 @@
+package storage
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/Grey0520/s3proxy/internal/s3err"
+)
+
+// S3 限制对象的键最多 1024 字节
+const maxKeyLength = 1024
+
+// checkBucketName 按 S3 的命名规则检查存储桶名称，创建存储桶时使用
+// 名称由小写字母、数字、点和连字符组成，长度 3 到 63，每个以点分隔的部分都以字母或数字开头和结尾，
+// 因此名称同时是合法的 DNS 名称，也不可能是 .、.. 或者包含路径分隔符
+func checkBucketName(bucketName string) error {
+	invalid := func(reason string) error {
+		return s3err.ErrInvalidBucketName.WithMessage(fmt.Sprintf("invalid bucket name %q: %s", bucketName, reason))
+	}
+	if len(bucketName) < 3 || len(bucketName) > 63 {
+		return invalid("must be between 3 and 63 characters long")
+	}
+	for _, label := range strings.Split(bucketName, ".") {
+		if label == "" {
+			return invalid("must not contain empty labels")
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+				return invalid("can contain only lowercase letters, numbers, dots and hyphens")
+			}
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return invalid("each label must begin and end with a letter or number")
+		}
+	}
+	if net.ParseIP(bucketName) != nil {
+		return invalid("must not be formatted as an IP address")
+	}
+	for _, prefix := range []string{"xn--", "sthree-"} {
+		if strings.HasPrefix(bucketName, prefix) {
+			return invalid(fmt.Sprintf("must not start with %q", prefix))
+		}
+	}
+	for _, suffix := range []string{"-s3alias", "--ol-s3"} {
+		if strings.HasSuffix(bucketName, suffix) {
+			return invalid(fmt.Sprintf("must not end with %q", suffix))
+		}
+	}
+	return nil
+}
+
+// checkObjectKey 检查对象的键是 S3 允许的键：不为空、UTF-8 编码、不超过 1024 字节
+func checkObjectKey(objectKey string) error {
+	if objectKey == "" {
+		return s3err.ErrInvalidArgument.WithMessage("object key must not be empty")
+	}
+	if len(objectKey) > maxKeyLength {
+		return s3err.ErrKeyTooLong
+	}
+	if !utf8.ValidString(objectKey) {
+		return s3err.ErrInvalidArgument.WithMessage(fmt.Sprintf("object key %q is not valid UTF-8", objectKey))
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Grey0520/s3proxy/internal/s3err"
+)
+
+func TestCheckBucketName(t *testing.T) {
+	for _, name := range []string{"abc", "my-bucket", "logs.example.com", "a1b2c3", "1bucket", strings.Repeat("a", 63)} {
+		if err := checkBucketName(name); err != nil {
+			t.Errorf("Expected %q to be valid, got %v", name, err)
+		}
+	}
+	invalid := []string{
+		"", ".", "..", "ab", strings.Repeat("a", 64),
+		"My-Bucket", "my_bucket", "a/b", `a\b`, "bucket\x00", "bücket",
+		".bucket", "bucket.", "my..bucket", "-bucket", "bucket-", "my.-bucket", "my-.bucket",
+		"192.168.5.4", "xn--bucket", "sthree-bucket", "bucket-s3alias", "bucket--ol-s3",
+	}
+	for _, name := range invalid {
+		if err := checkBucketName(name); !errors.Is(err, s3err.ErrInvalidBucketName) {
+			t.Errorf("Expected InvalidBucketName for %q, got %v", name, err)
+		}
+	}
+}
+
+func TestLFSStoreObjectKeys(t *testing.T) {
+	store := newTestLFSStore(t, t.TempDir())
+	store.CreateBucket("bucket")
+
+	for _, key := range []string{".", "..", "./a", "a/.", "a/..", "a/./b", "a/b/.."} {
+		if err := putString(t, store, "bucket", key, "x"); !errors.Is(err, s3err.ErrInvalidArgument) {
+			t.Errorf("Expected InvalidArgument for PUT %q, got %v", key, err)
+		}
+		if _, err := store.GetObject("bucket", key); !errors.Is(err, s3err.ErrInvalidArgument) {
+			t.Errorf("Expected InvalidArgument for GET %q, got %v", key, err)
+		}
+		if err := store.DeleteObject("bucket", key); !errors.Is(err, s3err.ErrInvalidArgument) {
+			t.Errorf("Expected InvalidArgument for DELETE %q, got %v", key, err)
+		}
+	}
+	if err := putString(t, store, "bucket", "", "x"); !errors.Is(err, s3err.ErrInvalidArgument) {
+		t.Errorf("Expected InvalidArgument for empty key, got %v", err)
+	}
+	if err := putString(t, store, "bucket", "\xff", "x"); !errors.Is(err, s3err.ErrInvalidArgument) {
+		t.Errorf("Expected InvalidArgument for invalid UTF-8, got %v", err)
+	}
+	if err := putString(t, store, "bucket", strings.Repeat("k", 1025), "x"); !errors.Is(err, s3err.ErrKeyTooLong) {
+		t.Errorf("Expected KeyTooLong, got %v", err)
+	}
+	// 包含 .. 但不会离开存储桶目录的键仍然可以使用
+	for _, key := range []string{"../a", "a/../../b", "..a/b..", "a/.../b"} {
+		if err := putString(t, store, "bucket", key, key); err != nil {
+			t.Errorf("Expected no error for %q, got %v", key, err)
+		}
+	}
+}
+
+func TestErasureStoreBucketNames(t *testing.T) {
+	store := newTestErasureStore(t, 3, 1)
+
+	for _, name := range []string{"..", ".", "Bucket", "a/b"} {
+		if err := store.CreateBucket(name); !errors.Is(err, s3err.ErrInvalidBucketName) {
+			t.Errorf("Expected InvalidBucketName for %q, got %v", name, err)
+		}
+	}
+	for _, name := range []string{"..", "."} {
+		if err := store.DeleteBucket(name); !errors.Is(err, s3err.ErrNoSuchBucket) {
+			t.Errorf("Expected NoSuchBucket for %q, got %v", name, err)
+		}
+	}
+}
+
+// FuzzLFSStorePaths 用任意的存储桶名称和键访问 LFSStore，检查所有文件操作都留在 basePath 中：
+// basePath 之外的文件没有被读取、修改或删除，也没有创建新的文件
+func FuzzLFSStorePaths(f *testing.F) {
+	seeds := [][2]string{
+		{"bucket", "key"},
+		{"..", "key"},
+		{".", "outside/secret"},
+		{"../outside", "secret"},
+		{"bucket", ".."},
+		{"bucket", "../.."},
+		{"bucket", "../../outside/secret"},
+		{"bucket", "a/../../.."},
+		{"bucket", "a/.."},
+		{"bucket", "./."},
+		{"bucket", "/../../outside/secret"},
+		{"bucket", "..\\..\\outside"},
+		{"bucket", "..//..//outside"},
+		{"bucket", "x\x00/../.."},
+		{"bucket", "x.attrs"},
+		{".s3proxy", "buckets.json"},
+		{"b..", "../.."},
+	}
+	for _, seed := range seeds {
+		f.Add(seed[0], seed[1])
+	}
+	f.Fuzz(func(t *testing.T, bucketName, objectKey string) {
+		root := t.TempDir()
+		base := filepath.Join(root, "base")
+		outside := filepath.Join(root, "outside")
+		os.MkdirAll(outside, 0o755)
+		os.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0o644)
+
+		store := newTestLFSStore(t, base)
+		store.CreateBucket("bucket")
+		store.CreateBucket(bucketName)
+		for _, b := range []string{"bucket", bucketName} {
+			store.PutObject(b, objectKey, &Object{ContentType: "text/plain", Data: io.NopCloser(strings.NewReader("data"))})
+			if obj, err := store.GetObject(b, objectKey); err == nil {
+				data, _ := io.ReadAll(obj.Data)
+				obj.Data.Close()
+				if string(data) == "secret" {
+					t.Fatalf("Read file outside basePath with bucket %q key %q", b, objectKey)
+				}
+			}
+			store.HeadObject(b, objectKey)
+			store.CopyObject(b, objectKey, b, objectKey+"-copy")
+			store.ListBucket(b)
+			store.DeleteObject(b, objectKey+"-copy")
+			store.DeleteObject(b, objectKey)
+			store.DeleteBucket(b)
+		}
+		store.Close()
+
+		var files []string
+		filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if path == base {
+				return filepath.SkipDir
+			}
+			files = append(files, path)
+			return nil
+		})
+		if len(files) != 3 || files[0] != root || files[1] != outside || files[2] != filepath.Join(outside, "secret") {
+			t.Fatalf("Files outside basePath changed with bucket %q key %q: %v", bucketName, objectKey, files)
+		}
+		if data, err := os.ReadFile(filepath.Join(outside, "secret")); err != nil || string(data) != "secret" {
+			t.Fatalf("File outside basePath changed with bucket %q key %q", bucketName, objectKey)
+		}
+	})
+}
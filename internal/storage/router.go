@@ -0,0 +1,287 @@
+package storage
+
+import (
+	"encoding/xml"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/Grey0520/s3proxy/internal/s3err"
+)
+
+// DefaultBackend 是 Cloud.Provider 对应的后端名称，没有路由匹配的存储桶交给它处理
+const DefaultBackend = "default"
+
+type route struct {
+	match   func(bucketName string) bool
+	backend string
+}
+
+// Router 按存储桶名称把请求分发到不同的后端
+// 路由按添加的顺序匹配，都不匹配时使用 fallback；跨后端的复制和移动通过流式读写完成
+type Router struct {
+	backends map[string]StorageProvider
+	// 后端的名称，按添加的顺序，ListAllMyBuckets 按这个顺序合并结果
+	names    []string
+	routes   []route
+	fallback string
+}
+
+// NewRouter 创建一个没有后端的路由，fallback 为空时拒绝没有路由匹配的存储桶
+func NewRouter(fallback string) *Router {
+	return &Router{
+		backends: make(map[string]StorageProvider),
+		fallback: fallback,
+	}
+}
+
+// AddBackend 注册一个后端
+func (r *Router) AddBackend(name string, backend StorageProvider) error {
+	if name == "" {
+		return fmt.Errorf("backend name is required")
+	}
+	if _, ok := r.backends[name]; ok {
+		return fmt.Errorf("duplicate backend %s", name)
+	}
+	r.backends[name] = backend
+	r.names = append(r.names, name)
+	return nil
+}
+
+// AddRoute 把匹配 pattern 的存储桶交给 backend
+// match 为 exact、glob 或 regex，为空时 pattern 含有 *?[ 按 glob 匹配，否则按名称精确匹配
+// regex 需要匹配整个存储桶名称
+func (r *Router) AddRoute(pattern, match, backend string) error {
+	if _, ok := r.backends[backend]; !ok {
+		return fmt.Errorf("route %s refers to unknown backend %s", pattern, backend)
+	}
+	if match == "" {
+		match = "exact"
+		if strings.ContainsAny(pattern, "*?[") {
+			match = "glob"
+		}
+	}
+
+	var fn func(string) bool
+	switch match {
+	case "exact":
+		fn = func(bucketName string) bool { return bucketName == pattern }
+	case "glob":
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid glob %s: %v", pattern, err)
+		}
+		fn = func(bucketName string) bool {
+			ok, _ := path.Match(pattern, bucketName)
+			return ok
+		}
+	case "regex":
+		re, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return fmt.Errorf("invalid regex %s: %v", pattern, err)
+		}
+		fn = re.MatchString
+	default:
+		return fmt.Errorf("unsupported route match %s", match)
+	}
+	r.routes = append(r.routes, route{match: fn, backend: backend})
+	return nil
+}
+
+// Backend 返回处理存储桶的后端名称，没有后端时返回空字符串
+func (r *Router) Backend(bucketName string) string {
+	for _, rt := range r.routes {
+		if rt.match(bucketName) {
+			return rt.backend
+		}
+	}
+	if _, ok := r.backends[r.fallback]; ok {
+		return r.fallback
+	}
+	return ""
+}
+
+func (r *Router) backend(bucketName string) (StorageProvider, error) {
+	name := r.Backend(bucketName)
+	if name == "" {
+		return nil, fmt.Errorf("no backend is configured for bucket %s: %w", bucketName, s3err.ErrNoSuchBucket)
+	}
+	return r.backends[name], nil
+}
+
+func (r *Router) CreateBucket(bucketName string) error {
+	name := r.Backend(bucketName)
+	if name == "" {
+		return s3err.ErrInvalidArgument.WithMessage(fmt.Sprintf("no backend is configured for bucket %s", bucketName))
+	}
+	return r.backends[name].CreateBucket(bucketName)
+}
+
+func (r *Router) DeleteBucket(bucketName string) error {
+	backend, err := r.backend(bucketName)
+	if err != nil {
+		return err
+	}
+	return backend.DeleteBucket(bucketName)
+}
+
+func (r *Router) ListBucket(bucketName string, opts ...ListOption) (*ListBucketResult, error) {
+	backend, err := r.backend(bucketName)
+	if err != nil {
+		return nil, err
+	}
+	return backend.ListBucket(bucketName, opts...)
+}
+
+// ListAllMyBuckets 合并所有后端的存储桶
+// 后端中路由到其他后端的存储桶无法访问，不会出现在结果里
+func (r *Router) ListAllMyBuckets() (*ListAllMyBucketsResult, error) {
+	result := &ListAllMyBucketsResult{
+		XMLName: xml.Name{Local: "ListAllMyBucketsResult"},
+		Owner:   newFakeOwner(),
+	}
+	for i, name := range r.names {
+		res, err := r.backends[name].ListAllMyBuckets()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list buckets of backend %s: %v", name, err)
+		}
+		if i == 0 {
+			result.Owner = res.Owner
+		}
+		for _, b := range res.Buckets.Bucket {
+			if r.Backend(b.Name) == name {
+				result.Buckets.Bucket = append(result.Buckets.Bucket, b)
+			}
+		}
+	}
+	sort.Slice(result.Buckets.Bucket, func(i, j int) bool {
+		return result.Buckets.Bucket[i].Name < result.Buckets.Bucket[j].Name
+	})
+	return result, nil
+}
+
+func (r *Router) GetBucketAcl(bucketName string) (*AccessControlPolicy, error) {
+	backend, err := r.backend(bucketName)
+	if err != nil {
+		return nil, err
+	}
+	return backend.GetBucketAcl(bucketName)
+}
+
+func (r *Router) PutObject(bucketName, objectKey string, data *Object, opts ...ObjectOption) error {
+	backend, err := r.backend(bucketName)
+	if err != nil {
+		return err
+	}
+	return backend.PutObject(bucketName, objectKey, data, opts...)
+}
+
+func (r *Router) GetObject(bucketName, objectKey string, opts ...ObjectOption) (*Object, error) {
+	backend, err := r.backend(bucketName)
+	if err != nil {
+		return nil, err
+	}
+	return backend.GetObject(bucketName, objectKey, opts...)
+}
+
+func (r *Router) DeleteObject(bucketName, objectKey string) error {
+	backend, err := r.backend(bucketName)
+	if err != nil {
+		return err
+	}
+	return backend.DeleteObject(bucketName, objectKey)
+}
+
+// CopyObject 同一个后端内直接复制，跨后端时从源后端读出再写入目标后端
+// 跨后端复制不保留源对象的服务端加密，目标对象使用目标存储桶的默认加密
+func (r *Router) CopyObject(srcBucketName, srcObjectKey, destBucketName, destObjectKey string, opts ...ObjectOption) error {
+	src, err := r.backend(srcBucketName)
+	if err != nil {
+		return err
+	}
+	dst, err := r.backend(destBucketName)
+	if err != nil {
+		return err
+	}
+	if r.Backend(srcBucketName) == r.Backend(destBucketName) {
+		return src.CopyObject(srcBucketName, srcObjectKey, destBucketName, destObjectKey, opts...)
+	}
+
+	o := newObjectOptions(opts)
+	obj, err := src.GetObject(srcBucketName, srcObjectKey, WithSSECustomerKey(o.CopySourceSSECustomerKey))
+	if err != nil {
+		return err
+	}
+	defer obj.Data.Close()
+	return dst.PutObject(destBucketName, destObjectKey, &Object{
+		Key:         destObjectKey,
+		Size:        obj.Size,
+		ContentType: obj.ContentType,
+		Data:        obj.Data,
+	}, WithSSECustomerKey(o.SSECustomerKey))
+}
+
+// MoveObject 跨后端时先复制再删除源对象
+func (r *Router) MoveObject(srcBucketName, srcObjectKey, destBucketName, destObjectKey string) error {
+	src, err := r.backend(srcBucketName)
+	if err != nil {
+		return err
+	}
+	if r.Backend(srcBucketName) == r.Backend(destBucketName) {
+		return src.MoveObject(srcBucketName, srcObjectKey, destBucketName, destObjectKey)
+	}
+	if err := r.CopyObject(srcBucketName, srcObjectKey, destBucketName, destObjectKey); err != nil {
+		return err
+	}
+	return src.DeleteObject(srcBucketName, srcObjectKey)
+}
+
+func (r *Router) HeadObject(bucketName, objectKey string, opts ...ObjectOption) (map[string]string, error) {
+	backend, err := r.backend(bucketName)
+	if err != nil {
+		return nil, err
+	}
+	return backend.HeadObject(bucketName, objectKey, opts...)
+}
+
+func (r *Router) encryptionConfigurer(bucketName string) (BucketEncryptionConfigurer, error) {
+	backend, err := r.backend(bucketName)
+	if err != nil {
+		return nil, err
+	}
+	return encryptionConfigurer(backend)
+}
+
+func (r *Router) PutBucketEncryption(bucketName string, cfg *ServerSideEncryptionConfiguration) error {
+	configurer, err := r.encryptionConfigurer(bucketName)
+	if err != nil {
+		return err
+	}
+	return configurer.PutBucketEncryption(bucketName, cfg)
+}
+
+func (r *Router) GetBucketEncryption(bucketName string) (*ServerSideEncryptionConfiguration, error) {
+	configurer, err := r.encryptionConfigurer(bucketName)
+	if err != nil {
+		return nil, err
+	}
+	return configurer.GetBucketEncryption(bucketName)
+}
+
+func (r *Router) DeleteBucketEncryption(bucketName string) error {
+	configurer, err := r.encryptionConfigurer(bucketName)
+	if err != nil {
+		return err
+	}
+	return configurer.DeleteBucketEncryption(bucketName)
+}
+
+// Backends 返回所有后端，键为后端名称
+func (r *Router) Backends() map[string]StorageProvider {
+	backends := make(map[string]StorageProvider, len(r.backends))
+	for name, backend := range r.backends {
+		backends[name] = backend
+	}
+	return backends
+}
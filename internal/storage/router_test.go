@@ -0,0 +1,201 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/Grey0520/s3proxy/internal/config"
+	"github.com/Grey0520/s3proxy/internal/s3err"
+)
+
+// newTestRouter 创建一个路由：logs-* 到 local，prod-.* 到 memory，其余交给 default
+func newTestRouter(t *testing.T) (*Router, StorageProvider, StorageProvider) {
+	local, err := NewLFSStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	prod, _ := NewMemoryStore(0)
+	fallback, _ := NewMemoryStore(0)
+
+	router := NewRouter(DefaultBackend)
+	router.AddBackend(DefaultBackend, fallback)
+	router.AddBackend("local", local)
+	router.AddBackend("prod", prod)
+	if err := router.AddRoute("logs-*", "", "local"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := router.AddRoute("prod-[a-z]+", "regex", "prod"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	return router, local, prod
+}
+
+func TestRouterRoutes(t *testing.T) {
+	router, _, _ := newTestRouter(t)
+
+	tests := map[string]string{
+		"logs-2024": "local",
+		"logs":      DefaultBackend,
+		"prod-eu":   "prod",
+		"prod-1":    DefaultBackend,
+		"xprod-eu":  DefaultBackend,
+	}
+	for bucketName, want := range tests {
+		if got := router.Backend(bucketName); got != want {
+			t.Errorf("Expected backend %s for %s, got %s", want, bucketName, got)
+		}
+	}
+
+	if err := router.AddRoute("a", "", "missing"); err == nil {
+		t.Errorf("Expected error for unknown backend")
+	}
+	if err := router.AddRoute("(", "regex", "prod"); err == nil {
+		t.Errorf("Expected error for invalid regex")
+	}
+	if err := router.AddRoute("a", "prefix", "prod"); err == nil {
+		t.Errorf("Expected error for unsupported match")
+	}
+	if err := router.AddBackend("prod", nil); err == nil {
+		t.Errorf("Expected error for duplicate backend")
+	}
+
+	strict := NewRouter("")
+	if err := strict.CreateBucket("bucket"); !errors.Is(err, s3err.ErrInvalidArgument) {
+		t.Errorf("Expected InvalidArgument, got %v", err)
+	}
+	if _, err := strict.ListBucket("bucket"); !errors.Is(err, s3err.ErrNoSuchBucket) {
+		t.Errorf("Expected NoSuchBucket, got %v", err)
+	}
+}
+
+func TestRouterBuckets(t *testing.T) {
+	router, local, prod := newTestRouter(t)
+
+	for _, b := range []string{"logs-a", "prod-eu", "other"} {
+		if err := router.CreateBucket(b); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	}
+	if _, err := local.ListBucket("logs-a"); err != nil {
+		t.Errorf("Expected logs-a on local backend, got %v", err)
+	}
+	if _, err := prod.ListBucket("prod-eu"); err != nil {
+		t.Errorf("Expected prod-eu on prod backend, got %v", err)
+	}
+	// 路由到其他后端的存储桶不可访问，不应出现在列表中
+	prod.CreateBucket("logs-hidden")
+
+	result, err := router.ListAllMyBuckets()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	var names []string
+	for _, b := range result.Buckets.Bucket {
+		names = append(names, b.Name)
+	}
+	if len(names) != 3 || names[0] != "logs-a" || names[1] != "other" || names[2] != "prod-eu" {
+		t.Errorf("Unexpected buckets %v", names)
+	}
+
+	if err := router.PutBucketEncryption("prod-eu", &ServerSideEncryptionConfiguration{}); !errors.Is(err, s3err.ErrNotImplemented) {
+		t.Errorf("Expected NotImplemented, got %v", err)
+	}
+	if _, err := router.GetBucketEncryption("logs-a"); errors.Is(err, s3err.ErrNotImplemented) {
+		t.Errorf("Expected local backend to support bucket encryption, got %v", err)
+	}
+}
+
+func TestRouterCrossBackendCopy(t *testing.T) {
+	router, local, prod := newTestRouter(t)
+	router.CreateBucket("logs-a")
+	router.CreateBucket("prod-eu")
+
+	if err := putString(t, router, "logs-a", "key.txt", "cross backend"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := router.CopyObject("logs-a", "key.txt", "prod-eu", "copy.txt"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	obj, err := prod.GetObject("prod-eu", "copy.txt")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	data, _ := io.ReadAll(obj.Data)
+	obj.Data.Close()
+	if string(data) != "cross backend" || obj.ContentType != "text/plain" {
+		t.Errorf("Unexpected object %q with content type %s", data, obj.ContentType)
+	}
+
+	if err := router.MoveObject("prod-eu", "copy.txt", "logs-a", "moved.txt"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, err := prod.HeadObject("prod-eu", "copy.txt"); !errors.Is(err, s3err.ErrNoSuchKey) {
+		t.Errorf("Expected source to be deleted, got %v", err)
+	}
+	if _, err := local.HeadObject("logs-a", "moved.txt"); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+
+	if err := router.CopyObject("logs-a", "missing", "prod-eu", "x"); !errors.Is(err, s3err.ErrNoSuchKey) {
+		t.Errorf("Expected NoSuchKey, got %v", err)
+	}
+}
+
+func TestNewStorageProviderBackends(t *testing.T) {
+	cfg := config.Config{
+		Cloud: config.CloudsConfig{Provider: "memory"},
+		Backends: []config.BackendConfig{
+			{Name: "logs", CloudsConfig: config.CloudsConfig{Provider: "local", Filesystem: config.FilesystemConfig{Basedir: t.TempDir()}}},
+		},
+		Routes: []config.RouteConfig{{Bucket: "logs-*", Backend: "logs"}},
+	}
+	stg, err := NewStorageProvider(cfg)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	router, ok := stg.(*Router)
+	if !ok {
+		t.Fatalf("Expected *Router, got %T", stg)
+	}
+	if router.Backend("logs-1") != "logs" || router.Backend("other") != DefaultBackend {
+		t.Errorf("Unexpected routes")
+	}
+
+	// 释放 logs 的 basedir，下面的错误只能来自 bad
+	router.Backends()["logs"].(*LFSStore).Close()
+	cfg.Backends = append(cfg.Backends, config.BackendConfig{Name: "bad", CloudsConfig: config.CloudsConfig{Provider: "nope"}})
+	if _, err := NewStorageProvider(cfg); err == nil {
+		t.Errorf("Expected error for unsupported provider")
+	}
+}
+
+// 没有被引用的后端只用于检查配置，创建后立即关闭
+func TestNewStorageProviderUnusedBackend(t *testing.T) {
+	dir := t.TempDir()
+	cfg := config.Config{
+		Cloud: config.CloudsConfig{Provider: "memory"},
+		Backends: []config.BackendConfig{
+			{Name: "unused", CloudsConfig: config.CloudsConfig{Provider: "local", Filesystem: config.FilesystemConfig{Basedir: dir}}},
+		},
+	}
+	if _, err := NewStorageProvider(cfg); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	store, err := NewLFSStore(dir)
+	if err != nil {
+		t.Fatalf("Expected the unused backend to release its basedir, got %v", err)
+	}
+	store.Close()
+
+	// 出错时已经创建的后端也会被关闭
+	cfg.Backends = append(cfg.Backends, config.BackendConfig{Name: "bad", CloudsConfig: config.CloudsConfig{Provider: "nope"}})
+	if _, err := NewStorageProvider(cfg); err == nil {
+		t.Fatalf("Expected error for unsupported provider")
+	}
+	store, err = NewLFSStore(dir)
+	if err != nil {
+		t.Fatalf("Expected the basedir to be released after an error, got %v", err)
+	}
+	store.Close()
+}
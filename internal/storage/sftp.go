@@ -0,0 +1,503 @@
+package storage
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Grey0520/s3proxy/internal/s3err"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// 上传时先写入同目录下以此为前缀的临时文件，关闭后再重命名为目标文件，
+// 读取方不会看到写了一半的对象。列举对象时跳过这些文件
+const sftpTempPrefix = ".s3proxy-upload-"
+
+// SFTPStore 把对象保存在远端 SFTP 服务器上，root 下的每个一级目录对应一个存储桶，
+// 对象键中的 / 对应子目录
+//
+// SFTP 没有地方保存对象元数据，Content-Type 根据扩展名推断，ETag 由修改时间和大小生成
+type SFTPStore struct {
+	Client *sftp.Client
+	conn   *ssh.Client
+	root   string
+}
+
+// SFTPClientConfig 根据用户名、密码和私钥生成 SSH 客户端配置，密码和私钥至少提供一个
+// privateKey 是 PEM 格式的私钥或者私钥文件的路径；knownHosts 是 known_hosts 文件的路径，
+// 为空时必须显式设置 insecureIgnoreHostKey，不校验服务器的身份
+func SFTPClientConfig(user, password, privateKey, knownHosts string, insecureIgnoreHostKey bool) (*ssh.ClientConfig, error) {
+	cfg := &ssh.ClientConfig{
+		User:    user,
+		Timeout: 30 * time.Second,
+	}
+
+	if privateKey != "" {
+		data := []byte(privateKey)
+		if !strings.Contains(privateKey, "PRIVATE KEY") {
+			var err error
+			if data, err = os.ReadFile(privateKey); err != nil {
+				return nil, fmt.Errorf("failed to read sftp private key: %v", err)
+			}
+		}
+		signer, err := ssh.ParsePrivateKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sftp private key: %v", err)
+		}
+		cfg.Auth = append(cfg.Auth, ssh.PublicKeys(signer))
+	}
+	if password != "" {
+		cfg.Auth = append(cfg.Auth, ssh.Password(password))
+	}
+	if len(cfg.Auth) == 0 {
+		return nil, fmt.Errorf("sftp password or private key is required")
+	}
+
+	switch {
+	case knownHosts != "":
+		callback, err := knownhosts.New(knownHosts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read known hosts: %v", err)
+		}
+		cfg.HostKeyCallback = callback
+	case insecureIgnoreHostKey:
+		cfg.HostKeyCallback = ssh.InsecureIgnoreHostKey()
+	default:
+		return nil, fmt.Errorf("sftp known hosts file is required to verify the server")
+	}
+	return cfg, nil
+}
+
+// NewSFTPStore 连接 addr（host:port）上的 SFTP 服务器，root 为存放存储桶的远端目录
+func NewSFTPStore(addr, root string, cfg *ssh.ClientConfig) (*SFTPStore, error) {
+	if !strings.Contains(addr, ":") {
+		addr += ":22"
+	}
+	conn, err := ssh.Dial("tcp", addr, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to sftp server: %v", err)
+	}
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to start sftp session: %v", err)
+	}
+
+	if root == "" {
+		root = "."
+	}
+	if err := client.MkdirAll(root); err != nil {
+		client.Close()
+		conn.Close()
+		return nil, fmt.Errorf("failed to create root directory %s: %v", root, err)
+	}
+	return &SFTPStore{
+		Client: client,
+		conn:   conn,
+		root:   root,
+	}, nil
+}
+
+// Close 断开与服务器的连接
+func (store *SFTPStore) Close() error {
+	store.Client.Close()
+	return store.conn.Close()
+}
+
+func (store *SFTPStore) bucketPath(bucketName string) (string, error) {
+	if bucketName == "" || bucketName == "." || bucketName == ".." ||
+		strings.ContainsAny(bucketName, `/\`) || strings.HasPrefix(bucketName, ".") {
+		return "", s3err.ErrInvalidArgument.WithMessage(fmt.Sprintf("invalid bucket name %q", bucketName))
+	}
+	return path.Join(store.root, bucketName), nil
+}
+
+// objectPath 返回对象在服务器上的路径，拒绝会跳出存储桶目录的键
+func (store *SFTPStore) objectPath(bucketName, objectKey string) (string, error) {
+	dir, err := store.bucketPath(bucketName)
+	if err != nil {
+		return "", err
+	}
+	for _, elem := range strings.Split(objectKey, "/") {
+		if elem == "" || elem == "." || elem == ".." || strings.HasPrefix(elem, sftpTempPrefix) {
+			return "", s3err.ErrInvalidArgument.WithMessage(fmt.Sprintf("object key %q is not supported by the sftp backend", objectKey))
+		}
+	}
+	return path.Join(dir, objectKey), nil
+}
+
+// checkBucket 确认存储桶存在
+func (store *SFTPStore) checkBucket(bucketName string) (string, error) {
+	dir, err := store.bucketPath(bucketName)
+	if err != nil {
+		return "", err
+	}
+	info, err := store.Client.Stat(dir)
+	if err != nil || !info.IsDir() {
+		if err == nil || isNotExist(err) {
+			return "", fmt.Errorf("bucket %s does not exist: %w", bucketName, s3err.ErrNoSuchBucket)
+		}
+		return "", fmt.Errorf("failed to get bucket %s: %v", bucketName, err)
+	}
+	return dir, nil
+}
+
+func (store *SFTPStore) CreateBucket(bucketName string) error {
+	if err := checkBucketName(bucketName); err != nil {
+		return err
+	}
+	dir, err := store.bucketPath(bucketName)
+	if err != nil {
+		return err
+	}
+	if _, err := store.Client.Stat(dir); err == nil {
+		return fmt.Errorf("bucket %s already exists: %w", bucketName, s3err.ErrBucketAlreadyExists)
+	}
+	if err := store.Client.Mkdir(dir); err != nil {
+		return fmt.Errorf("failed to create bucket %s: %v", bucketName, err)
+	}
+	return nil
+}
+
+func (store *SFTPStore) DeleteBucket(bucketName string) error {
+	dir, err := store.checkBucket(bucketName)
+	if err != nil {
+		return err
+	}
+	objects, err := store.walk(dir, 1)
+	if err != nil {
+		return fmt.Errorf("failed to get bucket %s: %v", bucketName, err)
+	}
+	if len(objects) > 0 {
+		return fmt.Errorf("bucket %s is not empty: %w", bucketName, s3err.ErrBucketNotEmpty)
+	}
+	// 剩下的只有空目录和未完成的上传
+	if err := store.Client.RemoveAll(dir); err != nil {
+		return fmt.Errorf("failed to delete bucket %s: %v", bucketName, err)
+	}
+	return nil
+}
+
+type sftpObject struct {
+	key  string
+	info os.FileInfo
+}
+
+// walk 列举目录下的对象，limit 大于 0 时最多返回 limit 个
+func (store *SFTPStore) walk(dir string, limit int) ([]sftpObject, error) {
+	var objects []sftpObject
+	walker := store.Client.Walk(dir)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			return nil, err
+		}
+		info := walker.Stat()
+		if !info.Mode().IsRegular() || strings.HasPrefix(info.Name(), sftpTempPrefix) {
+			continue
+		}
+		objects = append(objects, sftpObject{
+			key:  strings.TrimPrefix(walker.Path(), dir+"/"),
+			info: info,
+		})
+		if limit > 0 && len(objects) >= limit {
+			break
+		}
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].key < objects[j].key })
+	return objects, nil
+}
+
+func (store *SFTPStore) ListBucket(bucketName string, opts ...ListOption) (*ListBucketResult, error) {
+	dir, err := store.checkBucket(bucketName)
+	if err != nil {
+		return nil, err
+	}
+	objects, err := store.walk(dir, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list objects: %v", err)
+	}
+
+	result := &ListBucketResult{
+		XMLName: xml.Name{Local: "ListBucketResult"},
+		Name:    bucketName,
+	}
+	for _, obj := range objects {
+		result.Contents = append(result.Contents, Content{
+			Key:          obj.key,
+			LastModified: obj.info.ModTime(),
+			ETag:         sftpETag(obj.info),
+			Size:         obj.info.Size(),
+			StorageClass: "STANDARD",
+			Owner:        newFakeOwner(),
+		})
+	}
+	return newListOptions(opts).paginate(result), nil
+}
+
+func (store *SFTPStore) ListAllMyBuckets() (*ListAllMyBucketsResult, error) {
+	infos, err := store.Client.ReadDir(store.root)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list buckets: %v", err)
+	}
+	var buckets []Bucket
+	for _, info := range infos {
+		if info.IsDir() && !strings.HasPrefix(info.Name(), ".") {
+			buckets = append(buckets, Bucket{
+				Name:         info.Name(),
+				CreationDate: info.ModTime(),
+			})
+		}
+	}
+	return &ListAllMyBucketsResult{
+		XMLName: xml.Name{Local: "ListAllMyBucketsResult"},
+		Owner:   newFakeOwner(),
+		Buckets: Buckets{
+			Bucket: buckets,
+		},
+	}, nil
+}
+
+func (store *SFTPStore) GetBucketAcl(bucketName string) (*AccessControlPolicy, error) {
+	if _, err := store.checkBucket(bucketName); err != nil {
+		return nil, err
+	}
+	owner := newFakeOwner()
+	return &AccessControlPolicy{
+		Owner: owner,
+		AccessControlList: AccessControlList{
+			Grant: []Grant{
+				{
+					Grantee: Grantee{
+						ID:          owner.ID,
+						DisplayName: owner.DisplayName,
+					},
+					Permission: "FULL_CONTROL",
+				},
+			},
+		},
+	}, nil
+}
+
+func (store *SFTPStore) PutObject(bucketName, objectKey string, data *Object, opts ...ObjectOption) error {
+	if err := checkSFTPEncryption(data.ServerSideEncryption, newObjectOptions(opts)); err != nil {
+		return err
+	}
+	return store.write(bucketName, objectKey, data.Data)
+}
+
+// write 把数据流写入临时文件，完成后重命名为目标文件
+func (store *SFTPStore) write(bucketName, objectKey string, r io.Reader) error {
+	if _, err := store.checkBucket(bucketName); err != nil {
+		return err
+	}
+	p, err := store.objectPath(bucketName, objectKey)
+	if err != nil {
+		return err
+	}
+	if err := store.Client.MkdirAll(path.Dir(p)); err != nil {
+		return fmt.Errorf("failed to create object %s: %v", objectKey, err)
+	}
+
+	suffix := make([]byte, 8)
+	rand.Read(suffix)
+	tmp := path.Join(path.Dir(p), sftpTempPrefix+hex.EncodeToString(suffix))
+	f, err := store.Client.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		return fmt.Errorf("failed to create object %s: %v", objectKey, err)
+	}
+	if _, err := f.ReadFrom(r); err != nil {
+		f.Close()
+		store.Client.Remove(tmp)
+		return fmt.Errorf("failed to write object %s: %v", objectKey, err)
+	}
+	if err := f.Close(); err != nil {
+		store.Client.Remove(tmp)
+		return fmt.Errorf("failed to write object %s: %v", objectKey, err)
+	}
+	if err := store.rename(tmp, p); err != nil {
+		store.Client.Remove(tmp)
+		return fmt.Errorf("failed to write object %s: %v", objectKey, err)
+	}
+	return nil
+}
+
+// rename 覆盖目标文件，优先使用 OpenSSH 的 posix-rename 扩展，保证读取方看不到中间状态
+func (store *SFTPStore) rename(oldname, newname string) error {
+	err := store.Client.PosixRename(oldname, newname)
+	if err == nil {
+		return nil
+	}
+	// 不支持扩展的服务器上，标准的 rename 不能覆盖已存在的文件
+	if rmErr := store.Client.Remove(newname); rmErr != nil && !isNotExist(rmErr) {
+		return err
+	}
+	return store.Client.Rename(oldname, newname)
+}
+
+func (store *SFTPStore) GetObject(bucketName, objectKey string, opts ...ObjectOption) (*Object, error) {
+	if err := checkSFTPEncryption("", newObjectOptions(opts)); err != nil {
+		return nil, err
+	}
+	p, info, err := store.stat(bucketName, objectKey)
+	if err != nil {
+		return nil, err
+	}
+	f, err := store.Client.Open(p)
+	if err != nil {
+		return nil, sftpObjectError(objectKey, err)
+	}
+
+	// 由调用者关闭 Data，sftp.File 支持 Seek，可以处理范围读取
+	return &Object{
+		Key:          objectKey,
+		Size:         info.Size(),
+		LastModified: info.ModTime(),
+		ContentType:  sftpContentType(objectKey),
+		ETag:         sftpETag(info),
+		Data:         f,
+	}, nil
+}
+
+func (store *SFTPStore) DeleteObject(bucketName, objectKey string) error {
+	if _, err := store.checkBucket(bucketName); err != nil {
+		return err
+	}
+	p, err := store.objectPath(bucketName, objectKey)
+	if err != nil {
+		return err
+	}
+	// 与 S3 一样，删除不存在的对象不是错误
+	if err := store.Client.Remove(p); err != nil && !isNotExist(err) {
+		return fmt.Errorf("failed to delete object %s: %v", objectKey, err)
+	}
+	return nil
+}
+
+// CopyObject 从服务器读出源对象再写入目标对象，SFTP 没有服务端复制
+func (store *SFTPStore) CopyObject(srcBucketName, srcObjectKey, destBucketName, destObjectKey string, opts ...ObjectOption) error {
+	o := newObjectOptions(opts)
+	if err := checkSFTPEncryption("", o); err != nil {
+		return err
+	}
+	if o.CopySourceSSECustomerKey != nil {
+		return s3err.ErrNotImplemented.WithMessage("customer-provided encryption keys are not supported")
+	}
+
+	p, _, err := store.stat(srcBucketName, srcObjectKey)
+	if err != nil {
+		return err
+	}
+	f, err := store.Client.Open(p)
+	if err != nil {
+		return sftpObjectError(srcObjectKey, err)
+	}
+	defer f.Close()
+	return store.write(destBucketName, destObjectKey, f)
+}
+
+// MoveObject 直接在服务器上重命名
+func (store *SFTPStore) MoveObject(srcBucketName, srcObjectKey, destBucketName, destObjectKey string) error {
+	src, _, err := store.stat(srcBucketName, srcObjectKey)
+	if err != nil {
+		return err
+	}
+	if _, err := store.checkBucket(destBucketName); err != nil {
+		return err
+	}
+	dst, err := store.objectPath(destBucketName, destObjectKey)
+	if err != nil {
+		return err
+	}
+	if err := store.Client.MkdirAll(path.Dir(dst)); err != nil {
+		return fmt.Errorf("failed to move object %s: %v", srcObjectKey, err)
+	}
+	if err := store.rename(src, dst); err != nil {
+		return fmt.Errorf("failed to move object %s to %s: %v", srcObjectKey, destObjectKey, err)
+	}
+	return nil
+}
+
+func (store *SFTPStore) HeadObject(bucketName, objectKey string, opts ...ObjectOption) (map[string]string, error) {
+	if err := checkSFTPEncryption("", newObjectOptions(opts)); err != nil {
+		return nil, err
+	}
+	_, info, err := store.stat(bucketName, objectKey)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{
+		"Size":         strconv.FormatInt(info.Size(), 10),
+		"LastModified": info.ModTime().UTC().Format(time.RFC3339),
+		"ContentType":  sftpContentType(objectKey),
+		"ETag":         sftpETag(info),
+	}, nil
+}
+
+// stat 返回对象的路径和文件信息，目录不是对象
+func (store *SFTPStore) stat(bucketName, objectKey string) (string, os.FileInfo, error) {
+	if _, err := store.checkBucket(bucketName); err != nil {
+		return "", nil, err
+	}
+	p, err := store.objectPath(bucketName, objectKey)
+	if err != nil {
+		return "", nil, err
+	}
+	info, err := store.Client.Stat(p)
+	if err != nil {
+		return "", nil, sftpObjectError(objectKey, err)
+	}
+	if !info.Mode().IsRegular() {
+		return "", nil, fmt.Errorf("object %s does not exist: %w", objectKey, s3err.ErrNoSuchKey)
+	}
+	return p, info, nil
+}
+
+// checkSFTPEncryption SFTP 后端不加密数据，拒绝所有加密请求
+func checkSFTPEncryption(algorithm string, o *ObjectOptions) error {
+	if o.SSECustomerKey != nil {
+		return s3err.ErrNotImplemented.WithMessage("customer-provided encryption keys are not supported")
+	}
+	if algorithm != "" {
+		return s3err.ErrNotImplemented.WithMessage("server-side encryption is not supported by the sftp backend")
+	}
+	return nil
+}
+
+// sftpETag 由修改时间和大小生成 ETag，格式与 MD5 不同，避免客户端拿它校验内容
+func sftpETag(info os.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, info.ModTime().Unix(), info.Size())
+}
+
+func sftpContentType(objectKey string) string {
+	if t := mime.TypeByExtension(path.Ext(objectKey)); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
+
+func sftpObjectError(objectKey string, err error) error {
+	if isNotExist(err) {
+		return fmt.Errorf("object %s does not exist: %w", objectKey, s3err.ErrNoSuchKey)
+	}
+	return fmt.Errorf("failed to get object %s: %v", objectKey, err)
+}
+
+func isNotExist(err error) bool {
+	var status *sftp.StatusError
+	if errors.As(err, &status) && status.FxCode() == sftp.ErrSSHFxNoSuchFile {
+		return true
+	}
+	return errors.Is(err, os.ErrNotExist)
+}
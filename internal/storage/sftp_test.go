@@ -0,0 +1,273 @@
+package storage
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Grey0520/s3proxy/internal/s3err"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// newTestSFTPServer 在本地启动一个只支持 sftp 子系统的 SSH 服务器，文件保存在临时目录
+// 返回服务器地址和服务器上的根目录
+func newTestSFTPServer(t *testing.T) (string, string) {
+	_, priv, _ := ed25519.GenerateKey(rand.Reader)
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			if c.User() == "s3proxy" && string(pass) == "secret" {
+				return nil, nil
+			}
+			return nil, errors.New("access denied")
+		},
+	}
+	config.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	root := t.TempDir()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveTestSFTP(conn, config, root)
+		}
+	}()
+	return listener.Addr().String(), root
+}
+
+func serveTestSFTP(conn net.Conn, config *ssh.ServerConfig, root string) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			for req := range requests {
+				ok := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if !ok {
+					continue
+				}
+				server, err := sftp.NewServer(channel, sftp.WithServerWorkingDirectory(root))
+				if err != nil {
+					channel.Close()
+					return
+				}
+				server.Serve()
+				channel.Close()
+			}
+		}()
+	}
+}
+
+func newTestSFTPStore(t *testing.T) (*SFTPStore, string) {
+	addr, root := newTestSFTPServer(t)
+	cfg, err := SFTPClientConfig("s3proxy", "secret", "", "", true)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	store, err := NewSFTPStore(addr, "data", cfg)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	if err := store.CreateBucket("bucket"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	return store, filepath.Join(root, "data")
+}
+
+func TestSFTPClientConfig(t *testing.T) {
+	if _, err := SFTPClientConfig("user", "", "", "", true); err == nil {
+		t.Errorf("Expected error without password or private key")
+	}
+	if _, err := SFTPClientConfig("user", "secret", "", "", false); err == nil {
+		t.Errorf("Expected error without known hosts")
+	}
+	if _, err := SFTPClientConfig("user", "", "/nonexistent/id_ed25519", "", true); err == nil {
+		t.Errorf("Expected error for missing private key")
+	}
+
+	addr, _ := newTestSFTPServer(t)
+	cfg, _ := SFTPClientConfig("s3proxy", "wrong", "", "", true)
+	if _, err := NewSFTPStore(addr, "", cfg); err == nil {
+		t.Errorf("Expected error for wrong password")
+	}
+}
+
+func TestSFTPStoreBuckets(t *testing.T) {
+	store, root := newTestSFTPStore(t)
+
+	if err := store.CreateBucket("bucket"); !errors.Is(err, s3err.ErrBucketAlreadyExists) {
+		t.Errorf("Expected BucketAlreadyExists, got %v", err)
+	}
+	store.CreateBucket("another")
+	os.Mkdir(filepath.Join(root, ".hidden"), 0755)
+
+	result, err := store.ListAllMyBuckets()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(result.Buckets.Bucket) != 2 || result.Buckets.Bucket[0].Name != "another" {
+		t.Errorf("Unexpected buckets %+v", result.Buckets.Bucket)
+	}
+	if _, err := store.GetBucketAcl("missing"); !errors.Is(err, s3err.ErrNoSuchBucket) {
+		t.Errorf("Expected NoSuchBucket, got %v", err)
+	}
+
+	putString(t, store, "bucket", "dir/key", "x")
+	if err := store.DeleteBucket("bucket"); !errors.Is(err, s3err.ErrBucketNotEmpty) {
+		t.Errorf("Expected BucketNotEmpty, got %v", err)
+	}
+	store.DeleteObject("bucket", "dir/key")
+	if err := store.DeleteBucket("bucket"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "bucket")); !os.IsNotExist(err) {
+		t.Errorf("Expected bucket directory to be removed, got %v", err)
+	}
+}
+
+func TestSFTPStoreObjects(t *testing.T) {
+	store, root := newTestSFTPStore(t)
+	store.CreateBucket("other")
+
+	if err := putString(t, store, "bucket", "dir/key.txt", "hello sftp"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := putString(t, store, "missing", "key", "x"); !errors.Is(err, s3err.ErrNoSuchBucket) {
+		t.Errorf("Expected NoSuchBucket, got %v", err)
+	}
+	data, _ := os.ReadFile(filepath.Join(root, "bucket", "dir", "key.txt"))
+	if string(data) != "hello sftp" {
+		t.Errorf("Unexpected file content %q", data)
+	}
+
+	obj, err := store.GetObject("bucket", "dir/key.txt")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	obj.Data.(io.Seeker).Seek(6, io.SeekStart)
+	data, _ = io.ReadAll(obj.Data)
+	obj.Data.Close()
+	if string(data) != "sftp" || obj.ContentType != "text/plain; charset=utf-8" || obj.Size != 10 {
+		t.Errorf("Unexpected object %q %+v", data, obj)
+	}
+
+	head, err := store.HeadObject("bucket", "dir/key.txt")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if head["Size"] != "10" || head["ETag"] != obj.ETag {
+		t.Errorf("Unexpected head result %v", head)
+	}
+	if _, err := store.HeadObject("bucket", "dir"); !errors.Is(err, s3err.ErrNoSuchKey) {
+		t.Errorf("Expected NoSuchKey for directory, got %v", err)
+	}
+
+	if err := store.CopyObject("bucket", "dir/key.txt", "bucket", "copy.txt"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := store.MoveObject("bucket", "dir/key.txt", "other", "a/moved.txt"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, err := store.GetObject("bucket", "dir/key.txt"); !errors.Is(err, s3err.ErrNoSuchKey) {
+		t.Errorf("Expected NoSuchKey, got %v", err)
+	}
+	result, err := store.ListBucket("other")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(result.Contents) != 1 || result.Contents[0].Key != "a/moved.txt" || result.Contents[0].Size != 10 {
+		t.Errorf("Unexpected listing %+v", result.Contents)
+	}
+
+	if err := store.DeleteObject("bucket", "missing"); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+	err = store.PutObject("bucket", "key", &Object{ServerSideEncryption: SSEAlgorithmAES256, Data: io.NopCloser(strings.NewReader("x"))})
+	if !errors.Is(err, s3err.ErrNotImplemented) {
+		t.Errorf("Expected NotImplemented, got %v", err)
+	}
+}
+
+type failingReader struct{ n int }
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if r.n <= 0 {
+		return 0, errors.New("connection reset")
+	}
+	n := copy(p, strings.Repeat("x", min(len(p), r.n)))
+	r.n -= n
+	return n, nil
+}
+
+func TestSFTPStoreAtomicPut(t *testing.T) {
+	store, root := newTestSFTPStore(t)
+
+	putString(t, store, "bucket", "key", "old content")
+	err := store.PutObject("bucket", "key", &Object{Data: io.NopCloser(&failingReader{n: 100})})
+	if err == nil {
+		t.Fatalf("Expected error from failing upload")
+	}
+
+	// 上传失败时原对象保持不变，也不留下临时文件
+	data, _ := os.ReadFile(filepath.Join(root, "bucket", "key"))
+	if string(data) != "old content" {
+		t.Errorf("Expected old content to survive, got %q", data)
+	}
+	entries, _ := os.ReadDir(filepath.Join(root, "bucket"))
+	if len(entries) != 1 {
+		t.Errorf("Expected no temporary files, got %v", entries)
+	}
+
+	if err := putString(t, store, "bucket", "key", "new"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	data, _ = os.ReadFile(filepath.Join(root, "bucket", "key"))
+	if string(data) != "new" {
+		t.Errorf("Expected overwritten content, got %q", data)
+	}
+}
+
+func TestSFTPStorePathTraversal(t *testing.T) {
+	store, _ := newTestSFTPStore(t)
+
+	for _, key := range []string{"../escape", "a/../../escape", "/abs", "a//b", sftpTempPrefix + "x"} {
+		if err := putString(t, store, "bucket", key, "x"); !errors.Is(err, s3err.ErrInvalidArgument) {
+			t.Errorf("Expected InvalidArgument for key %q, got %v", key, err)
+		}
+	}
+	for _, bucket := range []string{"..", "a/b", ".hidden"} {
+		if err := store.CreateBucket(bucket); !errors.Is(err, s3err.ErrInvalidBucketName) {
+			t.Errorf("Expected InvalidBucketName for bucket %q, got %v", bucket, err)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package storage
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// 服务端加密使用分块的 AES-256-GCM：明文按 sseChunkSize 切块，每块单独加密并带上认证标签，
+// 这样范围读取只需要解密覆盖到的块。块序号作为 nonce，最后一块在附加数据中打标记，
+// 可以发现块被调换或者文件被截断。
+const (
+	SSEAlgorithmAES256 = "AES256"
+
+	sseChunkSize  = 64 * 1024
+	sseTagSize    = 16
+	sseCipherSize = sseChunkSize + sseTagSize
+	sseKeySize    = 32
+)
+
+var errSSECorrupted = errors.New("encrypted object is corrupted")
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func sseChunkNonce(index int64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], uint64(index))
+	return nonce
+}
+
+func sseChunkAAD(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// ssePlaintextSize 根据密文长度计算明文长度
+func ssePlaintextSize(cipherSize int64) (int64, error) {
+	if cipherSize < sseTagSize {
+		return 0, errSSECorrupted
+	}
+	chunks := (cipherSize + sseCipherSize - 1) / sseCipherSize
+	last := cipherSize - (chunks-1)*sseCipherSize
+	if last < sseTagSize {
+		return 0, errSSECorrupted
+	}
+	return (chunks-1)*sseChunkSize + last - sseTagSize, nil
+}
+
+// newDataKey 生成一个随机的对象数据密钥
+func newDataKey() ([]byte, error) {
+	key := make([]byte, sseKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to generate data key: %v", err)
+	}
+	return key, nil
+}
+
+// wrapKey 用主密钥加密数据密钥，返回 base64(nonce || 密文)
+func wrapKey(masterKey, dataKey []byte) (string, error) {
+	aead, err := newGCM(masterKey)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %v", err)
+	}
+	sealed := aead.Seal(nonce, nonce, dataKey, nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// unwrapKey 是 wrapKey 的逆过程
+func unwrapKey(masterKey []byte, wrapped string) ([]byte, error) {
+	raw, err := base64.StdEncoding.DecodeString(wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("invalid wrapped key: %v", err)
+	}
+	aead, err := newGCM(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) < aead.NonceSize() {
+		return nil, fmt.Errorf("invalid wrapped key")
+	}
+	dataKey, err := aead.Open(nil, raw[:aead.NonceSize()], raw[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key, is the master key correct? %v", err)
+	}
+	return dataKey, nil
+}
+
+// encryptWriter 把写入的明文分块加密后写到下层 writer
+// Close 写出最后一块，但不会关闭下层 writer
+type encryptWriter struct {
+	w     io.Writer
+	aead  cipher.AEAD
+	buf   []byte
+	n     int
+	out   []byte
+	index int64
+}
+
+func newEncryptWriter(w io.Writer, key []byte) (*encryptWriter, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptWriter{
+		w:    w,
+		aead: aead,
+		buf:  make([]byte, sseChunkSize),
+		out:  make([]byte, 0, sseCipherSize),
+	}, nil
+}
+
+func (ew *encryptWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// 缓冲区满了并且还有数据，说明当前块不是最后一块
+		if ew.n == sseChunkSize {
+			if err := ew.flush(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(ew.buf[ew.n:], p)
+		ew.n += n
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (ew *encryptWriter) Close() error {
+	return ew.flush(true)
+}
+
+func (ew *encryptWriter) flush(last bool) error {
+	sealed := ew.aead.Seal(ew.out[:0], sseChunkNonce(ew.index), ew.buf[:ew.n], sseChunkAAD(last))
+	if _, err := ew.w.Write(sealed); err != nil {
+		return err
+	}
+	ew.index++
+	ew.n = 0
+	return nil
+}
+
+// decryptReader 解密 encryptWriter 写出的数据，支持 Seek，读取时只解密用到的块
+type decryptReader struct {
+	src    io.ReadSeekCloser
+	aead   cipher.AEAD
+	size   int64
+	chunks int64
+
+	offset int64
+	srcPos int64
+	chunk  []byte
+	cipher []byte
+	loaded int64
+}
+
+func newDecryptReader(src io.ReadSeekCloser, key []byte, cipherSize int64) (*decryptReader, error) {
+	size, err := ssePlaintextSize(cipherSize)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return &decryptReader{
+		src:    src,
+		aead:   aead,
+		size:   size,
+		chunks: (cipherSize + sseCipherSize - 1) / sseCipherSize,
+		cipher: make([]byte, sseCipherSize),
+		loaded: -1,
+	}, nil
+}
+
+// Size 返回明文长度
+func (r *decryptReader) Size() int64 {
+	return r.size
+}
+
+func (r *decryptReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	index := r.offset / sseChunkSize
+	if index != r.loaded {
+		if err := r.load(index); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.chunk[r.offset-index*sseChunkSize:])
+	r.offset += int64(n)
+	return n, nil
+}
+
+func (r *decryptReader) load(index int64) error {
+	pos := index * sseCipherSize
+	if pos != r.srcPos {
+		if _, err := r.src.Seek(pos, io.SeekStart); err != nil {
+			return err
+		}
+		r.srcPos = pos
+	}
+
+	last := index == r.chunks-1
+	length := sseCipherSize
+	if last {
+		length = int(r.size-index*sseChunkSize) + sseTagSize
+	}
+	n, err := io.ReadFull(r.src, r.cipher[:length])
+	r.srcPos += int64(n)
+	if err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return errSSECorrupted
+		}
+		return err
+	}
+
+	chunk, err := r.aead.Open(r.chunk[:0], sseChunkNonce(index), r.cipher[:length], sseChunkAAD(last))
+	if err != nil {
+		return errSSECorrupted
+	}
+	r.chunk = chunk
+	r.loaded = index
+	return nil
+}
+
+func (r *decryptReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative position %d", offset)
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+func (r *decryptReader) Close() error {
+	return r.src.Close()
+}
@@ -0,0 +1,121 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+)
+
+// nopSeekCloser 让 bytes.Reader 满足 io.ReadSeekCloser
+type nopSeekCloser struct {
+	*bytes.Reader
+}
+
+func (nopSeekCloser) Close() error { return nil }
+
+func encryptForTest(t *testing.T, key, plain []byte) []byte {
+	var buf bytes.Buffer
+	ew, err := newEncryptWriter(&buf, key)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, err := ew.Write(plain); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := ew.Close(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestSSERoundTrip(t *testing.T) {
+	key, _ := newDataKey()
+	for _, size := range []int{0, 1, sseChunkSize - 1, sseChunkSize, sseChunkSize + 1, 3*sseChunkSize + 17} {
+		plain := make([]byte, size)
+		rand.Read(plain)
+
+		sealed := encryptForTest(t, key, plain)
+		got, err := ssePlaintextSize(int64(len(sealed)))
+		if err != nil || got != int64(size) {
+			t.Fatalf("size %d: expected plaintext size %d, got %d (%v)", size, size, got, err)
+		}
+
+		dr, err := newDecryptReader(nopSeekCloser{bytes.NewReader(sealed)}, key, int64(len(sealed)))
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		out, err := io.ReadAll(dr)
+		if err != nil {
+			t.Fatalf("size %d: expected no error, got %v", size, err)
+		}
+		if !bytes.Equal(out, plain) {
+			t.Fatalf("size %d: decrypted data does not match", size)
+		}
+	}
+}
+
+func TestSSESeek(t *testing.T) {
+	key, _ := newDataKey()
+	plain := make([]byte, 5*sseChunkSize+100)
+	rand.Read(plain)
+	sealed := encryptForTest(t, key, plain)
+
+	dr, err := newDecryptReader(nopSeekCloser{bytes.NewReader(sealed)}, key, int64(len(sealed)))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	for _, r := range [][2]int64{{3*sseChunkSize - 10, 20}, {0, 5}, {int64(len(plain)) - 7, 7}, {sseChunkSize, sseChunkSize}} {
+		if _, err := dr.Seek(r[0], io.SeekStart); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		out := make([]byte, r[1])
+		if _, err := io.ReadFull(dr, out); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if !bytes.Equal(out, plain[r[0]:r[0]+r[1]]) {
+			t.Fatalf("range %v: decrypted data does not match", r)
+		}
+	}
+}
+
+func TestSSETamper(t *testing.T) {
+	key, _ := newDataKey()
+	plain := make([]byte, 2*sseChunkSize+1)
+	sealed := encryptForTest(t, key, plain)
+
+	// 截断到完整的块边界，最后一块的标记不对
+	truncated := sealed[:2*sseCipherSize]
+	dr, err := newDecryptReader(nopSeekCloser{bytes.NewReader(truncated)}, key, int64(len(truncated)))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, err := io.ReadAll(dr); err != errSSECorrupted {
+		t.Errorf("Expected errSSECorrupted for truncated object, got %v", err)
+	}
+
+	flipped := append([]byte(nil), sealed...)
+	flipped[10] ^= 1
+	dr, _ = newDecryptReader(nopSeekCloser{bytes.NewReader(flipped)}, key, int64(len(flipped)))
+	if _, err := io.ReadAll(dr); err != errSSECorrupted {
+		t.Errorf("Expected errSSECorrupted for modified object, got %v", err)
+	}
+}
+
+func TestWrapKey(t *testing.T) {
+	master, _ := newDataKey()
+	dataKey, _ := newDataKey()
+	wrapped, err := wrapKey(master, dataKey)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	got, err := unwrapKey(master, wrapped)
+	if err != nil || !bytes.Equal(got, dataKey) {
+		t.Fatalf("Expected unwrapped key to match, got %v", err)
+	}
+
+	other, _ := newDataKey()
+	if _, err := unwrapKey(other, wrapped); err == nil {
+		t.Error("Expected error when unwrapping with another master key")
+	}
+}
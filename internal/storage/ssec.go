@@ -0,0 +1,96 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+
+	"github.com/Grey0520/s3proxy/internal/s3err"
+)
+
+// SSECustomerKey 是客户端通过 SSE-C 请求头提供的密钥
+type SSECustomerKey struct {
+	Algorithm string
+	Key       []byte
+	// base64 编码的密钥 MD5，原样返回给客户端
+	KeyMD5 string
+}
+
+// ParseSSECustomerKey 校验 SSE-C 请求头，三个值都为空时返回 nil
+func ParseSSECustomerKey(algorithm, key, keyMD5 string) (*SSECustomerKey, error) {
+	if algorithm == "" && key == "" && keyMD5 == "" {
+		return nil, nil
+	}
+	if algorithm != SSEAlgorithmAES256 {
+		return nil, s3err.ErrInvalidArgument.WithMessage("The encryption algorithm specified is not valid, only AES256 is supported.")
+	}
+	raw, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(raw) != sseKeySize {
+		return nil, s3err.ErrInvalidArgument.WithMessage("The secret key was invalid for the specified algorithm.")
+	}
+	sum := md5.Sum(raw)
+	if keyMD5 != base64.StdEncoding.EncodeToString(sum[:]) {
+		return nil, s3err.ErrInvalidArgument.WithMessage("The calculated MD5 hash of the key did not match the hash that was provided.")
+	}
+	return &SSECustomerKey{
+		Algorithm: algorithm,
+		Key:       raw,
+		KeyMD5:    keyMD5,
+	}, nil
+}
+
+// ssecDerive 从客户密钥和盐派生出对象的数据密钥和用于校验密钥的 HMAC
+// 磁盘上只保存盐和 HMAC，无法由它们还原出客户密钥
+func ssecDerive(customerKey, salt []byte) (dataKey, keyHMAC []byte) {
+	mac := hmac.New(sha256.New, customerKey)
+	mac.Write([]byte("s3proxy-ssec-data:"))
+	mac.Write(salt)
+	dataKey = mac.Sum(nil)
+
+	mac = hmac.New(sha256.New, customerKey)
+	mac.Write([]byte("s3proxy-ssec-verify:"))
+	mac.Write(salt)
+	keyHMAC = mac.Sum(nil)
+	return dataKey, keyHMAC
+}
+
+func newSSECSalt() ([]byte, error) {
+	salt := make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %v", err)
+	}
+	return salt, nil
+}
+
+// ObjectOptions 是读写对象时的附加参数
+type ObjectOptions struct {
+	// 读写目标对象使用的 SSE-C 密钥
+	SSECustomerKey *SSECustomerKey
+	// CopyObject 读取源对象使用的 SSE-C 密钥
+	CopySourceSSECustomerKey *SSECustomerKey
+}
+
+type ObjectOption func(*ObjectOptions)
+
+func WithSSECustomerKey(key *SSECustomerKey) ObjectOption {
+	return func(o *ObjectOptions) {
+		o.SSECustomerKey = key
+	}
+}
+
+func WithCopySourceSSECustomerKey(key *SSECustomerKey) ObjectOption {
+	return func(o *ObjectOptions) {
+		o.CopySourceSSECustomerKey = key
+	}
+}
+
+func newObjectOptions(opts []ObjectOption) *ObjectOptions {
+	o := &ObjectOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
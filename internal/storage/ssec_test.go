@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Grey0520/s3proxy/internal/s3err"
+)
+
+func newTestCustomerKey(t *testing.T, b byte) *SSECustomerKey {
+	raw := bytes.Repeat([]byte{b}, sseKeySize)
+	sum := md5.Sum(raw)
+	key, err := ParseSSECustomerKey(SSEAlgorithmAES256, base64.StdEncoding.EncodeToString(raw), base64.StdEncoding.EncodeToString(sum[:]))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	return key
+}
+
+func TestParseSSECustomerKey(t *testing.T) {
+	if key, err := ParseSSECustomerKey("", "", ""); key != nil || err != nil {
+		t.Errorf("Expected nil key without headers, got %v %v", key, err)
+	}
+
+	raw := bytes.Repeat([]byte{1}, sseKeySize)
+	encoded := base64.StdEncoding.EncodeToString(raw)
+	sum := md5.Sum(raw)
+	keyMD5 := base64.StdEncoding.EncodeToString(sum[:])
+
+	tests := []struct {
+		algorithm, key, keyMD5 string
+	}{
+		{"aws:kms", encoded, keyMD5},
+		{SSEAlgorithmAES256, base64.StdEncoding.EncodeToString(raw[:16]), keyMD5},
+		{SSEAlgorithmAES256, encoded, base64.StdEncoding.EncodeToString(raw[:16])},
+		{SSEAlgorithmAES256, "", ""},
+	}
+	for _, tt := range tests {
+		if _, err := ParseSSECustomerKey(tt.algorithm, tt.key, tt.keyMD5); !errors.Is(err, s3err.ErrInvalidArgument) {
+			t.Errorf("Expected InvalidArgument for %+v, got %v", tt, err)
+		}
+	}
+}
+
+func TestLFSStoreSSECustomerKey(t *testing.T) {
+	store, _ := NewLFSStore(t.TempDir())
+	store.CreateBucket("bucket")
+	key := newTestCustomerKey(t, 1)
+
+	err := store.PutObject("bucket", "key", &Object{
+		Data: io.NopCloser(bytes.NewReader([]byte("customer secret"))),
+	}, WithSSECustomerKey(key))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// 磁盘上既没有明文也没有客户密钥
+	raw, _ := os.ReadFile(filepath.Join(store.basePath, "bucket", "key"))
+	attrs, _ := os.ReadFile(filepath.Join(store.basePath, "bucket", "key.attrs"))
+	if bytes.Contains(raw, []byte("customer secret")) {
+		t.Error("Expected object to be encrypted on disk")
+	}
+	if strings.Contains(string(attrs), base64.StdEncoding.EncodeToString(key.Key)) || strings.Contains(string(attrs), key.KeyMD5) {
+		t.Error("Expected customer key not to be persisted")
+	}
+
+	if _, err := store.GetObject("bucket", "key"); !errors.Is(err, s3err.ErrInvalidRequest) {
+		t.Errorf("Expected InvalidRequest without key, got %v", err)
+	}
+	if _, err := store.GetObject("bucket", "key", WithSSECustomerKey(newTestCustomerKey(t, 2))); !errors.Is(err, s3err.ErrAccessDenied) {
+		t.Errorf("Expected AccessDenied with wrong key, got %v", err)
+	}
+	if _, err := store.HeadObject("bucket", "key"); !errors.Is(err, s3err.ErrInvalidRequest) {
+		t.Errorf("Expected InvalidRequest for HEAD without key, got %v", err)
+	}
+
+	obj, err := store.GetObject("bucket", "key", WithSSECustomerKey(key))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	data, _ := io.ReadAll(obj.Data)
+	obj.Data.Close()
+	if string(data) != "customer secret" || obj.SSECustomerKeyMD5 != key.KeyMD5 {
+		t.Errorf("Unexpected object %q, key MD5 %q", data, obj.SSECustomerKeyMD5)
+	}
+
+	head, err := store.HeadObject("bucket", "key", WithSSECustomerKey(key))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if head["Size"] != "15" || head["SSECustomerAlgorithm"] != SSEAlgorithmAES256 {
+		t.Errorf("Unexpected head result %v", head)
+	}
+
+	// 复制时用新密钥重新加密
+	newKey := newTestCustomerKey(t, 3)
+	if err := store.CopyObject("bucket", "key", "bucket", "copy", WithSSECustomerKey(newKey)); !errors.Is(err, s3err.ErrInvalidRequest) {
+		t.Errorf("Expected InvalidRequest without copy source key, got %v", err)
+	}
+	if err := store.CopyObject("bucket", "key", "bucket", "copy", WithSSECustomerKey(newKey), WithCopySourceSSECustomerKey(key)); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	obj, err = store.GetObject("bucket", "copy", WithSSECustomerKey(newKey))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	data, _ = io.ReadAll(obj.Data)
+	obj.Data.Close()
+	if string(data) != "customer secret" {
+		t.Errorf("Unexpected copied object %q", data)
+	}
+
+	// 未加密的对象不接受 SSE-C 参数
+	store.PutObject("bucket", "plain", &Object{Data: io.NopCloser(bytes.NewReader([]byte("plain")))})
+	if _, err := store.GetObject("bucket", "plain", WithSSECustomerKey(key)); !errors.Is(err, s3err.ErrInvalidRequest) {
+		t.Errorf("Expected InvalidRequest for unencrypted object, got %v", err)
+	}
+}
@@ -1,30 +1,301 @@
 package storage
 
-import "github.com/Grey0520/s3proxy/internal/config"
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/Grey0520/s3proxy/internal/config"
+	"github.com/Grey0520/s3proxy/internal/s3err"
+)
 
 type StorageProvider interface {
 	CreateBucket(bucketName string) error
 	DeleteBucket(bucketName string) error
-	ListBucket(bucketName string) (*ListBucketResult, error)
+	ListBucket(bucketName string, opts ...ListOption) (*ListBucketResult, error)
 	ListAllMyBuckets() (*ListAllMyBucketsResult, error)
 	GetBucketAcl(bucketName string) (*AccessControlPolicy, error)
 
-	PutObject(bucketName, objectKey string, data *Object) error
-	GetObject(bucketName, objectKey string) (*Object, error)
+	PutObject(bucketName, objectKey string, data *Object, opts ...ObjectOption) error
+	GetObject(bucketName, objectKey string, opts ...ObjectOption) (*Object, error)
 	DeleteObject(bucketName, objectKey string) error
 	// ListObjects(bucketName string, prefix string, recursive bool) ([]*Object, error)
-	CopyObject(srcBucketName, srcObjectKey, destBucketName, destObjectKey string) error
+	CopyObject(srcBucketName, srcObjectKey, destBucketName, destObjectKey string, opts ...ObjectOption) error
 	MoveObject(srcBucketName, srcObjectKey, destBucketName, destObjectKey string) error
-	HeadObject(bucketName, objectKey string) (map[string]string, error)
+	HeadObject(bucketName, objectKey string, opts ...ObjectOption) (map[string]string, error)
+}
+
+// BucketEncryptionConfigurer 由支持存储桶默认加密的后端实现
+type BucketEncryptionConfigurer interface {
+	PutBucketEncryption(bucketName string, cfg *ServerSideEncryptionConfiguration) error
+	GetBucketEncryption(bucketName string) (*ServerSideEncryptionConfiguration, error)
+	DeleteBucketEncryption(bucketName string) error
+}
+
+// encryptionConfigurer 返回支持默认加密的后端，不支持时返回 NotImplemented
+func encryptionConfigurer(p StorageProvider) (BucketEncryptionConfigurer, error) {
+	configurer, ok := p.(BucketEncryptionConfigurer)
+	if !ok {
+		return nil, s3err.ErrNotImplemented.WithMessage("bucket encryption is not supported by this backend")
+	}
+	return configurer, nil
+}
+
+// WalkProviders 对 p 以及 CacheStore、Router、MirrorStore 和 TieredStore 下层的每个后端调用 fn，每个后端只调用一次
+// name 为后端名称，Router 的后端使用路由中的名称，镜像和分层的下层后端加上 .primary、.secondary、.hot 和 .cold 后缀
+// CacheStore 与它缓存的后端使用相同的名称
+func WalkProviders(p StorageProvider, fn func(name string, p StorageProvider)) {
+	walkProviders(DefaultBackend, p, fn, make(map[StorageProvider]bool))
+}
+
+func walkProviders(name string, p StorageProvider, fn func(name string, p StorageProvider), seen map[StorageProvider]bool) {
+	if p == nil || seen[p] {
+		return
+	}
+	seen[p] = true
+	fn(name, p)
+	switch s := p.(type) {
+	case *CacheStore:
+		walkProviders(name, s.StorageProvider, fn, seen)
+	case *Router:
+		names := make([]string, 0, len(s.backends))
+		for n := range s.backends {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		for _, n := range names {
+			walkProviders(n, s.backends[n], fn, seen)
+		}
+	case *MirrorStore:
+		walkProviders(name+".primary", s.Primary, fn, seen)
+		walkProviders(name+".secondary", s.Secondary, fn, seen)
+	case *TieredStore:
+		walkProviders(name+".hot", s.Hot, fn, seen)
+		walkProviders(name+".cold", s.Cold, fn, seen)
+	}
+}
+
+// NewStorageProvider 根据配置创建后端，配置了 routes 时返回按存储桶路由的 Router
+// local 追加到每个本地存储的选项之后，供 fsck 这样的离线命令使用
+func NewStorageProvider(cfg config.Config, local ...LFSOption) (StorageProvider, error) {
+	b := &providerBuilder{
+		cfg:      cfg,
+		local:    local,
+		built:    make(map[string]StorageProvider),
+		building: make(map[string]bool),
+	}
+	p, err := b.provider()
+	// 只为检查配置而创建的后端，以及出错之前创建的后端，不会再被使用，释放它们的文件锁和后台任务
+	b.release(p)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (b *providerBuilder) provider() (StorageProvider, error) {
+	cfg := b.cfg
+	// 没有被路由或组合后端引用的后端也要创建，以免配置错误被忽略
+	for _, backend := range cfg.Backends {
+		if _, err := b.named(backend.Name); err != nil {
+			return nil, err
+		}
+	}
+	if len(cfg.Routes) == 0 {
+		return b.build(cfg.Cloud)
+	}
+
+	router := NewRouter(DefaultBackend)
+	if cfg.Cloud.Provider != "" {
+		backend, err := b.named(DefaultBackend)
+		if err != nil {
+			return nil, err
+		}
+		router.AddBackend(DefaultBackend, backend)
+	}
+	for _, r := range cfg.Routes {
+		if _, ok := router.backends[r.Backend]; !ok {
+			backend, err := b.named(r.Backend)
+			if err != nil {
+				return nil, err
+			}
+			router.AddBackend(r.Backend, backend)
+		}
+		if err := router.AddRoute(r.Bucket, r.Match, r.Backend); err != nil {
+			return nil, err
+		}
+	}
+	return router, nil
+}
+
+// providerBuilder 按名称创建 backends 中的后端，同一个后端只创建一次
+// mirror 这样的组合后端通过名称引用其他后端
+type providerBuilder struct {
+	cfg      config.Config
+	local    []LFSOption
+	built    map[string]StorageProvider
+	building map[string]bool
+}
+
+// release 关闭已经创建、但不在 p 中使用的后端，p 为 nil 时关闭所有已经创建的后端
+func (b *providerBuilder) release(p StorageProvider) {
+	used := make(map[StorageProvider]bool)
+	if p != nil {
+		WalkProviders(p, func(_ string, p StorageProvider) { used[p] = true })
+	}
+	for _, name := range sortedKeys(b.built) {
+		WalkProviders(b.built[name], func(_ string, p StorageProvider) {
+			if c, ok := p.(io.Closer); ok && !used[p] {
+				used[p] = true
+				c.Close()
+			}
+		})
+	}
+}
+
+// named 返回名为 name 的后端，default 对应 cloud
+func (b *providerBuilder) named(name string) (StorageProvider, error) {
+	if p, ok := b.built[name]; ok {
+		return p, nil
+	}
+	if b.building[name] {
+		return nil, fmt.Errorf("backend %s refers to itself", name)
+	}
+
+	var cfg *config.CloudsConfig
+	if name == DefaultBackend && b.cfg.Cloud.Provider != "" {
+		cfg = &b.cfg.Cloud
+	}
+	for i := range b.cfg.Backends {
+		if b.cfg.Backends[i].Name == name {
+			cfg = &b.cfg.Backends[i].CloudsConfig
+		}
+	}
+	if cfg == nil {
+		return nil, fmt.Errorf("unknown backend %s", name)
+	}
+
+	b.building[name] = true
+	p, err := b.build(*cfg)
+	delete(b.building, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create backend %s: %v", name, err)
+	}
+	if p == nil {
+		return nil, fmt.Errorf("unsupported provider %s for backend %s", cfg.Provider, name)
+	}
+	b.built[name] = p
+	return p, nil
+}
+
+func (b *providerBuilder) build(cfg config.CloudsConfig) (StorageProvider, error) {
+	var p StorageProvider
+	var err error
+	switch cfg.Provider {
+	case "mirror":
+		p, err = b.mirror(cfg.Mirror)
+	case "tiering":
+		p, err = b.tiering(cfg.Tiering)
+	default:
+		p, err = newProvider(cfg, b.local...)
+	}
+	if err != nil || p == nil || cfg.Cache.Dir == "" {
+		return p, err
+	}
+	return NewCacheStore(p, cfg.Cache.Dir, cfg.Cache.MaxSize, cfg.Cache.Revalidate)
+}
+
+func (b *providerBuilder) mirror(cfg config.MirrorConfig) (StorageProvider, error) {
+	primary, err := b.named(cfg.Primary)
+	if err != nil {
+		return nil, err
+	}
+	secondary, err := b.named(cfg.Secondary)
+	if err != nil {
+		return nil, err
+	}
+	return NewMirrorStore(primary, secondary, cfg)
+}
+
+func (b *providerBuilder) tiering(cfg config.TieringConfig) (StorageProvider, error) {
+	hot, err := b.named(cfg.Hot)
+	if err != nil {
+		return nil, err
+	}
+	cold, err := b.named(cfg.Cold)
+	if err != nil {
+		return nil, err
+	}
+	return NewTieredStore(hot, cold, cfg)
 }
 
-func NewStorageProvider(cfg config.Config) (StorageProvider, error) {
-	// Stub
-	switch cfg.Cloud.Provider {
+func newProvider(cfg config.CloudsConfig, local ...LFSOption) (StorageProvider, error) {
+	switch cfg.Provider {
 	case "aws":
-		return NewAWSStore(cfg.Cloud.Identity, cfg.Cloud.Key, cfg.Cloud.Region)
+		opts := []AWSOption{
+			WithPathStyle(cfg.S3.PathStyle),
+			WithDisableSSL(cfg.S3.DisableSSL),
+			WithSignatureVersion(cfg.S3.SignatureVersion),
+		}
+		if cfg.Endpoint != "" {
+			opts = append(opts, WithEndpoint(cfg.Endpoint))
+		}
+		if cfg.S3.CABundle != "" {
+			opts = append(opts, WithCABundle(cfg.S3.CABundle))
+		}
+		return NewAWSStore(cfg.Identity, cfg.Key, cfg.Region, opts...)
+	case "gcs":
+		// Credential 为服务账号 JSON 或其路径，Appid 为项目 ID
+		return NewGCSStore(cfg.Credential, cfg.Appid)
+	case "azure":
+		// Identity 和 Key 为存储账户名和账户密钥
+		return NewAzureStore(cfg.Identity, cfg.Key, cfg.Endpoint)
+	case "sftp":
+		c := cfg.SFTP
+		clientConfig, err := SFTPClientConfig(cfg.Identity, cfg.Key, cfg.Credential, c.KnownHosts, c.InsecureIgnoreHostKey)
+		if err != nil {
+			return nil, err
+		}
+		return NewSFTPStore(cfg.Endpoint, c.Root, clientConfig)
+	case "memory":
+		return NewMemoryStore(cfg.Memory.MaxSize)
 	case "local":
-		return NewLFSStore(cfg.Cloud.Filesystem.Basedir)
+		if fs := cfg.Filesystem; len(fs.Dirs) > 0 {
+			if fs.Encryption.MasterKey.Raw() != "" || fs.Compression.Algorithm != "" || fs.Dedup.Enabled || fs.Index.Enabled || fs.Scrub.Interval > 0 || fs.Watch.Enabled {
+				return nil, fmt.Errorf("encryption, compression, dedup, index, scrub and watch are not supported with multiple data directories")
+			}
+			var opts []ErasureOption
+			if c := fs.Space; c.MinFreeBytes > 0 || c.MinFreeInodes > 0 {
+				opts = append(opts, WithErasureSpaceGuard(c.MinFreeBytes, c.MinFreeInodes, c.Interval))
+			}
+			return NewErasureStore(fs.Dirs, fs.Erasure.DataShards, fs.Erasure.ParityShards, opts...)
+		}
+		var opts []LFSOption
+		if key := cfg.Filesystem.Encryption.MasterKey.Raw(); key != "" {
+			opts = append(opts, WithMasterKey(key))
+		}
+		if c := cfg.Filesystem.Compression; c.Algorithm != "" {
+			opts = append(opts, WithCompression(c.Algorithm, c.Buckets, c.ContentTypes))
+		}
+		if c := cfg.Filesystem.Dedup; c.Enabled {
+			opts = append(opts, WithDedup(c.GCInterval))
+		}
+		if cfg.Filesystem.Index.Enabled {
+			opts = append(opts, WithIndex())
+		}
+		if c := cfg.Filesystem.Scrub; c.Interval > 0 || c.Quarantine {
+			opts = append(opts, WithScrub(c.Interval, c.Quarantine))
+		}
+		if c := cfg.Filesystem.Watch; c.Enabled {
+			opts = append(opts, WithWatch(c.Interval, nil))
+		}
+		if c := cfg.Filesystem.Space; c.MinFreeBytes > 0 || c.MinFreeInodes > 0 {
+			opts = append(opts, WithSpaceGuard(c.MinFreeBytes, c.MinFreeInodes, c.Interval))
+		}
+		if d := cfg.Filesystem.Durability; d != "" {
+			opts = append(opts, WithDurability(d))
+		}
+		return NewLFSStore(cfg.Filesystem.Basedir, append(opts, local...)...)
 	default:
 		return nil, nil
 	}
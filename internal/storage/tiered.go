@@ -0,0 +1,474 @@
+package storage
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Grey0520/s3proxy/internal/config"
+	"github.com/Grey0520/s3proxy/internal/s3err"
+)
+
+// TieredStore 把新对象写入 hot，满足策略的旧对象由后台任务移到 cold
+//
+// 移走的对象在 stateDir 中留下一条记录（stub），记录对象原来的大小、ETag 等信息，
+// 读取、列举时根据记录透明地访问 cold，列举结果的 StorageClass 表示对象实际所在的层
+type TieredStore struct {
+	Hot  StorageProvider
+	Cold StorageProvider
+
+	maxAge    time.Duration
+	maxIdle   time.Duration
+	coldClass string
+	stateDir  string
+
+	mu sync.Mutex
+	// bucket -> key -> stub
+	stubs map[string]map[string]*tierStub
+	// 对象最后一次被读取的时间，只保存在内存中，重启后以修改时间为准
+	accessed map[string]time.Time
+
+	// 同一个对象的写入和移动互斥
+	locks [64]sync.Mutex
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// tierStub 是移到 cold 的对象的记录
+type tierStub struct {
+	Bucket       string    `json:"bucket"`
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	ETag         string    `json:"etag"`
+	ContentType  string    `json:"contentType"`
+	LastModified time.Time `json:"lastModified"`
+}
+
+func (s *tierStub) name() string {
+	sum := sha1.Sum([]byte(s.Bucket + "\x00" + s.Key))
+	return hex.EncodeToString(sum[:]) + ".json"
+}
+
+// NewTieredStore 创建 tiering 后端，cfg.Interval 大于 0 时启动后台任务
+func NewTieredStore(hot, cold StorageProvider, cfg config.TieringConfig) (*TieredStore, error) {
+	if hot == nil || cold == nil {
+		return nil, fmt.Errorf("tiering requires a hot and a cold backend")
+	}
+	if cfg.StateDir == "" {
+		return nil, fmt.Errorf("tiering state directory is required")
+	}
+	if err := os.MkdirAll(cfg.StateDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create tiering state directory: %v", err)
+	}
+	coldClass := cfg.ColdStorageClass
+	if coldClass == "" {
+		coldClass = "STANDARD_IA"
+	}
+
+	t := &TieredStore{
+		Hot:       hot,
+		Cold:      cold,
+		maxAge:    cfg.MaxAge,
+		maxIdle:   cfg.MaxIdle,
+		coldClass: coldClass,
+		stateDir:  cfg.StateDir,
+		stubs:     make(map[string]map[string]*tierStub),
+		accessed:  make(map[string]time.Time),
+		done:      make(chan struct{}),
+	}
+	if err := t.load(); err != nil {
+		return nil, err
+	}
+	if cfg.Interval > 0 && (cfg.MaxAge > 0 || cfg.MaxIdle > 0) {
+		go t.run(cfg.Interval)
+	}
+	return t, nil
+}
+
+func (t *TieredStore) load() error {
+	files, err := filepath.Glob(filepath.Join(t.stateDir, "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("failed to read tiering state: %v", err)
+		}
+		stub := &tierStub{}
+		if err := json.Unmarshal(data, stub); err != nil {
+			return fmt.Errorf("invalid tiering state %s: %v", file, err)
+		}
+		t.setStub(stub)
+	}
+	return nil
+}
+
+// Close 停止后台任务
+func (t *TieredStore) Close() error {
+	t.closeOnce.Do(func() { close(t.done) })
+	return nil
+}
+
+func (t *TieredStore) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.done:
+			return
+		case <-ticker.C:
+		}
+		if _, err := t.Demote(time.Now()); err != nil {
+			log.Printf("tiering: %v", err)
+		}
+	}
+}
+
+func (t *TieredStore) lock(bucketName, objectKey string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(bucketName + "\x00" + objectKey))
+	return &t.locks[h.Sum32()%uint32(len(t.locks))]
+}
+
+func (t *TieredStore) stub(bucketName, objectKey string) *tierStub {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.stubs[bucketName][objectKey]
+}
+
+// setStub 只更新内存中的记录
+func (t *TieredStore) setStub(stub *tierStub) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stubs[stub.Bucket] == nil {
+		t.stubs[stub.Bucket] = make(map[string]*tierStub)
+	}
+	t.stubs[stub.Bucket][stub.Key] = stub
+}
+
+func (t *TieredStore) saveStub(stub *tierStub) error {
+	data, _ := json.Marshal(stub)
+	file := filepath.Join(t.stateDir, stub.name())
+	if err := os.WriteFile(file+".tmp", data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(file+".tmp", file); err != nil {
+		return err
+	}
+	t.setStub(stub)
+	return nil
+}
+
+// removeStub 删除记录和 cold 中的对象，对象不在 cold 时什么也不做
+func (t *TieredStore) removeStub(bucketName, objectKey string) error {
+	stub := t.stub(bucketName, objectKey)
+	if stub == nil {
+		return nil
+	}
+	if err := t.Cold.DeleteObject(bucketName, objectKey); err != nil && !errors.Is(err, s3err.ErrNoSuchKey) {
+		return err
+	}
+	if err := os.Remove(filepath.Join(t.stateDir, stub.name())); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	t.mu.Lock()
+	delete(t.stubs[bucketName], objectKey)
+	t.mu.Unlock()
+	return nil
+}
+
+func (t *TieredStore) touch(bucketName, objectKey string) {
+	t.mu.Lock()
+	t.accessed[bucketName+"\x00"+objectKey] = time.Now()
+	t.mu.Unlock()
+}
+
+// Demote 把满足策略的对象从 hot 移到 cold，返回移动的对象数
+func (t *TieredStore) Demote(now time.Time) (int, error) {
+	buckets, err := t.Hot.ListAllMyBuckets()
+	if err != nil {
+		return 0, fmt.Errorf("failed to list buckets: %v", err)
+	}
+	moved := 0
+	for _, b := range buckets.Buckets.Bucket {
+		result, err := t.Hot.ListBucket(b.Name)
+		if err != nil {
+			return moved, fmt.Errorf("failed to list bucket %s: %v", b.Name, err)
+		}
+		for _, c := range result.Contents {
+			if !t.expired(b.Name, c, now) {
+				continue
+			}
+			if err := t.demote(b.Name, c.Key); err != nil {
+				log.Printf("tiering: failed to demote %s/%s: %v", b.Name, c.Key, err)
+				continue
+			}
+			moved++
+		}
+	}
+	return moved, nil
+}
+
+func (t *TieredStore) expired(bucketName string, c Content, now time.Time) bool {
+	if t.maxAge > 0 && now.Sub(c.LastModified) >= t.maxAge {
+		return true
+	}
+	if t.maxIdle > 0 {
+		t.mu.Lock()
+		last, ok := t.accessed[bucketName+"\x00"+c.Key]
+		t.mu.Unlock()
+		if !ok || last.Before(c.LastModified) {
+			last = c.LastModified
+		}
+		return now.Sub(last) >= t.maxIdle
+	}
+	return false
+}
+
+// demote 复制到 cold，写入记录后再删除 hot 中的对象
+func (t *TieredStore) demote(bucketName, objectKey string) error {
+	l := t.lock(bucketName, objectKey)
+	l.Lock()
+	defer l.Unlock()
+
+	obj, err := t.Hot.GetObject(bucketName, objectKey)
+	if err != nil {
+		return err
+	}
+	defer obj.Data.Close()
+	// SSE-C 对象没有密钥无法读取，这里只是防御
+	if obj.SSECustomerAlgorithm != "" {
+		return fmt.Errorf("object %s is encrypted with a customer-provided key", objectKey)
+	}
+
+	if err := t.Cold.CreateBucket(bucketName); err != nil &&
+		!errors.Is(err, s3err.ErrBucketAlreadyExists) && !errors.Is(err, s3err.ErrBucketAlreadyOwnedByYou) {
+		return err
+	}
+	// cold 不支持对象的加密方式时 PutObject 失败，对象留在 hot
+	err = t.Cold.PutObject(bucketName, objectKey, &Object{
+		Key:                  objectKey,
+		Size:                 obj.Size,
+		ContentType:          obj.ContentType,
+		Data:                 obj.Data,
+		ServerSideEncryption: obj.ServerSideEncryption,
+	})
+	if err != nil {
+		return err
+	}
+
+	stub := &tierStub{
+		Bucket:       bucketName,
+		Key:          objectKey,
+		Size:         obj.Size,
+		ETag:         obj.ETag,
+		ContentType:  obj.ContentType,
+		LastModified: obj.LastModified,
+	}
+	if err := t.saveStub(stub); err != nil {
+		return err
+	}
+	return t.Hot.DeleteObject(bucketName, objectKey)
+}
+
+func (t *TieredStore) CreateBucket(bucketName string) error {
+	if err := t.Hot.CreateBucket(bucketName); err != nil {
+		return err
+	}
+	// cold 中的存储桶在第一次移动对象时创建
+	return nil
+}
+
+func (t *TieredStore) DeleteBucket(bucketName string) error {
+	t.mu.Lock()
+	n := len(t.stubs[bucketName])
+	t.mu.Unlock()
+	if n > 0 {
+		return fmt.Errorf("bucket %s is not empty: %w", bucketName, s3err.ErrBucketNotEmpty)
+	}
+	if err := t.Hot.DeleteBucket(bucketName); err != nil {
+		return err
+	}
+	if err := t.Cold.DeleteBucket(bucketName); err != nil && !errors.Is(err, s3err.ErrNoSuchBucket) {
+		log.Printf("tiering: failed to delete cold bucket %s: %v", bucketName, err)
+	}
+	return nil
+}
+
+// ListBucket 合并 hot 中的对象和移到 cold 的对象
+func (t *TieredStore) ListBucket(bucketName string, opts ...ListOption) (*ListBucketResult, error) {
+	// 两层的结果合并之后才能截断，热存储中不限制数量
+	o := newListOptions(opts)
+	result, err := t.Hot.ListBucket(bucketName, WithPrefix(o.Prefix), WithMarker(o.Marker))
+	if err != nil {
+		return nil, err
+	}
+
+	t.mu.Lock()
+	stubs := make([]*tierStub, 0, len(t.stubs[bucketName]))
+	for _, stub := range t.stubs[bucketName] {
+		stubs = append(stubs, stub)
+	}
+	t.mu.Unlock()
+	if len(stubs) == 0 {
+		return o.paginate(result), nil
+	}
+
+	owner := newFakeOwner()
+	if len(result.Contents) > 0 {
+		owner = result.Contents[0].Owner
+	}
+	for _, stub := range stubs {
+		result.Contents = append(result.Contents, Content{
+			Key:          stub.Key,
+			LastModified: stub.LastModified,
+			ETag:         stub.ETag,
+			Size:         stub.Size,
+			StorageClass: t.coldClass,
+			Owner:        owner,
+		})
+	}
+	return o.paginate(result), nil
+}
+
+func (t *TieredStore) ListAllMyBuckets() (*ListAllMyBucketsResult, error) {
+	return t.Hot.ListAllMyBuckets()
+}
+
+func (t *TieredStore) GetBucketAcl(bucketName string) (*AccessControlPolicy, error) {
+	return t.Hot.GetBucketAcl(bucketName)
+}
+
+func (t *TieredStore) PutObject(bucketName, objectKey string, data *Object, opts ...ObjectOption) error {
+	l := t.lock(bucketName, objectKey)
+	l.Lock()
+	defer l.Unlock()
+
+	if err := t.Hot.PutObject(bucketName, objectKey, data, opts...); err != nil {
+		return err
+	}
+	return t.removeStub(bucketName, objectKey)
+}
+
+func (t *TieredStore) GetObject(bucketName, objectKey string, opts ...ObjectOption) (*Object, error) {
+	if t.stub(bucketName, objectKey) == nil {
+		obj, err := t.Hot.GetObject(bucketName, objectKey, opts...)
+		if err == nil {
+			t.touch(bucketName, objectKey)
+			return obj, nil
+		}
+		// 读取时对象可能刚好被移走
+		if !errors.Is(err, s3err.ErrNoSuchKey) || t.stub(bucketName, objectKey) == nil {
+			return nil, err
+		}
+	}
+	return t.getCold(bucketName, objectKey, opts...)
+}
+
+func (t *TieredStore) getCold(bucketName, objectKey string, opts ...ObjectOption) (*Object, error) {
+	stub := t.stub(bucketName, objectKey)
+	if stub == nil {
+		return nil, fmt.Errorf("object %s does not exist: %w", objectKey, s3err.ErrNoSuchKey)
+	}
+	obj, err := t.Cold.GetObject(bucketName, objectKey, opts...)
+	if err != nil {
+		return nil, err
+	}
+	t.touch(bucketName, objectKey)
+	// 使用对象在 hot 中的元数据，cold 生成的 ETag 可能不同
+	obj.Size = stub.Size
+	obj.ETag = stub.ETag
+	obj.ContentType = stub.ContentType
+	obj.LastModified = stub.LastModified
+	return obj, nil
+}
+
+func (t *TieredStore) DeleteObject(bucketName, objectKey string) error {
+	l := t.lock(bucketName, objectKey)
+	l.Lock()
+	defer l.Unlock()
+
+	if err := t.removeStub(bucketName, objectKey); err != nil {
+		return err
+	}
+	return t.Hot.DeleteObject(bucketName, objectKey)
+}
+
+// CopyObject 总是把目标对象写入 hot
+func (t *TieredStore) CopyObject(srcBucketName, srcObjectKey, destBucketName, destObjectKey string, opts ...ObjectOption) error {
+	l := t.lock(destBucketName, destObjectKey)
+	l.Lock()
+	defer l.Unlock()
+
+	if t.stub(srcBucketName, srcObjectKey) == nil {
+		if err := t.Hot.CopyObject(srcBucketName, srcObjectKey, destBucketName, destObjectKey, opts...); err != nil {
+			return err
+		}
+	} else {
+		obj, err := t.GetObject(srcBucketName, srcObjectKey, WithSSECustomerKey(newObjectOptions(opts).CopySourceSSECustomerKey))
+		if err != nil {
+			return err
+		}
+		defer obj.Data.Close()
+		err = t.Hot.PutObject(destBucketName, destObjectKey, &Object{
+			Key:         destObjectKey,
+			Size:        obj.Size,
+			ContentType: obj.ContentType,
+			Data:        obj.Data,
+		}, WithSSECustomerKey(newObjectOptions(opts).SSECustomerKey))
+		if err != nil {
+			return err
+		}
+	}
+	return t.removeStub(destBucketName, destObjectKey)
+}
+
+func (t *TieredStore) MoveObject(srcBucketName, srcObjectKey, destBucketName, destObjectKey string) error {
+	if t.stub(srcBucketName, srcObjectKey) == nil {
+		l := t.lock(destBucketName, destObjectKey)
+		l.Lock()
+		defer l.Unlock()
+		if err := t.Hot.MoveObject(srcBucketName, srcObjectKey, destBucketName, destObjectKey); err != nil {
+			return err
+		}
+		return t.removeStub(destBucketName, destObjectKey)
+	}
+
+	if err := t.CopyObject(srcBucketName, srcObjectKey, destBucketName, destObjectKey); err != nil {
+		return err
+	}
+	return t.DeleteObject(srcBucketName, srcObjectKey)
+}
+
+// HeadObject 对移到 cold 的对象同样交给 cold 检查加密参数，再使用记录中的元数据
+func (t *TieredStore) HeadObject(bucketName, objectKey string, opts ...ObjectOption) (map[string]string, error) {
+	stub := t.stub(bucketName, objectKey)
+	if stub == nil {
+		return t.Hot.HeadObject(bucketName, objectKey, opts...)
+	}
+	head, err := t.Cold.HeadObject(bucketName, objectKey, opts...)
+	if err != nil {
+		// 对象可能刚好被重新写入 hot
+		if errors.Is(err, s3err.ErrNoSuchKey) && t.stub(bucketName, objectKey) == nil {
+			return t.Hot.HeadObject(bucketName, objectKey, opts...)
+		}
+		return nil, err
+	}
+	head["Size"] = strconv.FormatInt(stub.Size, 10)
+	head["LastModified"] = stub.LastModified.UTC().Format(time.RFC3339)
+	head["ContentType"] = stub.ContentType
+	head["ETag"] = stub.ETag
+	head["StorageClass"] = t.coldClass
+	return head, nil
+}
@@ -0,0 +1,265 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Grey0520/s3proxy/internal/config"
+	"github.com/Grey0520/s3proxy/internal/s3err"
+)
+
+func newTestTieredStore(t *testing.T, cfg config.TieringConfig) (*TieredStore, *MemoryStore, *MemoryStore) {
+	hot := newTestMemoryStore(t, 0)
+	cold, _ := NewMemoryStore(0)
+	cfg.StateDir = t.TempDir()
+	store, err := NewTieredStore(hot, cold, cfg)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store, hot, cold
+}
+
+func TestTieredStoreDemote(t *testing.T) {
+	store, hot, cold := newTestTieredStore(t, config.TieringConfig{MaxAge: time.Hour})
+	putString(t, store, "bucket", "old.txt", "old object")
+	putString(t, store, "bucket", "new.txt", "new")
+	head, _ := store.HeadObject("bucket", "old.txt")
+
+	if n, err := store.Demote(time.Now()); err != nil || n != 0 {
+		t.Fatalf("Expected nothing to demote, got %d, %v", n, err)
+	}
+	if n, err := store.Demote(time.Now().Add(2 * time.Hour)); err != nil || n != 2 {
+		t.Fatalf("Expected 2 objects demoted, got %d, %v", n, err)
+	}
+	if _, err := hot.HeadObject("bucket", "old.txt"); !errors.Is(err, s3err.ErrNoSuchKey) {
+		t.Errorf("Expected object to leave hot tier, got %v", err)
+	}
+	if _, err := cold.HeadObject("bucket", "old.txt"); err != nil {
+		t.Errorf("Expected object in cold tier, got %v", err)
+	}
+
+	// 读取和列举不受影响
+	if got := readString(t, store, "bucket", "old.txt"); got != "old object" {
+		t.Errorf("Unexpected content %q", got)
+	}
+	coldHead, err := store.HeadObject("bucket", "old.txt")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if coldHead["ETag"] != head["ETag"] || coldHead["Size"] != "10" || coldHead["StorageClass"] != "STANDARD_IA" {
+		t.Errorf("Unexpected head result %v", coldHead)
+	}
+	result, err := store.ListBucket("bucket")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(result.Contents) != 2 || result.Contents[1].Key != "old.txt" || result.Contents[1].StorageClass != "STANDARD_IA" {
+		t.Errorf("Unexpected listing %+v", result.Contents)
+	}
+
+	// 重新写入的对象回到 hot
+	putString(t, store, "bucket", "old.txt", "rewritten")
+	if _, err := cold.HeadObject("bucket", "old.txt"); !errors.Is(err, s3err.ErrNoSuchKey) {
+		t.Errorf("Expected stale cold copy to be removed, got %v", err)
+	}
+	result, _ = store.ListBucket("bucket")
+	for _, c := range result.Contents {
+		if c.Key == "old.txt" && c.StorageClass != "STANDARD" {
+			t.Errorf("Expected rewritten object in hot tier, got %+v", c)
+		}
+	}
+}
+
+func TestTieredStoreIdle(t *testing.T) {
+	store, _, _ := newTestTieredStore(t, config.TieringConfig{MaxIdle: time.Hour})
+	putString(t, store, "bucket", "read", "x")
+	putString(t, store, "bucket", "unread", "x")
+
+	now := time.Now().Add(2 * time.Hour)
+	store.touch("bucket", "read")
+	store.accessed["bucket\x00read"] = now.Add(-time.Minute)
+	if n, _ := store.Demote(now); n != 1 {
+		t.Fatalf("Expected 1 object demoted, got %d", n)
+	}
+	if head, _ := store.HeadObject("bucket", "unread"); head["StorageClass"] != "STANDARD_IA" {
+		t.Errorf("Expected unread object in cold tier, got %v", head)
+	}
+	if head, _ := store.HeadObject("bucket", "read"); head["StorageClass"] != "" {
+		t.Errorf("Expected recently read object in hot tier, got %v", head)
+	}
+}
+
+func TestTieredStoreColdObjects(t *testing.T) {
+	store, _, cold := newTestTieredStore(t, config.TieringConfig{MaxAge: time.Hour})
+	store.CreateBucket("other")
+	putString(t, store, "bucket", "a", "cold data")
+	putString(t, store, "bucket", "b", "x")
+	store.Demote(time.Now().Add(2 * time.Hour))
+
+	if err := store.DeleteBucket("bucket"); !errors.Is(err, s3err.ErrBucketNotEmpty) {
+		t.Errorf("Expected BucketNotEmpty, got %v", err)
+	}
+	if err := store.CopyObject("bucket", "a", "bucket", "copy"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if head, _ := store.HeadObject("bucket", "copy"); head["StorageClass"] != "" || head["Size"] != "9" {
+		t.Errorf("Expected copy in hot tier, got %v", head)
+	}
+	if err := store.MoveObject("bucket", "a", "other", "moved"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if got := readString(t, store, "other", "moved"); got != "cold data" {
+		t.Errorf("Unexpected content %q", got)
+	}
+	if _, err := store.GetObject("bucket", "a"); !errors.Is(err, s3err.ErrNoSuchKey) {
+		t.Errorf("Expected NoSuchKey, got %v", err)
+	}
+
+	// 记录保存在 stateDir 中，重启后仍然可以读取
+	restarted, err := NewTieredStore(store.Hot, store.Cold, config.TieringConfig{StateDir: store.stateDir})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if got := readString(t, restarted, "bucket", "b"); got != "x" {
+		t.Errorf("Unexpected content %q", got)
+	}
+	if err := restarted.DeleteObject("bucket", "b"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, err := cold.HeadObject("bucket", "b"); !errors.Is(err, s3err.ErrNoSuchKey) {
+		t.Errorf("Expected cold object to be deleted, got %v", err)
+	}
+	restarted.DeleteObject("bucket", "copy")
+	if err := restarted.DeleteBucket("bucket"); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+
+	if _, err := NewTieredStore(store.Hot, store.Cold, config.TieringConfig{}); err == nil {
+		t.Errorf("Expected error without state directory")
+	}
+}
+
+func TestTieredStoreEncryption(t *testing.T) {
+	hot, cold := newEncryptedStore(t), newEncryptedStore(t)
+	defer hot.Close()
+	defer cold.Close()
+	store, err := NewTieredStore(hot, cold, config.TieringConfig{MaxAge: time.Hour, StateDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	defer store.Close()
+	store.CreateBucket("bucket")
+	err = store.PutObject("bucket", "key", &Object{
+		Data:                 io.NopCloser(strings.NewReader("secret")),
+		ServerSideEncryption: SSEAlgorithmAES256,
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if n, err := store.Demote(time.Now().Add(2 * time.Hour)); err != nil || n != 1 {
+		t.Fatalf("Expected 1 object demoted, got %d, %v", n, err)
+	}
+
+	// cold 中的对象保持原来的加密方式
+	head, err := cold.HeadObject("bucket", "key")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if head["ServerSideEncryption"] != SSEAlgorithmAES256 {
+		t.Errorf("Expected encrypted cold object, got %v", head)
+	}
+	raw, err := os.ReadFile(filepath.Join(cold.basePath, "bucket", "key"))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if strings.Contains(string(raw), "secret") {
+		t.Error("Expected no plaintext in cold tier")
+	}
+	if got := readString(t, store, "bucket", "key"); got != "secret" {
+		t.Errorf("Unexpected content %q", got)
+	}
+
+	// HeadObject 和 GetObject 一样检查 SSE-C 参数
+	key := newTestCustomerKey(t, 1)
+	if _, err := store.HeadObject("bucket", "key", WithSSECustomerKey(key)); !errors.Is(err, s3err.ErrInvalidRequest) {
+		t.Errorf("Expected InvalidRequest for SSE-C key on SSE-S3 object, got %v", err)
+	}
+	if head, err := store.HeadObject("bucket", "key"); err != nil || head["ServerSideEncryption"] != SSEAlgorithmAES256 || head["StorageClass"] != "STANDARD_IA" {
+		t.Errorf("Unexpected head result %v, %v", head, err)
+	}
+
+	// SSE-C 对象没有密钥无法读取，留在 hot
+	err = store.PutObject("bucket", "ssec", &Object{Data: io.NopCloser(strings.NewReader("x"))}, WithSSECustomerKey(key))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	store.Demote(time.Now().Add(2 * time.Hour))
+	if _, err := hot.HeadObject("bucket", "ssec", WithSSECustomerKey(key)); err != nil {
+		t.Errorf("Expected SSE-C object to stay in hot tier, got %v", err)
+	}
+}
+
+func TestTieredStoreUnsupportedEncryption(t *testing.T) {
+	// memory 不支持加密，加密的对象不能以明文移过去
+	hot := newEncryptedStore(t)
+	defer hot.Close()
+	cold, _ := NewMemoryStore(0)
+	store, err := NewTieredStore(hot, cold, config.TieringConfig{MaxAge: time.Hour, StateDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	defer store.Close()
+	store.CreateBucket("bucket")
+	err = store.PutObject("bucket", "key", &Object{
+		Data:                 io.NopCloser(strings.NewReader("secret")),
+		ServerSideEncryption: SSEAlgorithmAES256,
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if n, _ := store.Demote(time.Now().Add(2 * time.Hour)); n != 0 {
+		t.Errorf("Expected encrypted object to stay in hot tier, %d demoted", n)
+	}
+	if _, err := cold.HeadObject("bucket", "key"); !errors.Is(err, s3err.ErrNoSuchKey) {
+		t.Errorf("Expected nothing in cold tier, got %v", err)
+	}
+	if got := readString(t, store, "bucket", "key"); got != "secret" {
+		t.Errorf("Unexpected content %q", got)
+	}
+}
+
+func TestNewStorageProviderTiering(t *testing.T) {
+	cfg := config.Config{
+		Cloud: config.CloudsConfig{Provider: "tiering", Tiering: config.TieringConfig{Hot: "hot", Cold: "cold", StateDir: t.TempDir()}},
+		Backends: []config.BackendConfig{
+			{Name: "hot", CloudsConfig: config.CloudsConfig{Provider: "local", Filesystem: config.FilesystemConfig{Basedir: t.TempDir()}}},
+			{Name: "cold", CloudsConfig: config.CloudsConfig{Provider: "memory"}},
+		},
+	}
+	stg, err := NewStorageProvider(cfg)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	store, ok := stg.(*TieredStore)
+	if !ok {
+		t.Fatalf("Expected *TieredStore, got %T", stg)
+	}
+	store.Close()
+	hot, ok := store.Hot.(*LFSStore)
+	if !ok {
+		t.Fatalf("Expected local hot tier, got %T", store.Hot)
+	}
+	// 释放 basedir，下面的错误只能来自配置
+	hot.Close()
+
+	cfg.Cloud.Tiering.Cold = "missing"
+	if _, err := NewStorageProvider(cfg); err == nil {
+		t.Errorf("Expected error for unknown backend")
+	}
+}
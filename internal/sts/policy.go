@@ -0,0 +1,123 @@
+package sts
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// 会话策略的最大长度，与 AWS 对内联策略的限制一致
+const maxPolicySize = 2048
+
+// Policy 是 IAM 策略的一个子集，只支持 Effect / Action / Resource
+type Policy struct {
+	Version   string      `json:"Version,omitempty"`
+	Statement []Statement `json:"Statement"`
+}
+
+type Statement struct {
+	Sid      string       `json:"Sid,omitempty"`
+	Effect   string       `json:"Effect"`
+	Action   stringOrList `json:"Action"`
+	Resource stringOrList `json:"Resource"`
+}
+
+// stringOrList 兼容 IAM 策略中既可以是字符串也可以是数组的字段
+type stringOrList []string
+
+func (l *stringOrList) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*l = []string{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*l = list
+	return nil
+}
+
+// ParsePolicy 解析内联策略
+// 不认识的字段（如 Condition、NotAction）会被拒绝，以免静默地放宽权限
+func ParsePolicy(raw string) (*Policy, error) {
+	if len(raw) > maxPolicySize {
+		return nil, fmt.Errorf("policy exceeds %d bytes", maxPolicySize)
+	}
+
+	dec := json.NewDecoder(bytes.NewReader([]byte(raw)))
+	dec.DisallowUnknownFields()
+	policy := &Policy{}
+	if err := dec.Decode(policy); err != nil {
+		return nil, fmt.Errorf("invalid policy document: %v", err)
+	}
+	if len(policy.Statement) == 0 {
+		return nil, fmt.Errorf("policy has no statement")
+	}
+	for i, st := range policy.Statement {
+		if st.Effect != "Allow" && st.Effect != "Deny" {
+			return nil, fmt.Errorf("statement %d has invalid effect %q", i, st.Effect)
+		}
+		if len(st.Action) == 0 || len(st.Resource) == 0 {
+			return nil, fmt.Errorf("statement %d must have both Action and Resource", i)
+		}
+	}
+	return policy, nil
+}
+
+// Allows 判断策略是否允许对资源执行操作，显式的 Deny 优先
+func (p *Policy) Allows(action, resource string) bool {
+	allowed := false
+	for _, st := range p.Statement {
+		if !matchAny(st.Action, action, true) || !matchAny(st.Resource, resource, false) {
+			continue
+		}
+		if st.Effect == "Deny" {
+			return false
+		}
+		allowed = true
+	}
+	return allowed
+}
+
+func matchAny(patterns []string, value string, foldCase bool) bool {
+	for _, p := range patterns {
+		if foldCase {
+			p, value = strings.ToLower(p), strings.ToLower(value)
+		}
+		if wildcardMatch(p, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// wildcardMatch 支持 IAM 的 * 和 ? 通配符，与 path.Match 不同的是 * 可以匹配 /
+func wildcardMatch(pattern, value string) bool {
+	if pattern == "*" {
+		return true
+	}
+	// 把 / 换成不会出现在资源名中的字符，再交给 path.Match
+	const sep = "\x00"
+	pattern = strings.ReplaceAll(pattern, "/", sep)
+	value = strings.ReplaceAll(value, "/", sep)
+	pattern = escapeMatchMeta(pattern)
+	ok, err := path.Match(pattern, value)
+	return err == nil && ok
+}
+
+// escapeMatchMeta 转义 path.Match 中除了 * 和 ? 以外的特殊字符
+func escapeMatchMeta(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		switch c {
+		case '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
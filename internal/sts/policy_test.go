@@ -0,0 +1,77 @@
+package sts
+
+import "testing"
+
+func TestParsePolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		wantErr bool
+	}{
+		{
+			name: "single action and resource",
+			raw:  `{"Version":"2012-10-17","Statement":[{"Effect":"Allow","Action":"s3:GetObject","Resource":"arn:aws:s3:::bucket/*"}]}`,
+		},
+		{
+			name: "lists",
+			raw:  `{"Statement":[{"Effect":"Allow","Action":["s3:GetObject","s3:PutObject"],"Resource":["arn:aws:s3:::a/*","arn:aws:s3:::b/*"]}]}`,
+		},
+		{
+			name:    "invalid effect",
+			raw:     `{"Statement":[{"Effect":"Maybe","Action":"s3:*","Resource":"*"}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "unsupported condition",
+			raw:     `{"Statement":[{"Effect":"Allow","Action":"s3:*","Resource":"*","Condition":{}}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "no statement",
+			raw:     `{"Version":"2012-10-17"}`,
+			wantErr: true,
+		},
+		{
+			name:    "not json",
+			raw:     `allow everything`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParsePolicy(tt.raw); (err != nil) != tt.wantErr {
+				t.Errorf("ParsePolicy() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPolicyAllows(t *testing.T) {
+	policy, err := ParsePolicy(`{"Statement":[
+		{"Effect":"Allow","Action":"s3:Get*","Resource":"arn:aws:s3:::ci-cache/*"},
+		{"Effect":"Allow","Action":"s3:PutObject","Resource":"arn:aws:s3:::ci-cache/build-?/*"},
+		{"Effect":"Deny","Action":"s3:*","Resource":"arn:aws:s3:::ci-cache/secret/*"}
+	]}`)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	tests := []struct {
+		action   string
+		resource string
+		want     bool
+	}{
+		{"s3:GetObject", "arn:aws:s3:::ci-cache/a/b/c.tar", true},
+		{"S3:GETOBJECT", "arn:aws:s3:::ci-cache/a", true},
+		{"s3:PutObject", "arn:aws:s3:::ci-cache/build-1/out.tar", true},
+		{"s3:PutObject", "arn:aws:s3:::ci-cache/build-12/out.tar", false},
+		{"s3:DeleteObject", "arn:aws:s3:::ci-cache/a", false},
+		{"s3:GetObject", "arn:aws:s3:::other/a", false},
+		{"s3:GetObject", "arn:aws:s3:::ci-cache/secret/key", false},
+	}
+	for _, tt := range tests {
+		if got := policy.Allows(tt.action, tt.resource); got != tt.want {
+			t.Errorf("Allows(%s, %s) = %v, want %v", tt.action, tt.resource, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package sts
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Grey0520/s3proxy/internal/config"
+)
+
+const (
+	tokenPrefix = "s3p1"
+	// 临时凭证的 AccessKey 前缀与 AWS 保持一致
+	accessKeyPrefix = "ASIA"
+	// AWS 允许的最短会话时长
+	minDuration = 15 * time.Minute
+)
+
+// Claims 是会话令牌中携带的信息
+type Claims struct {
+	AccessKey string `json:"ak"`
+	// 签发者（长期凭证用户）的 CanonicalID
+	Parent      string `json:"p"`
+	SessionName string `json:"sn,omitempty"`
+	Expiration  int64  `json:"exp"`
+	// 内联策略原文，为空表示不额外限制
+	Policy string `json:"pol,omitempty"`
+
+	policy *Policy
+}
+
+// ExpiresAt 返回会话的过期时间
+func (c *Claims) ExpiresAt() time.Time {
+	return time.Unix(c.Expiration, 0).UTC()
+}
+
+// Allows 判断会话策略是否允许该操作，没有策略时继承签发者的全部权限
+func (c *Claims) Allows(action, resource string) bool {
+	if c.policy == nil {
+		return true
+	}
+	return c.policy.Allows(action, resource)
+}
+
+// Credentials 是签发的一组临时凭证
+type Credentials struct {
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+	Expiration   time.Time
+}
+
+// Issuer 签发并校验自包含的会话令牌
+// 令牌使用 HMAC 签名，临时 SecretKey 由令牌内容派生，服务端不需要保存任何状态
+type Issuer struct {
+	key             []byte
+	defaultDuration time.Duration
+	maxDuration     time.Duration
+}
+
+// NewIssuer 根据配置创建 Issuer，没有配置签名密钥时返回 nil
+func NewIssuer(cfg config.STSConfig) *Issuer {
+	if cfg.SigningKey.Raw() == "" {
+		return nil
+	}
+	issuer := &Issuer{
+		key:             []byte(cfg.SigningKey.Raw()),
+		defaultDuration: cfg.DefaultDuration,
+		maxDuration:     cfg.MaxDuration,
+	}
+	if issuer.defaultDuration <= 0 {
+		issuer.defaultDuration = time.Hour
+	}
+	if issuer.maxDuration < issuer.defaultDuration {
+		issuer.maxDuration = issuer.defaultDuration
+	}
+	return issuer
+}
+
+// Issue 为 parent 签发一组临时凭证，duration 为 0 时使用默认时长
+func (issuer *Issuer) Issue(parent, sessionName string, duration time.Duration, policy string, now time.Time) (*Credentials, error) {
+	if duration == 0 {
+		duration = issuer.defaultDuration
+	}
+	if duration < minDuration || duration > issuer.maxDuration {
+		return nil, fmt.Errorf("duration must be between %v and %v", minDuration, issuer.maxDuration)
+	}
+	if policy != "" {
+		if _, err := ParsePolicy(policy); err != nil {
+			return nil, err
+		}
+	}
+
+	accessKey, err := newAccessKey()
+	if err != nil {
+		return nil, err
+	}
+	claims := Claims{
+		AccessKey:   accessKey,
+		Parent:      parent,
+		SessionName: sessionName,
+		Expiration:  now.Add(duration).Unix(),
+		Policy:      policy,
+	}
+	raw, err := json.Marshal(claims)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode session claims: %v", err)
+	}
+	payload := base64.RawURLEncoding.EncodeToString(raw)
+
+	return &Credentials{
+		AccessKey:    accessKey,
+		SecretKey:    issuer.secretFor(payload),
+		SessionToken: tokenPrefix + "." + payload + "." + issuer.sign(payload),
+		Expiration:   claims.ExpiresAt(),
+	}, nil
+}
+
+// Validate 校验会话令牌，返回其中的信息和对应的临时 SecretKey
+func (issuer *Issuer) Validate(token string, now time.Time) (*Claims, string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != tokenPrefix {
+		return nil, "", fmt.Errorf("malformed session token")
+	}
+	payload, mac := parts[1], parts[2]
+	if subtle.ConstantTimeCompare([]byte(issuer.sign(payload)), []byte(mac)) != 1 {
+		return nil, "", fmt.Errorf("invalid session token signature")
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, "", fmt.Errorf("malformed session token: %v", err)
+	}
+	claims := &Claims{}
+	if err := json.Unmarshal(raw, claims); err != nil {
+		return nil, "", fmt.Errorf("malformed session token: %v", err)
+	}
+	if !now.Before(claims.ExpiresAt()) {
+		return nil, "", fmt.Errorf("session token expired at %v", claims.ExpiresAt())
+	}
+	if claims.Policy != "" {
+		if claims.policy, err = ParsePolicy(claims.Policy); err != nil {
+			return nil, "", err
+		}
+	}
+	return claims, issuer.secretFor(payload), nil
+}
+
+func (issuer *Issuer) sign(payload string) string {
+	return base64.RawURLEncoding.EncodeToString(issuer.mac("token:" + payload))
+}
+
+func (issuer *Issuer) secretFor(payload string) string {
+	return base64.StdEncoding.EncodeToString(issuer.mac("secret:" + payload))[:40]
+}
+
+func (issuer *Issuer) mac(data string) []byte {
+	h := hmac.New(sha256.New, issuer.key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func newAccessKey() (string, error) {
+	buf := make([]byte, 10)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate access key: %v", err)
+	}
+	return accessKeyPrefix + base32.StdEncoding.EncodeToString(buf), nil
+}
@@ -0,0 +1,98 @@
+package sts
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Grey0520/s3proxy/internal/config"
+)
+
+func newTestIssuer() *Issuer {
+	return NewIssuer(config.STSConfig{
+		SigningKey:      "test-signing-key",
+		DefaultDuration: time.Hour,
+		MaxDuration:     12 * time.Hour,
+	})
+}
+
+func TestNewIssuerDisabled(t *testing.T) {
+	if NewIssuer(config.STSConfig{}) != nil {
+		t.Error("Expected nil issuer without signing key")
+	}
+}
+
+func TestIssueAndValidate(t *testing.T) {
+	issuer := newTestIssuer()
+	now := time.Now()
+	policy := `{"Statement":[{"Effect":"Allow","Action":"s3:GetObject","Resource":"arn:aws:s3:::bucket/*"}]}`
+
+	creds, err := issuer.Issue("parent-id", "ci", 0, policy, now)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !strings.HasPrefix(creds.AccessKey, "ASIA") {
+		t.Errorf("Expected ASIA access key, got %s", creds.AccessKey)
+	}
+	if want := now.Add(time.Hour).Unix(); creds.Expiration.Unix() != want {
+		t.Errorf("Expected expiration %d, got %d", want, creds.Expiration.Unix())
+	}
+
+	claims, secret, err := issuer.Validate(creds.SessionToken, now)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if secret != creds.SecretKey {
+		t.Error("Expected derived secret to match issued secret")
+	}
+	if claims.AccessKey != creds.AccessKey || claims.Parent != "parent-id" {
+		t.Errorf("Unexpected claims %+v", claims)
+	}
+	if !claims.Allows("s3:GetObject", "arn:aws:s3:::bucket/key") {
+		t.Error("Expected policy to allow GetObject")
+	}
+	if claims.Allows("s3:PutObject", "arn:aws:s3:::bucket/key") {
+		t.Error("Expected policy to deny PutObject")
+	}
+
+	if _, _, err := issuer.Validate(creds.SessionToken, now.Add(2*time.Hour)); err == nil {
+		t.Error("Expected expired token to be rejected")
+	}
+}
+
+func TestValidateTampered(t *testing.T) {
+	issuer := newTestIssuer()
+	creds, err := issuer.Issue("parent-id", "", time.Hour, "", time.Now())
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	parts := strings.Split(creds.SessionToken, ".")
+	other, err := issuer.Issue("other-id", "", time.Hour, "", time.Now())
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	// 拼接别的令牌的内容，签名应当对不上
+	forged := parts[0] + "." + strings.Split(other.SessionToken, ".")[1] + "." + parts[2]
+	if _, _, err := issuer.Validate(forged, time.Now()); err == nil {
+		t.Error("Expected forged token to be rejected")
+	}
+
+	otherIssuer := NewIssuer(config.STSConfig{SigningKey: "another-key", DefaultDuration: time.Hour})
+	if _, _, err := otherIssuer.Validate(creds.SessionToken, time.Now()); err == nil {
+		t.Error("Expected token signed by another key to be rejected")
+	}
+}
+
+func TestIssueDuration(t *testing.T) {
+	issuer := newTestIssuer()
+	if _, err := issuer.Issue("p", "", time.Minute, "", time.Now()); err == nil {
+		t.Error("Expected too short duration to be rejected")
+	}
+	if _, err := issuer.Issue("p", "", 24*time.Hour, "", time.Now()); err == nil {
+		t.Error("Expected too long duration to be rejected")
+	}
+	if _, err := issuer.Issue("p", "", time.Hour, "{", time.Now()); err == nil {
+		t.Error("Expected malformed policy to be rejected")
+	}
+}